@@ -0,0 +1,776 @@
+package fs9
+
+import (
+	"math"
+
+	"github.com/reusee/e4"
+)
+
+// Chunk is an immutable piece of file content
+type Chunk struct {
+	id    int64
+	codec string // name of the codec Data is encoded with, empty if not encoded
+	size  int    // logical size
+	Data  []byte // stored bytes
+}
+
+// newChunk encodes data with codec. data is stored as is if codec is nil or the encoded form is not smaller
+func newChunk(data []byte, codec Codec) (*Chunk, error) {
+	chunk := &Chunk{
+		id:   newNodeID(),
+		size: len(data),
+		Data: data,
+	}
+	if codec != nil {
+		encoded, err := codec.Encode(data)
+		if err != nil {
+			return nil, we(err)
+		}
+		if len(encoded) < len(data) {
+			chunk.codec = codec.Name()
+			chunk.Data = encoded
+		}
+	}
+	return chunk, nil
+}
+
+// newHoleChunk returns a chunk of size zero bytes that stores nothing
+func newHoleChunk(size int64) *Chunk {
+	return &Chunk{
+		id:   newNodeID(),
+		size: int(size),
+	}
+}
+
+// IsHole reports whether the chunk is a hole of zero bytes
+func (c *Chunk) IsHole() bool {
+	return c.codec == "" && len(c.Data) == 0 && c.size > 0
+}
+
+// Size returns the logical size
+func (c *Chunk) Size() int {
+	return c.size
+}
+
+// StoredSize returns the size of stored bytes
+func (c *Chunk) StoredSize() int {
+	return len(c.Data)
+}
+
+// Codec returns the name of codec used to encode the chunk, or empty string if not encoded
+func (c *Chunk) Codec() string {
+	return c.codec
+}
+
+// Bytes returns the decoded content. the returned slice must not be modified
+func (c *Chunk) Bytes() ([]byte, error) {
+	if c.IsHole() {
+		return make([]byte, c.size), nil
+	}
+	if c.codec == "" {
+		return c.Data, nil
+	}
+	codec, err := GetCodec(c.codec)
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.Decode(c.Data)
+	if err != nil {
+		return nil, we(err)
+	}
+	if len(data) != c.size {
+		return nil, we.With(
+			e4.Info("decoded %d bytes, expected %d", len(data), c.size),
+		)(ErrBadRecord)
+	}
+	return data, nil
+}
+
+// slice returns a chunk of content in [from, to)
+func (c *Chunk) slice(from, to int, codec Codec) (*Chunk, error) {
+	if c.IsHole() {
+		return newHoleChunk(int64(to - from)), nil
+	}
+	data, err := c.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return newChunk(append([]byte(nil), data[from:to]...), codec)
+}
+
+// Chunks is a persistent list of content-defined chunks.
+// it is never modified in place; WriteAt and Truncate return new lists sharing unchanged chunks and tree nodes
+type Chunks struct {
+	root *chunkNode
+}
+
+// chunkNode is a node of a treap of chunks ordered by offset.
+// priorities are derived from chunk ids, so the shape of a tree depends on its chunks only
+type chunkNode struct {
+	chunk       *Chunk
+	priority    uint64
+	left, right *chunkNode
+	size        int64 // logical size of the subtree
+	allocated   int64 // logical size of non-hole chunks in the subtree
+	count       int   // number of chunks in the subtree
+}
+
+func newChunkNode(chunk *Chunk, priority uint64, left, right *chunkNode) *chunkNode {
+	node := &chunkNode{
+		chunk:    chunk,
+		priority: priority,
+		left:     left,
+		right:    right,
+		size:     int64(chunk.size),
+		count:    1,
+	}
+	if !chunk.IsHole() {
+		node.allocated = node.size
+	}
+	if left != nil {
+		node.size += left.size
+		node.allocated += left.allocated
+		node.count += left.count
+	}
+	if right != nil {
+		node.size += right.size
+		node.allocated += right.allocated
+		node.count += right.count
+	}
+	return node
+}
+
+func chunkPriority(chunk *Chunk) uint64 {
+	// splitmix64 finalizer
+	z := uint64(chunk.id) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (n *chunkNode) getSize() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *chunkNode) getCount() int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
+// joinChunkNodes returns a tree of chunks of a followed by chunks of b
+func joinChunkNodes(a, b *chunkNode) *chunkNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		return newChunkNode(a.chunk, a.priority, a.left, joinChunkNodes(a.right, b))
+	}
+	return newChunkNode(b.chunk, b.priority, joinChunkNodes(a, b.left), b.right)
+}
+
+// splitChunkNodes returns trees of the first i chunks and the rest
+func splitChunkNodes(n *chunkNode, i int) (*chunkNode, *chunkNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if i <= n.left.getCount() {
+		l, r := splitChunkNodes(n.left, i)
+		return l, newChunkNode(n.chunk, n.priority, r, n.right)
+	}
+	l, r := splitChunkNodes(n.right, i-n.left.getCount()-1)
+	return newChunkNode(n.chunk, n.priority, n.left, l), r
+}
+
+// appendChunks returns a tree of chunks of n followed by chunks
+func appendChunks(n *chunkNode, chunks []*Chunk) *chunkNode {
+	for _, chunk := range chunks {
+		if chunk.size == 0 {
+			continue
+		}
+		n = joinChunkNodes(n, newChunkNode(chunk, chunkPriority(chunk), nil, nil))
+	}
+	return n
+}
+
+// walk calls fn with chunks from the one containing offset, until fn returns false. base is the offset of n
+func (n *chunkNode) walk(base int64, offset int64, fn func(offset int64, chunk *Chunk) (bool, error)) (bool, error) {
+	if n == nil {
+		return true, nil
+	}
+	chunkOffset := base + n.left.getSize()
+	if offset < chunkOffset {
+		if more, err := n.left.walk(base, offset, fn); !more || err != nil {
+			return more, err
+		}
+	}
+	end := chunkOffset + int64(n.chunk.size)
+	if offset < end {
+		if more, err := fn(chunkOffset, n.chunk); !more || err != nil {
+			return more, err
+		}
+	}
+	return n.right.walk(end, offset, fn)
+}
+
+// find returns the index, offset and the chunk containing offset, or the number of chunks, size and nil if offset is not less than size
+func (n *chunkNode) find(offset int64) (i int, chunkOffset int64, chunk *Chunk) {
+	for n != nil {
+		leftSize := n.left.getSize()
+		if offset < chunkOffset+leftSize {
+			n = n.left
+			continue
+		}
+		chunkOffset += leftSize
+		i += n.left.getCount()
+		if offset < chunkOffset+int64(n.chunk.size) {
+			chunk = n.chunk
+			return
+		}
+		chunkOffset += int64(n.chunk.size)
+		i++
+		n = n.right
+	}
+	return
+}
+
+// at returns the i-th chunk
+func (n *chunkNode) at(i int) *Chunk {
+	for {
+		leftCount := n.left.getCount()
+		if i < leftCount {
+			n = n.left
+		} else if i == leftCount {
+			return n.chunk
+		} else {
+			i -= leftCount + 1
+			n = n.right
+		}
+	}
+}
+
+func (n *chunkNode) equal(n2 *chunkNode) bool {
+	if n == n2 {
+		return true
+	}
+	if n == nil || n2 == nil {
+		return false
+	}
+	return n.chunk.id == n2.chunk.id &&
+		n.count == n2.count &&
+		n.left.equal(n2.left) &&
+		n.right.equal(n2.right)
+}
+
+// content-defined chunking parameters, see FastCDC
+const (
+	minChunkSize = 2 << 10
+	avgChunkSize = 8 << 10
+	maxChunkSize = 64 << 10
+
+	// more bits than log2(avgChunkSize) before the average size, fewer after
+	chunkMaskS = uint64(1<<15-1) << (64 - 15)
+	chunkMaskL = uint64(1<<11-1) << (64 - 11)
+)
+
+var gearTable = func() (ret [256]uint64) {
+	// splitmix64
+	var x uint64
+	for i := range ret {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		ret[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// cutPoint returns the length of the first chunk of data
+func cutPoint(data []byte) int {
+	return cutPointFrom(data, 0)
+}
+
+// cutPointFrom is cutPoint of data known to have no cut point before skip
+func cutPointFrom(data []byte, skip int) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if normal > n {
+		normal = n
+	}
+	if skip > n {
+		skip = n
+	}
+	var hash uint64
+	i := minChunkSize
+	if skip-64 > i {
+		// the hash depends on the last 64 bytes only
+		for i = skip - 64; i < skip; i++ {
+			hash = hash<<1 + gearTable[data[i]]
+		}
+	}
+	for ; i < normal; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if i >= skip && hash&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if i >= skip && hash&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// NewChunks splits a copy of data into chunks encoded with codec. codec may be nil
+func NewChunks(data []byte, codec Codec) (Chunks, error) {
+	var chunks []*Chunk
+	for len(data) > 0 {
+		n := cutPoint(data)
+		chunkData := make([]byte, n)
+		copy(chunkData, data)
+		chunk, err := newChunk(chunkData, codec)
+		if err != nil {
+			return Chunks{}, err
+		}
+		chunks = append(chunks, chunk)
+		data = data[n:]
+	}
+	return chunksOf(chunks), nil
+}
+
+// chunksOf builds a list from existing chunks
+func chunksOf(chunks []*Chunk) Chunks {
+	return Chunks{
+		root: appendChunks(nil, chunks),
+	}
+}
+
+func (c Chunks) Size() int64 {
+	return c.root.getSize()
+}
+
+// Len returns the number of chunks
+func (c Chunks) Len() int {
+	return c.root.getCount()
+}
+
+// Range calls fn with each chunk and its offset
+func (c Chunks) Range(fn func(offset int64, chunk *Chunk) error) error {
+	_, err := c.root.walk(0, 0, func(offset int64, chunk *Chunk) (bool, error) {
+		return true, fn(offset, chunk)
+	})
+	return err
+}
+
+// Allocated returns the logical size of content not in holes
+func (c Chunks) Allocated() int64 {
+	if c.root == nil {
+		return 0
+	}
+	return c.root.allocated
+}
+
+// Equal reports whether c and c2 consist of the same chunks
+func (c Chunks) Equal(c2 Chunks) bool {
+	return c.root.equal(c2.root)
+}
+
+// StoredSize returns the size of stored bytes
+func (c Chunks) StoredSize() (n int64) {
+	c.Range(func(_ int64, chunk *Chunk) error {
+		n += int64(len(chunk.Data))
+		return nil
+	})
+	return
+}
+
+// Bytes returns a copy of the whole content
+func (c Chunks) Bytes() ([]byte, error) {
+	ret := make([]byte, c.Size())
+	if _, err := c.ReadAt(ret, 0); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ReadAt copies content at offset to buf. bytes beyond the end are not touched
+func (c Chunks) ReadAt(buf []byte, offset int64) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	_, err = c.root.walk(0, offset, func(chunkOffset int64, chunk *Chunk) (bool, error) {
+		start := offset + int64(n) - chunkOffset
+		if chunk.IsHole() {
+			zeros := buf[n:]
+			if l := int64(chunk.size) - start; int64(len(zeros)) > l {
+				zeros = zeros[:l]
+			}
+			for i := range zeros {
+				zeros[i] = 0
+			}
+			n += len(zeros)
+			return n < len(buf), nil
+		}
+		data, err := chunk.Bytes()
+		if err != nil {
+			return false, err
+		}
+		n += copy(buf[n:], data[start:])
+		return n < len(buf), nil
+	})
+	return
+}
+
+// WriteAt returns a new list with data written at offset. gap between the end and offset is a hole.
+// new chunks are encoded with codec
+func (c Chunks) WriteAt(data []byte, offset int64, codec Codec) (Chunks, error) {
+	if len(data) == 0 {
+		return c, nil
+	}
+	size := c.Size()
+	newSize := offset + int64(len(data))
+	if newSize < size {
+		newSize = size
+	}
+	return c.rewrite(offset, data, newSize, codec)
+}
+
+// Truncate returns a new list with the specified size. extended part is a hole.
+// new chunks are encoded with codec
+func (c Chunks) Truncate(size int64, codec Codec) (Chunks, error) {
+	if size == c.Size() {
+		return c, nil
+	}
+	if size > c.Size() {
+		return Chunks{
+			root: appendChunks(c.root, []*Chunk{newHoleChunk(size - c.Size())}),
+		}, nil
+	}
+	i, offset, chunk := c.root.find(size)
+	head, _ := splitChunkNodes(c.root, i)
+	if offset < size {
+		part, err := chunk.slice(0, int(size-offset), codec)
+		if err != nil {
+			return Chunks{}, err
+		}
+		head = appendChunks(head, []*Chunk{part})
+	}
+	return Chunks{
+		root: head,
+	}, nil
+}
+
+// Recode returns a new list with all chunks encoded with codec. chunks already encoded with codec are shared
+func (c Chunks) Recode(codec Codec) (Chunks, error) {
+	name := ""
+	if codec != nil {
+		name = codec.Name()
+	}
+	chunks := make([]*Chunk, 0, c.Len())
+	changed := false
+	if err := c.Range(func(_ int64, chunk *Chunk) error {
+		if chunk.codec != name && !chunk.IsHole() {
+			data, err := chunk.Bytes()
+			if err != nil {
+				return err
+			}
+			chunk, err = newChunk(data, codec)
+			if err != nil {
+				return err
+			}
+			changed = true
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	}); err != nil {
+		return Chunks{}, err
+	}
+	if !changed {
+		return c, nil
+	}
+	return chunksOf(chunks), nil
+}
+
+// checkRange checks that [offset, offset+length) is a non-empty range of content
+func checkRange(offset, length int64) error {
+	if offset < 0 || length <= 0 || offset > math.MaxInt64-length {
+		return we.With(
+			e4.Info("offset %d length %d", offset, length),
+		)(ErrBadArgument)
+	}
+	return nil
+}
+
+// PunchHole returns a new list with content in [offset, offset+length) replaced by a hole. the size is not changed.
+// new chunks are encoded with codec
+func (c Chunks) PunchHole(offset, length int64, codec Codec) (Chunks, error) {
+	if err := checkRange(offset, length); err != nil {
+		return Chunks{}, err
+	}
+	end := offset + length
+	if end > c.Size() {
+		end = c.Size()
+	}
+	if offset >= end {
+		return c, nil
+	}
+	i, start, chunk := c.root.find(offset)
+	head, _ := splitChunkNodes(c.root, i)
+	var chunks []*Chunk
+	if start < offset {
+		part, err := chunk.slice(0, int(offset-start), codec)
+		if err != nil {
+			return Chunks{}, err
+		}
+		chunks = append(chunks, part)
+	}
+	chunks = append(chunks, newHoleChunk(end-offset))
+	j, start, chunk := c.root.find(end)
+	_, tail := splitChunkNodes(c.root, j)
+	if start < end {
+		part, err := chunk.slice(int(end-start), chunk.size, codec)
+		if err != nil {
+			return Chunks{}, err
+		}
+		chunks = append(chunks, part)
+		_, tail = splitChunkNodes(tail, 1)
+	}
+	return Chunks{
+		root: joinChunkNodes(appendChunks(head, chunks), tail),
+	}, nil
+}
+
+// Allocate returns a new list with holes in [offset, offset+length) filled with zeros,
+// extended if offset+length is beyond the end. new chunks are encoded with codec
+func (c Chunks) Allocate(offset, length int64, codec Codec) (Chunks, error) {
+	if err := checkRange(offset, length); err != nil {
+		return Chunks{}, err
+	}
+	end := offset + length
+	var holes [][2]int64
+	if _, err := c.root.walk(0, offset, func(start int64, chunk *Chunk) (bool, error) {
+		if start >= end {
+			return false, nil
+		}
+		if chunk.IsHole() {
+			from, to := start, start+int64(chunk.size)
+			if from < offset {
+				from = offset
+			}
+			if to > end {
+				to = end
+			}
+			holes = append(holes, [2]int64{from, to})
+		}
+		return true, nil
+	}); err != nil {
+		return Chunks{}, err
+	}
+	if size := c.Size(); end > size {
+		from := size
+		if from < offset {
+			from = offset
+		}
+		holes = append(holes, [2]int64{from, end})
+	}
+	zeros := make([]byte, maxChunkSize)
+	for _, hole := range holes {
+		for pos := hole[0]; pos < hole[1]; pos += int64(len(zeros)) {
+			data := zeros
+			if l := hole[1] - pos; l < int64(len(data)) {
+				data = data[:l]
+			}
+			var err error
+			c, err = c.WriteAt(data, pos, codec)
+			if err != nil {
+				return Chunks{}, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// SeekData returns the offset of the first data at or after offset, or false if there is none
+func (c Chunks) SeekData(offset int64) (ret int64, ok bool) {
+	c.root.walk(0, offset, func(start int64, chunk *Chunk) (bool, error) {
+		if chunk.IsHole() {
+			return true, nil
+		}
+		ret, ok = start, true
+		if ret < offset {
+			ret = offset
+		}
+		return false, nil
+	})
+	return
+}
+
+// SeekHole returns the offset of the first hole at or after offset. the end of content is a hole
+func (c Chunks) SeekHole(offset int64) (ret int64) {
+	ret = c.Size()
+	c.root.walk(0, offset, func(start int64, chunk *Chunk) (bool, error) {
+		if !chunk.IsHole() {
+			return true, nil
+		}
+		ret = start
+		if ret < offset {
+			ret = offset
+		}
+		return false, nil
+	})
+	return
+}
+
+// rewrite returns a new list of size newSize with data at offset.
+// chunks before the one containing offset are shared. new chunks are cut from there,
+// until a cut point after the written range coincides with an old boundary, then the remaining old chunks are shared.
+// holes not overwritten are kept, and the gap between the end and offset is a hole
+func (c Chunks) rewrite(offset int64, data []byte, newSize int64, codec Codec) (Chunks, error) {
+	size := c.Size()
+	n := c.Len()
+	writeEnd := offset + int64(len(data))
+
+	// holeEnd returns the end of the hole at p of the new content, or p if p is not in a hole
+	holeEnd := func(p int64) int64 {
+		if p >= offset && p < writeEnd {
+			return p
+		}
+		end := newSize
+		if p < offset {
+			end = offset
+		}
+		if p < size {
+			_, start, chunk := c.root.find(p)
+			if !chunk.IsHole() {
+				return p
+			}
+			if e := start + int64(chunk.size); e < end {
+				end = e
+			}
+		}
+		return end
+	}
+
+	// nextHole returns the start of the first hole of the new content in [p, limit), or limit if there is none
+	nextHole := func(p int64, limit int64) int64 {
+		for p < limit {
+			if p >= offset && p < writeEnd {
+				p = writeEnd
+				continue
+			}
+			if p >= size {
+				return p
+			}
+			_, start, chunk := c.root.find(p)
+			if chunk.IsHole() {
+				return p
+			}
+			p = start + int64(chunk.size)
+		}
+		return limit
+	}
+
+	i, pos, chunk := c.root.find(offset)
+	if i == n && i > 0 && offset == size {
+		if last := c.root.at(i - 1); !last.IsHole() {
+			// the last chunk was cut by the end of content, not by the content
+			i--
+			chunk = last
+			pos -= int64(chunk.size)
+		}
+	}
+	head, _ := splitChunkNodes(c.root, i)
+
+	skip := 0
+	if chunk != nil && chunk.IsHole() {
+		// the part before offset is kept
+		if pos < offset {
+			head = appendChunks(head, []*Chunk{newHoleChunk(offset - pos)})
+			pos = offset
+		}
+	} else if chunk != nil {
+		// positions of the chunk before skip are known to be not cut points
+		skip = chunk.size - 1
+		if unchanged := offset - pos; unchanged < int64(skip) {
+			skip = int(unchanged)
+		}
+	}
+
+	var chunks []*Chunk
+	var tail *chunkNode
+	for pos < newSize {
+		if pos >= writeEnd {
+			// resync
+			if j, boundary, _ := c.root.find(pos); j < n && boundary == pos {
+				_, tail = splitChunkNodes(c.root, j)
+				break
+			}
+		}
+
+		if end := holeEnd(pos); end > pos {
+			if l := len(chunks); l > 0 && chunks[l-1].IsHole() {
+				chunks[l-1] = newHoleChunk(int64(chunks[l-1].size) + end - pos)
+			} else {
+				chunks = append(chunks, newHoleChunk(end-pos))
+			}
+			pos = end
+			skip = 0
+			continue
+		}
+
+		// new content at pos, up to the next hole
+		limit := pos + maxChunkSize
+		if limit > newSize {
+			limit = newSize
+		}
+		window := make([]byte, nextHole(pos, limit)-pos)
+		if pos < size {
+			if _, err := c.ReadAt(window, pos); err != nil {
+				return Chunks{}, err
+			}
+		}
+		l := int64(len(window))
+		if pos < writeEnd && pos+l > offset {
+			from := offset - pos
+			if from < 0 {
+				copy(window, data[-from:])
+			} else {
+				copy(window[from:], data)
+			}
+		}
+
+		cut := cutPointFrom(window, skip)
+		skip = 0
+		chunkData := window
+		if cut < len(window) {
+			chunkData = make([]byte, cut)
+			copy(chunkData, window)
+		}
+		chunk, err := newChunk(chunkData, codec)
+		if err != nil {
+			return Chunks{}, err
+		}
+		chunks = append(chunks, chunk)
+		pos += int64(cut)
+	}
+
+	return Chunks{
+		root: joinChunkNodes(appendChunks(head, chunks), tail),
+	}, nil
+}
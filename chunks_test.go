@@ -0,0 +1,221 @@
+package fs9
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func chunkIDs(c Chunks) map[int64]bool {
+	ret := make(map[int64]bool)
+	c.Range(func(_ int64, chunk *Chunk) error {
+		ret[chunk.id] = true
+		return nil
+	})
+	return ret
+}
+
+func sharedChunks(a, b Chunks) (n int) {
+	ids := chunkIDs(a)
+	for id := range chunkIDs(b) {
+		if ids[id] {
+			n++
+		}
+	}
+	return
+}
+
+func chunkOffsets(c Chunks) (ret []int64) {
+	c.Range(func(offset int64, _ *Chunk) error {
+		ret = append(ret, offset)
+		return nil
+	})
+	return
+}
+
+func chunksBytes(c Chunks) []byte {
+	data, err := c.Bytes()
+	ce(err)
+	return data
+}
+
+func TestChunks(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	mustChunks := func(c Chunks, err error) Chunks {
+		ce(err)
+		return c
+	}
+
+	rnd := rand.New(rand.NewSource(42))
+	data := make([]byte, 1<<20)
+	rnd.Read(data)
+	c := mustChunks(NewChunks(data, nil))
+	eq(
+		c.Size(), int64(len(data)),
+		bytes.Equal(chunksBytes(c), data), true,
+	)
+	n := c.Len()
+	eq(
+		n > len(data)/maxChunkSize, true,
+		n < len(data)/minChunkSize, true,
+	)
+
+	// cut points depend on content only
+	eq(c.Len(), mustChunks(NewChunks(data, nil)).Len())
+
+	// overwrite
+	c2 := mustChunks(c.WriteAt([]byte("foo"), 1<<19, nil))
+	copy(data[1<<19:], "foo")
+	eq(
+		bytes.Equal(chunksBytes(c2), data), true,
+		sharedChunks(c, c2) >= n-2, true,
+		c2.Size(), c.Size(),
+	)
+
+	// append
+	c3 := mustChunks(c2.WriteAt([]byte("bar"), c2.Size(), nil))
+	eq(
+		bytes.Equal(chunksBytes(c3), append(data, "bar"...)), true,
+		sharedChunks(c2, c3) >= n-2, true,
+	)
+
+	// write past end
+	c4 := mustChunks(c2.WriteAt([]byte("baz"), c2.Size()+10, nil))
+	expected := append(append(append([]byte(nil), data...), make([]byte, 10)...), "baz"...)
+	eq(bytes.Equal(chunksBytes(c4), expected), true)
+
+	// shrink
+	c5 := mustChunks(c2.Truncate(1<<18, nil))
+	eq(
+		bytes.Equal(chunksBytes(c5), data[:1<<18]), true,
+		sharedChunks(c2, c5) >= c5.Len()-1, true,
+	)
+	eq(mustChunks(c2.Truncate(0, nil)).Len(), 0)
+
+	// extend
+	c6 := mustChunks(c5.Truncate(1<<18+100, nil))
+	eq(
+		bytes.Equal(chunksBytes(c6), append(append([]byte(nil), data[:1<<18]...), make([]byte, 100)...)), true,
+		sharedChunks(c5, c6) >= c5.Len()-1, true,
+	)
+
+	// unchanged
+	eq(
+		sharedChunks(c2, mustChunks(c2.Truncate(c2.Size(), nil))), n,
+		sharedChunks(c2, mustChunks(c2.WriteAt(nil, 0, nil))), n,
+	)
+
+	// read across chunks
+	readAt := func(buf []byte, offset int64) int {
+		n, err := c2.ReadAt(buf, offset)
+		ce(err)
+		return n
+	}
+	buf := make([]byte, maxChunkSize*2)
+	eq(
+		readAt(buf, 1000), len(buf),
+		bytes.Equal(buf, data[1000:1000+len(buf)]), true,
+		readAt(buf, c2.Size()-10), 10,
+		readAt(buf, c2.Size()+10), 0,
+	)
+
+	// random writes
+	for i := 0; i < 100; i++ {
+		offset := rnd.Intn(len(data) + 1000)
+		buf := make([]byte, rnd.Intn(maxChunkSize*2))
+		rnd.Read(buf)
+		c = mustChunks(c.WriteAt(buf, int64(offset), nil))
+		if end := offset + len(buf); end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[offset:], buf)
+	}
+	eq(bytes.Equal(chunksBytes(c), data), true)
+
+	// streaming writes cut the same chunks as a bulk write, and keep old versions
+	data = make([]byte, 1<<20)
+	rnd.Read(data)
+	var stream Chunks
+	var versions []Chunks
+	for offset := 0; offset < len(data); offset += 4096 {
+		versions = append(versions, stream)
+		stream = mustChunks(stream.WriteAt(data[offset:offset+4096], int64(offset), nil))
+	}
+	eq(
+		bytes.Equal(chunksBytes(stream), data), true,
+		stream.Equal(mustChunks(NewChunks(data, nil))), false, // new ids
+		chunkOffsets(stream), chunkOffsets(mustChunks(NewChunks(data, nil))),
+	)
+	for i, version := range versions {
+		eq(bytes.Equal(chunksBytes(version), data[:i*4096]), true)
+	}
+	eq(
+		stream.Equal(stream), true,
+		mustChunks(stream.Truncate(stream.Size(), nil)).Equal(stream), true,
+		chunksOf(nil).Len(), 0,
+	)
+
+	// holes
+	c = Chunks{}
+	data = data[:0]
+	for i := 0; i < 500; i++ {
+		offset := rnd.Intn(len(data) + maxChunkSize)
+		length := rnd.Intn(maxChunkSize * 2)
+		end := offset + length
+		switch rnd.Intn(4) {
+		case 0:
+			buf := make([]byte, length)
+			rnd.Read(buf)
+			c = mustChunks(c.WriteAt(buf, int64(offset), nil))
+			if end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[offset:], buf)
+		case 1:
+			punched, err := c.PunchHole(int64(offset), int64(length), nil)
+			if length == 0 {
+				eq(is(err, ErrBadArgument), true)
+				break
+			}
+			c = mustChunks(punched, err)
+			if end > len(data) {
+				end = len(data)
+			}
+			for j := offset; j < end; j++ {
+				data[j] = 0
+			}
+		case 2:
+			allocated, err := c.Allocate(int64(offset), int64(length), nil)
+			if length == 0 {
+				eq(is(err, ErrBadArgument), true)
+				break
+			}
+			c = mustChunks(allocated, err)
+			if end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+		case 3:
+			c = mustChunks(c.Truncate(int64(end), nil))
+			if end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			data = data[:end]
+		}
+		eq(
+			c.Size(), int64(len(data)),
+			c.Allocated() <= c.Size(), true,
+		)
+	}
+	eq(bytes.Equal(chunksBytes(c), data), true)
+	hole := c.SeekHole(0)
+	if hole < c.Size() {
+		next, ok := c.SeekData(hole)
+		if ok {
+			eq(next > hole, true)
+		}
+	}
+
+}
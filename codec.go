@@ -0,0 +1,126 @@
+package fs9
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/reusee/e4"
+)
+
+// Codec compresses content chunks at rest.
+// codecs are identified by name in stored content, so a codec must be registered to read content encoded by it
+type Codec interface {
+	Name() string
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+var codecs sync.Map // name -> Codec
+
+// RegisterCodec registers codec by its name, replacing the one with the same name
+func RegisterCodec(codec Codec) {
+	codecs.Store(codec.Name(), codec)
+}
+
+// GetCodec returns the registered codec. empty name returns nil, meaning no compression
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	v, ok := codecs.Load(name)
+	if !ok {
+		return nil, we.With(
+			e4.Info("codec: %s", name),
+		)(ErrUnknownCodec)
+	}
+	return v.(Codec), nil
+}
+
+var (
+	NoneCodec  Codec = noneCodec{}
+	GzipCodec  Codec = gzipCodec{}
+	FlateCodec Codec = flateCodec{}
+)
+
+func init() {
+	RegisterCodec(NoneCodec)
+	RegisterCodec(GzipCodec)
+	RegisterCodec(FlateCodec)
+}
+
+// noneCodec stores content as is. it is for overriding a compressing default of the FS
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (noneCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Encode(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	if err := w.Close(); err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, we(err)
+	}
+	ret, err := io.ReadAll(r)
+	if err != nil {
+		return nil, we(err)
+	}
+	return ret, nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Encode(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	if _, err := w.Write(data); err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	if err := w.Close(); err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(data []byte) ([]byte, error) {
+	ret, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, we(err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,144 @@
+package fs9
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestCompressedMemFS(t *testing.T) {
+	testFS(t, func() FS {
+		return NewMemFS(OptCodec(GzipCodec))
+	})
+}
+
+type countingCodec struct {
+	Codec
+	decodes *int
+}
+
+func (countingCodec) Name() string {
+	return "counting"
+}
+
+func (c countingCodec) Decode(data []byte) ([]byte, error) {
+	*c.decodes++
+	return c.Codec.Decode(data)
+}
+
+func TestCodec(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	_, err := GetCodec("foo")
+	eq(is(err, ErrUnknownCodec), true)
+	codec, err := GetCodec("")
+	ce(err)
+	eq(codec == nil, true)
+
+	data := bytes.Repeat([]byte("foobarbaz"), 10000)
+	for _, name := range []string{"none", "gzip", "flate"} {
+		codec, err := GetCodec(name)
+		ce(err)
+		encoded, err := codec.Encode(data)
+		ce(err)
+		decoded, err := codec.Decode(encoded)
+		ce(err)
+		eq(bytes.Equal(decoded, data), true)
+	}
+
+	m := NewMemFS(OptCodec(FlateCodec))
+	h, err := m.Create("foo")
+	ce(err)
+	_, err = h.Write(data)
+	ce(err)
+	ce(h.Close())
+	stat, err := m.Stat("foo")
+	ce(err)
+	eq(stat.Size(), int64(len(data)))
+	stats, err := m.ContentStats()
+	ce(err)
+	eq(
+		stats.LogicalBytes, int64(len(data)),
+		stats.StoredBytes < stats.LogicalBytes/10, true,
+	)
+	content, err := fs.ReadFile(m, "foo")
+	ce(err)
+	eq(bytes.Equal(content, data), true)
+
+	// snapshots share chunks
+	snapshot := m.Snapshot()
+	ce(m.Truncate("foo", 10))
+	content, err = fs.ReadFile(snapshot, "foo")
+	ce(err)
+	eq(bytes.Equal(content, data), true)
+	content, err = fs.ReadFile(m, "foo")
+	ce(err)
+	eq(content, data[:10])
+
+	// per-file override
+	ce(m.Truncate("foo", 0))
+	ce(m.ChangeCodec("foo", "none"))
+	h, err = m.OpenHandle("foo")
+	ce(err)
+	_, err = h.Write(data)
+	ce(err)
+	stats, err = m.ContentStats()
+	ce(err)
+	eq(stats.StoredBytes, stats.LogicalBytes)
+
+	// re-encode existing content
+	decodes := 0
+	RegisterCodec(countingCodec{
+		Codec:   GzipCodec,
+		decodes: &decodes,
+	})
+	ce(m.ChangeCodec("foo", "counting"))
+	stats, err = m.ContentStats()
+	ce(err)
+	eq(stats.StoredBytes < stats.LogicalBytes/10, true)
+	buf := make([]byte, 9)
+	_, err = h.ReadAt(buf, 9*1000)
+	ce(err)
+	eq(
+		buf, []byte("foobarbaz"),
+		decodes, 1,
+	)
+	ce(h.Close())
+
+	// back to default
+	ce(m.ChangeCodec("foo", ""))
+	stats, err = m.ContentStats()
+	ce(err)
+	eq(stats.StoredBytes < stats.LogicalBytes/10, true)
+	content, err = fs.ReadFile(m, "foo")
+	ce(err)
+	eq(bytes.Equal(content, data), true)
+
+	err = m.ChangeCodec("foo", "bar")
+	eq(is(err, ErrUnknownCodec), true)
+}
+
+func TestCompressedDiskFS(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	dir := t.TempDir()
+
+	d, err := NewDiskFS(dir, OptCodec(GzipCodec))
+	ce(err)
+	data := bytes.Repeat([]byte("foobarbaz"), 10000)
+	h, err := d.Create("foo")
+	ce(err)
+	_, err = h.Write(data)
+	ce(err)
+	ce(h.Close())
+
+	d, err = NewDiskFS(dir)
+	ce(err)
+	content, err := fs.ReadFile(d, "foo")
+	ce(err)
+	eq(bytes.Equal(content, data), true)
+	stats, err := d.ContentStats()
+	ce(err)
+	eq(stats.StoredBytes < stats.LogicalBytes/10, true)
+}
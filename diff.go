@@ -0,0 +1,382 @@
+package fs9
+
+import (
+	"io/fs"
+	pathpkg "path"
+	"sort"
+
+	"github.com/reusee/e4"
+)
+
+type ChangeKind uint8
+
+const (
+	ChangeAdded ChangeKind = iota + 1
+	ChangeRemoved
+	ChangeModified
+	ChangeRenamed
+	// a new path of a file that exists in the old snapshot
+	ChangeLinked
+	// a removed path of a file that still exists in the new snapshot
+	ChangeUnlinked
+)
+
+func (c ChangeKind) String() string {
+	switch c {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	case ChangeRenamed:
+		return "renamed"
+	case ChangeLinked:
+		return "linked"
+	case ChangeUnlinked:
+		return "unlinked"
+	}
+	return "unknown"
+}
+
+// Change is a difference between two snapshots
+type Change struct {
+	Kind ChangeKind
+	// slash-separated path in the new snapshot, or in the old snapshot for ChangeRemoved and ChangeUnlinked
+	Path string
+	// path in the old snapshot of ChangeRenamed
+	OldPath string
+	ID      FileID
+	// stat of the file in each snapshot, nil if absent
+	Old, New fs.FileInfo
+}
+
+// Diff calls fn with changes from a to b in path order. a and b must be MemFS-based and derived from the same FS.
+//
+// Files are matched by FileID: a file moved to another path is reported as ChangeRenamed,
+// and paths added or removed for a file that has other paths are reported as ChangeLinked or ChangeUnlinked.
+// Entries of a renamed dir are not reported unless changed. Entries of added or removed dirs are reported one by one.
+// A file is ChangeModified if its node changed, dirs are modified when their entries change.
+//
+// Changed files are found by comparing file maps, where shards shared by a and b are skipped without loading,
+// and Diff returns without walking if nothing changed. Otherwise dirs are walked from the root to find the paths,
+// since files do not refer to their parents. A dir with the same entries in a and b may still contain changed files,
+// so its subtree is skipped once all paths of changed files are found, as counted by their link counts.
+func Diff(a, b FS, fn func(Change) error) error {
+	snapshotA, err := memSnapshot(a)
+	if err != nil {
+		return err
+	}
+	snapshotB, err := memSnapshot(b)
+	if err != nil {
+		return err
+	}
+	if snapshotA.root.id != snapshotB.root.id {
+		return we.With(
+			e4.Info("snapshots of different FS"),
+		)(ErrBadArgument)
+	}
+
+	d := &snapshotDiff{
+		ctx:     snapshotA.ctx,
+		a:       snapshotA.files,
+		b:       snapshotB.files,
+		changed: make(map[FileID]bool),
+		matched: make(map[FileID]bool),
+	}
+	if err := diffNodes(
+		d.a, d.b,
+		func(node Node) error {
+			if file, ok := node.(*File); ok {
+				d.changed[file.ID] = true
+			}
+			return nil
+		},
+		func(node Node) error {
+			if file, ok := node.(*File); ok {
+				d.changed[file.ID] = true
+			}
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+	if len(d.changed) == 0 {
+		return nil
+	}
+	for id := range d.changed {
+		for _, files := range []*FileMap{d.a, d.b} {
+			file, err := files.getFile(d.ctx, id)
+			if err != nil {
+				return err
+			}
+			if file != nil {
+				d.pending += file.Nlink
+			}
+		}
+	}
+
+	rootID := snapshotA.root.id
+	d.matched[rootID] = true
+	d.found(rootID, 2)
+	if d.changed[rootID] {
+		if err := d.add(ChangeModified, ".", "", rootID); err != nil {
+			return err
+		}
+	}
+	if err := d.diffDir(".", rootID); err != nil {
+		return err
+	}
+	if err := d.resolve(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(d.changes, func(i, j int) bool {
+		return d.changes[i].Path < d.changes[j].Path
+	})
+	for _, change := range d.changes {
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type snapshotDiff struct {
+	ctx     Scope
+	a, b    *FileMap
+	changed map[FileID]bool // file nodes not shared by a and b
+	pending int             // paths of changed files in a and b not found yet
+	matched map[FileID]bool // files at the same path in a and b
+	removed []diffPath      // paths in a only
+	added   []diffPath      // paths in b only
+	changes []Change
+}
+
+type diffPath struct {
+	path string
+	id   FileID
+}
+
+func (d *snapshotDiff) getFile(files *FileMap, id FileID) (*File, error) {
+	file, err := files.getFile(d.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, we.With(
+			e4.Info("file %d", id),
+		)(ErrFileNotFound)
+	}
+	return file, nil
+}
+
+func (d *snapshotDiff) stat(files *FileMap, id FileID, p string) (fs.FileInfo, error) {
+	file, err := d.getFile(files, id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil { // NOCOVER
+		return nil, err
+	}
+	info.name = pathpkg.Base(p)
+	return info, nil
+}
+
+func (d *snapshotDiff) add(kind ChangeKind, p string, oldPath string, id FileID) error {
+	change := Change{
+		Kind:    kind,
+		Path:    p,
+		OldPath: oldPath,
+		ID:      id,
+	}
+	var err error
+	switch kind {
+	case ChangeAdded:
+		change.New, err = d.stat(d.b, id, p)
+	case ChangeRemoved:
+		change.Old, err = d.stat(d.a, id, p)
+	case ChangeUnlinked:
+		if change.Old, err = d.stat(d.a, id, p); err == nil {
+			change.New, err = d.stat(d.b, id, p)
+		}
+	case ChangeRenamed:
+		if change.Old, err = d.stat(d.a, id, oldPath); err == nil {
+			change.New, err = d.stat(d.b, id, p)
+		}
+	default:
+		if change.Old, err = d.stat(d.a, id, p); err == nil {
+			change.New, err = d.stat(d.b, id, p)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	d.changes = append(d.changes, change)
+	return nil
+}
+
+// found counts n paths of file id found
+func (d *snapshotDiff) found(id FileID, n int) {
+	if d.changed[id] {
+		d.pending -= n
+	}
+}
+
+// diffDir compares entries of a dir matched in a and b, and walks matched sub dirs that may contain changed files
+func (d *snapshotDiff) diffDir(dir string, id FileID) error {
+	dirA, err := d.getFile(d.a, id)
+	if err != nil {
+		return err
+	}
+	dirB, err := d.getFile(d.b, id)
+	if err != nil {
+		return err
+	}
+	if d.pending <= 0 && (dirA.nodeID == dirB.nodeID || sameSubs(dirA, dirB)) {
+		// same entries, and no changed file left
+		return nil
+	}
+	return join3(
+		setNodes(dirA.Subs), setNodes(dirB.Subs), nil,
+		func(nodeA, nodeB, _ Node) error {
+			entryA := asDirEntry(nodeA)
+			entryB := asDirEntry(nodeB)
+			var p string
+			if entryA != nil {
+				p = pathpkg.Join(dir, entryA.name)
+			} else {
+				p = pathpkg.Join(dir, entryB.name)
+			}
+			if entryA == nil || entryB == nil || entryA.id != entryB.id {
+				if entryA != nil {
+					if err := d.collect(&d.removed, d.a, p, entryA); err != nil {
+						return err
+					}
+				}
+				if entryB != nil {
+					if err := d.collect(&d.added, d.b, p, entryB); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			d.matched[entryA.id] = true
+			d.found(entryA.id, 2)
+			if d.changed[entryA.id] {
+				if err := d.add(ChangeModified, p, "", entryA.id); err != nil {
+					return err
+				}
+			}
+			if !entryA.isDir {
+				return nil
+			}
+			return d.diffDir(p, entryA.id)
+		},
+	)
+}
+
+func sameSubs(a, b *File) bool {
+	if a.Subs == nil || b.Subs == nil {
+		return a.Subs == b.Subs
+	}
+	return a.Subs.Equal(b.Subs)
+}
+
+// collect appends paths of entry and its descendants
+func (d *snapshotDiff) collect(paths *[]diffPath, files *FileMap, p string, entry *DirEntry) error {
+	*paths = append(*paths, diffPath{
+		path: p,
+		id:   entry.id,
+	})
+	d.found(entry.id, 1)
+	if !entry.isDir {
+		return nil
+	}
+	dir, err := d.getFile(files, entry.id)
+	if err != nil {
+		return err
+	}
+	for _, node := range setNodes(dir.Subs) {
+		sub := asDirEntry(node)
+		if err := d.collect(paths, files, pathpkg.Join(p, sub.name), sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve turns added and removed paths into changes
+func (d *snapshotDiff) resolve() error {
+	removedPaths := make(map[FileID][]string)
+	existed := make(map[FileID]bool) // files with paths in a
+	for id := range d.matched {
+		existed[id] = true
+	}
+	for _, removed := range d.removed {
+		removedPaths[removed.id] = append(removedPaths[removed.id], removed.path)
+		existed[removed.id] = true
+	}
+	addedPaths := make(map[FileID][]string)
+	for _, added := range d.added {
+		addedPaths[added.id] = append(addedPaths[added.id], added.path)
+	}
+
+	// renames, parents first
+	renamed := make(map[string]string) // old path -> new path
+	pairedOld := make(map[string]bool)
+	pairedNew := make(map[string]bool)
+	for _, added := range d.added {
+		olds := removedPaths[added.id]
+		if len(olds) == 0 {
+			continue
+		}
+		oldPath := olds[0]
+		removedPaths[added.id] = olds[1:]
+		renamed[oldPath] = added.path
+		pairedOld[oldPath] = true
+		pairedNew[added.path] = true
+		implied := pathpkg.Base(oldPath) == pathpkg.Base(added.path) &&
+			renamed[pathpkg.Dir(oldPath)] == pathpkg.Dir(added.path)
+		if !implied {
+			if err := d.add(ChangeRenamed, added.path, oldPath, added.id); err != nil {
+				return err
+			}
+		}
+		if d.changed[added.id] {
+			if err := d.add(ChangeModified, added.path, "", added.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, added := range d.added {
+		if pairedNew[added.path] {
+			continue
+		}
+		kind := ChangeAdded
+		if existed[added.id] {
+			kind = ChangeLinked
+		}
+		if err := d.add(kind, added.path, "", added.id); err != nil {
+			return err
+		}
+	}
+
+	for _, removed := range d.removed {
+		if pairedOld[removed.path] {
+			continue
+		}
+		kind := ChangeRemoved
+		if d.matched[removed.id] || len(addedPaths[removed.id]) > 0 {
+			kind = ChangeUnlinked
+		}
+		if err := d.add(kind, removed.path, "", removed.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
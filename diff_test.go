@@ -0,0 +1,151 @@
+package fs9
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestDiff(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	write := func(fsys FS, name string, content string) {
+		h, err := fsys.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+	type change struct {
+		Kind    ChangeKind
+		Path    string
+		OldPath string
+	}
+	diff := func(a, b FS) (ret []change) {
+		ce(Diff(a, b, func(c Change) error {
+			ret = append(ret, change{c.Kind, c.Path, c.OldPath})
+			return nil
+		}))
+		return
+	}
+
+	m := NewMemFS()
+	write(m, "a", "a")
+	write(m, "b", "b")
+	write(m, "c", "c")
+	ce(m.Link("c", "c2"))
+	ce(m.MakeDirAll("d/e"))
+	write(m, "d/x", "x")
+	write(m, "d/e/y", "y")
+	snapshot := m.Snapshot()
+	eq(len(diff(snapshot, m)), 0)
+
+	write(m, "a", "foo")
+	ce(m.Link("a", "a2"))
+	ce(m.Remove("b"))
+	ce(m.Remove("c2"))
+	ce(m.Rename("d", "d2"))
+	write(m, "d2/e/y", "foo")
+	ce(m.MakeDir("n"))
+	write(m, "n/f", "f")
+	eq(
+		diff(snapshot, m), []change{
+			{ChangeModified, ".", ""},
+			{ChangeModified, "a", ""},
+			{ChangeLinked, "a2", ""},
+			{ChangeRemoved, "b", ""},
+			{ChangeModified, "c", ""}, // link count
+			{ChangeUnlinked, "c2", ""},
+			{ChangeRenamed, "d2", "d"},
+			{ChangeModified, "d2/e/y", ""},
+			{ChangeAdded, "n", ""},
+			{ChangeAdded, "n/f", ""},
+		},
+	)
+
+	// reverse
+	eq(
+		diff(m, snapshot), []change{
+			{ChangeModified, ".", ""},
+			{ChangeModified, "a", ""},
+			{ChangeUnlinked, "a2", ""},
+			{ChangeAdded, "b", ""},
+			{ChangeModified, "c", ""},
+			{ChangeLinked, "c2", ""},
+			{ChangeRenamed, "d", "d2"},
+			{ChangeModified, "d/e/y", ""},
+			{ChangeRemoved, "n", ""},
+			{ChangeRemoved, "n/f", ""},
+		},
+	)
+
+	// infos
+	var changes []Change
+	ce(Diff(snapshot, m, func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	}))
+	eq(
+		changes[1].Old.Size(), int64(1),
+		changes[1].New.Size(), int64(3),
+		changes[3].New == nil, true,
+		changes[6].Old.Name(), "d",
+		changes[6].New.Name(), "d2",
+		changes[6].Kind.String(), "renamed",
+		changes[8].Old == nil, true,
+	)
+
+	// renamed and modified, moved out of a removed dir
+	snapshot = m.Snapshot()
+	write(m, "n/f", "foo")
+	ce(m.Rename("n/f", "f"))
+	ce(m.Remove("n"))
+	eq(
+		diff(snapshot, m), []change{
+			{ChangeModified, ".", ""},
+			{ChangeRenamed, "f", "n/f"},
+			{ChangeModified, "f", ""},
+			{ChangeRemoved, "n", ""},
+		},
+	)
+
+	// errors
+	err := Diff(snapshot, NewMemFS(), nil)
+	eq(is(err, ErrBadArgument), true)
+	err = Diff(snapshot, m, func(Change) error {
+		return ErrClosed
+	})
+	eq(is(err, ErrClosed), true)
+}
+
+// a change in a large tree. dirs after the changed file are not walked
+func BenchmarkDiff(b *testing.B) {
+	m := NewMemFS()
+	for i := 0; i < 100; i++ {
+		dir := fmt.Sprintf("%02d", i)
+		ce(m.MakeDir(dir))
+		for j := 0; j < 100; j++ {
+			f, err := m.Create(fmt.Sprintf("%s/%d", dir, j))
+			ce(err)
+			ce(f.Close())
+		}
+	}
+	snapshot := m.Snapshot()
+	f, err := m.Create("00/0")
+	ce(err)
+	_, err = f.Write([]byte("foo"))
+	ce(err)
+	ce(f.Close())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		ce(Diff(snapshot, m, func(c Change) error {
+			n++
+			return nil
+		}))
+		if n != 1 {
+			b.Fatalf("%d changes", n)
+		}
+	}
+}
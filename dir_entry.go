@@ -6,7 +6,7 @@ import (
 	"io/fs"
 	"strings"
 
-	"github.com/reusee/it"
+	"github.com/reusee/e4"
 )
 
 type DirEntry struct {
@@ -67,21 +67,30 @@ func (d DirEntry) Dump(w io.Writer, level int) { // NOCOVER
 	fmt.Fprintf(w, "%sentry: %s %d\n", strings.Repeat(" ", level), d.name, d.id)
 }
 
-//TODO 3-way merge
-func (d DirEntry) Merge(ctx Scope, node2 Node) (Node, error) { // NOCOVER
-	entry2, ok := node2.(DirEntry)
-	if !ok {
-		panic(fmt.Errorf("bad merge type %T", node2))
+// Merge takes the file of node2. entries of different names are not merged
+func (d DirEntry) Merge(ctx Scope, node2 Node) (Node, error) {
+	var entry2 DirEntry
+	switch node2 := node2.(type) {
+	case DirEntry:
+		entry2 = node2
+	case *DirEntry:
+		entry2 = *node2
+	default:
+		return nil, we.With(
+			e4.Info("bad merge type %T", node2),
+		)(ErrTypeMismatch)
 	}
 	if entry2.nodeID == d.nodeID {
 		// not changed
 		return d, nil
 	}
 	if entry2.name != d.name {
-		panic(fmt.Errorf("cannot merge different name"))
+		return nil, we.With(
+			e4.Info("cannot merge %s and %s", d.name, entry2.name),
+		)(ErrNameMismatch)
 	}
 	// new
 	newNode := entry2
-	newNode.nodeID = it.NewNodeID()
+	newNode.nodeID = newNodeID()
 	return newNode, nil
 }
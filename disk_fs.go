@@ -0,0 +1,114 @@
+package fs9
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reusee/e4"
+)
+
+// DiskStore is a Store that keeps each key in a file under a local directory
+type DiskStore struct {
+	dir string
+}
+
+var _ Store = new(DiskStore)
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, we(err)
+	}
+	return &DiskStore{
+		dir: dir,
+	}, nil
+}
+
+// NewDiskFS returns a StoreFS persisted to dir
+func NewDiskFS(dir string, options ...MemFSOption) (*StoreFS, error) {
+	store, err := NewDiskStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreFS(store, options...)
+}
+
+func (d *DiskStore) path(key string) (string, error) {
+	if !isStoreKey(key) {
+		return "", we.With(
+			e4.Info("key: %q", key),
+		)(ErrInvalidPath)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+func (d *DiskStore) Get(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, we(err)
+	}
+	return data, nil
+}
+
+func (d *DiskStore) Put(key string, value []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return we(err)
+	}
+	// write then rename, so readers never see partial values
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, value, 0644); err != nil {
+		return we(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return we(err)
+	}
+	return nil
+}
+
+func (d *DiskStore) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return we(err)
+	}
+	return nil
+}
+
+func (d *DiskStore) List(prefix string, fn func(key string) error) error {
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil { // NOCOVER
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return we(err)
+	}
+	return nil
+}
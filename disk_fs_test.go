@@ -0,0 +1,241 @@
+package fs9
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestDiskFS(t *testing.T) {
+	testFS(t, func() FS {
+		fs, err := NewDiskFS(t.TempDir())
+		ce(err)
+		return fs
+	})
+}
+
+func TestDiskFSReopen(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	dir := t.TempDir()
+
+	d, err := NewDiskFS(dir)
+	ce(err)
+	ce(d.MakeDirAll("foo/bar"))
+	h, err := d.Create("foo/bar/baz")
+	ce(err)
+	_, err = h.Write([]byte("baz"))
+	ce(err)
+	ce(h.Close())
+	ce(d.Link("foo/bar/baz", "qux"))
+	ce(d.SymLink("foo/bar/baz", "quux"))
+	ce(d.ChangeOwner("qux", 42, 24))
+
+	// reopen
+	d, err = NewDiskFS(dir)
+	ce(err)
+	content, err := fs.ReadFile(d, "quux")
+	ce(err)
+	eq(content, []byte("baz"))
+	stat, err := d.Stat("foo/bar/baz")
+	ce(err)
+	ext := stat.Sys().(ExtFileInfo)
+	eq(
+		stat.Size(), int64(3),
+		ext.UserID, 42,
+		ext.GroupID, 24,
+	)
+	link, err := d.ReadLink("quux")
+	ce(err)
+	eq(link, "foo/bar/baz")
+
+	// unreachable nodes are removed
+	ce(d.Remove("foo", OptAll(true)))
+	ce(d.Remove("qux"))
+	ce(d.Remove("quux"))
+	reachable := make(map[int64]bool)
+	chunks := make(map[int64]bool)
+	ce(walkNodes(d.files, func(node Node) error {
+		reachable[nodeID(node)] = true
+		if file, ok := node.(*File); ok {
+			for id := range chunkIDs(file.Content) {
+				chunks[id] = true
+			}
+		}
+		return nil
+	}))
+	eq(
+		len(storedKeys(dir, "nodes")), len(reachable),
+		len(storedKeys(dir, "chunks")), len(chunks),
+	)
+}
+
+func storedKeys(dir string, prefix string) map[string]bool {
+	ret := make(map[string]bool)
+	ce(fs.WalkDir(os.DirFS(dir), prefix, func(path string, entry fs.DirEntry, err error) error {
+		ce(err)
+		if !entry.IsDir() {
+			ret[path] = true
+		}
+		return nil
+	}))
+	return ret
+}
+
+func TestDiskFSChunks(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	dir := t.TempDir()
+
+	d, err := NewDiskFS(dir)
+	ce(err)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(42)).Read(data)
+	h, err := d.Create("foo")
+	ce(err)
+	_, err = h.Write(data)
+	ce(err)
+	before := storedKeys(dir, "chunks")
+
+	// only chunks around the written range are stored
+	_, err = h.Seek(1<<19, io.SeekStart)
+	ce(err)
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	ce(h.Close())
+	after := storedKeys(dir, "chunks")
+	shared := 0
+	for key := range after {
+		if before[key] {
+			shared++
+		}
+	}
+	eq(
+		len(before) > 16, true,
+		len(after)-shared <= 2, true,
+		len(before)-shared <= 2, true,
+	)
+
+	d, err = NewDiskFS(dir)
+	ce(err)
+	copy(data[1<<19:], "foo")
+	content, err := fs.ReadFile(d, "foo")
+	ce(err)
+	eq(bytes.Equal(content, data), true)
+}
+
+func TestDiskFSBadRange(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	dir := t.TempDir()
+
+	d, err := NewDiskFS(dir)
+	ce(err)
+	h, err := d.Create("foo")
+	ce(err)
+	_, err = h.Write(make([]byte, 100))
+	ce(err)
+	eq(
+		is(h.PunchHole(-10, 20), ErrBadArgument), true,
+		is(h.PunchHole(10, 0), ErrBadArgument), true,
+		is(h.PunchHole(10, math.MaxInt64), ErrBadArgument), true,
+		is(h.Allocate(-10, 20), ErrBadArgument), true,
+		is(h.Allocate(10, -1), ErrBadArgument), true,
+		is(h.Allocate(math.MaxInt64, 1), ErrBadArgument), true,
+	)
+	ce(h.Close())
+
+	// reopen
+	d, err = NewDiskFS(dir)
+	ce(err)
+	content, err := fs.ReadFile(d, "foo")
+	ce(err)
+	eq(len(content), 100)
+}
+
+// overwriteStore records puts of node and chunk keys that exist
+type overwriteStore struct {
+	Store
+	overwritten []string
+}
+
+func (o *overwriteStore) Put(key string, value []byte) error {
+	if !strings.HasPrefix(key, storeNodePrefix) && !strings.HasPrefix(key, storeChunkPrefix) {
+		return o.Store.Put(key, value)
+	}
+	if _, err := o.Store.Get(key); err == nil {
+		o.overwritten = append(o.overwritten, key)
+	}
+	return o.Store.Put(key, value)
+}
+
+func TestDiskFSNodeIDs(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	// ids of processes started in the same second
+	defer func(source func() int64, last int64) {
+		nodeIDSource = source
+		seedNodeID(last)
+	}(nodeIDSource, atomic.LoadInt64(&lastNodeID))
+	restart := func() {
+		var serial int64
+		nodeIDSource = func() int64 {
+			serial++
+			return 1<<40 + serial
+		}
+		atomic.StoreInt64(&lastNodeID, 0)
+	}
+	write := func(s *StoreFS, name string, content string) {
+		h, err := s.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+
+	disk, err := NewDiskStore(t.TempDir())
+	ce(err)
+	store := &overwriteStore{
+		Store: disk,
+	}
+	restart()
+	s, err := NewStoreFS(store)
+	ce(err)
+	write(s, "foo", "foo")
+
+	restart()
+	s, err = NewStoreFS(store)
+	ce(err)
+	id := newNodeID()
+	for _, prefix := range []string{storeNodePrefix, storeChunkPrefix} {
+		ce(store.List(prefix, func(key string) error {
+			stored, err := strconv.ParseInt(path.Base(key), 16, 64)
+			ce(err)
+			eq(id > stored, true)
+			return nil
+		}))
+	}
+	for i := 0; i < 10; i++ {
+		write(s, fmt.Sprintf("bar%d", i), "bar")
+	}
+	eq(len(store.overwritten), 0)
+
+	s, err = NewStoreFS(store)
+	ce(err)
+	data, err := fs.ReadFile(s, "foo")
+	ce(err)
+	eq(string(data), "foo")
+	for i := 0; i < 10; i++ {
+		data, err := fs.ReadFile(s, fmt.Sprintf("bar%d", i))
+		ce(err)
+		eq(string(data), "bar")
+	}
+}
@@ -0,0 +1,288 @@
+package fs9
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/reusee/e4"
+)
+
+// KeyProvider supplies AES keys for encryption at rest. keys are 16, 24 or 32 bytes long
+type KeyProvider interface {
+	// CurrentKey returns the key for newly stored data
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key of id. unknown ids return an error matching ErrKeyNotFound
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is an in-memory KeyProvider
+type KeyRing struct {
+	sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+var _ KeyProvider = new(KeyRing)
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Add adds a key. the first added key becomes the current key
+func (k *KeyRing) Add(id string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return we.With(
+			e4.Info("key %s", id),
+			ErrBadArgument,
+		)(err)
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.keys[id] = key
+	if k.current == "" {
+		k.current = id
+	}
+	return nil
+}
+
+func (k *KeyRing) SetCurrent(id string) error {
+	k.Lock()
+	defer k.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return we.With(
+			e4.Info("key %s", id),
+		)(ErrKeyNotFound)
+	}
+	k.current = id
+	return nil
+}
+
+// Remove removes a key. the current key cannot be removed
+func (k *KeyRing) Remove(id string) error {
+	k.Lock()
+	defer k.Unlock()
+	if id == k.current {
+		return we.With(
+			e4.Info("key %s is current", id),
+		)(ErrBadArgument)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	if k.current == "" {
+		return "", nil, we(ErrKeyNotFound)
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, we.With(
+			e4.Info("key %s", id),
+		)(ErrKeyNotFound)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, we(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil { // NOCOVER
+		return nil, we(err)
+	}
+	return aead, nil
+}
+
+// seal encrypts data with the current key. the nonce is prepended to the returned cipher text.
+// aad binds the cipher text to its record, so records cannot be swapped
+func seal(keys KeyProvider, data []byte, aad []byte) (keyID string, sealed []byte, err error) {
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil { // NOCOVER
+		return "", nil, we(err)
+	}
+	return keyID, aead.Seal(nonce, nonce, data, aad), nil
+}
+
+// unseal decrypts data sealed by seal. tampered data or wrong keys return an error matching ErrAuthFailed
+func unseal(keys KeyProvider, keyID string, sealed []byte, aad []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, we.With(
+			e4.Info("key %s", keyID),
+		)(ErrKeyNotFound)
+	}
+	key, err := keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, we(ErrAuthFailed)
+	}
+	nonce := sealed[:aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, we.With(
+			e4.Info("key %s: %v", keyID, err),
+		)(ErrAuthFailed)
+	}
+	return data, nil
+}
+
+func recordAAD(kind string, ids ...int64) []byte {
+	aad := make([]byte, len(kind)+8*len(ids))
+	copy(aad, kind)
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(aad[len(kind)+8*i:], uint64(id))
+	}
+	return aad
+}
+
+// nameAAD binds a sealed name to the entry and the dir containing it, so names can not be moved between dirs
+func nameAAD(dir FileID, entry *dirEntryRecord) []byte {
+	return recordAAD("name", int64(dir), entry.NodeID)
+}
+
+// sealChunk encrypts chunk data if the FS has keys
+func (m *MemFS) sealChunk(rec *chunkRecord) error {
+	if m.keys == nil {
+		return nil
+	}
+	keyID, sealed, err := seal(m.keys, rec.Data, recordAAD("chunk", rec.ID))
+	if err != nil {
+		return err
+	}
+	rec.KeyID = keyID
+	rec.Data = sealed
+	return nil
+}
+
+func (m *MemFS) unsealChunk(rec *chunkRecord) error {
+	if rec.KeyID == "" {
+		return nil
+	}
+	data, err := unseal(m.keys, rec.KeyID, rec.Data, recordAAD("chunk", rec.ID))
+	if err != nil {
+		return err
+	}
+	rec.KeyID = ""
+	rec.Data = data
+	return nil
+}
+
+// sealNames encrypts dir entry names if the FS has keys and name encryption is enabled
+func (m *MemFS) sealNames(rec *nodeRecord) error {
+	if m.keys == nil || !m.encryptNames || rec.File == nil {
+		return nil
+	}
+	for i, entry := range rec.File.Subs {
+		keyID, sealed, err := seal(m.keys, []byte(entry.Name), nameAAD(rec.File.ID, &entry))
+		if err != nil {
+			return err
+		}
+		entry.Name = ""
+		entry.KeyID = keyID
+		entry.SealedName = sealed
+		rec.File.Subs[i] = entry
+	}
+	return nil
+}
+
+func (m *MemFS) unsealNames(rec *nodeRecord) error {
+	if rec.File == nil {
+		return nil
+	}
+	for i, entry := range rec.File.Subs {
+		if entry.KeyID == "" {
+			continue
+		}
+		name, err := unseal(m.keys, entry.KeyID, entry.SealedName, nameAAD(rec.File.ID, &entry))
+		if err != nil {
+			return err
+		}
+		entry.Name = string(name)
+		entry.KeyID = ""
+		entry.SealedName = nil
+		rec.File.Subs[i] = entry
+	}
+	return nil
+}
+
+// Rekey re-encrypts all persisted content chunks, and dir entry names if name encryption is enabled, with the current key.
+// it runs over a snapshot of the persisted tree without blocking writes; data committed concurrently is encrypted with the current key already.
+// keys used before can be removed from the provider after Rekey returns
+func (s *StoreFS) Rekey() error {
+	if s.keys == nil {
+		return we.With(
+			e4.Info("no key provider"),
+		)(ErrBadArgument)
+	}
+
+	s.RLock()
+	snapshot := s.persisted
+	s.RUnlock()
+
+	chunks := make(map[int64]bool)
+	return walkNodes(snapshot, func(node Node) error {
+		file, ok := node.(*File)
+		if !ok {
+			return nil
+		}
+
+		if err := file.Content.Range(func(_ int64, chunk *Chunk) error {
+			if chunks[chunk.id] {
+				return nil
+			}
+			chunks[chunk.id] = true
+			s.RLock()
+			defer s.RUnlock()
+			if s.chunkRefs[chunk.id] == 0 {
+				// deleted after the snapshot
+				return nil
+			}
+			return s.putChunk(chunk)
+		}); err != nil {
+			return err
+		}
+
+		if !s.encryptNames || !file.IsDir {
+			return nil
+		}
+		s.RLock()
+		defer s.RUnlock()
+		current, err := s.persisted.getFile(s.ctx, file.ID)
+		if err != nil {
+			return err
+		}
+		if current == nil || current.nodeID != file.nodeID {
+			// replaced after the snapshot
+			return nil
+		}
+		return s.putNode(file)
+	})
+}
@@ -0,0 +1,253 @@
+package fs9
+
+import (
+	"bytes"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+// mapStore is an in-memory Store for tests
+type mapStore struct {
+	sync.Mutex
+	values map[string][]byte
+}
+
+var _ Store = new(mapStore)
+
+func newMapStore() *mapStore {
+	return &mapStore{
+		values: make(map[string][]byte),
+	}
+}
+
+func (m *mapStore) Get(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	value, ok := m.values[key]
+	if !ok {
+		return nil, we(fs.ErrNotExist)
+	}
+	return value, nil
+}
+
+func (m *mapStore) Put(key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *mapStore) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *mapStore) List(prefix string, fn func(key string) error) error {
+	m.Lock()
+	var keys []string
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	m.Unlock()
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contains reports whether any stored value contains data
+func (m *mapStore) contains(data []byte) bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, value := range m.values {
+		if bytes.Contains(value, data) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestKeyRing(ids ...string) *KeyRing {
+	ring := NewKeyRing()
+	for _, id := range ids {
+		ce(ring.Add(id, bytes.Repeat([]byte(id[:1]), 32)))
+	}
+	return ring
+}
+
+func TestEncryptedStoreFS(t *testing.T) {
+	testFS(t, func() FS {
+		fs, err := NewStoreFS(
+			newMapStore(),
+			OptEncryption(newTestKeyRing("a")),
+			OptEncryptNames(true),
+		)
+		ce(err)
+		return fs
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	store := newMapStore()
+	ring := newTestKeyRing("a")
+	s, err := NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	ce(err)
+	ce(s.MakeDir("secret-dir"))
+	h, err := s.Create("secret-dir/secret-name")
+	ce(err)
+	content := bytes.Repeat([]byte("secret content"), 1000)
+	_, err = h.Write(content)
+	ce(err)
+	ce(h.Close())
+	eq(
+		store.contains([]byte("secret content")), false,
+		store.contains([]byte("secret-dir")), false,
+		store.contains([]byte("secret-name")), false,
+	)
+
+	// reopen
+	s, err = NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	ce(err)
+	data, err := fs.ReadFile(s, "secret-dir/secret-name")
+	ce(err)
+	eq(bytes.Equal(data, content), true)
+
+	// no keys
+	_, err = NewStoreFS(store)
+	eq(is(err, ErrKeyNotFound), true)
+
+	// wrong key
+	wrongRing := NewKeyRing()
+	ce(wrongRing.Add("a", bytes.Repeat([]byte("x"), 32)))
+	_, err = NewStoreFS(store, OptEncryption(wrongRing))
+	eq(is(err, ErrAuthFailed), true)
+
+	// rekey
+	ce(ring.Add("b", bytes.Repeat([]byte("b"), 32)))
+	ce(ring.SetCurrent("b"))
+	snapshot := s.Snapshot()
+	ce(s.Rekey())
+	ce(ring.Remove("a"))
+	s, err = NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	ce(err)
+	data, err = fs.ReadFile(s, "secret-dir/secret-name")
+	ce(err)
+	eq(bytes.Equal(data, content), true)
+	data, err = fs.ReadFile(snapshot, "secret-dir/secret-name")
+	ce(err)
+	eq(bytes.Equal(data, content), true)
+	eq(ring.Remove("b") != nil, true)
+
+	// tampered
+	ce(store.List(storeChunkPrefix, func(key string) error {
+		value := store.values[key]
+		value[len(value)/2]++
+		return nil
+	}))
+	_, err = NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	eq(is(err, ErrAuthFailed), true)
+}
+
+func TestEncryptionMovedNames(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	store := newMapStore()
+	ring := newTestKeyRing("a")
+	s, err := NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	ce(err)
+	ce(s.MakeDirAll("a/foo"))
+	ce(s.MakeDirAll("b/bar"))
+
+	// move the sealed entry of a to b
+	dirs := make(map[string]nodeRecord)
+	ce(store.List(storeNodePrefix, func(key string) error {
+		var rec nodeRecord
+		ce(s.getRecord(key, &rec))
+		if rec.File != nil && rec.File.IsDir && len(rec.File.Subs) == 1 && rec.File.Subs[0].IsDir {
+			dirs[key] = rec
+		}
+		return nil
+	}))
+	eq(len(dirs), 2)
+	var keys []string
+	for key := range dirs {
+		keys = append(keys, key)
+	}
+	from, to := dirs[keys[0]], dirs[keys[1]]
+	to.File.Subs = append(to.File.Subs, from.File.Subs...)
+	ce(s.putRecord(keys[1], to))
+
+	_, err = NewStoreFS(store, OptEncryption(ring), OptEncryptNames(true))
+	eq(is(err, ErrAuthFailed), true)
+}
+
+func TestEncryptionNamesNotEncrypted(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	store := newMapStore()
+	s, err := NewStoreFS(store, OptEncryption(newTestKeyRing("a")))
+	ce(err)
+	h, err := s.Create("plain-name")
+	ce(err)
+	_, err = h.Write([]byte("secret content"))
+	ce(err)
+	ce(h.Close())
+	eq(
+		store.contains([]byte("secret content")), false,
+		store.contains([]byte("plain-name")), true,
+	)
+
+	// unencrypted stores can be opened with keys and rekeyed
+	store = newMapStore()
+	s, err = NewStoreFS(store)
+	ce(err)
+	h, err = s.Create("foo")
+	ce(err)
+	_, err = h.Write([]byte("plain content"))
+	ce(err)
+	ce(h.Close())
+	eq(store.contains([]byte("plain content")), true)
+	s, err = NewStoreFS(store, OptEncryption(newTestKeyRing("a")))
+	ce(err)
+	ce(s.Rekey())
+	eq(store.contains([]byte("plain content")), false)
+}
+
+func TestKeyRing(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	ring := NewKeyRing()
+	_, _, err := ring.CurrentKey()
+	eq(is(err, ErrKeyNotFound), true)
+	err = ring.Add("a", []byte("short"))
+	eq(is(err, ErrBadArgument), true)
+	ce(ring.Add("a", make([]byte, 16)))
+	id, _, err := ring.CurrentKey()
+	ce(err)
+	eq(id, "a")
+	eq(is(ring.SetCurrent("b"), ErrKeyNotFound), true)
+	_, err = ring.Key("b")
+	eq(is(err, ErrKeyNotFound), true)
+
+	_, err = unseal(ring, "a", []byte("short"), nil)
+	eq(is(err, ErrAuthFailed), true)
+	keyID, sealed, err := seal(ring, []byte("foo"), []byte("aad"))
+	ce(err)
+	_, err = unseal(ring, keyID, sealed, []byte("other aad"))
+	eq(is(err, ErrAuthFailed), true)
+	data, err := unseal(ring, keyID, sealed, []byte("aad"))
+	ce(err)
+	eq(data, []byte("foo"))
+}
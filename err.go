@@ -3,19 +3,35 @@ package fs9
 import "errors"
 
 var (
-	ErrBadArgument  = errors.New("bad argument")
-	ErrCannotLink   = errors.New("cannot link")
-	ErrCannotRemove = errors.New("cannot remove")
-	ErrClosed       = errors.New("closed")
-	ErrDirNotEmpty  = errors.New("dir not empty")
-	ErrFileExisted  = errors.New("file existed")
-	ErrFileNotFound = errors.New("file not found")
-	ErrImmutable    = errors.New("immutable")
-	ErrInvalidName  = errors.New("invalid name")
-	ErrInvalidPath  = errors.New("invalid path")
-	ErrNameMismatch = errors.New("name mismatch")
-	ErrNoPermission = errors.New("no permission")
-	ErrNodeNotFound = errors.New("node not found")
-	ErrOutOfBounds  = errors.New("out of bounds")
-	ErrTypeMismatch = errors.New("type mismatch")
+	ErrAuthFailed    = errors.New("authentication failed")
+	ErrBadArgument   = errors.New("bad argument")
+	ErrBadRecord     = errors.New("bad record")
+	ErrCannotLink    = errors.New("cannot link")
+	ErrCannotRemove  = errors.New("cannot remove")
+	ErrClosed        = errors.New("closed")
+	ErrCrossDevice   = errors.New("cross device")
+	ErrDirNotEmpty   = errors.New("dir not empty")
+	ErrFileExisted   = errors.New("file existed")
+	ErrFileNotFound  = errors.New("file not found")
+	ErrImmutable     = errors.New("immutable")
+	ErrIsDir         = errors.New("is a dir")
+	ErrInvalidName   = errors.New("invalid name")
+	ErrInvalidPath   = errors.New("invalid path")
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrNameMismatch  = errors.New("name mismatch")
+	ErrNoPermission  = errors.New("no permission")
+	ErrNotDir        = errors.New("not a dir")
+	ErrNotSupported  = errors.New("not supported")
+	ErrNodeNotFound  = errors.New("node not found")
+	ErrOutOfBounds   = errors.New("out of bounds")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrRollback      = errors.New("rollback")
+	ErrTooManyLinks  = errors.New("too many links")
+	ErrTxDone        = errors.New("transaction done")
+	ErrTypeMismatch  = errors.New("type mismatch")
+	ErrUnknownCodec  = errors.New("unknown codec")
+
+	ErrXattrExisted  = errors.New("xattr existed")
+	ErrXattrNotFound = errors.New("xattr not found")
+	ErrXattrTooLarge = errors.New("xattr too large")
 )
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/reusee/e4"
 	"github.com/reusee/it"
 )
 
@@ -19,10 +20,14 @@ type File struct {
 	ModTime    time.Time
 	Subs       *NodeSet // name -> NamedFileID
 	Symlink    string
-	Content    []byte //TODO sharded bytes slice
+	Content    Chunks
+	Codec      string // name of codec for new content chunks, empty for the default of the FS
 	UserID     int
 	GroupID    int
 	AccessTime time.Time
+	Xattrs     map[string][]byte // extended attributes. not modified in place, shared by versions of the file
+	Project    FileID            // id of the dir of the dir quota charged, zero if none
+	Nlink      int               // number of dir entries of the file. unreachable files are dropped
 }
 
 type FileID uint64
@@ -42,11 +47,11 @@ func (f FileID) Cmp(i any) int { // NOCOVER
 func NewFile(isDir bool) *File {
 	var mode fs.FileMode
 	if isDir {
-		mode = fs.ModeDir
+		mode = fs.ModeDir | 0777
 	}
 	f := &File{
-		nodeID:  it.NewNodeID(),
-		ID:      FileID(it.NewNodeID()),
+		nodeID:  newNodeID(),
+		ID:      FileID(newNodeID()),
 		IsDir:   isDir,
 		Mode:    mode,
 		ModTime: time.Now(),
@@ -64,7 +69,7 @@ func (f *File) Clone() *File {
 		now = now.Add(time.Nanosecond)
 	}
 	newFile.ModTime = now
-	newFile.nodeID = it.NewNodeID()
+	newFile.nodeID = newNodeID()
 	return &newFile
 }
 
@@ -113,64 +118,89 @@ func (f File) Dump(w io.Writer, level int) { // NOCOVER
 }
 
 func (f File) Stat() (FileInfo, error) {
+	nlink := f.Nlink
+	if f.IsDir {
+		// the entry in parent, "." and ".." of sub dirs
+		nlink = 2
+		for _, node := range setNodes(f.Subs) {
+			if asDirEntry(node).isDir {
+				nlink++
+			}
+		}
+	}
 	return FileInfo{
 		size:    f.Size,
 		mode:    f.Mode,
 		modTime: f.ModTime,
 		isDir:   f.IsDir,
 		ext: ExtFileInfo{
+			ID:         f.ID,
 			UserID:     f.UserID,
 			GroupID:    f.GroupID,
 			AccessTime: f.AccessTime,
+			Blocks:     (f.Content.Allocated() + 511) / 512,
+			Nlink:      nlink,
 		},
 	}, nil
 }
 
 func (f File) ReadAt(buf []byte, offset int64) (n int, err error) {
-	if int(offset) > len(f.Content) {
-		offset = int64(len(f.Content))
-	}
-	end := int(offset) + len(buf)
-	if end > len(f.Content) {
-		end = len(f.Content)
+	n, err = f.Content.ReadAt(buf, offset)
+	if err != nil {
+		return n, err
 	}
-	n = copy(buf, f.Content[offset:end])
 	if n < len(buf) {
 		err = io.EOF
 	}
 	return
 }
 
+// WriteAt returns a new file with data written at offset, encoded with the codec named by f.Codec
 func (f *File) WriteAt(data []byte, offset int64) (*File, int, error) {
+	codec, err := GetCodec(f.Codec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f.writeAt(data, offset, codec)
+}
+
+func (f *File) writeAt(data []byte, offset int64, codec Codec) (*File, int, error) {
+	content, err := f.Content.WriteAt(data, offset, codec)
+	if err != nil {
+		return nil, 0, err
+	}
 	newFile := f.Clone()
-	if l := int(offset) + len(data); l > len(f.Content) {
-		newFile.Content = make([]byte, l)
-	} else {
-		newFile.Content = make([]byte, len(f.Content))
-	}
-	copy(newFile.Content, f.Content)
-	copy(newFile.Content[offset:], data)
-	newFile.Size = int64(len(newFile.Content))
+	newFile.Content = content
+	newFile.Size = content.Size()
 	return newFile, len(data), nil
 }
 
-//TODO 3-way merge
-func (f *File) Merge(ctx Scope, node2 Node) (Node, error) { // NOCOVER
+// Merge takes attributes and content of node2, and merges dir entries of both
+func (f *File) Merge(ctx Scope, node2 Node) (Node, error) {
 	file2, ok := node2.(*File)
 	if !ok {
-		panic(fmt.Errorf("bad merge type: %T", node2))
+		return nil, we.With(
+			e4.Info("bad merge type: %T", node2),
+		)(ErrTypeMismatch)
 	}
 	if node2.Equal(f) {
 		// not changed
 		return f, nil
 	}
 	if file2.ID != f.ID {
-		panic(fmt.Errorf("cannot mrege different id"))
+		return nil, we.With(
+			e4.Info("cannot merge file %d and %d", f.ID, file2.ID),
+		)(ErrBadArgument)
+	}
+	if f.IsDir != file2.IsDir {
+		return nil, we.With(
+			e4.Info("cannot merge dir and non-dir"),
+		)(ErrTypeMismatch)
 	}
 
 	// new
 	newFile := *file2
-	newFile.nodeID = it.NewNodeID()
+	newFile.nodeID = newNodeID()
 	newSubsNode, err := f.Subs.Merge(ctx, file2.Subs)
 	if err != nil {
 		return nil, err
@@ -12,6 +12,14 @@ func fileChangeMode(mode fs.FileMode) func(*File) error {
 	}
 }
 
+// fileChangePerm sets permission bits of mode, type bits are kept
+func fileChangePerm(mode fs.FileMode) func(*File) error {
+	return func(file *File) error {
+		file.Mode = file.Mode&fs.ModeType | mode&^fs.ModeType
+		return nil
+	}
+}
+
 func fileChagneOwner(uid int, gid int) func(*File) error {
 	return func(file *File) error {
 		if uid != -1 {
@@ -24,23 +32,56 @@ func fileChagneOwner(uid int, gid int) func(*File) error {
 	}
 }
 
-func fileTruncate(size int64) func(*File) error {
+func fileTruncate(size int64, codecOf func(*File) (Codec, error)) func(*File) error {
 	return func(file *File) error {
 		if file.Size == size {
 			return nil
 		}
-		if size < file.Size {
-			file.Content = file.Content[:size]
-		} else {
-			newContent := make([]byte, size)
-			copy(newContent, file.Content)
-			file.Content = newContent
+		codec, err := codecOf(file)
+		if err != nil {
+			return err
+		}
+		content, err := file.Content.Truncate(size, codec)
+		if err != nil {
+			return err
 		}
+		file.Content = content
 		file.Size = size
 		return nil
 	}
 }
 
+func filePunchHole(offset, length int64, codecOf func(*File) (Codec, error)) func(*File) error {
+	return func(file *File) error {
+		codec, err := codecOf(file)
+		if err != nil {
+			return err
+		}
+		content, err := file.Content.PunchHole(offset, length, codec)
+		if err != nil {
+			return err
+		}
+		file.Content = content
+		return nil
+	}
+}
+
+func fileAllocate(offset, length int64, codecOf func(*File) (Codec, error)) func(*File) error {
+	return func(file *File) error {
+		codec, err := codecOf(file)
+		if err != nil {
+			return err
+		}
+		content, err := file.Content.Allocate(offset, length, codec)
+		if err != nil {
+			return err
+		}
+		file.Content = content
+		file.Size = content.Size()
+		return nil
+	}
+}
+
 func fileChangeTimes(atime, mtime time.Time) func(*File) error {
 	return func(file *File) error {
 		file.AccessTime = atime
@@ -48,3 +89,19 @@ func fileChangeTimes(atime, mtime time.Time) func(*File) error {
 		return nil
 	}
 }
+
+func fileChangeCodec(name string, codecOf func(*File) (Codec, error)) func(*File) error {
+	return func(file *File) error {
+		file.Codec = name
+		codec, err := codecOf(file)
+		if err != nil {
+			return err
+		}
+		content, err := file.Content.Recode(codec)
+		if err != nil {
+			return err
+		}
+		file.Content = content
+		return nil
+	}
+}
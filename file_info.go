@@ -15,9 +15,12 @@ type FileInfo struct {
 }
 
 type ExtFileInfo struct {
+	ID         FileID
 	UserID     int
 	GroupID    int
 	AccessTime time.Time
+	Blocks     int64 // number of allocated 512-byte blocks
+	Nlink      int   // number of dir entries of the file. for dirs, 2 plus the number of sub dirs
 }
 
 var _ fs.FileInfo = FileInfo{}
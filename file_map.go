@@ -5,6 +5,7 @@ import (
 	"io"
 	"strings"
 
+	"github.com/reusee/e4"
 	"github.com/reusee/it"
 )
 
@@ -20,7 +21,7 @@ var _ Node = new(FileMap)
 
 func NewFileMap(level int, shardKey uint8) *FileMap {
 	return &FileMap{
-		nodeID:   it.NewNodeID(),
+		nodeID:   newNodeID(),
 		subs:     it.NewNodeSet(nil),
 		level:    level,
 		shardKey: shardKey,
@@ -37,7 +38,7 @@ func (f *FileMap) Equal(n2 Node) bool {
 
 func (f *FileMap) Clone() *FileMap {
 	newMap := *f
-	newMap.nodeID = it.NewNodeID()
+	newMap.nodeID = newNodeID()
 	return &newMap
 }
 
@@ -109,23 +110,38 @@ func (f *FileMap) Mutate(
 	return f, nil
 }
 
+// getFile returns the file of id, or nil if not exists
+func (f *FileMap) getFile(ctx Scope, id FileID) (file *File, err error) {
+	_, err = f.Mutate(ctx, f.GetPath(id), func(node Node) (Node, error) {
+		if node != nil {
+			file = node.(*File)
+		}
+		return node, nil
+	})
+	return
+}
+
 func (f FileMap) Dump(w io.Writer, level int) {
 	fmt.Fprintf(w, "%sfile map %x\n", strings.Repeat(" ", level), f.shardKey)
 	f.subs.Dump(w, level+1)
 }
 
-//TODO 3-way merge
-func (f *FileMap) Merge(ctx Scope, node2 Node) (Node, error) { // NOCOVER
+// Merge merges files of the same shard, node2 takes precedence
+func (f *FileMap) Merge(ctx Scope, node2 Node) (Node, error) {
 	map2, ok := node2.(*FileMap)
-	if !ok { // NOCOVER
-		panic(fmt.Errorf("bad merge type %T", node2))
+	if !ok {
+		return nil, we.With(
+			e4.Info("bad merge type %T", node2),
+		)(ErrTypeMismatch)
 	}
 	if map2.Equal(f) {
 		// not chnaged
 		return f, nil
 	}
 	if map2.level != f.level || map2.shardKey != f.shardKey {
-		panic(fmt.Errorf("cannot merge"))
+		return nil, we.With(
+			e4.Info("cannot merge shard %d/%x and %d/%x", f.level, f.shardKey, map2.level, map2.shardKey),
+		)(ErrBadArgument)
 	}
 	// new
 	newMap := NewFileMap(map2.level, map2.shardKey)
@@ -10,8 +10,10 @@ import (
 func TestFileRead(t *testing.T) {
 	defer he(nil, e4.TestingFatal(t))
 
+	content, err := NewChunks([]byte("foo"), nil)
+	ce(err)
 	file := &File{
-		Content: []byte("foo"),
+		Content: content,
 	}
 
 	buf := make([]byte, 1)
@@ -48,22 +50,22 @@ func TestFileWrite(t *testing.T) {
 	ce(err)
 	eq(
 		n, 3,
-		file.Content, []byte(""),
-		newFile.Content, []byte("foo"),
+		chunksBytes(file.Content), []byte(""),
+		chunksBytes(newFile.Content), []byte("foo"),
 	)
 
 	newFile, n, err = newFile.WriteAt([]byte("bar"), 0)
 	ce(err)
 	eq(
 		n, 3,
-		newFile.Content, []byte("bar"),
+		chunksBytes(newFile.Content), []byte("bar"),
 	)
 
 	newFile, n, err = newFile.WriteAt([]byte("oo"), 1)
 	ce(err)
 	eq(
 		n, 2,
-		newFile.Content, []byte("boo"),
+		chunksBytes(newFile.Content), []byte("boo"),
 	)
 
 }
@@ -2,7 +2,10 @@ package fs9
 
 import (
 	"io/fs"
+	"os"
 	"time"
+
+	"github.com/reusee/e4"
 )
 
 type FS interface {
@@ -18,24 +21,74 @@ type FS interface {
 	OpenHandle(path string, options ...OpenOption) (Handle, error)
 	ReadLink(name string) (string, error)
 	Remove(path string, options ...RemoveOption) error
-	Rename(oldpath, newpath string) error
+	Rename(oldpath, newpath string, options ...RenameOption) error
 	SymLink(oldname, newname string) error
 	Truncate(name string, size int64) error
 	Stat(name string) (fs.FileInfo, error)
 	LinkStat(name string) (fs.FileInfo, error)
 
+	GetXattr(name string, attr string, options ...ChangeOption) ([]byte, error)
+	ListXattr(name string, options ...ChangeOption) ([]string, error)
+	SetXattr(name string, attr string, value []byte, flag int, options ...ChangeOption) error
+	RemoveXattr(name string, attr string, options ...ChangeOption) error
+
 	Snapshot() FS
 }
 
 type OpenOption func(*openSpec)
 
 type openSpec struct {
-	Create bool
+	Flag   int
+	Perm   fs.FileMode
+	Buffer int64
 }
 
+// open flags not in package os
+const (
+	// fail if the last path element is a symlink
+	O_NOFOLLOW = 1 << 29
+	// fail if the file is not a dir
+	O_DIRECTORY = 1 << 30
+)
+
+const accessModes = os.O_RDONLY | os.O_WRONLY | os.O_RDWR
+
+// newOpenSpec returns the spec of options. the default is os.O_RDWR with 0666 permissions for new files
+func newOpenSpec(options []OpenOption) openSpec {
+	spec := openSpec{
+		Flag: os.O_RDWR,
+		Perm: 0666,
+	}
+	for _, option := range options {
+		option(&spec)
+	}
+	return spec
+}
+
+// OptCreate sets or clears os.O_CREATE
 func OptCreate(b bool) OpenOption {
 	return func(spec *openSpec) {
-		spec.Create = b
+		if b {
+			spec.Flag |= os.O_CREATE
+		} else {
+			spec.Flag &^= os.O_CREATE
+		}
+	}
+}
+
+// OptFlag sets flags and permissions for new files as in os.OpenFile. O_NOFOLLOW and O_DIRECTORY are also supported
+func OptFlag(flag int, perm fs.FileMode) OpenOption {
+	return func(spec *openSpec) {
+		spec.Flag = flag
+		spec.Perm = perm
+	}
+}
+
+// OptBuffer makes writes of the handle collected in memory, and committed on Sync, Close,
+// or when more than size bytes are buffered. zero disables buffering
+func OptBuffer(size int64) OpenOption {
+	return func(spec *openSpec) {
+		spec.Buffer = size
 	}
 }
 
@@ -51,6 +104,37 @@ func OptAll(b bool) RemoveOption {
 	}
 }
 
+type RenameOption func(*renameSpec)
+
+type renameSpec struct {
+	NoReplace bool
+	Exchange  bool
+}
+
+// OptNoReplace fails renaming if the new path exists
+func OptNoReplace(b bool) RenameOption {
+	return func(spec *renameSpec) {
+		spec.NoReplace = b
+	}
+}
+
+// OptExchange swaps the old and new paths atomically. both paths must exist. can not be used with OptNoReplace
+func OptExchange(b bool) RenameOption {
+	return func(spec *renameSpec) {
+		spec.Exchange = b
+	}
+}
+
+// check rejects options that can not be used together
+func (s renameSpec) check() error {
+	if s.NoReplace && s.Exchange {
+		return we.With(
+			e4.Info("no-replace with exchange"),
+		)(ErrBadArgument)
+	}
+	return nil
+}
+
 type changeSpec struct {
 	NoFollow bool
 }
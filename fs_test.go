@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	iofs "io/fs"
 	"math/rand"
+	"os"
 	pathpkg "path"
 	"sort"
 	"strings"
@@ -200,6 +201,22 @@ func testFS(
 			// bad seek
 			_, err = h.Seek(42, 42)
 			eq(is(err, ErrBadArgument), true)
+			pos, err := h.Seek(3, io.SeekStart)
+			ce(err)
+			eq(pos, int64(3))
+			_, err = h.Seek(-1, io.SeekStart)
+			eq(is(err, ErrBadArgument), true)
+			_, err = h.Seek(-4, io.SeekCurrent)
+			eq(is(err, ErrBadArgument), true)
+			_, err = h.Seek(-100, io.SeekEnd)
+			eq(is(err, ErrBadArgument), true)
+			_, err = h.Seek(-1, SeekData)
+			eq(is(err, ErrBadArgument), true)
+			_, err = h.Seek(-1, SeekHole)
+			eq(is(err, ErrBadArgument), true)
+			pos, err = h.Seek(0, io.SeekCurrent)
+			ce(err)
+			eq(pos, int64(3))
 
 		}
 
@@ -359,6 +376,59 @@ func testFS(
 		eq(content, []byte("foo"))
 	})
 
+	t.Run("symlink resolution", func(t *testing.T) {
+		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+		fs := newFS()
+		ce(fs.MakeDirAll("a/b"))
+		f, err := fs.Create("a/b/foo")
+		ce(err)
+		_, err = f.Write([]byte("foo"))
+		ce(err)
+		ce(f.Close())
+		read := func(name string) string {
+			content, err := iofs.ReadFile(fs, name)
+			ce(err)
+			return string(content)
+		}
+
+		// relative and absolute targets
+		ce(fs.SymLink("foo", "a/b/rel"))
+		ce(fs.SymLink("../b/./foo", "a/b/up"))
+		ce(fs.SymLink("/a/b/foo", "abs"))
+		// intermediate parts
+		ce(fs.SymLink("a/b", "dir"))
+		ce(fs.SymLink("b/..", "a/parent"))
+		ce(fs.SymLink("../../../..", "a/b/root"))
+		eq(
+			read("a/b/rel"), "foo",
+			read("a/b/up"), "foo",
+			read("abs"), "foo",
+			read("dir/foo"), "foo",
+			read("dir/rel"), "foo",
+			read("a/parent/b/up"), "foo",
+			read("a/b/root/a/b/foo"), "foo",
+		)
+		ce(fs.MakeDir("dir/c"))
+		_, err = fs.Stat("a/b/c")
+		ce(err)
+		stat, err := fs.LinkStat("dir/rel")
+		ce(err)
+		eq(stat.Mode()&iofs.ModeSymlink != 0, true)
+
+		// loops
+		ce(fs.SymLink("loop2", "loop1"))
+		ce(fs.SymLink("loop1", "loop2"))
+		ce(fs.SymLink("self/foo", "self"))
+		_, err = fs.Stat("loop1")
+		eq(is(err, ErrTooManyLinks), true)
+		_, err = fs.Open("self")
+		eq(is(err, ErrTooManyLinks), true)
+		_, err = fs.Stat("self/foo")
+		eq(is(err, ErrTooManyLinks), true)
+		_, err = fs.LinkStat("loop1")
+		ce(err)
+	})
+
 	t.Run("rename", func(t *testing.T) {
 		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
 		fs := newFS()
@@ -370,10 +440,49 @@ func testFS(
 		eq(is(err, ErrFileNotFound), true)
 		_, err = fs.Open("bar")
 		ce(err)
-		_, err = fs.Create("qux")
+		h, err := fs.Create("qux")
 		ce(err)
-		err = fs.Rename("qux", "bar")
-		eq(is(err, ErrFileExisted), true)
+		_, err = h.Write([]byte("qux"))
+		ce(err)
+		ce(h.Close())
+		eq(
+			is(fs.Rename("qux", "bar", OptNoReplace(true)), ErrFileExisted), true,
+			is(fs.Rename("qux", "bar", OptNoReplace(true), OptExchange(true)), ErrBadArgument), true,
+		)
+
+		// replace
+		ce(fs.Rename("qux", "bar"))
+		content, err := iofs.ReadFile(fs, "bar")
+		ce(err)
+		eq(string(content), "qux")
+		_, err = fs.Stat("qux")
+		eq(is(err, ErrFileNotFound), true)
+		ce(fs.Rename("bar", "bar"))
+
+		// symlink
+		ce(fs.SymLink("bar", "link"))
+		ce(fs.Rename("link", "link2"))
+		link, err := fs.ReadLink("link2")
+		ce(err)
+		eq(link, "bar")
+		_, err = fs.Stat("bar")
+		ce(err)
+
+		// dirs
+		ce(fs.MakeDirAll("d/e"))
+		ce(fs.MakeDir("empty"))
+		eq(
+			is(fs.Rename("d", "d/e/d"), ErrInvalidPath), true,
+			is(fs.Rename("d", "d/d"), ErrInvalidPath), true,
+			is(fs.Rename("d", "bar"), ErrNotDir), true,
+			is(fs.Rename("bar", "d"), ErrIsDir), true,
+			is(fs.Rename("empty", "d"), ErrDirNotEmpty), true,
+		)
+		ce(fs.Rename("d", "empty"))
+		_, err = fs.Stat("empty/e")
+		ce(err)
+		_, err = fs.Stat("d")
+		eq(is(err, ErrFileNotFound), true)
 	})
 
 	t.Run("handle", func(t *testing.T) {
@@ -688,4 +797,305 @@ func testFS(
 		eq(is(err, ErrFileNotFound), true)
 	})
 
+	t.Run("open flags", func(t *testing.T) {
+		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+		fs := newFS()
+
+		// create with perm
+		h, err := fs.OpenHandle("foo", OptFlag(os.O_WRONLY|os.O_CREATE, 0600))
+		ce(err)
+		_, err = h.Write([]byte("foo"))
+		ce(err)
+		_, err = h.Read(make([]byte, 1))
+		eq(is(err, ErrNoPermission), true)
+		ce(h.Close())
+		stat, err := fs.Stat("foo")
+		ce(err)
+		eq(stat.Mode().Perm(), iofs.FileMode(0600))
+
+		// exclusive
+		_, err = fs.OpenHandle("foo", OptFlag(os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644))
+		eq(is(err, ErrFileExisted), true)
+
+		// read only
+		h, err = fs.OpenHandle("foo", OptFlag(os.O_RDONLY, 0))
+		ce(err)
+		_, err = h.Write([]byte("bar"))
+		eq(is(err, ErrNoPermission), true)
+		eq(is(h.Truncate(0), ErrNoPermission), true)
+		ce(h.Close())
+
+		// append
+		h, err = fs.OpenHandle("foo", OptFlag(os.O_WRONLY|os.O_APPEND, 0))
+		ce(err)
+		_, err = h.Seek(0, 0)
+		ce(err)
+		_, err = h.Write([]byte("bar"))
+		ce(err)
+		ce(h.Close())
+		content, err := iofs.ReadFile(fs, "foo")
+		ce(err)
+		eq(string(content), "foobar")
+
+		// truncate
+		h, err = fs.OpenHandle("foo", OptFlag(os.O_RDWR|os.O_TRUNC, 0))
+		ce(err)
+		ce(h.Close())
+		stat, err = fs.Stat("foo")
+		ce(err)
+		eq(stat.Size(), int64(0))
+
+		// no follow
+		ce(fs.SymLink("foo", "bar"))
+		_, err = fs.OpenHandle("bar", OptFlag(os.O_RDONLY|O_NOFOLLOW, 0))
+		eq(is(err, ErrInvalidPath), true)
+		h, err = fs.OpenHandle("bar", OptFlag(os.O_RDONLY, 0))
+		ce(err)
+		ce(h.Close())
+
+		// directory
+		ce(fs.MakeDir("dir"))
+		_, err = fs.OpenHandle("foo", OptFlag(os.O_RDONLY|O_DIRECTORY, 0))
+		eq(is(err, ErrNotDir), true)
+		h, err = fs.OpenHandle("dir", OptFlag(os.O_RDONLY|O_DIRECTORY, 0))
+		ce(err)
+		ce(h.Close())
+		for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_TRUNC} {
+			_, err = fs.OpenHandle("dir", OptFlag(flag, 0))
+			eq(is(err, ErrIsDir), true)
+		}
+		stat, err = fs.Stat("dir")
+		ce(err)
+		eq(stat.Size(), int64(0))
+
+		// create through dangling symlink
+		ce(fs.SymLink("../target", "dir/dangling"))
+		_, err = fs.OpenHandle("dir/dangling", OptFlag(os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600))
+		eq(is(err, ErrFileExisted), true)
+		h, err = fs.OpenHandle("dir/dangling", OptFlag(os.O_WRONLY|os.O_CREATE, 0600))
+		ce(err)
+		_, err = h.Write([]byte("target"))
+		ce(err)
+		ce(h.Close())
+		stat, err = fs.LinkStat("dir/dangling")
+		ce(err)
+		eq(stat.Mode()&iofs.ModeSymlink != 0, true)
+		stat, err = fs.Stat("target")
+		ce(err)
+		eq(stat.Mode(), iofs.FileMode(0600))
+		content, err = iofs.ReadFile(fs, "dir/dangling")
+		ce(err)
+		eq(string(content), "target")
+	})
+
+	t.Run("buffered handle", func(t *testing.T) {
+		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+		fs := newFS()
+		h, err := fs.OpenHandle("foo", OptCreate(true), OptBuffer(1<<16))
+		ce(err)
+		var expected []byte
+		for i := 0; i < 200; i++ {
+			offset := rand.Intn(len(expected) + 100)
+			data := make([]byte, rand.Intn(10000))
+			rand.Read(data)
+			_, err := h.Seek(int64(offset), 0)
+			ce(err)
+			_, err = h.Write(data)
+			ce(err)
+			if end := offset + len(data); end > len(expected) {
+				expected = append(expected, make([]byte, end-len(expected))...)
+			}
+			copy(expected[offset:], data)
+
+			// reads see writes of the handle
+			stat, err := h.Stat()
+			ce(err)
+			eq(stat.Size(), int64(len(expected)))
+			buf := make([]byte, len(expected)+1)
+			n, err := h.ReadAt(buf, 0)
+			eq(
+				is(err, io.EOF), true,
+				bytes.Equal(buf[:n], expected), true,
+			)
+		}
+		ce(h.Close())
+		content, err := iofs.ReadFile(fs, "foo")
+		ce(err)
+		eq(bytes.Equal(content, expected), true)
+	})
+
+	t.Run("sparse files", func(t *testing.T) {
+		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+		fs := newFS()
+		h, err := fs.OpenHandle("foo", OptCreate(true))
+		ce(err)
+		defer h.Close()
+		blocks := func() int64 {
+			stat, err := h.Stat()
+			ce(err)
+			return stat.Sys().(ExtFileInfo).Blocks
+		}
+		seek := func(offset int64, whence int) int64 {
+			ret, err := h.Seek(offset, whence)
+			ce(err)
+			return ret
+		}
+
+		// holes
+		ce(h.Truncate(1 << 30))
+		eq(blocks(), int64(0))
+		_, err = h.Seek(0, SeekData)
+		eq(is(err, ErrOutOfBounds), true)
+		eq(seek(0, SeekHole), int64(0))
+		eq(seek(1<<20, io.SeekStart), int64(1<<20))
+		_, err = h.Write([]byte("foo"))
+		ce(err)
+		eq(
+			blocks(), int64(1),
+			seek(0, SeekData), int64(1<<20),
+			seek(0, SeekHole), int64(0),
+			seek(1<<20, SeekHole), int64(1<<20+3),
+		)
+		buf := make([]byte, 5)
+		_, err = h.ReadAt(buf, 1<<20-1)
+		ce(err)
+		eq(string(buf), "\x00foo\x00")
+
+		// write past end
+		_, err = h.Seek(1<<31, io.SeekStart)
+		ce(err)
+		_, err = h.Write([]byte("bar"))
+		ce(err)
+		eq(
+			blocks(), int64(1),
+			seek(1<<20+3, SeekData), int64(1<<31),
+		)
+
+		// punch hole
+		ce(h.PunchHole(1<<20+1, 1))
+		_, err = h.ReadAt(buf, 1<<20-1)
+		ce(err)
+		eq(
+			string(buf), "\x00f\x00o\x00",
+			seek(1<<20, SeekHole), int64(1<<20+1),
+			seek(1<<20+1, SeekData), int64(1<<20+2),
+		)
+		ce(h.PunchHole(0, 1<<32))
+		stat, err := h.Stat()
+		ce(err)
+		eq(
+			stat.Size(), int64(1<<31+3),
+			blocks(), int64(0),
+		)
+
+		// allocate
+		ce(h.Allocate(1<<31, 1<<20))
+		stat, err = h.Stat()
+		ce(err)
+		eq(
+			stat.Size(), int64(1<<31+1<<20),
+			blocks(), int64(1<<20/512),
+			seek(0, SeekData), int64(1<<31),
+		)
+	})
+
+	t.Run("xattrs", func(t *testing.T) {
+		defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+		fs := newFS()
+		h, err := fs.Create("foo")
+		ce(err)
+		defer h.Close()
+		get := func(name, attr string, options ...ChangeOption) string {
+			value, err := fs.GetXattr(name, attr, options...)
+			ce(err)
+			return string(value)
+		}
+
+		// set and get
+		ce(fs.SetXattr("foo", "user.foo", []byte("foo"), 0))
+		ce(fs.SetXattr("foo", "trusted.foo", []byte("bar"), 0))
+		attrs, err := fs.ListXattr("foo")
+		ce(err)
+		eq(
+			get("foo", "user.foo"), "foo",
+			get("foo", "trusted.foo"), "bar",
+			attrs, []string{"trusted.foo", "user.foo"},
+		)
+		_, err = fs.GetXattr("foo", "user.bar")
+		eq(is(err, ErrXattrNotFound), true)
+
+		// flags
+		eq(
+			is(fs.SetXattr("foo", "user.foo", nil, XATTR_CREATE), ErrXattrExisted), true,
+			is(fs.SetXattr("foo", "user.bar", nil, XATTR_REPLACE), ErrXattrNotFound), true,
+		)
+		ce(fs.SetXattr("foo", "user.foo", []byte("baz"), XATTR_REPLACE))
+		ce(fs.SetXattr("foo", "user.bar", nil, XATTR_CREATE))
+		eq(
+			get("foo", "user.foo"), "baz",
+			get("foo", "user.bar"), "",
+		)
+
+		// names and sizes
+		eq(
+			is(fs.SetXattr("foo", "foo", nil, 0), ErrNotSupported), true,
+			is(fs.SetXattr("foo", "user.", nil, 0), ErrInvalidName), true,
+			is(fs.SetXattr("foo", "user."+strings.Repeat("a", 256), nil, 0), ErrXattrTooLarge), true,
+			is(fs.SetXattr("foo", "user.foo", make([]byte, 64<<10+1), 0), ErrXattrTooLarge), true,
+		)
+		ce(fs.SetXattr("foo", "user.foo", make([]byte, 64<<10), 0))
+
+		// remove
+		ce(fs.RemoveXattr("foo", "user.bar"))
+		eq(is(fs.RemoveXattr("foo", "user.bar"), ErrXattrNotFound), true)
+
+		// handle
+		ce(h.SetXattr("security.foo", []byte("qux"), 0))
+		value, err := h.GetXattr("security.foo")
+		ce(err)
+		attrs, err = h.ListXattr()
+		ce(err)
+		eq(
+			string(value), "qux",
+			get("foo", "security.foo"), "qux",
+			attrs, []string{"security.foo", "trusted.foo", "user.foo"},
+		)
+		ce(h.RemoveXattr("security.foo"))
+
+		// modification time not changed
+		stat, err := fs.Stat("foo")
+		ce(err)
+		ce(fs.SetXattr("foo", "user.time", nil, 0))
+		ce(fs.RemoveXattr("foo", "user.time"))
+		ce(h.SetXattr("user.time", nil, 0))
+		ce(h.RemoveXattr("user.time"))
+		stat2, err := fs.Stat("foo")
+		ce(err)
+		eq(stat2.ModTime().Equal(stat.ModTime()), true)
+
+		// symlink
+		ce(fs.SymLink("foo", "link"))
+		ce(fs.SetXattr("link", "user.link", []byte("foo"), 0))
+		eq(get("foo", "user.link"), "foo")
+		eq(is(fs.SetXattr("link", "user.link", nil, 0, OptNoFollow(true)), ErrNoPermission), true)
+		ce(fs.SetXattr("link", "trusted.link", []byte("link"), 0, OptNoFollow(true)))
+		attrs, err = fs.ListXattr("link", OptNoFollow(true))
+		ce(err)
+		eq(
+			get("link", "trusted.link", OptNoFollow(true)), "link",
+			attrs, []string{"trusted.link"},
+		)
+		_, err = fs.GetXattr("foo", "trusted.link")
+		eq(is(err, ErrXattrNotFound), true)
+
+		// snapshot
+		snapshot := fs.Snapshot()
+		ce(fs.SetXattr("foo", "user.foo", []byte("new"), 0))
+		value, err = snapshot.GetXattr("foo", "user.foo")
+		ce(err)
+		eq(
+			len(value), 64<<10,
+			get("foo", "user.foo"), "new",
+		)
+	})
 }
@@ -19,4 +19,21 @@ type Handle interface {
 	Name() string
 	Sync() error
 	Truncate(size int64) error
+	// PunchHole deallocates content in the range, reads of it return zeros. the size is not changed
+	PunchHole(offset, length int64) error
+	// Allocate allocates holes in the range, extending the file if the range is beyond the end
+	Allocate(offset, length int64) error
+
+	GetXattr(attr string) ([]byte, error)
+	ListXattr() ([]string, error)
+	SetXattr(attr string, value []byte, flag int) error
+	RemoveXattr(attr string) error
 }
+
+// whence values of Seek in addition to io.SeekStart, io.SeekCurrent and io.SeekEnd
+const (
+	// seek to the next data at or after offset
+	SeekData = 3
+	// seek to the next hole at or after offset. the end of file is a hole
+	SeekHole = 4
+)
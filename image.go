@@ -0,0 +1,329 @@
+package fs9
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/reusee/dscope"
+	"github.com/reusee/e4"
+	"github.com/reusee/sb"
+)
+
+// image format:
+// an imageHeader, then imageRecords of all *FileMap and *File nodes and their content chunks in any order,
+// then an imageRecord with End set.
+// delta images written by SaveIncremental have Base set to the FilesID of the previous image, and contain only nodes not in it.
+// with OptEncryption, chunks and optionally dir entry names are encrypted as in StoreFS
+
+const (
+	imageMagic   = "fs9 image"
+	imageVersion = 1
+)
+
+type imageHeader struct {
+	Magic   string
+	Version int
+	RootID  FileID
+	FilesID int64
+	Base    int64
+}
+
+type imageRecord struct {
+	Node  *nodeRecord
+	Chunk *chunkRecord
+	End   bool
+}
+
+func (r *nodeRecord) nodeID() int64 {
+	switch {
+	case r.FileMap != nil:
+		return r.FileMap.NodeID
+	case r.File != nil:
+		return r.File.NodeID
+	}
+	return 0
+}
+
+func writeRecord(w io.Writer, value any) error {
+	if err := sb.Copy(
+		sb.Marshal(value),
+		sb.Encode(w),
+	); err != nil {
+		return we(err)
+	}
+	return nil
+}
+
+func readRecord(r io.Reader, target any) error {
+	if err := sb.Copy(
+		sb.Decode(r),
+		sb.Unmarshal(target),
+	); err != nil {
+		return we.With(
+			ErrBadRecord,
+		)(err)
+	}
+	return nil
+}
+
+// Save writes a snapshot of the whole tree to w. writers are not blocked while saving
+func (m *MemFS) Save(w io.Writer) error {
+	m.RLock()
+	rootID := m.root.id
+	files := m.files
+	m.RUnlock()
+
+	chunks := make(map[int64]bool)
+	return m.writeImage(w, imageHeader{
+		RootID:  rootID,
+		FilesID: files.nodeID,
+	}, func(w io.Writer) error {
+		return walkNodes(files, func(node Node) error {
+			return m.saveNode(w, node, chunks)
+		})
+	})
+}
+
+// SaveIncremental writes a delta image of nodes reachable from cur but not from prev to w.
+// prev should be a snapshot that is already saved by Save or SaveIncremental
+func SaveIncremental(w io.Writer, prev, cur FS) error {
+	prevFS, err := memSnapshot(prev)
+	if err != nil {
+		return err
+	}
+	m, err := memSnapshot(cur)
+	if err != nil {
+		return err
+	}
+
+	chunks := make(map[int64]bool)
+	return m.writeImage(w, imageHeader{
+		RootID:  m.root.id,
+		FilesID: m.files.nodeID,
+		Base:    prevFS.files.nodeID,
+	}, func(w io.Writer) error {
+		return diffNodes(
+			prevFS.files, m.files,
+			func(Node) error {
+				return nil
+			},
+			func(node Node) error {
+				if file, ok := node.(*File); ok {
+					// chunks of the previous version are in the previous image
+					old, err := prevFS.files.getFile(prevFS.ctx, file.ID)
+					if err != nil {
+						return err
+					}
+					if old != nil {
+						if err := old.Content.Range(func(_ int64, chunk *Chunk) error {
+							chunks[chunk.id] = true
+							return nil
+						}); err != nil {
+							return err
+						}
+					}
+				}
+				return m.saveNode(w, node, chunks)
+			},
+		)
+	})
+}
+
+func (m *MemFS) writeImage(w io.Writer, header imageHeader, fn func(io.Writer) error) error {
+	bw := bufio.NewWriter(w)
+	header.Magic = imageMagic
+	header.Version = imageVersion
+	if err := writeRecord(bw, header); err != nil {
+		return err
+	}
+	if err := fn(bw); err != nil {
+		return err
+	}
+	if err := writeRecord(bw, imageRecord{
+		End: true,
+	}); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return we(err)
+	}
+	return nil
+}
+
+// saveNode writes node and its content chunks not in saved
+func (m *MemFS) saveNode(w io.Writer, node Node, saved map[int64]bool) error {
+	if file, ok := node.(*File); ok {
+		if err := file.Content.Range(func(_ int64, chunk *Chunk) error {
+			if saved[chunk.id] {
+				return nil
+			}
+			saved[chunk.id] = true
+			rec := chunkToRecord(chunk)
+			if err := m.sealChunk(rec); err != nil {
+				return err
+			}
+			return writeRecord(w, imageRecord{
+				Chunk: rec,
+			})
+		}); err != nil {
+			return err
+		}
+	}
+	rec, err := nodeToRecord(node)
+	if err != nil { // NOCOVER
+		return err
+	}
+	if err := m.sealNames(rec); err != nil {
+		return err
+	}
+	return writeRecord(w, imageRecord{
+		Node: rec,
+	})
+}
+
+// imageRecords holds records read from images
+type imageRecords struct {
+	nodes  map[int64]*nodeRecord
+	chunks map[int64]*chunkRecord
+}
+
+func newImageRecords() *imageRecords {
+	return &imageRecords{
+		nodes:  make(map[int64]*nodeRecord),
+		chunks: make(map[int64]*chunkRecord),
+	}
+}
+
+// read reads an image from r into records
+func (i *imageRecords) read(r io.Reader) (header imageHeader, err error) {
+	if err := readRecord(r, &header); err != nil {
+		return header, err
+	}
+	if header.Magic != imageMagic {
+		return header, we.With(
+			e4.Info("bad magic: %q", header.Magic),
+		)(ErrBadRecord)
+	}
+	if header.Version != imageVersion {
+		return header, we.With(
+			e4.Info("version: %d", header.Version),
+		)(ErrBadRecord)
+	}
+	for {
+		var rec imageRecord
+		if err := readRecord(r, &rec); err != nil {
+			return header, err
+		}
+		switch {
+		case rec.End:
+			return header, nil
+		case rec.Node != nil:
+			i.nodes[rec.Node.nodeID()] = rec.Node
+		case rec.Chunk != nil:
+			i.chunks[rec.Chunk.ID] = rec.Chunk
+		default:
+			return header, we.With(
+				e4.Info("empty record"),
+			)(ErrBadRecord)
+		}
+	}
+}
+
+// build rebuilds a MemFS from records
+func (i *imageRecords) build(header imageHeader, options ...MemFSOption) (*MemFS, error) {
+	m := newMemFS(dscope.New(), nil, header.RootID, options...)
+
+	chunks := make(map[int64]*Chunk)
+	loadChunk := func(id int64) (*Chunk, error) {
+		if chunk, ok := chunks[id]; ok {
+			return chunk, nil
+		}
+		rec, ok := i.chunks[id]
+		if !ok {
+			return nil, we.With(
+				e4.Info("chunk %d not found", id),
+			)(ErrBadRecord)
+		}
+		r := *rec
+		if err := m.unsealChunk(&r); err != nil {
+			return nil, err
+		}
+		chunk := recordToChunk(&r)
+		chunks[id] = chunk
+		return chunk, nil
+	}
+
+	var load func(id int64) (Node, error)
+	load = func(id int64) (Node, error) {
+		rec, ok := i.nodes[id]
+		if !ok {
+			return nil, we.With(
+				e4.Info("node %d not found", id),
+			)(ErrBadRecord)
+		}
+		r := *rec
+		if r.File != nil {
+			file := *r.File
+			file.Subs = append([]dirEntryRecord(nil), file.Subs...)
+			r.File = &file
+			if err := m.unsealNames(&r); err != nil {
+				return nil, err
+			}
+		}
+		return recordToNode(&r, m, load, loadChunk)
+	}
+
+	node, err := load(header.FilesID)
+	if err != nil {
+		return nil, err
+	}
+	files, ok := node.(*FileMap)
+	if !ok {
+		return nil, we.With(
+			e4.Info("root node is %T", node),
+		)(ErrBadRecord)
+	}
+	root, err := files.getFile(m.ctx, header.RootID)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil || !root.IsDir {
+		return nil, we.With(
+			e4.Info("bad root dir"),
+		)(ErrBadRecord)
+	}
+	m.files = files
+	return m, nil
+}
+
+// Load reads a MemFS saved by MemFS.Save. options should include the key provider if the image is encrypted
+func Load(r io.Reader, options ...MemFSOption) (*MemFS, error) {
+	return LoadIncremental(r, nil, options...)
+}
+
+// LoadIncremental reads a MemFS from a base image saved by MemFS.Save and delta images saved by SaveIncremental, in saving order
+func LoadIncremental(base io.Reader, deltas []io.Reader, options ...MemFSOption) (*MemFS, error) {
+	records := newImageRecords()
+	header, err := records.read(bufio.NewReader(base))
+	if err != nil {
+		return nil, err
+	}
+	if header.Base != 0 {
+		return nil, we.With(
+			e4.Info("delta image without base"),
+		)(ErrBadRecord)
+	}
+	for _, r := range deltas {
+		delta, err := records.read(bufio.NewReader(r))
+		if err != nil {
+			return nil, err
+		}
+		if delta.Base != header.FilesID {
+			return nil, we.With(
+				e4.Info("delta image not based on the previous image"),
+			)(ErrBadRecord)
+		}
+		header = delta
+	}
+	return records.build(header, options...)
+}
@@ -0,0 +1,213 @@
+package fs9
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+func TestImage(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	ce(m.MakeDirAll("foo/bar"))
+	h, err := m.Create("foo/bar/secret-name")
+	ce(err)
+	content := bytes.Repeat([]byte("secret content"), 10000)
+	_, err = h.Write(content)
+	ce(err)
+	ce(h.Close())
+	ce(m.Link("foo/bar/secret-name", "hard"))
+	ce(m.SymLink("hard", "sym"))
+	ce(m.ChangeMode("hard", 0600))
+	ce(m.ChangeOwner("sym", 42, 24, OptNoFollow(true)))
+	ce(m.SetXattr("hard", "user.foo", []byte("foo"), 0))
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	ce(m.ChangeTimes("foo", t1, t1))
+
+	buf := new(bytes.Buffer)
+	ce(m.Save(buf))
+	loaded, err := Load(bytes.NewReader(buf.Bytes()))
+	ce(err)
+	ce(Diff(m, loaded, func(c Change) error {
+		return fmt.Errorf("unexpected change: %+v", c)
+	}))
+	data, err := fs.ReadFile(loaded, "sym")
+	ce(err)
+	eq(bytes.Equal(data, content), true)
+	link, err := loaded.ReadLink("sym")
+	ce(err)
+	eq(link, "hard")
+	value, err := loaded.GetXattr("hard", "user.foo")
+	ce(err)
+	eq(string(value), "foo")
+	stat, err := loaded.Stat("foo/bar/secret-name")
+	ce(err)
+	origStat, err := m.Stat("foo/bar/secret-name")
+	ce(err)
+	eq(
+		stat.Mode(), fs.FileMode(0600),
+		stat.Sys().(ExtFileInfo).ID, origStat.Sys().(ExtFileInfo).ID,
+	)
+	stat, err = loaded.LinkStat("sym")
+	ce(err)
+	eq(
+		stat.Sys().(ExtFileInfo).UserID, 42,
+		stat.Sys().(ExtFileInfo).GroupID, 24,
+	)
+	stat, err = loaded.Stat("foo")
+	ce(err)
+	eq(
+		stat.ModTime().Equal(t1), true,
+		stat.Sys().(ExtFileInfo).AccessTime.Equal(t1), true,
+	)
+	// hard links share the file
+	h, err = loaded.Create("hard")
+	ce(err)
+	ce(h.Close())
+	stat, err = loaded.Stat("foo/bar/secret-name")
+	ce(err)
+	eq(stat.Size(), int64(0))
+
+	// encrypted
+	ring := newTestKeyRing("a")
+	m2, err := Load(bytes.NewReader(buf.Bytes()), OptEncryption(ring), OptEncryptNames(true))
+	ce(err)
+	buf.Reset()
+	ce(m2.Save(buf))
+	eq(
+		bytes.Contains(buf.Bytes(), []byte("secret content")), false,
+		bytes.Contains(buf.Bytes(), []byte("secret-name")), false,
+	)
+	_, err = Load(bytes.NewReader(buf.Bytes()))
+	eq(is(err, ErrKeyNotFound), true)
+	m2, err = Load(bytes.NewReader(buf.Bytes()), OptEncryption(ring))
+	ce(err)
+	data, err = fs.ReadFile(m2, "foo/bar/secret-name")
+	ce(err)
+	eq(bytes.Equal(data, content), true)
+
+	// bad images
+	_, err = Load(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), OptEncryption(ring))
+	eq(is(err, ErrBadRecord), true)
+	_, err = Load(bytes.NewReader([]byte("foo")))
+	eq(is(err, ErrBadRecord), true)
+	bad := new(bytes.Buffer)
+	ce(writeRecord(bad, imageHeader{
+		Magic:   "foo",
+		Version: imageVersion,
+	}))
+	_, err = Load(bad)
+	eq(is(err, ErrBadRecord), true)
+
+	// save while writing
+	m = NewMemFS()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h, err := m.Create(fmt.Sprintf("%d-%d", i, j))
+				ce(err)
+				_, err = h.Write([]byte("foo"))
+				ce(err)
+				ce(h.Close())
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		buf.Reset()
+		ce(m.Save(buf))
+		_, err := Load(buf)
+		ce(err)
+	}
+	wg.Wait()
+}
+
+func TestIncrementalImage(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	write := func(fsys FS, name string, content []byte) {
+		h, err := fsys.Create(name)
+		ce(err)
+		_, err = h.Write(content)
+		ce(err)
+		ce(h.Close())
+	}
+	noChange := func(a, b FS) {
+		ce(Diff(a, b, func(c Change) error {
+			return fmt.Errorf("unexpected change: %+v", c)
+		}))
+	}
+
+	m := NewMemFS()
+	ce(m.MakeDir("d"))
+	for i := 0; i < 100; i++ {
+		write(m, fmt.Sprintf("d/%d", i), bytes.Repeat([]byte{byte(i)}, 100000))
+	}
+	base := new(bytes.Buffer)
+	ce(m.Save(base))
+	snapshot1 := m.Snapshot()
+
+	// no change
+	delta := new(bytes.Buffer)
+	ce(SaveIncremental(delta, snapshot1, m))
+	loaded, err := LoadIncremental(bytes.NewReader(base.Bytes()), []io.Reader{
+		bytes.NewReader(delta.Bytes()),
+	})
+	ce(err)
+	noChange(m, loaded)
+
+	// small changes
+	write(m, "d/0", []byte("foo"))
+	ce(m.Rename("d/1", "1"))
+	ce(m.Remove("d/2"))
+	delta1 := new(bytes.Buffer)
+	ce(SaveIncremental(delta1, snapshot1, m))
+	eq(delta1.Len() < base.Len()/10, true)
+	snapshot2 := m.Snapshot()
+	h, err := m.OpenHandle("d/3")
+	ce(err)
+	_, err = h.Seek(50000, io.SeekStart)
+	ce(err)
+	_, err = h.Write([]byte("bar"))
+	ce(err)
+	ce(h.Close())
+	ce(m.SymLink("d/3", "link"))
+	delta2 := new(bytes.Buffer)
+	ce(SaveIncremental(delta2, snapshot2, m))
+	eq(delta2.Len() < base.Len()/10, true)
+
+	loaded, err = LoadIncremental(bytes.NewReader(base.Bytes()), []io.Reader{
+		bytes.NewReader(delta1.Bytes()),
+	})
+	ce(err)
+	noChange(snapshot2, loaded)
+	loaded, err = LoadIncremental(bytes.NewReader(base.Bytes()), []io.Reader{
+		bytes.NewReader(delta1.Bytes()),
+		bytes.NewReader(delta2.Bytes()),
+	})
+	ce(err)
+	noChange(m, loaded)
+	data, err := fs.ReadFile(loaded, "link")
+	ce(err)
+	eq(string(data[50000:50003]), "bar")
+
+	// bad chains
+	_, err = Load(bytes.NewReader(delta1.Bytes()))
+	eq(is(err, ErrBadRecord), true)
+	_, err = LoadIncremental(bytes.NewReader(base.Bytes()), []io.Reader{
+		bytes.NewReader(delta2.Bytes()),
+	})
+	eq(is(err, ErrBadRecord), true)
+	err = SaveIncremental(new(bytes.Buffer), snapshot1, NewLayeredFS(m))
+	eq(is(err, ErrTypeMismatch), true)
+}
@@ -0,0 +1,1450 @@
+package fs9
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+// LayeredFS stacks a writable upper FS over read-only lower FSs.
+//
+// Lookups go from the upper layer down. A non-dir hides files of the same path in lower layers, dirs are merged across layers.
+// Files of lower layers are copied to the upper layer on first write or metadata change, with their parent dirs.
+// Removing a path that exists in lower layers creates a whiteout file named ".wh.<name>" in the upper layer.
+// A dir created over a whiteout contains an opaque marker named ".wh..wh..opq", which hides the dirs of the same path in lower layers.
+// Names with the ".wh." prefix are reserved.
+type LayeredFS struct {
+	sync.RWMutex
+	layers  []FS // upper first
+	copyUps int64
+}
+
+var _ FS = new(LayeredFS)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueName     = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// NewLayeredFS returns a LayeredFS writing to upper. lowers are never written, the first has the highest priority
+func NewLayeredFS(upper FS, lowers ...FS) *LayeredFS {
+	return &LayeredFS{
+		layers: append([]FS{upper}, lowers...),
+	}
+}
+
+func (l *LayeredFS) upper() FS {
+	return l.layers[0]
+}
+
+// layeredEntry is a resolved path
+type layeredEntry struct {
+	path   []string    // without symlinks, except the last part if not followed
+	layers []int       // layers containing the path, top first. more than one for merged dirs only
+	info   fs.FileInfo // of the top layer, not following symlink
+}
+
+func (e *layeredEntry) name() string {
+	return partsToName(e.path)
+}
+
+func partsToName(parts []string) string {
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+func isNotExist(err error) bool {
+	return is(err, ErrFileNotFound) || is(err, fs.ErrNotExist)
+}
+
+func (l *LayeredFS) exists(layer int, name string) (bool, error) {
+	_, err := l.layers[layer].LinkStat(name)
+	if isNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// lookupChild looks up name in dir of dirLayers
+func (l *LayeredFS) lookupChild(dir []string, dirLayers []int, name string) (*layeredEntry, error) {
+	path := make([]string, len(dir)+1)
+	copy(path, dir)
+	path[len(dir)] = name
+	entry := &layeredEntry{
+		path: path,
+	}
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return nil, we.With(
+			e4.Info("path %s", entry.name()),
+		)(ErrFileNotFound)
+	}
+
+	for _, layer := range dirLayers {
+		info, err := l.layers[layer].LinkStat(entry.name())
+		if isNotExist(err) {
+			whiteout, err := l.exists(layer, partsToName(append(dir[:len(dir):len(dir)], whiteoutPrefix+name)))
+			if err != nil {
+				return nil, err
+			}
+			if whiteout {
+				break
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if entry.info == nil {
+			entry.info = info
+			entry.layers = append(entry.layers, layer)
+			if !info.IsDir() {
+				break
+			}
+		} else if info.IsDir() {
+			entry.layers = append(entry.layers, layer)
+		} else {
+			// hidden by dir
+			break
+		}
+		opaque, err := l.exists(layer, partsToName(append(path[:len(path):len(path)], opaqueName)))
+		if err != nil {
+			return nil, err
+		}
+		if opaque {
+			break
+		}
+	}
+
+	if entry.info == nil {
+		return nil, we.With(
+			e4.Info("path %s", entry.name()),
+		)(ErrFileNotFound)
+	}
+	return entry, nil
+}
+
+func (l *LayeredFS) root() (*layeredEntry, error) {
+	info, err := l.upper().LinkStat(".")
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]int, len(l.layers))
+	for i := range layers {
+		layers[i] = i
+	}
+	return &layeredEntry{
+		layers: layers,
+		info:   info,
+	}, nil
+}
+
+func (l *LayeredFS) resolve(name string, followSymlink bool) (*layeredEntry, error) {
+	parts, err := NameToPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.resolvePath(parts, followSymlink, 0)
+}
+
+func (l *LayeredFS) resolvePath(parts []string, followSymlink bool, depth int) (*layeredEntry, error) {
+	root, err := l.root()
+	if err != nil {
+		return nil, err
+	}
+	return l.walk(root, parts, followSymlink, depth)
+}
+
+// walk resolves parts from dir entry. ".." parts from symlink targets go to the parent dir
+func (l *LayeredFS) walk(entry *layeredEntry, parts []string, followSymlink bool, depth int) (*layeredEntry, error) {
+	for i, name := range parts {
+		if !entry.info.IsDir() {
+			return nil, we.With(
+				e4.Info("%s is not dir", entry.name()),
+			)(ErrFileNotFound)
+		}
+		var err error
+		if name == ".." {
+			if len(entry.path) > 0 {
+				entry, err = l.parentOf(entry)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		entry, err = l.lookupChild(entry.path, entry.layers, name)
+		if err != nil {
+			return nil, err
+		}
+		last := i == len(parts)-1
+		if entry.info.Mode()&fs.ModeSymlink != 0 && (!last || followSymlink) {
+			if depth >= maxLinkDepth {
+				return nil, we.With(
+					e4.Info("%s", entry.name()),
+				)(ErrTooManyLinks)
+			}
+			target, err := l.layers[entry.layers[0]].ReadLink(entry.name())
+			if err != nil {
+				return nil, err
+			}
+			targetParts, abs := linkTargetToPath(target)
+			var dir *layeredEntry
+			if abs {
+				dir, err = l.root()
+			} else {
+				dir, err = l.parentOf(entry)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return l.walk(
+				dir,
+				append(targetParts, parts[i+1:]...),
+				followSymlink,
+				depth+1,
+			)
+		}
+	}
+	return entry, nil
+}
+
+// readDir returns merged entries of a dir
+func (l *LayeredFS) readDir(dir *layeredEntry) ([]fs.DirEntry, error) {
+	seen := make(map[string]bool)
+	var ret []fs.DirEntry
+	for _, layer := range dir.layers {
+		entries, err := fs.ReadDir(l.layers[layer], dir.name())
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if name == opaqueName {
+				continue
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				// hide lower layers
+				seen[strings.TrimPrefix(name, whiteoutPrefix)] = true
+				continue
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			ret = append(ret, entry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name() < ret[j].Name()
+	})
+	return ret, nil
+}
+
+// lowerVisible reports whether name in dir exists in lower layers
+func (l *LayeredFS) lowerVisible(dir *layeredEntry, name string) (bool, error) {
+	for _, layer := range dir.layers {
+		if layer == 0 {
+			continue
+		}
+		ok, err := l.exists(layer, partsToName(append(dir.path[:len(dir.path):len(dir.path)], name)))
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+		ok, err = l.exists(layer, partsToName(append(dir.path[:len(dir.path):len(dir.path)], whiteoutPrefix+name)))
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// copyUp copies the entry and its parent dirs to the upper layer. the write lock must be held
+func (l *LayeredFS) copyUp(entry *layeredEntry) error {
+	if entry.layers[0] == 0 {
+		return nil
+	}
+
+	// parents
+	for i := 1; i < len(entry.path); i++ {
+		ok, err := l.exists(0, partsToName(entry.path[:i]))
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		parent, err := l.resolvePath(entry.path[:i], false, 0)
+		if err != nil {
+			return err
+		}
+		if err := l.copyUp(parent); err != nil {
+			return err
+		}
+	}
+
+	name := entry.name()
+	upper := l.upper()
+	lower := l.layers[entry.layers[0]]
+	info := entry.info
+	switch {
+
+	case info.IsDir():
+		if err := upper.MakeDir(name); err != nil {
+			return err
+		}
+
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := lower.ReadLink(name)
+		if err != nil {
+			return err
+		}
+		if err := upper.SymLink(target, name); err != nil {
+			return err
+		}
+
+	default:
+		if err := copyFile(upper, lower, name); err != nil {
+			return err
+		}
+
+	}
+
+	if err := copyXattrs(upper, lower, name); err != nil {
+		return err
+	}
+	if err := upper.ChangeMode(name, info.Mode(), OptNoFollow(true)); err != nil {
+		return err
+	}
+	atime := info.ModTime()
+	if ext, ok := info.Sys().(ExtFileInfo); ok {
+		if err := upper.ChangeOwner(name, ext.UserID, ext.GroupID, OptNoFollow(true)); err != nil {
+			return err
+		}
+		atime = ext.AccessTime
+	}
+	if err := upper.ChangeTimes(name, atime, info.ModTime(), OptNoFollow(true)); err != nil {
+		return err
+	}
+
+	entry.layers = append([]int{0}, entry.layers...)
+	atomic.AddInt64(&l.copyUps, 1)
+	return nil
+}
+
+func copyXattrs(dst, src FS, name string) error {
+	attrs, err := src.ListXattr(name, OptNoFollow(true))
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		value, err := src.GetXattr(name, attr, OptNoFollow(true))
+		if err != nil {
+			return err
+		}
+		if err := dst.SetXattr(name, attr, value, 0, OptNoFollow(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src FS, name string) (err error) {
+	r, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := w.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if h, ok := r.(Handle); ok {
+		return copySparse(w, h)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return we(err)
+	}
+	return nil
+}
+
+// copySparse copies data ranges of src to dst, holes are not allocated
+func copySparse(dst Handle, src Handle) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	for offset := int64(0); offset < size; {
+		data, err := src.Seek(offset, SeekData)
+		if is(err, ErrOutOfBounds) {
+			break
+		} else if err != nil {
+			return err
+		}
+		hole, err := src.Seek(data, SeekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, io.NewSectionReader(src, data, hole-data)); err != nil {
+			return we(err)
+		}
+		offset = hole
+	}
+	return dst.Truncate(size)
+}
+
+// copyUpTree copies the entry and all entries under it to the upper layer
+func (l *LayeredFS) copyUpTree(entry *layeredEntry) error {
+	if err := l.copyUp(entry); err != nil {
+		return err
+	}
+	if !entry.info.IsDir() || len(entry.layers) == 1 {
+		return nil
+	}
+	entries, err := l.readDir(entry)
+	if err != nil {
+		return err
+	}
+	for _, sub := range entries {
+		child, err := l.lookupChild(entry.path, entry.layers, sub.Name())
+		if err != nil {
+			return err
+		}
+		if err := l.copyUpTree(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareCreate checks that name does not exist, copies up its parent dir and removes its whiteout.
+// whiteout reports whether there was a whiteout, so a new dir should be opaque
+func (l *LayeredFS) prepareCreate(name string) (path string, whiteout bool, err error) {
+	parts, err := NameToPath(name)
+	if err != nil {
+		return "", false, err
+	}
+	if len(parts) == 0 {
+		return "", false, we(ErrFileExisted)
+	}
+	base := parts[len(parts)-1]
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return "", false, we.With(
+			e4.Info("reserved name: %s", base),
+		)(ErrInvalidName)
+	}
+	parent, err := l.resolvePath(parts[:len(parts)-1], true, 0)
+	if err != nil {
+		return "", false, err
+	}
+	if !parent.info.IsDir() {
+		return "", false, we.With(
+			e4.Info("%s is not dir", parent.name()),
+		)(ErrFileNotFound)
+	}
+	if _, err := l.lookupChild(parent.path, parent.layers, base); err == nil {
+		return "", false, we.With(
+			e4.Info("path %s", name),
+		)(ErrFileExisted)
+	} else if !isNotExist(err) {
+		return "", false, err
+	}
+	if err := l.copyUp(parent); err != nil {
+		return "", false, err
+	}
+	path = partsToName(append(parent.path[:len(parent.path):len(parent.path)], base))
+	whiteoutName := partsToName(append(parent.path[:len(parent.path):len(parent.path)], whiteoutPrefix+base))
+	whiteout, err = l.exists(0, whiteoutName)
+	if err != nil {
+		return "", false, err
+	}
+	if whiteout {
+		if err := l.upper().Remove(whiteoutName); err != nil {
+			return "", false, err
+		}
+	}
+	return path, whiteout, nil
+}
+
+func (l *LayeredFS) makeOpaque(name string) error {
+	h, err := l.upper().Create(pathpkg.Join(name, opaqueName))
+	if err != nil {
+		return err
+	}
+	return h.Close()
+}
+
+// whiteout hides name of dir in lower layers, if visible
+func (l *LayeredFS) whiteout(dir *layeredEntry, name string) error {
+	visible, err := l.lowerVisible(dir, name)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return nil
+	}
+	if err := l.copyUp(dir); err != nil {
+		return err
+	}
+	h, err := l.upper().Create(partsToName(append(dir.path[:len(dir.path):len(dir.path)], whiteoutPrefix+name)))
+	if err != nil {
+		return err
+	}
+	return h.Close()
+}
+
+func (l *LayeredFS) parentOf(entry *layeredEntry) (*layeredEntry, error) {
+	return l.resolvePath(entry.path[:len(entry.path)-1], false, 0)
+}
+
+func (l *LayeredFS) ChangeMode(name string, mode fs.FileMode, options ...ChangeOption) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, options)
+	if err != nil {
+		return err
+	}
+	return l.upper().ChangeMode(path, mode, options...)
+}
+
+func (l *LayeredFS) ChangeOwner(name string, uid, gid int, options ...ChangeOption) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, options)
+	if err != nil {
+		return err
+	}
+	return l.upper().ChangeOwner(path, uid, gid, options...)
+}
+
+func (l *LayeredFS) ChangeTimes(name string, atime time.Time, mtime time.Time, options ...ChangeOption) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, options)
+	if err != nil {
+		return err
+	}
+	return l.upper().ChangeTimes(path, atime, mtime, options...)
+}
+
+func (l *LayeredFS) Truncate(name string, size int64) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, nil)
+	if err != nil {
+		return err
+	}
+	return l.upper().Truncate(path, size)
+}
+
+func (l *LayeredFS) GetXattr(name string, attr string, options ...ChangeOption) ([]byte, error) {
+	l.RLock()
+	defer l.RUnlock()
+	entry, err := l.resolveByOptions(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return l.layers[entry.layers[0]].GetXattr(entry.name(), attr, OptNoFollow(true))
+}
+
+func (l *LayeredFS) ListXattr(name string, options ...ChangeOption) ([]string, error) {
+	l.RLock()
+	defer l.RUnlock()
+	entry, err := l.resolveByOptions(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return l.layers[entry.layers[0]].ListXattr(entry.name(), OptNoFollow(true))
+}
+
+func (l *LayeredFS) SetXattr(name string, attr string, value []byte, flag int, options ...ChangeOption) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, options)
+	if err != nil {
+		return err
+	}
+	return l.upper().SetXattr(path, attr, value, flag, OptNoFollow(true))
+}
+
+func (l *LayeredFS) RemoveXattr(name string, attr string, options ...ChangeOption) error {
+	l.Lock()
+	defer l.Unlock()
+	path, err := l.copyUpByName(name, options)
+	if err != nil {
+		return err
+	}
+	return l.upper().RemoveXattr(path, attr, OptNoFollow(true))
+}
+
+func (l *LayeredFS) resolveByOptions(name string, options []ChangeOption) (*layeredEntry, error) {
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	return l.resolve(name, !spec.NoFollow)
+}
+
+func (l *LayeredFS) copyUpByName(name string, options []ChangeOption) (string, error) {
+	entry, err := l.resolveByOptions(name, options)
+	if err != nil {
+		return "", err
+	}
+	if err := l.copyUp(entry); err != nil {
+		return "", err
+	}
+	return entry.name(), nil
+}
+
+func (l *LayeredFS) Create(name string) (Handle, error) {
+	l.Lock()
+	defer l.Unlock()
+	entry, err := l.resolve(name, true)
+	if err == nil {
+		if err := l.copyUp(entry); err != nil {
+			return nil, err
+		}
+		h, err := l.upper().Create(entry.name())
+		if err != nil {
+			return nil, err
+		}
+		return l.newHandle(name, entry, h, os.O_RDWR), nil
+	} else if !isNotExist(err) {
+		return nil, err
+	}
+	path, _, err := l.prepareCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := l.upper().Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return l.newHandle(name, nil, h, os.O_RDWR), nil
+}
+
+func (l *LayeredFS) Link(oldname, newname string) error {
+	l.Lock()
+	defer l.Unlock()
+	entry, err := l.resolve(oldname, true)
+	if err != nil {
+		return err
+	}
+	if entry.info.IsDir() {
+		return we(ErrCannotLink)
+	}
+	path, _, err := l.prepareCreate(newname)
+	if err != nil {
+		return err
+	}
+	if err := l.copyUp(entry); err != nil {
+		return err
+	}
+	return l.upper().Link(entry.name(), path)
+}
+
+func (l *LayeredFS) MakeDir(name string) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.makeDir(name)
+}
+
+func (l *LayeredFS) makeDir(name string) error {
+	path, whiteout, err := l.prepareCreate(name)
+	if err != nil {
+		return err
+	}
+	if err := l.upper().MakeDir(path); err != nil {
+		return err
+	}
+	if whiteout {
+		return l.makeOpaque(path)
+	}
+	return nil
+}
+
+func (l *LayeredFS) MakeDirAll(name string) error {
+	parts, err := NameToPath(name)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	for i := 1; i <= len(parts); i++ {
+		entry, err := l.resolvePath(parts[:i], true, 0)
+		if err == nil {
+			if !entry.info.IsDir() {
+				return we.With(
+					e4.Info("%s is not dir", entry.name()),
+				)(ErrFileExisted)
+			}
+			continue
+		} else if !isNotExist(err) {
+			return err
+		}
+		if err := l.makeDir(partsToName(parts[:i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPath returns the name to create a file at name, which is not found by following symlinks.
+// if name is a dangling symlink, the name of its target is returned. exclusive creating fails on symlinks
+func (l *LayeredFS) createPath(name string, exclusive bool) (string, error) {
+	for depth := 0; ; depth++ {
+		entry, err := l.resolve(name, false)
+		if isNotExist(err) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+		if entry.info.Mode()&fs.ModeSymlink == 0 { // NOCOVER
+			return name, nil
+		}
+		if exclusive {
+			return "", we.With(
+				e4.Info("symlink: %s", name),
+			)(ErrFileExisted)
+		}
+		if depth >= maxLinkDepth {
+			return "", we.With(
+				e4.Info("%s", entry.name()),
+			)(ErrTooManyLinks)
+		}
+		target, err := l.layers[entry.layers[0]].ReadLink(entry.name())
+		if err != nil {
+			return "", err
+		}
+		parts, abs := linkTargetToPath(target)
+		if len(parts) == 0 || parts[len(parts)-1] == ".." {
+			return "", we.With(
+				e4.Info("symlink: %s", name),
+			)(ErrIsDir)
+		}
+		var dir *layeredEntry
+		if abs {
+			dir, err = l.root()
+		} else {
+			dir, err = l.parentOf(entry)
+		}
+		if err != nil {
+			return "", err
+		}
+		dir, err = l.walk(dir, parts[:len(parts)-1], true, 0)
+		if err != nil {
+			return "", err
+		}
+		name = partsToName(append(dir.path[:len(dir.path):len(dir.path)], parts[len(parts)-1]))
+	}
+}
+
+func (l *LayeredFS) Open(name string) (fs.File, error) {
+	return l.OpenHandle(name, OptFlag(os.O_RDONLY, 0))
+}
+
+func (l *LayeredFS) OpenHandle(name string, options ...OpenOption) (Handle, error) {
+	spec := newOpenSpec(options)
+	flag := spec.Flag
+	access := flag & accessModes
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		l.Lock()
+		defer l.Unlock()
+	} else {
+		l.RLock()
+		defer l.RUnlock()
+	}
+
+	entry, err := l.resolve(name, flag&O_NOFOLLOW == 0)
+	if isNotExist(err) && flag&os.O_CREATE != 0 {
+		createName := name
+		if flag&O_NOFOLLOW == 0 {
+			// dangling symlinks are resolved to the path to create
+			createName, err = l.createPath(name, flag&os.O_EXCL != 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		path, _, err := l.prepareCreate(createName)
+		if err != nil {
+			return nil, err
+		}
+		h, err := l.upper().OpenHandle(path, OptFlag(flag, spec.Perm), OptBuffer(spec.Buffer))
+		if err != nil {
+			return nil, err
+		}
+		return l.newHandle(name, nil, h, flag), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, we(ErrFileExisted)
+	}
+	if entry.info.Mode()&fs.ModeSymlink != 0 {
+		return nil, we.With(
+			e4.Info("symlink: %s", name),
+		)(ErrInvalidPath)
+	}
+	if flag&O_DIRECTORY != 0 && !entry.info.IsDir() {
+		return nil, we.With(
+			e4.Info("%s", name),
+		)(ErrNotDir)
+	}
+	if entry.info.IsDir() && (access != os.O_RDONLY || flag&os.O_TRUNC != 0) {
+		return nil, we.With(
+			e4.Info("open dir for writing: %s", name),
+		)(ErrIsDir)
+	}
+	layer := entry.layers[0]
+	layerFlag := flag &^ (os.O_CREATE | os.O_EXCL | O_NOFOLLOW)
+	if flag&os.O_TRUNC != 0 && access != os.O_RDONLY && layer != 0 {
+		// truncate in the upper layer
+		if err := l.copyUp(entry); err != nil {
+			return nil, err
+		}
+		layer = 0
+	}
+	if layer != 0 {
+		// lower layers are not written, handles switch to the upper layer on copy-up
+		layerFlag = os.O_RDONLY
+	}
+
+	h, err := l.layers[layer].OpenHandle(entry.name(), OptFlag(layerFlag, 0), OptBuffer(spec.Buffer))
+	if err != nil {
+		return nil, err
+	}
+	handle := l.newHandle(name, entry, h, flag)
+	handle.upper = layer == 0
+	return handle, nil
+}
+
+func (l *LayeredFS) ReadLink(name string) (string, error) {
+	l.RLock()
+	defer l.RUnlock()
+	entry, err := l.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return l.layers[entry.layers[0]].ReadLink(entry.name())
+}
+
+func (l *LayeredFS) Remove(name string, options ...RemoveOption) error {
+	parts, err := NameToPath(name)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// root
+		return l.upper().Remove(name, options...)
+	}
+	var spec removeSpec
+	for _, option := range options {
+		option(&spec)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	entry, err := l.resolvePath(parts, false, 0)
+	if err != nil {
+		return err
+	}
+	if entry.info.IsDir() && !spec.All {
+		entries, err := l.readDir(entry)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return we.With(
+				e4.Info("path %s", name),
+			)(ErrDirNotEmpty)
+		}
+	}
+	return l.removeEntry(entry)
+}
+
+// removeEntry removes entry from the upper layer and hides it in lower layers
+func (l *LayeredFS) removeEntry(entry *layeredEntry) error {
+	if entry.layers[0] == 0 {
+		if err := l.upper().Remove(entry.name(), OptAll(true)); err != nil {
+			return err
+		}
+	}
+	parent, err := l.parentOf(entry)
+	if err != nil {
+		return err
+	}
+	return l.whiteout(parent, entry.path[len(entry.path)-1])
+}
+
+func (l *LayeredFS) Rename(oldpath, newpath string, options ...RenameOption) error {
+	var spec renameSpec
+	for _, option := range options {
+		option(&spec)
+	}
+	if err := spec.check(); err != nil {
+		return err
+	}
+	if spec.Exchange {
+		return we.With(
+			e4.Info("exchange in layered fs"),
+		)(ErrNotSupported)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	entry, err := l.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	if len(entry.path) == 0 {
+		return we.With(
+			e4.Info("cannot rename root"),
+		)(ErrNoPermission)
+	}
+	parent, base, target, err := l.checkReplace(entry, newpath, spec)
+	if err != nil {
+		return err
+	}
+	if target != nil && target.name() == entry.name() {
+		return nil
+	}
+
+	// nothing is removed before the rename, so a failed rename leaves both paths as they were
+	if err := l.copyUp(parent); err != nil {
+		return err
+	}
+	if err := l.copyUpTree(entry); err != nil {
+		return err
+	}
+	path := partsToName(append(parent.path[:len(parent.path):len(parent.path)], base))
+	whiteoutName := partsToName(append(parent.path[:len(parent.path):len(parent.path)], whiteoutPrefix+base))
+	whiteout, err := l.exists(0, whiteoutName)
+	if err != nil {
+		return err
+	}
+	if entry.info.IsDir() {
+		visible, err := l.lowerVisible(parent, base)
+		if err != nil {
+			return err
+		}
+		if whiteout || visible {
+			// lower dirs at the new path are not merged
+			if err := l.makeOpaque(entry.name()); err != nil {
+				return err
+			}
+		}
+	}
+	// an upper dir may hold whiteouts, so it is swapped out instead of replaced
+	exchange := false
+	if target != nil && target.info.IsDir() {
+		exchange, err = l.exists(0, path)
+		if err != nil {
+			return err
+		}
+	}
+	if err := l.upper().Rename(entry.name(), path, OptExchange(exchange)); err != nil {
+		return err
+	}
+	if exchange {
+		if err := l.upper().Remove(entry.name(), OptAll(true)); err != nil {
+			return err
+		}
+	}
+	if whiteout {
+		if err := l.upper().Remove(whiteoutName); err != nil {
+			return err
+		}
+	}
+	oldParent, err := l.parentOf(entry)
+	if err != nil {
+		return err
+	}
+	return l.whiteout(oldParent, entry.path[len(entry.path)-1])
+}
+
+// checkReplace checks that entry can be renamed to newpath, and returns the parent dir, the base name and the existing target
+func (l *LayeredFS) checkReplace(entry *layeredEntry, newpath string, spec renameSpec) (parent *layeredEntry, base string, target *layeredEntry, err error) {
+	parts, err := NameToPath(newpath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(parts) == 0 {
+		return nil, "", nil, we.With(
+			e4.Info("cannot rename to root"),
+		)(ErrInvalidPath)
+	}
+	base = parts[len(parts)-1]
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return nil, "", nil, we.With(
+			e4.Info("reserved name: %s", base),
+		)(ErrInvalidName)
+	}
+	parent, err = l.resolvePath(parts[:len(parts)-1], true, 0)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if !parent.info.IsDir() {
+		return nil, "", nil, we.With(
+			e4.Info("%s is not dir", parent.name()),
+		)(ErrFileNotFound)
+	}
+	if entry.info.IsDir() && hasPathPrefix(parent.path, entry.path) {
+		return nil, "", nil, we.With(
+			e4.Info("cannot move dir into itself"),
+		)(ErrInvalidPath)
+	}
+	target, err = l.lookupChild(parent.path, parent.layers, base)
+	if isNotExist(err) {
+		return parent, base, nil, nil
+	} else if err != nil {
+		return nil, "", nil, err
+	}
+	if spec.NoReplace {
+		return nil, "", nil, we.With(
+			e4.Info("path %s", newpath),
+		)(ErrFileExisted)
+	}
+	if target.name() == entry.name() {
+		return parent, base, target, nil
+	}
+	if !target.info.IsDir() && entry.info.IsDir() {
+		return nil, "", nil, we.With(
+			e4.Info("path %s", newpath),
+		)(ErrNotDir)
+	}
+	if target.info.IsDir() {
+		if !entry.info.IsDir() {
+			return nil, "", nil, we.With(
+				e4.Info("path %s", newpath),
+			)(ErrIsDir)
+		}
+		entries, err := l.readDir(target)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if len(entries) > 0 {
+			return nil, "", nil, we.With(
+				e4.Info("path %s", newpath),
+			)(ErrDirNotEmpty)
+		}
+	}
+	return parent, base, target, nil
+}
+
+func hasPathPrefix(path []string, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, name := range prefix {
+		if path[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *LayeredFS) SymLink(oldname, newname string) error {
+	l.Lock()
+	defer l.Unlock()
+	path, _, err := l.prepareCreate(newname)
+	if err != nil {
+		return err
+	}
+	return l.upper().SymLink(oldname, path)
+}
+
+func (l *LayeredFS) Stat(name string) (fs.FileInfo, error) {
+	return l.stat(name, true)
+}
+
+func (l *LayeredFS) LinkStat(name string) (fs.FileInfo, error) {
+	return l.stat(name, false)
+}
+
+func (l *LayeredFS) stat(name string, followSymlink bool) (fs.FileInfo, error) {
+	l.RLock()
+	defer l.RUnlock()
+	entry, err := l.resolve(name, followSymlink)
+	if err != nil {
+		return nil, err
+	}
+	return renameInfo(entry.info, pathpkg.Base(name)), nil
+}
+
+// Snapshot returns a LayeredFS over snapshots of all layers
+func (l *LayeredFS) Snapshot() FS {
+	l.RLock()
+	defer l.RUnlock()
+	layers := make([]FS, 0, len(l.layers))
+	for _, layer := range l.layers {
+		layers = append(layers, layer.Snapshot())
+	}
+	return NewLayeredFS(layers[0], layers[1:]...)
+}
+
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (n namedFileInfo) Name() string {
+	return n.name
+}
+
+func renameInfo(info fs.FileInfo, name string) fs.FileInfo {
+	if info.Name() == name {
+		return info
+	}
+	return namedFileInfo{
+		FileInfo: info,
+		name:     name,
+	}
+}
+
+// LayeredHandle is a Handle of LayeredFS. handles of lower layer files switch to the upper layer on copy-up
+type LayeredHandle struct {
+	sync.Mutex
+	fs      *LayeredFS
+	name    string
+	path    string // resolved path
+	upper   bool
+	handle  Handle
+	flag    int // open flags
+	copyUps int64
+	isDir   bool
+	entries []fs.DirEntry
+	listed  bool
+	closed  bool
+}
+
+var _ Handle = new(LayeredHandle)
+
+func (l *LayeredFS) newHandle(name string, entry *layeredEntry, h Handle, flag int) *LayeredHandle {
+	handle := &LayeredHandle{
+		fs:      l,
+		name:    name,
+		upper:   true,
+		handle:  h,
+		flag:    flag,
+		copyUps: atomic.LoadInt64(&l.copyUps),
+	}
+	if entry != nil {
+		handle.path = entry.name()
+		handle.upper = entry.layers[0] == 0
+		handle.isDir = entry.info.IsDir()
+	}
+	return handle
+}
+
+// switchUpper replaces the lower layer handle with an upper layer handle of the same path and offset
+func (h *LayeredHandle) switchUpper() error {
+	offset, err := h.handle.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	upper, err := h.fs.upper().OpenHandle(h.path, OptFlag(h.flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC|O_NOFOLLOW), 0))
+	if err != nil {
+		return err
+	}
+	if _, err := upper.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := h.handle.Close(); err != nil {
+		return err
+	}
+	h.handle = upper
+	h.upper = true
+	return nil
+}
+
+// refresh switches to the upper layer if the file was copied up by others
+func (h *LayeredHandle) refresh() error {
+	if h.closed {
+		return ErrClosed
+	}
+	if h.upper {
+		return nil
+	}
+	copyUps := atomic.LoadInt64(&h.fs.copyUps)
+	if copyUps == h.copyUps {
+		return nil
+	}
+	h.copyUps = copyUps
+	h.fs.RLock()
+	defer h.fs.RUnlock()
+	ok, err := h.fs.exists(0, h.path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return h.switchUpper()
+}
+
+// copyUp copies the file to the upper layer before writing
+func (h *LayeredHandle) copyUp() error {
+	if h.closed {
+		return ErrClosed
+	}
+	if h.upper {
+		return nil
+	}
+	h.fs.Lock()
+	defer h.fs.Unlock()
+	entry, err := h.fs.resolve(h.path, false)
+	if err != nil {
+		return err
+	}
+	if err := h.fs.copyUp(entry); err != nil {
+		return err
+	}
+	return h.switchUpper()
+}
+
+func (h *LayeredHandle) Name() string {
+	return h.name
+}
+
+func (h *LayeredHandle) Stat() (fs.FileInfo, error) {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.refresh(); err != nil {
+		return nil, err
+	}
+	info, err := h.handle.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renameInfo(info, pathpkg.Base(h.name)), nil
+}
+
+func (h *LayeredHandle) Read(buf []byte) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_WRONLY {
+		return 0, errNotReadable
+	}
+	if err := h.refresh(); err != nil {
+		return 0, err
+	}
+	return h.handle.Read(buf)
+}
+
+func (h *LayeredHandle) ReadAt(buf []byte, offset int64) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_WRONLY {
+		return 0, errNotReadable
+	}
+	if err := h.refresh(); err != nil {
+		return 0, err
+	}
+	return h.handle.ReadAt(buf, offset)
+}
+
+func (h *LayeredHandle) Seek(offset int64, whence int) (int64, error) {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.refresh(); err != nil {
+		return 0, err
+	}
+	return h.handle.Seek(offset, whence)
+}
+
+func (h *LayeredHandle) ReadDir(n int) (ret []fs.DirEntry, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	if !h.isDir {
+		return h.handle.ReadDir(n)
+	}
+	if !h.listed {
+		h.fs.RLock()
+		entry, err := h.fs.resolve(h.path, false)
+		if err == nil {
+			h.entries, err = h.fs.readDir(entry)
+		}
+		h.fs.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		h.listed = true
+	}
+	if n <= 0 {
+		ret = h.entries
+		h.entries = nil
+		return ret, nil
+	}
+	if len(h.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(h.entries) {
+		n = len(h.entries)
+	}
+	ret = h.entries[:n]
+	h.entries = h.entries[n:]
+	return ret, nil
+}
+
+func (h *LayeredHandle) Close() error {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	return h.handle.Close()
+}
+
+func (h *LayeredHandle) Sync() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	return h.handle.Sync()
+}
+
+func (h *LayeredHandle) Write(data []byte) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_RDONLY {
+		return 0, errNotWritable
+	}
+	if err := h.copyUp(); err != nil {
+		return 0, err
+	}
+	return h.handle.Write(data)
+}
+
+func (h *LayeredHandle) Truncate(size int64) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_RDONLY {
+		return errNotWritable
+	}
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.Truncate(size)
+}
+
+func (h *LayeredHandle) PunchHole(offset, length int64) error {
+	if err := checkRange(offset, length); err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_RDONLY {
+		return errNotWritable
+	}
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.PunchHole(offset, length)
+}
+
+func (h *LayeredHandle) Allocate(offset, length int64) error {
+	if err := checkRange(offset, length); err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.flag&accessModes == os.O_RDONLY {
+		return errNotWritable
+	}
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.Allocate(offset, length)
+}
+
+func (h *LayeredHandle) ChangeMode(mode fs.FileMode) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.ChangeMode(mode)
+}
+
+func (h *LayeredHandle) ChangeOwner(uid, gid int) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.ChangeOwner(uid, gid)
+}
+
+func (h *LayeredHandle) ChangeTimes(atime, mtime time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.ChangeTimes(atime, mtime)
+}
+
+func (h *LayeredHandle) GetXattr(attr string) ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.refresh(); err != nil {
+		return nil, err
+	}
+	return h.handle.GetXattr(attr)
+}
+
+func (h *LayeredHandle) ListXattr() ([]string, error) {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.refresh(); err != nil {
+		return nil, err
+	}
+	return h.handle.ListXattr()
+}
+
+func (h *LayeredHandle) SetXattr(attr string, value []byte, flag int) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.SetXattr(attr, value, flag)
+}
+
+func (h *LayeredHandle) RemoveXattr(attr string) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.copyUp(); err != nil {
+		return err
+	}
+	return h.handle.RemoveXattr(attr)
+}
@@ -0,0 +1,218 @@
+package fs9
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestLayeredFS(t *testing.T) {
+	testFS(t, func() FS {
+		return NewLayeredFS(NewMemFS(), NewMemFS(), NewMemFS())
+	})
+}
+
+func TestLayeredFSLayers(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	write := func(fsys FS, name string, content string) {
+		h, err := fsys.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+	read := func(fsys FS, name string) string {
+		data, err := fs.ReadFile(fsys, name)
+		ce(err)
+		return string(data)
+	}
+	readDir := func(fsys FS, name string) (names []string) {
+		entries, err := fs.ReadDir(fsys, name)
+		ce(err)
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return
+	}
+	notFound := func(fsys FS, name string) bool {
+		_, err := fsys.LinkStat(name)
+		return is(err, ErrFileNotFound)
+	}
+
+	lower1 := NewMemFS()
+	ce(lower1.MakeDirAll("d/e"))
+	write(lower1, "a", "lower1 a")
+	write(lower1, "d/x", "lower1 x")
+	write(lower1, "d/e/y", "y")
+	lower2 := NewMemFS()
+	ce(lower2.MakeDir("d"))
+	write(lower2, "a", "lower2 a")
+	write(lower2, "b", "lower2 b")
+	write(lower2, "d/z", "lower2 z")
+	ce(lower2.SetXattr("d/z", "user.lower", []byte("lower"), 0))
+	upper := NewMemFS()
+	l := NewLayeredFS(upper, lower1, lower2)
+
+	// lookup and merged dirs
+	eq(
+		read(l, "a"), "lower1 a",
+		read(l, "b"), "lower2 b",
+		read(l, "d/z"), "lower2 z",
+		readDir(l, "."), []string{"a", "b", "d"},
+		readDir(l, "d"), []string{"e", "x", "z"},
+		readDir(upper, "."), []string(nil),
+	)
+
+	// lower dirs are not opened for writing
+	_, err := l.OpenHandle("d/e", OptFlag(os.O_RDWR, 0))
+	eq(
+		is(err, ErrIsDir), true,
+		notFound(upper, "d"), true,
+	)
+
+	// copy-up on write
+	h1, err := l.OpenHandle("d/x")
+	ce(err)
+	h2, err := l.OpenHandle("d/x")
+	ce(err)
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(h2, buf)
+	ce(err)
+	eq(string(buf), "lower1")
+	_, err = h1.Write([]byte("upper1"))
+	ce(err)
+	_, err = h2.Seek(0, io.SeekStart)
+	ce(err)
+	data, err := io.ReadAll(h2)
+	ce(err)
+	ce(h1.Close())
+	ce(h2.Close())
+	eq(
+		string(data), "upper1 x",
+		read(l, "d/x"), "upper1 x",
+		read(upper, "d/x"), "upper1 x",
+		read(lower1, "d/x"), "lower1 x",
+		readDir(l, "d"), []string{"e", "x", "z"},
+	)
+
+	// copy-up on metadata change, with parents
+	ce(l.ChangeMode("d/e/y", 0600))
+	stat, err := l.Stat("d/e/y")
+	ce(err)
+	eq(stat.Mode(), fs.FileMode(0600))
+	stat, err = lower1.Stat("d/e/y")
+	ce(err)
+	eq(stat.Mode(), fs.FileMode(0666))
+	stat, err = upper.Stat("d/e")
+	ce(err)
+	eq(stat.IsDir(), true)
+
+	// copy-up keeps extended attributes
+	value, err := l.GetXattr("d/z", "user.lower")
+	ce(err)
+	eq(string(value), "lower")
+	ce(l.SetXattr("d/z", "user.upper", []byte("upper"), 0))
+	attrs, err := upper.ListXattr("d/z")
+	ce(err)
+	eq(attrs, []string{"user.lower", "user.upper"})
+	attrs, err = lower2.ListXattr("d/z")
+	ce(err)
+	eq(attrs, []string{"user.lower"})
+
+	// whiteout
+	ce(l.Remove("b"))
+	eq(
+		notFound(l, "b"), true,
+		read(lower2, "b"), "lower2 b",
+		readDir(l, "."), []string{"a", "d"},
+		readDir(upper, "."), []string{".wh.b", "d"},
+		notFound(l, ".wh.b"), true,
+	)
+	_, err = l.Create(".wh.foo")
+	eq(is(err, ErrInvalidName), true)
+	write(l, "b", "upper b")
+	eq(
+		read(l, "b"), "upper b",
+		readDir(upper, "."), []string{"b", "d"},
+	)
+	// upper file hides lower files
+	ce(l.Remove("a"))
+	eq(notFound(l, "a"), true)
+
+	// opaque dir
+	err = l.Remove("d")
+	eq(is(err, ErrDirNotEmpty), true)
+	ce(l.Remove("d", OptAll(true)))
+	eq(notFound(l, "d"), true)
+	ce(l.MakeDir("d"))
+	eq(
+		readDir(l, "d"), []string(nil),
+		readDir(upper, "d"), []string{".wh..wh..opq"},
+	)
+	write(l, "d/x", "new x")
+	eq(readDir(l, "d"), []string{"x"})
+
+	// rename
+	l = NewLayeredFS(NewMemFS(), lower1, lower2)
+	ce(l.Rename("d", "d2"))
+	eq(
+		notFound(l, "d"), true,
+		readDir(l, "d2"), []string{"e", "x", "z"},
+		read(l, "d2/e/y"), "y",
+		read(l, "d2/z"), "lower2 z",
+	)
+	ce(l.Rename("d2", "d"))
+	eq(
+		readDir(l, "d"), []string{"e", "x", "z"},
+		read(l, "d/x"), "lower1 x",
+	)
+
+	// links across layers
+	ce(l.SymLink("d/z", "link"))
+	eq(read(l, "link"), "lower2 z")
+	ce(l.Link("d/e/y", "hard"))
+	write(l, "hard", "hard")
+	eq(
+		read(l, "d/e/y"), "hard",
+		read(lower1, "d/e/y"), "y",
+	)
+
+	// snapshot
+	snapshot := l.Snapshot()
+	write(l, "a", "foo")
+	eq(
+		read(snapshot, "a"), "lower1 a",
+		read(l, "a"), "foo",
+	)
+
+	// replace
+	upper = NewMemFS()
+	l = NewLayeredFS(upper, lower1, lower2)
+	write(l, "c", "upper c")
+	ce(l.Rename("c", "a"))
+	eq(
+		read(l, "a"), "upper c",
+		notFound(l, "c"), true,
+	)
+	ce(l.Remove("d/e/y"))
+	ce(l.MakeDir("e"))
+	write(l, "e/new", "new")
+	ce(l.Rename("e", "d/e"))
+	eq(
+		readDir(l, "d/e"), []string{"new"},
+		notFound(l, "e"), true,
+	)
+	// failed renames keep the target
+	ce(upper.MakeDir("q"))
+	ce(upper.SetQuota(Quota{Files: 10}, OptQuotaDir("q")))
+	write(l, "q/target", "target")
+	eq(is(l.Rename("a", "q/target"), ErrCrossDevice), true)
+	eq(
+		read(l, "q/target"), "target",
+		read(l, "a"), "upper c",
+	)
+}
@@ -2,50 +2,112 @@ package fs9
 
 import (
 	"io/fs"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/reusee/dscope"
-	"github.com/reusee/it"
+	"github.com/reusee/e4"
 )
 
 type MemFS struct {
 	sync.RWMutex
-	ctx   Scope
-	root  *DirEntry
-	files *FileMap // FileID -> *File
+	ctx      Scope
+	root     *DirEntry
+	files    *FileMap // FileID -> *File
+	onCommit func(files *FileMap) error
+	codec    Codec // default codec for file content
+
+	// encryption at rest
+	keys         KeyProvider
+	encryptNames bool
+
+	watchers       map[*Watcher]bool
+	watchLock      sync.Mutex // serializes dispatching of events
+	watchSeq       int64
+	watchQueueLock sync.Mutex
+	watchQueue     []watchCommit // commits not dispatched yet, in order
+	watchParents   *parentIndex  // of the last dispatched commit. built on demand
+
+	// quotas. maps are replaced, not modified in place
+	quotas map[quotaKey]Quota
+	usage  map[quotaKey]Usage // nil if usage is not tracked
+
+	// numbers of open handles of files
+	handlesLock sync.Mutex
+	handles     map[FileID]int
+}
+
+type MemFSOption func(*memFSSpec)
+
+type memFSSpec struct {
+	Codec        Codec
+	Keys         KeyProvider
+	EncryptNames bool
+}
+
+// OptCodec sets the default codec for file content. nil disables compression
+func OptCodec(codec Codec) MemFSOption {
+	return func(spec *memFSSpec) {
+		spec.Codec = codec
+	}
 }
 
 var _ fs.FS = new(MemFS)
 
 var _ FS = new(MemFS)
 
-func NewMemFS() *MemFS {
-	m := &MemFS{
-		files: NewFileMap(2, 0),
+// OptEncryption enables encryption of content chunks with keys from provider, when they are persisted
+func OptEncryption(provider KeyProvider) MemFSOption {
+	return func(spec *memFSSpec) {
+		spec.Keys = provider
+	}
+}
+
+// OptEncryptNames enables encryption of dir entry names, when they are persisted. it has effect only with OptEncryption
+func OptEncryptNames(b bool) MemFSOption {
+	return func(spec *memFSSpec) {
+		spec.EncryptNames = b
 	}
+}
 
-	// ctx
-	m.ctx = dscope.New()
+func NewMemFS(options ...MemFSOption) *MemFS {
+	files := NewFileMap(2, 0)
+	ctx := dscope.New()
 
 	// root file
 	rootFile := NewFile(true)
-	newNode, err := m.files.Mutate(m.ctx, m.files.GetPath(rootFile.ID), func(node Node) (Node, error) {
+	rootFile.Nlink = 1
+	newNode, err := files.Mutate(ctx, files.GetPath(rootFile.ID), func(node Node) (Node, error) {
 		return rootFile, nil
 	})
 	if err != nil {
 		panic(err)
 	}
-	m.files = newNode.(*FileMap)
+
+	return newMemFS(ctx, newNode.(*FileMap), rootFile.ID, options...)
+}
+
+func newMemFS(ctx Scope, files *FileMap, rootID FileID, options ...MemFSOption) *MemFS {
+	var spec memFSSpec
+	for _, option := range options {
+		option(&spec)
+	}
+	m := &MemFS{
+		ctx:          ctx,
+		files:        files,
+		codec:        spec.Codec,
+		keys:         spec.Keys,
+		encryptNames: spec.EncryptNames,
+	}
 	m.root = &DirEntry{
-		nodeID: it.NewNodeID(),
-		id:     rootFile.ID,
+		nodeID: newNodeID(),
+		id:     rootID,
 		name:   ".",
-		isDir:  rootFile.IsDir,
-		_type:  rootFile.Mode,
+		isDir:  true,
+		_type:  fs.ModeDir,
 		fs:     m,
 	}
-
 	return m
 }
 
@@ -53,80 +115,117 @@ func (m *MemFS) Snapshot() FS {
 	m.RLock()
 	defer m.RUnlock()
 	return &MemFS{
-		ctx:   m.ctx,
-		root:  m.root,
-		files: m.files,
+		ctx:          m.ctx,
+		root:         m.root,
+		files:        m.files,
+		codec:        m.codec,
+		keys:         m.keys,
+		encryptNames: m.encryptNames,
+	}
+}
+
+// memSnapshot returns a snapshot of a MemFS-based FS
+func memSnapshot(fsys FS) (*MemFS, error) {
+	m, ok := fsys.Snapshot().(*MemFS)
+	if !ok {
+		return nil, we.With(
+			e4.Info("%T is not MemFS-based", fsys),
+		)(ErrTypeMismatch)
 	}
+	return m, nil
 }
 
 func (m *MemFS) Open(path string) (fs.File, error) {
-	return m.OpenHandle(path)
+	return m.OpenHandle(path, OptFlag(os.O_RDONLY, 0))
 }
 
 func (m *MemFS) OpenHandle(name string, options ...OpenOption) (handle Handle, err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.OpenHandle(name, options...)
+	err = m.write(func(batch *MemFSWriteBatch) (err error) {
+		handle, err = batch.OpenHandle(name, options...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.retain(handle.(*MemHandle)); err != nil {
+		return nil, err
+	}
+	return
 }
 
 func (m *MemFS) MakeDir(p string) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.MakeDir(p)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.MakeDir(p)
+	})
 }
 
 func (m *MemFS) MakeDirAll(p string) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.MakeDirAll(p)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.MakeDirAll(p)
+	})
 }
 
 func (m *MemFS) Remove(name string, options ...RemoveOption) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.Remove(name, options...)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.Remove(name, options...)
+	})
 }
 
 func (m *MemFS) ChangeMode(name string, mode fs.FileMode, options ...ChangeOption) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.ChangeMode(name, mode, options...)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeMode(name, mode, options...)
+	})
 }
 
 func (m *MemFS) ChangeOwner(name string, uid, gid int, options ...ChangeOption) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.ChangeOwner(name, uid, gid, options...)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeOwner(name, uid, gid, options...)
+	})
 }
 
 func (m *MemFS) Truncate(name string, size int64) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.Truncate(name, size)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.Truncate(name, size)
+	})
+}
+
+// ChangeCodec sets the codec of a file and re-encodes its content. empty codec name selects the default of the FS
+func (m *MemFS) ChangeCodec(name string, codec string, options ...ChangeOption) (err error) {
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeCodec(name, codec, options...)
+	})
 }
 
 func (m *MemFS) ChangeTimes(name string, atime, mtime time.Time, options ...ChangeOption) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.ChangeTimes(name, atime, mtime, options...)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeTimes(name, atime, mtime, options...)
+	})
 }
 
 func (m *MemFS) Create(name string) (handle Handle, err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.Create(name)
+	err = m.write(func(batch *MemFSWriteBatch) (err error) {
+		handle, err = batch.Create(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.retain(handle.(*MemHandle)); err != nil {
+		return nil, err
+	}
+	return
 }
 
 func (m *MemFS) Link(oldname, newname string) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.Link(oldname, newname)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.Link(oldname, newname)
+	})
 }
 
 func (m *MemFS) SymLink(oldname, newname string) (err error) {
-	batch, done := m.NewWriteBatch()
-	defer done(&err)
-	return batch.SymLink(oldname, newname)
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.SymLink(oldname, newname)
+	})
 }
 
 func (m *MemFS) stat(name string, id FileID) (info FileInfo, err error) {
@@ -152,8 +251,46 @@ func (m *MemFS) ReadLink(name string) (link string, err error) {
 	defer done(&err)
 	return batch.ReadLink(name)
 }
-func (m *MemFS) Rename(oldname, newname string) (err error) {
-	batch, done := m.NewWriteBatch()
+func (m *MemFS) Rename(oldname, newname string, options ...RenameOption) (err error) {
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.Rename(oldname, newname, options...)
+	})
+}
+
+// codecOf returns the codec for new content chunks of file
+func (m *MemFS) codecOf(file *File) (Codec, error) {
+	if file.Codec != "" {
+		return GetCodec(file.Codec)
+	}
+	return m.codec, nil
+}
+
+// ContentStats reports sizes of file content. chunks shared by files are counted once
+type ContentStats struct {
+	Chunks       int
+	LogicalBytes int64
+	StoredBytes  int64
+}
+
+func (m *MemFS) ContentStats() (stats ContentStats, err error) {
+	batch, done := m.NewReadBatch()
 	defer done(&err)
-	return batch.Rename(oldname, newname)
+	seen := make(map[int64]bool)
+	err = walkNodes(batch.files, func(node Node) error {
+		file, ok := node.(*File)
+		if !ok {
+			return nil
+		}
+		return file.Content.Range(func(_ int64, chunk *Chunk) error {
+			if seen[chunk.id] {
+				return nil
+			}
+			seen[chunk.id] = true
+			stats.Chunks++
+			stats.LogicalBytes += int64(chunk.size)
+			stats.StoredBytes += int64(len(chunk.Data))
+			return nil
+		})
+	})
+	return
 }
@@ -2,21 +2,36 @@ package fs9
 
 import (
 	"io/fs"
+	"os"
 	pathpkg "path"
+	"strings"
 	"time"
 
-	"github.com/reusee/it"
+	"github.com/reusee/e4"
 )
 
 type MemFSReadBatch struct {
-	fs    *MemFS
-	ctx   Scope
-	root  *DirEntry
-	files *FileMap
+	fs      *MemFS
+	ctx     Scope
+	root    *DirEntry
+	files   *FileMap
+	touched *batchTouched // nil in read batches
+	cred    *Credentials  // nil if not checking permissions
+}
+
+// batchTouched records files read and written by a write batch. written files are also used to compute watch events
+type batchTouched struct {
+	reads  map[FileID]bool  // nil if not optimistic
+	writes map[FileID]*File // nil values for dropped files
 }
 
 type MemFSWriteBatch struct {
 	MemFSReadBatch
+	quotas     map[quotaKey]Quota
+	usage      map[quotaKey]Usage // usage of the FS when the batch started. nil if not tracked
+	usageDelta map[quotaKey]Usage // usage charged by the batch
+	unlinked   map[FileID]bool    // files losing links, to be reclaimed
+	linked     map[FileID]linkChange
 }
 
 func (m *MemFS) NewReadBatch() (
@@ -42,6 +57,8 @@ func (m *MemFS) NewReadBatch() (
 	return
 }
 
+// NewWriteBatch returns a batch holding the write lock until done is called.
+// single operations of MemFS and its handles use optimistic batches instead
 func (m *MemFS) NewWriteBatch() (
 	batch *MemFSWriteBatch,
 	done func(*error),
@@ -53,59 +70,317 @@ func (m *MemFS) NewWriteBatch() (
 			fs:    m,
 			root:  m.root,
 			files: m.files,
+			touched: &batchTouched{
+				writes: make(map[FileID]*File),
+			},
 		},
+		quotas: m.quotas,
+		usage:  m.usage,
 	}
 	batch.ctx = m.ctx
 
 	done = func(p *error) {
+		defer m.dispatchEvents()
 		defer m.Unlock()
 		if *p != nil {
 			return
 		}
+		if err := m.reclaim(batch); err != nil {
+			*p = err
+			return
+		}
 		if !batch.files.Equal(m.files) {
+			usage, err := m.applyUsage(batch)
+			if err != nil {
+				*p = err
+				return
+			}
+			if m.onCommit != nil {
+				if err := m.onCommit(batch.files); err != nil {
+					*p = err
+					return
+				}
+			}
+			m.queueEvents(m.files, batch.files, batch.touched.writes)
 			m.files = batch.files
+			m.usage = usage
 		}
 	}
 
 	return
 }
 
+// write runs fn in an optimistic write batch without holding the lock.
+// the batch is committed if files it touched are not changed by other commits since it started,
+// or fn is retried in a batch holding the lock, so that contended writers do not starve
+func (m *MemFS) write(fn func(batch *MemFSWriteBatch) error) (err error) {
+	m.RLock()
+	batch := &MemFSWriteBatch{
+		MemFSReadBatch: MemFSReadBatch{
+			fs:    m,
+			ctx:   m.ctx,
+			root:  m.root,
+			files: m.files,
+			touched: &batchTouched{
+				reads:  make(map[FileID]bool),
+				writes: make(map[FileID]*File),
+			},
+		},
+		quotas: m.quotas,
+		usage:  m.usage,
+	}
+	m.RUnlock()
+	base := batch.files
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+	if len(batch.touched.writes) == 0 {
+		return nil
+	}
+	ok, err := m.commitOptimistic(base, batch)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	// conflicted
+	lockedBatch, done := m.NewWriteBatch()
+	defer done(&err)
+	return fn(lockedBatch)
+}
+
+// commitOptimistic validates batch against commits since base and applies its writes. returns false on conflicts
+func (m *MemFS) commitOptimistic(base *FileMap, batch *MemFSWriteBatch) (bool, error) {
+	defer m.dispatchEvents()
+	m.Lock()
+	defer m.Unlock()
+
+	if batch.usage == nil && m.usage != nil {
+		// usage tracking enabled since the batch started
+		return false, nil
+	}
+
+	files := batch.files
+	if m.files.nodeID != base.nodeID {
+		// validate
+		changed := func(id FileID) (bool, error) {
+			a, err := base.getFile(m.ctx, id)
+			if err != nil {
+				return false, err
+			}
+			b, err := m.files.getFile(m.ctx, id)
+			if err != nil {
+				return false, err
+			}
+			if a == nil || b == nil {
+				return a != b, nil
+			}
+			return a.nodeID != b.nodeID, nil
+		}
+		for id := range batch.touched.reads {
+			if c, err := changed(id); err != nil {
+				return false, err
+			} else if c {
+				return false, nil
+			}
+		}
+		for id := range batch.touched.writes {
+			if c, err := changed(id); err != nil {
+				return false, err
+			} else if c {
+				return false, nil
+			}
+		}
+
+		// rebase
+		files = m.files
+		for id, file := range batch.touched.writes {
+			file := file
+			newNode, err := files.Mutate(m.ctx, files.GetPath(id), func(node Node) (Node, error) {
+				return file, nil
+			})
+			if err != nil {
+				return false, err
+			}
+			files = newNode.(*FileMap)
+		}
+	}
+
+	batch.files = files
+	if err := m.reclaim(batch); err != nil {
+		return false, err
+	}
+	files = batch.files
+	usage, err := m.applyUsage(batch)
+	if err != nil {
+		return false, err
+	}
+	if m.onCommit != nil {
+		if err := m.onCommit(files); err != nil {
+			return false, err
+		}
+	}
+	m.queueEvents(m.files, files, batch.touched.writes)
+	m.files = files
+	m.usage = usage
+	return true, nil
+}
+
 func (m *MemFSWriteBatch) OpenHandle(name string, options ...OpenOption) (handle Handle, err error) {
 	path, err := NameToPath(name)
 	if err != nil {
 		return nil, we(err)
 	}
 
-	var spec openSpec
-	for _, option := range options {
-		option(&spec)
-	}
+	spec := newOpenSpec(options)
+	flag := spec.Flag
+	access := flag & accessModes
 
-	id, err := m.GetFileIDByPath(path, true)
+	entry, err := m.GetDirEntryByPath(nil, path, flag&O_NOFOLLOW == 0)
+
+	var id FileID
 	if err != nil {
 
-		if is(err, ErrFileNotFound) && spec.Create {
+		if is(err, ErrFileNotFound) && flag&os.O_CREATE != 0 {
 			// try create
-			fileID, _, err := m.ensureFile(path, false)
+			if flag&O_NOFOLLOW == 0 {
+				// dangling symlinks are resolved to the path to create
+				path, err = m.createPath(path, flag&os.O_EXCL != 0)
+				if err != nil {
+					return nil, err
+				}
+			}
+			fileID, created, err := m.ensureFile(path, false)
 			if err != nil {
 				return nil, we(err)
 			}
+			if !created { // NOCOVER
+				return nil, we.With(
+					e4.Info("%s", name),
+				)(ErrFileExisted)
+			}
 			id = fileID
+			if err := m.changeFileByID(id, false, fileChangePerm(spec.Perm)); err != nil {
+				return nil, err
+			}
 
 		} else {
 			return nil, we(err)
 		}
+
+	} else {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, we(ErrFileExisted)
+		}
+		if entry._type&fs.ModeSymlink != 0 {
+			return nil, we.With(
+				e4.Info("symlink: %s", name),
+			)(ErrInvalidPath)
+		}
+		id = entry.id
+		file, err := m.GetFileByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if flag&O_DIRECTORY != 0 && !file.IsDir {
+			return nil, we.With(
+				e4.Info("%s", name),
+			)(ErrNotDir)
+		}
+		if file.IsDir && (access != os.O_RDONLY || flag&os.O_TRUNC != 0) {
+			return nil, we.With(
+				e4.Info("open dir for writing: %s", name),
+			)(ErrIsDir)
+		}
+		var perm fs.FileMode
+		if access != os.O_WRONLY {
+			perm |= permRead
+		}
+		if access != os.O_RDONLY {
+			perm |= permWrite
+		}
+		if err := m.checkPerm(file, perm); err != nil {
+			return nil, err
+		}
+		if flag&os.O_TRUNC != 0 && access != os.O_RDONLY {
+			if err := m.changeFileByID(id, false, fileTruncate(0, m.fs.codecOf)); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return m.NewHandle(name, id), nil
+	h := m.NewHandle(name, id)
+	h.readable = access != os.O_WRONLY
+	h.writable = access != os.O_RDONLY
+	h.append = flag&os.O_APPEND != 0
+	if spec.Buffer > 0 && h.writable {
+		h.buffer = newHandleBuffer(spec.Buffer)
+	}
+	return h, nil
 }
 
+// createPath returns the path to create a file at path, which is not found by following symlinks.
+// if path is a dangling symlink, the path of its target is returned. exclusive creating fails on symlinks
+func (m *MemFSWriteBatch) createPath(path []string, exclusive bool) ([]string, error) {
+	for depth := 0; ; depth++ {
+		entry, err := m.GetDirEntryByPath(nil, path, false)
+		if is(err, ErrFileNotFound) {
+			return path, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if entry._type&fs.ModeSymlink == 0 { // NOCOVER
+			return path, nil
+		}
+		if exclusive {
+			return nil, we.With(
+				e4.Info("symlink: %s", strings.Join(path, "/")),
+			)(ErrFileExisted)
+		}
+		if depth >= maxLinkDepth {
+			return nil, we.With(
+				e4.Info("%s", entry.name),
+			)(ErrTooManyLinks)
+		}
+		link, err := m.GetFileByID(entry.id)
+		if err != nil {
+			return nil, err
+		}
+		target, abs := linkTargetToPath(link.Symlink)
+		if len(target) == 0 || target[len(target)-1] == ".." {
+			return nil, we.With(
+				e4.Info("symlink: %s", strings.Join(path, "/")),
+			)(ErrIsDir)
+		}
+		dirs := []*DirEntry{m.root}
+		if !abs {
+			dirs, err = m.walk(dirs, path[:len(path)-1], true, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dirs, err = m.walk(dirs, target[:len(target)-1], true, 0)
+		if err != nil {
+			return nil, err
+		}
+		newPath := make([]string, 0, len(dirs))
+		for _, dir := range dirs[1:] {
+			newPath = append(newPath, dir.name)
+		}
+		path = append(newPath, target[len(target)-1])
+	}
+}
+
+// mutateDirEntry calls fn with the parent dir and the entry of path, and sets the entry to the returned node
 func (m *MemFSWriteBatch) mutateDirEntry(
 	path []string,
-	fn func(node Node) (Node, error),
+	fn func(parent *File, node Node) (Node, error),
 ) error {
 
-	parentID, err := m.GetFileIDByPath(path[:len(path)-1], false)
+	parentID, err := m.GetFileIDByPath(path[:len(path)-1], true)
 	if err != nil {
 		return we(err)
 	}
@@ -113,31 +388,87 @@ func (m *MemFSWriteBatch) mutateDirEntry(
 	if err != nil {
 		return we(err)
 	}
+	if err := m.checkPerm(parentFile, permExec); err != nil {
+		return err
+	}
 
 	name := path[len(path)-1]
 	newParentNode, err := parentFile.Mutate(m.ctx, KeyPath{name}, func(node Node) (Node, error) {
-		newNode, err := fn(node)
-		return newNode, err
+		newNode, err := fn(parentFile, node)
+		if err != nil {
+			return nil, err
+		}
+		var oldID, newID FileID
+		if node != nil {
+			oldID = asDirEntry(node).id
+		}
+		if newNode != nil {
+			newID = asDirEntry(newNode).id
+		}
+		if oldID != newID {
+			if oldID != 0 {
+				if err := m.changeLinks(oldID, -1); err != nil {
+					return nil, err
+				}
+			}
+			if newID != 0 {
+				if err := m.changeLinks(newID, 1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if m.cred != nil && (node != nil || newNode != nil) &&
+			(node == nil || newNode == nil || !node.Equal(newNode)) {
+			if err := m.checkPerm(parentFile, permWrite); err != nil {
+				return nil, err
+			}
+			if node != nil {
+				// removing or replacing
+				file, err := m.GetFileByID(asDirEntry(node).id)
+				if err != nil {
+					return nil, err
+				}
+				if err := m.checkSticky(parentFile, file); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return newNode, nil
 	})
 	if err != nil {
 		return we(err)
 	}
 
 	if !newParentNode.Equal(parentFile) {
-		newMapNode, err := m.files.Mutate(m.ctx, m.files.GetPath(parentID), func(node Node) (Node, error) {
-			return newParentNode, nil
-		})
-		if err != nil {
+		if err := m.updateFile(newParentNode.(*File)); err != nil {
 			return err
 		}
-		if !newMapNode.Equal(m.files) {
-			m.files = newMapNode.(*FileMap)
-		}
 	}
 
 	return nil
 }
 
+// setOwner sets the owner of a new file to the credentials of the batch
+func (m *MemFSReadBatch) setOwner(file *File) {
+	if m.cred == nil {
+		return
+	}
+	file.UserID = m.cred.UserID
+	file.GroupID = m.cred.GroupID
+}
+
+// snapshot returns a MemFS of the batch state
+func (m *MemFSReadBatch) snapshot() *MemFS {
+	return &MemFS{
+		ctx:          m.ctx,
+		root:         m.root,
+		files:        m.files,
+		codec:        m.fs.codec,
+		keys:         m.fs.keys,
+		encryptNames: m.fs.encryptNames,
+	}
+}
+
 func (m *MemFSReadBatch) GetFileIDByPath(path []string, followSymlink bool) (FileID, error) {
 	entry, err := m.GetDirEntryByPath(nil, path, followSymlink)
 	if err != nil {
@@ -146,41 +477,84 @@ func (m *MemFSReadBatch) GetFileIDByPath(path []string, followSymlink bool) (Fil
 	return entry.id, nil
 }
 
-func (m *MemFSReadBatch) GetDirEntryByPath(parent *DirEntry, path []string, followSymlink bool) (entry *DirEntry, err error) {
+// GetDirEntryByPath resolves path from parent, or the root if nil.
+// symlinks of intermediate parts are always followed, the last one only if followSymlink
+func (m *MemFSReadBatch) GetDirEntryByPath(parent *DirEntry, path []string, followSymlink bool) (*DirEntry, error) {
 	if parent == nil {
 		parent = m.root
 	}
-	if len(path) == 0 {
-		return parent, nil
-	}
-	file, err := m.GetFileByID(parent.id)
+	entries, err := m.walk([]*DirEntry{parent}, path, followSymlink, 0)
 	if err != nil {
-		return nil, we(err)
-	}
-	name := path[0]
-	_, err = file.Subs.Mutate(m.ctx, KeyPath{name}, func(node Node) (Node, error) {
-		if node == nil {
-			return nil, we(ErrFileNotFound)
-		}
-		e := node.(DirEntry)
-		entry = &e
-		return node, nil
-	})
-	if err != nil {
-		return nil, we(err)
+		return nil, err
 	}
-	if followSymlink && entry._type&fs.ModeSymlink > 0 {
-		file, err := m.GetFileByID(entry.id)
+	return entries[len(entries)-1], nil
+}
+
+// walk resolves path from the last of entries, which are the dirs from the root to the current one.
+// returned are the entries from the root to the resolved one
+func (m *MemFSReadBatch) walk(entries []*DirEntry, path []string, followSymlink bool, depth int) ([]*DirEntry, error) {
+	for i, name := range path {
+		dir := entries[len(entries)-1]
+		file, err := m.GetFileByID(dir.id)
 		if err != nil {
+			return nil, we(err)
+		}
+		if err := m.checkPerm(file, permExec); err != nil {
 			return nil, err
 		}
-		path, err := NameToPath(file.Symlink)
+
+		if name == ".." {
+			// from symlink targets
+			if !file.IsDir {
+				return nil, we.With(
+					e4.Info("%s", dir.name),
+				)(ErrNotDir)
+			}
+			if len(entries) > 1 {
+				entries = entries[:len(entries)-1]
+			}
+			continue
+		}
+
+		var entry *DirEntry
+		_, err = file.Subs.Mutate(m.ctx, KeyPath{name}, func(node Node) (Node, error) {
+			if node == nil {
+				return nil, we(ErrFileNotFound)
+			}
+			e := node.(DirEntry)
+			entry = &e
+			return node, nil
+		})
 		if err != nil {
-			return nil, err
+			return nil, we(err)
 		}
-		return m.GetDirEntryByPath(nil, path, followSymlink)
+
+		last := i == len(path)-1
+		if entry._type&fs.ModeSymlink > 0 && (!last || followSymlink) {
+			if depth >= maxLinkDepth {
+				return nil, we.With(
+					e4.Info("%s", entry.name),
+				)(ErrTooManyLinks)
+			}
+			link, err := m.GetFileByID(entry.id)
+			if err != nil {
+				return nil, err
+			}
+			target, abs := linkTargetToPath(link.Symlink)
+			if abs {
+				entries = []*DirEntry{m.root}
+			}
+			return m.walk(
+				entries,
+				append(target, path[i+1:]...),
+				followSymlink,
+				depth+1,
+			)
+		}
+
+		entries = append(entries, entry)
 	}
-	return m.GetDirEntryByPath(entry, path[1:], followSymlink)
+	return entries, nil
 }
 
 func (m *MemFSReadBatch) GetFileByID(id FileID) (*File, error) {
@@ -199,7 +573,9 @@ func (m *MemFSReadBatch) GetFileByID(id FileID) (*File, error) {
 	if err != nil {
 		return nil, we(err)
 	}
-	//TODO check permission
+	if m.touched != nil && m.touched.reads != nil {
+		m.touched.reads[id] = true
+	}
 	return file, nil
 }
 
@@ -238,13 +614,16 @@ func (m *MemFSWriteBatch) Link(oldname, newname string) error {
 	}
 
 	if err := m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
+		func(parent *File, node Node) (Node, error) {
 			if node != nil {
 				// existed
 				return node, ErrFileExisted
 			}
+			if err := m.checkProject(parent, entry.id); err != nil {
+				return nil, err
+			}
 			return DirEntry{
-				nodeID: it.NewNodeID(),
+				nodeID: newNodeID(),
 				id:     entry.id,
 				name:   path[len(path)-1],
 				isDir:  entry.isDir,
@@ -304,7 +683,7 @@ func (m *MemFSWriteBatch) ensureFile(
 ) {
 
 	if err = m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
+		func(parent *File, node Node) (Node, error) {
 			if node != nil {
 				// existed
 				fileID = node.(DirEntry).id
@@ -313,24 +692,17 @@ func (m *MemFSWriteBatch) ensureFile(
 
 			// add new file
 			file := NewFile(isDir)
+			m.setOwner(file)
+			file.Project = parent.Project
 			fileID = file.ID
 			created = true
-			newNode, err := m.files.Mutate(m.ctx, m.files.GetPath(file.ID), func(node Node) (Node, error) {
-				if node != nil { // NOCOVER
-					panic("impossible")
-				}
-				return file, nil
-			})
-			if err != nil {
+			if err := m.updateFile(file); err != nil {
 				return nil, we(err)
 			}
-			if !newNode.Equal(m.files) {
-				m.files = newNode.(*FileMap)
-			}
 
 			name := path[len(path)-1]
 			return DirEntry{
-				nodeID: it.NewNodeID(),
+				nodeID: newNodeID(),
 				id:     file.ID,
 				name:   name,
 				isDir:  file.IsDir,
@@ -397,7 +769,7 @@ func (m *MemFSWriteBatch) Remove(name string, options ...RemoveOption) error {
 	}
 
 	if err := m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
+		func(_ *File, node Node) (Node, error) {
 			if node == nil {
 				return nil, we(ErrFileNotFound)
 			}
@@ -410,13 +782,11 @@ func (m *MemFSWriteBatch) Remove(name string, options ...RemoveOption) error {
 					if err != nil {
 						return nil, err
 					}
-					iter := file.Subs.Range(nil)
-					v, err := iter.Next()
+					empty, err := dirEmpty(file)
 					if err != nil {
 						return nil, err
 					}
-					if v != nil {
-						// not empty
+					if !empty {
 						return nil, ErrDirNotEmpty
 					}
 				}
@@ -460,11 +830,18 @@ func (m *MemFSWriteBatch) ChangeMode(name string, mode fs.FileMode, options ...C
 	for _, fn := range options {
 		fn(&spec)
 	}
-	return m.changeFile(name, !spec.NoFollow, fileChangeMode(mode))
+	return m.changeFile(name, !spec.NoFollow, m.ownerOnly(fileChangeMode(mode)))
 }
 
 func (m *MemFSWriteBatch) updateFile(file *File) error {
 	newMapNode, err := m.files.Mutate(m.ctx, m.files.GetPath(file.ID), func(node Node) (Node, error) {
+		var old *File
+		if node != nil {
+			old = node.(*File)
+		}
+		if err := m.chargeUsage(old, file); err != nil {
+			return nil, err
+		}
 		return file, nil
 	})
 	if err != nil {
@@ -473,6 +850,9 @@ func (m *MemFSWriteBatch) updateFile(file *File) error {
 	if !newMapNode.Equal(m.files) {
 		m.files = newMapNode.(*FileMap)
 	}
+	if m.touched != nil {
+		m.touched.writes[file.ID] = file
+	}
 	return nil
 }
 
@@ -481,11 +861,22 @@ func (m *MemFSWriteBatch) ChangeOwner(name string, uid, gid int, options ...Chan
 	for _, fn := range options {
 		fn(&spec)
 	}
-	return m.changeFile(name, !spec.NoFollow, fileChagneOwner(uid, gid))
+	return m.changeFile(name, !spec.NoFollow, m.chownAllowed(uid, gid, fileChagneOwner(uid, gid)))
+}
+
+func (m *MemFSWriteBatch) ChangeCodec(name string, codec string, options ...ChangeOption) error {
+	if _, err := GetCodec(codec); err != nil {
+		return err
+	}
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	return m.changeFile(name, !spec.NoFollow, m.writableOnly(fileChangeCodec(codec, m.fs.codecOf)))
 }
 
 func (m *MemFSWriteBatch) Truncate(name string, size int64) error {
-	return m.changeFile(name, true, fileTruncate(size))
+	return m.changeFile(name, true, m.writableOnly(fileTruncate(size, m.fs.codecOf)))
 }
 
 func (m *MemFSWriteBatch) ChangeTimes(name string, atime, mtime time.Time, options ...ChangeOption) error {
@@ -493,7 +884,7 @@ func (m *MemFSWriteBatch) ChangeTimes(name string, atime, mtime time.Time, optio
 	for _, fn := range options {
 		fn(&spec)
 	}
-	return m.changeFile(name, !spec.NoFollow, fileChangeTimes(atime, mtime))
+	return m.changeFile(name, !spec.NoFollow, m.ownerOnly(fileChangeTimes(atime, mtime)))
 }
 
 func (m *MemFSWriteBatch) Create(name string) (Handle, error) {
@@ -519,9 +910,12 @@ func (m *MemFSWriteBatch) Create(name string) (Handle, error) {
 
 func (m *MemFSReadBatch) NewHandle(name string, id FileID) *MemHandle {
 	return &MemHandle{
-		name: name,
-		fs:   m.fs,
-		id:   id,
+		name:     name,
+		fs:       m.fs,
+		id:       id,
+		cred:     m.cred,
+		readable: true,
+		writable: true,
 	}
 }
 
@@ -531,31 +925,24 @@ func (m *MemFSWriteBatch) SymLink(oldname, newname string) error {
 		return err
 	}
 	if err := m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
+		func(parent *File, node Node) (Node, error) {
 			if node != nil {
 				// existed
 				return node, ErrFileExisted
 			}
 
 			file := NewFile(false)
+			m.setOwner(file)
+			file.Project = parent.Project
 			file.Mode = file.Mode | fs.ModeSymlink
 			file.Symlink = oldname
-			newNode, err := m.files.Mutate(m.ctx, m.files.GetPath(file.ID), func(node Node) (Node, error) {
-				if node != nil { // NOCOVER
-					panic("impossible")
-				}
-				return file, nil
-			})
-			if err != nil {
+			if err := m.updateFile(file); err != nil {
 				return nil, err
 			}
-			if !newNode.Equal(m.files) {
-				m.files = newNode.(*FileMap)
-			}
 
 			name := path[len(path)-1]
 			return DirEntry{
-				nodeID: it.NewNodeID(),
+				nodeID: newNodeID(),
 				id:     file.ID,
 				name:   name,
 				isDir:  file.IsDir,
@@ -577,43 +964,99 @@ func (m *MemFSReadBatch) ReadLink(name string) (link string, err error) {
 	return file.Symlink, nil
 }
 
-func (m *MemFSWriteBatch) Rename(oldname string, newname string) error {
+func (m *MemFSWriteBatch) Rename(oldname string, newname string, options ...RenameOption) error {
+	var spec renameSpec
+	for _, option := range options {
+		option(&spec)
+	}
+	if err := spec.check(); err != nil {
+		return err
+	}
+
 	oldpath, err := NameToPath(oldname)
 	if err != nil {
 		return err
 	}
-
-	entry, err := m.GetDirEntryByPath(nil, oldpath, true)
+	newpath, err := NameToPath(newname)
 	if err != nil {
 		return err
 	}
+	if len(oldpath) == 0 || len(newpath) == 0 {
+		return we.With(
+			e4.Info("cannot rename root"),
+		)(ErrInvalidPath)
+	}
 
-	path, err := NameToPath(oldname)
+	// symlinks are renamed, not the targets
+	entry, err := m.GetDirEntryByPath(nil, oldpath, false)
 	if err != nil {
 		return err
 	}
-	if err := m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
+	target, err := m.GetDirEntryByPath(nil, newpath, false)
+	if is(err, ErrFileNotFound) {
+		target = nil
+	} else if err != nil {
+		return err
+	}
+
+	if target != nil && spec.NoReplace {
+		return we.With(
+			e4.Info("path %s", newname),
+		)(ErrFileExisted)
+	}
+	if target == nil && spec.Exchange {
+		return we.With(
+			e4.Info("path %s", newname),
+		)(ErrFileNotFound)
+	}
+	if target != nil && target.id == entry.id {
+		// links of the same file
+		return nil
+	}
+	if target != nil && !spec.Exchange {
+		if err := m.checkReplace(entry, target); err != nil {
+			return err
+		}
+	}
+	if entry.IsDir() {
+		if err := m.checkNotUnder(newpath, entry.id); err != nil {
+			return err
+		}
+	}
+	if spec.Exchange && target.IsDir() {
+		if err := m.checkNotUnder(oldpath, target.id); err != nil {
+			return err
+		}
+	}
+
+	if err := m.mutateDirEntry(oldpath,
+		func(parent *File, node Node) (Node, error) {
 			if node == nil { // NOCOVER
 				panic("impossible")
 			}
-			return nil, nil
+			if !spec.Exchange {
+				return nil, nil
+			}
+			if err := m.checkProject(parent, target.id); err != nil {
+				return nil, err
+			}
+			e := *target
+			e.name = oldpath[len(oldpath)-1]
+			return e, nil
 		},
 	); err != nil {
 		return err
 	}
 
-	path, err = NameToPath(newname)
-	if err != nil {
-		return err
-	}
-	if err := m.mutateDirEntry(path,
-		func(node Node) (Node, error) {
-			if node != nil {
-				return node, ErrFileExisted
+	if err := m.mutateDirEntry(newpath,
+		func(parent *File, node Node) (Node, error) {
+			if err := m.checkProject(parent, entry.id); err != nil {
+				return nil, err
 			}
-			entry.name = path[len(path)-1]
-			return entry, nil
+			// existing entry is replaced
+			e := *entry
+			e.name = newpath[len(newpath)-1]
+			return e, nil
 		},
 	); err != nil {
 		return err
@@ -621,3 +1064,59 @@ func (m *MemFSWriteBatch) Rename(oldname string, newname string) error {
 
 	return nil
 }
+
+// checkReplace checks that target can be replaced by entry
+func (m *MemFSWriteBatch) checkReplace(entry *DirEntry, target *DirEntry) error {
+	if !target.IsDir() {
+		if entry.IsDir() {
+			return we.With(
+				e4.Info("%s", target.name),
+			)(ErrNotDir)
+		}
+		return nil
+	}
+	if !entry.IsDir() {
+		return we.With(
+			e4.Info("%s", target.name),
+		)(ErrIsDir)
+	}
+	file, err := m.GetFileByID(target.id)
+	if err != nil {
+		return err
+	}
+	empty, err := dirEmpty(file)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return we.With(
+			e4.Info("%s", target.name),
+		)(ErrDirNotEmpty)
+	}
+	return nil
+}
+
+// checkNotUnder checks that dir id is not a parent of path
+func (m *MemFSWriteBatch) checkNotUnder(path []string, id FileID) error {
+	dirs, err := m.walk([]*DirEntry{m.root}, path[:len(path)-1], true, 0)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if dir.id == id {
+			return we.With(
+				e4.Info("cannot move dir into itself"),
+			)(ErrInvalidPath)
+		}
+	}
+	return nil
+}
+
+func dirEmpty(file *File) (bool, error) {
+	iter := file.Subs.Range(nil)
+	v, err := iter.Next()
+	if err != nil {
+		return false, err
+	}
+	return v == nil, nil
+}
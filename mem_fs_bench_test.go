@@ -2,6 +2,8 @@ package fs9
 
 import (
 	"bytes"
+	"fmt"
+	"sync/atomic"
 	"testing"
 )
 
@@ -38,3 +40,70 @@ func BenchmarkMemFSParallelWrite(b *testing.B) {
 		}
 	})
 }
+
+// writes to separate files
+func BenchmarkMemFSParallelWriteFiles(b *testing.B) {
+	fs := NewMemFS()
+	bs := bytes.Repeat([]byte("a"), 4096)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		f, err := fs.OpenHandle(fmt.Sprintf("%d", atomic.AddInt64(&n, 1)), OptCreate(true))
+		ce(err)
+		defer f.Close()
+		for pb.Next() {
+			_, err := f.Seek(0, 0)
+			ce(err)
+			_, err = f.Write(bs)
+			ce(err)
+			b.SetBytes(int64(len(bs)))
+		}
+	})
+}
+
+func BenchmarkMemFSAppend(b *testing.B) {
+	fs := NewMemFS()
+	f, err := fs.OpenHandle("foo", OptCreate(true))
+	ce(err)
+	defer f.Close()
+	bs := bytes.Repeat([]byte("a"), 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = f.Write(bs)
+		ce(err)
+		b.SetBytes(int64(len(bs)))
+	}
+}
+
+// writes with a watcher in a large tree
+func BenchmarkMemFSWatchWrite(b *testing.B) {
+	fs := NewMemFS()
+	for i := 0; i < 100; i++ {
+		dir := fmt.Sprintf("%d", i)
+		ce(fs.MakeDir(dir))
+		for j := 0; j < 100; j++ {
+			f, err := fs.Create(fmt.Sprintf("%s/%d", dir, j))
+			ce(err)
+			ce(f.Close())
+		}
+	}
+	w, err := fs.Watch(".", true)
+	ce(err)
+	defer w.Close()
+	go func() {
+		for range w.Events() {
+		}
+	}()
+	f, err := fs.OpenHandle("foo", OptCreate(true))
+	ce(err)
+	defer f.Close()
+	bs := bytes.Repeat([]byte("a"), 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.Seek(0, 0)
+		ce(err)
+		_, err = f.Write(bs)
+		ce(err)
+		b.SetBytes(int64(len(bs)))
+	}
+}
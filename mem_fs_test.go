@@ -1,7 +1,10 @@
 package fs9
 
 import (
+	"fmt"
 	"io/fs"
+	"os"
+	"sync"
 	"testing"
 
 	"github.com/reusee/e4"
@@ -113,3 +116,311 @@ func TestMemFS2(t *testing.T) {
 	)
 
 }
+
+func TestMemFSConcurrentWrites(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	ce(m.MakeDir("d"))
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := m.Create(fmt.Sprintf("%d", i))
+			ce(err)
+			for j := 0; j < 50; j++ {
+				_, err := h.Write([]byte{byte(j)})
+				ce(err)
+				// same dir
+				ce(m.MakeDir(fmt.Sprintf("d/%d-%d", i, j)))
+			}
+			ce(h.Close())
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		stat, err := m.Stat(fmt.Sprintf("%d", i))
+		ce(err)
+		eq(stat.Size(), int64(50))
+	}
+	entries, err := fs.ReadDir(m, "d")
+	ce(err)
+	eq(len(entries), 8*50)
+
+	// conflicting batches are retried
+	runs := 0
+	err = m.write(func(batch *MemFSWriteBatch) error {
+		runs++
+		if runs == 1 {
+			ce(m.MakeDir("foo"))
+		}
+		return batch.MakeDir("foo")
+	})
+	eq(
+		is(err, ErrFileExisted), true,
+		runs, 2,
+	)
+	// unrelated batches are not
+	runs = 0
+	ce(m.write(func(batch *MemFSWriteBatch) error {
+		runs++
+		if runs == 1 {
+			ce(m.MakeDir("d/bar"))
+		}
+		return batch.Truncate("0", 0)
+	}))
+	eq(runs, 1)
+}
+
+func TestMemFSBufferedHandle(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	h, err := m.OpenHandle("foo", OptCreate(true), OptBuffer(dirtyPageSize*2))
+	ce(err)
+	size := func() int64 {
+		stat, err := m.Stat("foo")
+		ce(err)
+		return stat.Size()
+	}
+
+	// committed on Sync
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	eq(size(), int64(0))
+	ce(h.Sync())
+	eq(size(), int64(3))
+
+	// committed when the threshold is reached
+	_, err = h.Write(make([]byte, dirtyPageSize*2-3))
+	ce(err)
+	eq(size(), int64(3))
+	_, err = h.Write([]byte("bar"))
+	ce(err)
+	eq(size(), int64(dirtyPageSize*2+3))
+
+	// committed on Close
+	_, err = h.Seek(0, 0)
+	ce(err)
+	_, err = h.Write([]byte("baz"))
+	ce(err)
+	content, err := fs.ReadFile(m, "foo")
+	ce(err)
+	eq(string(content[:3]), "foo")
+	ce(h.Close())
+	content, err = fs.ReadFile(m, "foo")
+	ce(err)
+	eq(string(content[:3]), "baz")
+
+	// gaps between buffered writes are not written
+	h, err = m.OpenHandle("foo", OptBuffer(dirtyPageSize*2))
+	ce(err)
+	_, err = h.Write([]byte("a"))
+	ce(err)
+	_, err = h.Seek(100, 0)
+	ce(err)
+	_, err = h.Write([]byte("b"))
+	ce(err)
+	h2, err := m.OpenHandle("foo")
+	ce(err)
+	_, err = h2.Seek(50, 0)
+	ce(err)
+	_, err = h2.Write([]byte("X"))
+	ce(err)
+	ce(h2.Close())
+	ce(h.Close())
+	content, err = fs.ReadFile(m, "foo")
+	ce(err)
+	eq(
+		string(content[:3]), "aaz",
+		content[50], byte('X'),
+		content[100], byte('b'),
+	)
+
+	// appends are written at the end of file when committed
+	ce(m.Truncate("foo", 0))
+	h, err = m.OpenHandle("foo", OptFlag(os.O_WRONLY|os.O_APPEND, 0), OptBuffer(dirtyPageSize))
+	ce(err)
+	h2, err = m.OpenHandle("foo", OptFlag(os.O_RDWR|os.O_APPEND, 0), OptBuffer(dirtyPageSize))
+	ce(err)
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	_, err = h2.Write([]byte("bar"))
+	ce(err)
+	buf := make([]byte, 3)
+	_, err = h2.ReadAt(buf, 0)
+	ce(err)
+	eq(string(buf), "bar")
+	ce(h.Sync())
+	_, err = h2.ReadAt(buf, 3)
+	ce(err)
+	eq(string(buf), "bar")
+	ce(h2.Close())
+	ce(h.Close())
+	content, err = fs.ReadFile(m, "foo")
+	ce(err)
+	eq(string(content), "foobar")
+}
+
+func TestMemFSReclaim(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	numFiles := func() (n int) {
+		ce(walkNodes(m.files, func(node Node) error {
+			if _, ok := node.(*File); ok {
+				n++
+			}
+			return nil
+		}))
+		return
+	}
+	nlink := func(name string) int {
+		stat, err := m.LinkStat(name)
+		ce(err)
+		return stat.Sys().(ExtFileInfo).Nlink
+	}
+	write := func(name string, content string) {
+		h, err := m.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+
+	// links
+	write("foo", "foo")
+	ce(m.Link("foo", "bar"))
+	ce(m.SymLink("foo", "baz"))
+	eq(
+		nlink("."), 2,
+		nlink("foo"), 2,
+		nlink("baz"), 1,
+		numFiles(), 3,
+	)
+	ce(m.Rename("bar", "qux"))
+	ce(m.Remove("foo"))
+	eq(
+		nlink("qux"), 1,
+		numFiles(), 3,
+	)
+	ce(m.Remove("qux"))
+	ce(m.Remove("baz"))
+	eq(numFiles(), 1)
+
+	// trees
+	ce(m.MakeDirAll("a/b/c"))
+	write("a/b/c/foo", "foo")
+	write("a/bar", "bar")
+	eq(
+		nlink("."), 3,
+		nlink("a"), 3,
+		nlink("a/b"), 3,
+		nlink("a/b/c"), 2,
+	)
+	ce(m.Link("a/bar", "bar"))
+	ce(m.Remove("a", OptAll(true)))
+	eq(
+		nlink("bar"), 1,
+		numFiles(), 2,
+	)
+
+	// open but unlinked
+	h, err := m.OpenHandle("bar", OptFlag(os.O_RDWR, 0))
+	ce(err)
+	ce(m.Remove("bar"))
+	eq(numFiles(), 2)
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	buf := make([]byte, 3)
+	_, err = h.ReadAt(buf, 0)
+	ce(err)
+	eq(string(buf), "foo")
+	ce(h.Close())
+	eq(numFiles(), 1)
+
+	// quota usage is released
+	ce(m.SetQuota(Quota{Files: 2}))
+	write("foo", "foo")
+	ce(m.Remove("foo"))
+	write("bar", "bar")
+	usage, err := m.Usage()
+	ce(err)
+	eq(usage, Usage{Bytes: 3, Files: 2})
+}
+
+func TestMemFSRename(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	numFiles := func() (n int) {
+		ce(walkNodes(m.files, func(node Node) error {
+			if _, ok := node.(*File); ok {
+				n++
+			}
+			return nil
+		}))
+		return
+	}
+	read := func(name string) string {
+		content, err := fs.ReadFile(m, name)
+		ce(err)
+		return string(content)
+	}
+	write := func(name string, content string) {
+		h, err := m.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+
+	// replaced file is reclaimed
+	write("foo", "foo")
+	write("bar", "bar")
+	eq(numFiles(), 3)
+	ce(m.Rename("foo", "bar"))
+	eq(
+		read("bar"), "foo",
+		numFiles(), 2,
+	)
+
+	// links of the same file
+	ce(m.Link("bar", "baz"))
+	ce(m.Rename("bar", "baz"))
+	eq(
+		read("bar"), "foo",
+		read("baz"), "foo",
+	)
+
+	// exchange
+	ce(m.Remove("baz"))
+	ce(m.MakeDirAll("d/e"))
+	write("d/foo", "d/foo")
+	eq(is(m.Rename("bar", "qux", OptExchange(true)), ErrFileNotFound), true)
+	ce(m.Rename("bar", "d", OptExchange(true)))
+	eq(
+		read("d"), "foo",
+		read("bar/foo"), "d/foo",
+	)
+	ce(m.Rename("d", "bar/foo", OptExchange(true)))
+	eq(
+		read("d"), "d/foo",
+		read("bar/foo"), "foo",
+		numFiles(), 5,
+		is(m.Rename("bar", "bar/e", OptExchange(true)), ErrInvalidPath), true,
+		is(m.Rename("bar/e", "bar", OptExchange(true)), ErrInvalidPath), true,
+	)
+
+	// in transaction
+	ce(m.Update(func(tx *Tx) error {
+		ce(tx.Rename("d", "bar/foo", OptExchange(true)))
+		return tx.Rename("bar/foo", "d")
+	}))
+	eq(
+		read("d"), "d/foo",
+		numFiles(), 4,
+	)
+}
@@ -19,22 +19,119 @@ type MemHandle struct {
 	closed      bool
 	iter        Src
 	iterStarted bool
-	//TODO read/write permission
+	dirFS       *MemFS  // for infos of dir entries
+	tx          *Tx     // handles opened in Update operate in the transaction
+	readTx      *ReadTx // handles opened in View are read-only
+	cred        *Credentials
+	readable    bool
+	writable    bool
+	append      bool          // writes go to the end of file
+	buffer      *handleBuffer // not nil if writes are buffered
+	retained    bool          // counted as an open handle of the file
 }
 
 var _ Handle = new(MemHandle)
 
+func noDone(*error) {}
+
+// readBatch returns the batch to read from, the transaction one or a new one
+func (m *MemHandle) readBatch() (*MemFSReadBatch, func(*error), error) {
+	switch {
+	case m.tx != nil:
+		if m.tx.done {
+			return nil, nil, we(ErrTxDone)
+		}
+		return &m.tx.MemFSReadBatch, noDone, nil
+	case m.readTx != nil:
+		if m.readTx.done {
+			return nil, nil, we(ErrTxDone)
+		}
+		return m.readTx.MemFSReadBatch, noDone, nil
+	}
+	batch, done := m.fs.NewReadBatch()
+	batch.cred = m.cred
+	return batch, done, nil
+}
+
+// update runs fn in the transaction of the handle, or in an optimistic write batch
+func (m *MemHandle) update(fn func(batch *MemFSWriteBatch) error) error {
+	switch {
+	case m.tx != nil:
+		if m.tx.done {
+			return we(ErrTxDone)
+		}
+		return fn(m.tx.MemFSWriteBatch)
+	case m.readTx != nil:
+		return we(ErrImmutable)
+	}
+	return m.fs.write(func(batch *MemFSWriteBatch) error {
+		batch.cred = m.cred
+		return fn(batch)
+	})
+}
+
+// flush commits buffered writes in one batch
+func (m *MemHandle) flush() error {
+	if m.buffer == nil || m.buffer.empty() {
+		return nil
+	}
+	if err := m.update(func(batch *MemFSWriteBatch) error {
+		file, err := batch.GetFileByID(m.id)
+		if err != nil {
+			return err
+		}
+		codec, err := m.fs.codecOf(file)
+		if err != nil {
+			return err
+		}
+		newFile, err := m.buffer.flush(file, codec)
+		if err != nil {
+			return err
+		}
+		return batch.updateFile(newFile)
+	}); err != nil {
+		return err
+	}
+	m.buffer.reset()
+	return nil
+}
+
+var (
+	errNotReadable = we.With(
+		e4.Info("handle not opened for reading"),
+	)(ErrNoPermission)
+	errNotWritable = we.With(
+		e4.Info("handle not opened for writing"),
+	)(ErrNoPermission)
+)
+
 func (m *MemHandle) Name() string {
 	return m.name
 }
 
-func (m *MemHandle) Stat() (fs.FileInfo, error) {
+func (m *MemHandle) Stat() (_ fs.FileInfo, err error) {
 	m.Lock()
 	defer m.Unlock()
 	if m.closed {
 		return nil, ErrClosed
 	}
-	return m.fs.stat(path.Base(m.name), m.id)
+	batch, done, err := m.readBatch()
+	if err != nil {
+		return nil, err
+	}
+	defer done(&err)
+	info, err := batch.stat(path.Base(m.name), m.id)
+	if err != nil {
+		return nil, err
+	}
+	if m.buffer != nil {
+		file, err := batch.GetFileByID(m.id)
+		if err != nil {
+			return nil, err
+		}
+		info.size = m.buffer.size(file)
+	}
+	return info, nil
 }
 
 func (m *MemHandle) Read(buf []byte) (n int, err error) {
@@ -43,13 +140,19 @@ func (m *MemHandle) Read(buf []byte) (n int, err error) {
 	if m.closed {
 		return 0, ErrClosed
 	}
-	batch, done := m.fs.NewReadBatch()
+	if !m.readable {
+		return 0, errNotReadable
+	}
+	batch, done, err := m.readBatch()
+	if err != nil {
+		return 0, err
+	}
 	defer done(&err)
 	file, err := batch.GetFileByID(m.id)
 	if err != nil {
 		return 0, err
 	}
-	n, err = file.ReadAt(buf, m.offset)
+	n, err = m.readAt(file, buf, m.offset)
 	m.offset += int64(n)
 	return n, err
 }
@@ -60,20 +163,42 @@ func (m *MemHandle) ReadAt(buf []byte, offset int64) (n int, err error) {
 	if m.closed {
 		return 0, ErrClosed
 	}
-	batch, done := m.fs.NewReadBatch()
+	if !m.readable {
+		return 0, errNotReadable
+	}
+	batch, done, err := m.readBatch()
+	if err != nil {
+		return 0, err
+	}
 	defer done(&err)
 	file, err := batch.GetFileByID(m.id)
 	if err != nil {
 		return 0, err
 	}
+	return m.readAt(file, buf, offset)
+}
+
+func (m *MemHandle) readAt(file *File, buf []byte, offset int64) (int, error) {
+	if m.buffer != nil && !m.buffer.empty() {
+		return m.buffer.readAt(file, buf, offset)
+	}
 	return file.ReadAt(buf, offset)
 }
 
 func (m *MemHandle) Close() error {
 	m.Lock()
 	defer m.Unlock()
+	if m.closed {
+		return nil
+	}
+	err := m.flush()
 	m.closed = true
-	return nil
+	if m.retained {
+		if e := m.fs.release(m.id); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (m *MemHandle) Seek(offset int64, whence int) (n int64, err error) {
@@ -82,24 +207,72 @@ func (m *MemHandle) Seek(offset int64, whence int) (n int64, err error) {
 	if m.closed {
 		return 0, ErrClosed
 	}
+	var pos int64
 	switch whence {
 	case 0:
-		m.offset = offset
+		pos = offset
 	case 1:
-		m.offset += offset
+		pos = m.offset + offset
 	case 2:
-		batch, done := m.fs.NewReadBatch()
+		batch, done, err := m.readBatch()
+		if err != nil {
+			return 0, err
+		}
 		defer done(&err)
 		file, err := batch.GetFileByID(m.id)
 		if err != nil {
 			return 0, err
 		}
-		m.offset = file.Size + offset
+		size := file.Size
+		if m.buffer != nil {
+			size = m.buffer.size(file)
+		}
+		pos = size + offset
+	case SeekData, SeekHole:
+		if offset < 0 {
+			return m.offset, we.With(
+				e4.Info("negative offset %d", offset),
+			)(ErrBadArgument)
+		}
+		if err := m.flush(); err != nil {
+			return 0, err
+		}
+		batch, done, err := m.readBatch()
+		if err != nil {
+			return 0, err
+		}
+		defer done(&err)
+		file, err := batch.GetFileByID(m.id)
+		if err != nil {
+			return 0, err
+		}
+		if offset >= file.Size {
+			return m.offset, we.With(
+				e4.Info("offset %d, size %d", offset, file.Size),
+			)(ErrOutOfBounds)
+		}
+		if whence == SeekHole {
+			pos = file.Content.SeekHole(offset)
+			break
+		}
+		data, ok := file.Content.SeekData(offset)
+		if !ok {
+			return m.offset, we.With(
+				e4.Info("no data after %d", offset),
+			)(ErrOutOfBounds)
+		}
+		pos = data
 	default:
 		return m.offset, we.With(
 			e4.Info("bad whence"),
 		)(ErrBadArgument)
 	}
+	if pos < 0 {
+		return m.offset, we.With(
+			e4.Info("negative offset %d", pos),
+		)(ErrBadArgument)
+	}
+	m.offset = pos
 	return m.offset, nil
 }
 
@@ -109,24 +282,68 @@ func (m *MemHandle) Write(data []byte) (n int, err error) {
 	if m.closed {
 		return 0, ErrClosed
 	}
-	batch, done := m.fs.NewWriteBatch()
-	defer done(&err)
-	file, err := batch.GetFileByID(m.id)
-	if err != nil {
-		return 0, err
+	if !m.writable {
+		return 0, errNotWritable
 	}
-	var newFile *File
-	newFile, n, err = file.WriteAt(data, m.offset)
-	if err != nil {
-		return 0, err
+	if m.buffer != nil {
+		return m.bufferedWrite(data)
 	}
-	m.offset += int64(n)
-	if err := batch.updateFile(newFile); err != nil {
+	var offset int64
+	if err := m.update(func(batch *MemFSWriteBatch) error {
+		file, err := batch.GetFileByID(m.id)
+		if err != nil {
+			return err
+		}
+		offset = m.offset
+		if m.append {
+			// in the same batch, so appends do not interleave
+			offset = file.Size
+		}
+		codec, err := m.fs.codecOf(file)
+		if err != nil {
+			return err
+		}
+		var newFile *File
+		newFile, n, err = file.writeAt(data, offset, codec)
+		if err != nil {
+			return err
+		}
+		return batch.updateFile(newFile)
+	}); err != nil {
 		return 0, err
 	}
+	m.offset = offset + int64(n)
 	return
 }
 
+func (m *MemHandle) bufferedWrite(data []byte) (n int, err error) {
+	b := m.buffer
+	if m.append {
+		// the end of file is resolved when flushed
+		b.append(data)
+		batch, done, err := m.readBatch()
+		if err != nil {
+			return 0, err
+		}
+		file, err := batch.GetFileByID(m.id)
+		done(&err)
+		if err != nil {
+			return 0, err
+		}
+		m.offset = b.size(file)
+	} else {
+		b.writeAt(data, m.offset)
+		m.offset += int64(len(data))
+	}
+	if b.full() {
+		// data is kept in the buffer if failed
+		if err := m.flush(); err != nil {
+			return len(data), err
+		}
+	}
+	return len(data), nil
+}
+
 func (m *MemHandle) ReadDir(n int) (ret []fs.DirEntry, err error) {
 	m.Lock()
 	defer m.Unlock()
@@ -134,7 +351,10 @@ func (m *MemHandle) ReadDir(n int) (ret []fs.DirEntry, err error) {
 		return nil, ErrClosed
 	}
 	if !m.iterStarted {
-		batch, done := m.fs.NewReadBatch()
+		batch, done, err := m.readBatch()
+		if err != nil {
+			return nil, err
+		}
 		defer done(&err)
 		file, err := batch.GetFileByID(m.id)
 		if err != nil {
@@ -142,6 +362,11 @@ func (m *MemHandle) ReadDir(n int) (ret []fs.DirEntry, err error) {
 		}
 		m.iter = file.Subs.Range(nil)
 		m.iterStarted = true
+		m.dirFS = m.fs
+		if m.tx != nil || m.readTx != nil {
+			// the transaction holds the lock of fs
+			m.dirFS = batch.snapshot()
+		}
 	}
 	for {
 		if n > 0 && len(ret) == n {
@@ -159,7 +384,7 @@ func (m *MemHandle) ReadDir(n int) (ret []fs.DirEntry, err error) {
 			return
 		}
 		entry := v.(DirEntry)
-		entry.fs = m.fs
+		entry.fs = m.dirFS
 		ret = append(ret, entry)
 	}
 }
@@ -170,9 +395,9 @@ func (h *MemHandle) ChangeMode(mode fs.FileMode) (err error) {
 	if h.closed {
 		return ErrClosed
 	}
-	batch, done := h.fs.NewWriteBatch()
-	defer done(&err)
-	return batch.changeFileByID(h.id, true, fileChangeMode(mode))
+	return h.update(func(batch *MemFSWriteBatch) error {
+		return batch.changeFileByID(h.id, true, batch.ownerOnly(fileChangeMode(mode)))
+	})
 }
 
 func (h *MemHandle) ChangeOwner(uid, gid int) (err error) {
@@ -181,9 +406,9 @@ func (h *MemHandle) ChangeOwner(uid, gid int) (err error) {
 	if h.closed {
 		return ErrClosed
 	}
-	batch, done := h.fs.NewWriteBatch()
-	defer done(&err)
-	return batch.changeFileByID(h.id, true, fileChagneOwner(uid, gid))
+	return h.update(func(batch *MemFSWriteBatch) error {
+		return batch.changeFileByID(h.id, true, batch.chownAllowed(uid, gid, fileChagneOwner(uid, gid)))
+	})
 }
 
 func (h *MemHandle) Sync() error {
@@ -192,8 +417,7 @@ func (h *MemHandle) Sync() error {
 	if h.closed {
 		return ErrClosed
 	}
-	//TODO materialize
-	return nil
+	return h.flush()
 }
 
 func (h *MemHandle) Truncate(size int64) (err error) {
@@ -202,9 +426,46 @@ func (h *MemHandle) Truncate(size int64) (err error) {
 	if h.closed {
 		return ErrClosed
 	}
-	batch, done := h.fs.NewWriteBatch()
-	defer done(&err)
-	return batch.changeFileByID(h.id, true, fileTruncate(size))
+	if !h.writable {
+		return errNotWritable
+	}
+	if err := h.flush(); err != nil {
+		return err
+	}
+	return h.update(func(batch *MemFSWriteBatch) error {
+		return batch.changeFileByID(h.id, true, batch.writableOnly(fileTruncate(size, h.fs.codecOf)))
+	})
+}
+
+func (h *MemHandle) PunchHole(offset, length int64) (err error) {
+	if err := checkRange(offset, length); err != nil {
+		return err
+	}
+	return h.changeContent(filePunchHole(offset, length, h.fs.codecOf))
+}
+
+func (h *MemHandle) Allocate(offset, length int64) (err error) {
+	if err := checkRange(offset, length); err != nil {
+		return err
+	}
+	return h.changeContent(fileAllocate(offset, length, h.fs.codecOf))
+}
+
+func (h *MemHandle) changeContent(fn func(*File) error) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	if !h.writable {
+		return errNotWritable
+	}
+	if err := h.flush(); err != nil {
+		return err
+	}
+	return h.update(func(batch *MemFSWriteBatch) error {
+		return batch.changeFileByID(h.id, true, batch.writableOnly(fn))
+	})
 }
 
 func (h *MemHandle) ChangeTimes(atime, mtime time.Time) (err error) {
@@ -213,7 +474,7 @@ func (h *MemHandle) ChangeTimes(atime, mtime time.Time) (err error) {
 	if h.closed {
 		return ErrClosed
 	}
-	batch, done := h.fs.NewWriteBatch()
-	defer done(&err)
-	return batch.changeFileByID(h.id, true, fileChangeTimes(atime, mtime))
+	return h.update(func(batch *MemFSWriteBatch) error {
+		return batch.changeFileByID(h.id, true, batch.ownerOnly(fileChangeTimes(atime, mtime)))
+	})
 }
@@ -0,0 +1,204 @@
+package fs9
+
+import (
+	"io"
+	"sort"
+)
+
+const dirtyPageSize = 4096
+
+// dirtyPage is a page of buffered content. only bytes in ranges are written, others are not read from the file,
+// so that writes of other handles to them are kept
+type dirtyPage struct {
+	data   []byte
+	ranges []dirtyRange // sorted, not overlapping or adjacent
+}
+
+// dirtyRange is [lo, hi) in a page
+type dirtyRange struct {
+	lo, hi int
+}
+
+// add marks [lo, hi) as written
+func (p *dirtyPage) add(lo, hi int) {
+	ranges := make([]dirtyRange, 0, len(p.ranges)+1)
+	for _, r := range p.ranges {
+		if r.hi < lo || r.lo > hi {
+			ranges = append(ranges, r)
+			continue
+		}
+		// merge
+		if r.lo < lo {
+			lo = r.lo
+		}
+		if r.hi > hi {
+			hi = r.hi
+		}
+	}
+	ranges = append(ranges, dirtyRange{lo: lo, hi: hi})
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].lo < ranges[j].lo
+	})
+	p.ranges = ranges
+}
+
+// handleBuffer collects writes of a buffered MemHandle
+type handleBuffer struct {
+	limit    int64
+	pages    map[int64]*dirtyPage
+	end      int64  // end of buffered writes at offsets
+	appended []byte // data of O_APPEND writes, written at the end of file when flushed
+}
+
+func newHandleBuffer(limit int64) *handleBuffer {
+	return &handleBuffer{
+		limit: limit,
+		pages: make(map[int64]*dirtyPage),
+	}
+}
+
+func (b *handleBuffer) empty() bool {
+	return len(b.pages) == 0 && len(b.appended) == 0
+}
+
+func (b *handleBuffer) full() bool {
+	return int64(len(b.pages))*dirtyPageSize+int64(len(b.appended)) > b.limit
+}
+
+// appendOffset returns the offset of appended data in file
+func (b *handleBuffer) appendOffset(file *File) int64 {
+	if b.end > file.Size {
+		return b.end
+	}
+	return file.Size
+}
+
+// size returns the file size seen by the handle
+func (b *handleBuffer) size(file *File) int64 {
+	return b.appendOffset(file) + int64(len(b.appended))
+}
+
+func (b *handleBuffer) append(data []byte) {
+	b.appended = append(b.appended, data...)
+}
+
+func (b *handleBuffer) writeAt(data []byte, offset int64) {
+	if end := offset + int64(len(data)); end > b.end {
+		b.end = end
+	}
+	for len(data) > 0 {
+		index := offset / dirtyPageSize
+		pageOffset := int(offset % dirtyPageSize)
+		page, ok := b.pages[index]
+		if !ok {
+			page = &dirtyPage{
+				data: make([]byte, dirtyPageSize),
+			}
+			b.pages[index] = page
+		}
+		n := copy(page.data[pageOffset:], data)
+		page.add(pageOffset, pageOffset+n)
+		offset += int64(n)
+		data = data[n:]
+	}
+}
+
+// readAt reads content of file with buffered writes applied
+func (b *handleBuffer) readAt(file *File, buf []byte, offset int64) (n int, err error) {
+	size := b.size(file)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	n = len(buf)
+	if int64(n) > size-offset {
+		n = int(size - offset)
+	}
+	m, err := file.Content.ReadAt(buf[:n], offset)
+	if err != nil {
+		return 0, err
+	}
+	for i := m; i < n; i++ {
+		buf[i] = 0
+	}
+	// copies [from, to) of data at dataOffset in the file
+	overlay := func(data []byte, dataOffset int64, from, to int64) {
+		if from < offset {
+			from = offset
+		}
+		if to > offset+int64(n) {
+			to = offset + int64(n)
+		}
+		if from < to {
+			copy(buf[from-offset:to-offset], data[from-dataOffset:to-dataOffset])
+		}
+	}
+	for index := offset / dirtyPageSize; index*dirtyPageSize < offset+int64(n); index++ {
+		page, ok := b.pages[index]
+		if !ok {
+			continue
+		}
+		pageStart := index * dirtyPageSize
+		for _, r := range page.ranges {
+			overlay(page.data, pageStart, pageStart+int64(r.lo), pageStart+int64(r.hi))
+		}
+	}
+	if len(b.appended) > 0 {
+		appendOffset := b.appendOffset(file)
+		overlay(b.appended, appendOffset, appendOffset, size)
+	}
+	if n < len(buf) {
+		err = io.EOF
+	}
+	return
+}
+
+// flush writes dirty ranges to file, contiguous ones in one write, and appended data at the end of file
+func (b *handleBuffer) flush(file *File, codec Codec) (*File, error) {
+	indexes := make([]int64, 0, len(b.pages))
+	for index := range b.pages {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	var data []byte
+	var offset int64
+	write := func() (err error) {
+		if len(data) == 0 {
+			return nil
+		}
+		file, _, err = file.writeAt(data, offset, codec)
+		data = data[:0]
+		return
+	}
+	for _, index := range indexes {
+		page := b.pages[index]
+		pageStart := index * dirtyPageSize
+		for _, r := range page.ranges {
+			if pageStart+int64(r.lo) != offset+int64(len(data)) {
+				if err := write(); err != nil {
+					return nil, err
+				}
+				offset = pageStart + int64(r.lo)
+			}
+			data = append(data, page.data[r.lo:r.hi]...)
+		}
+	}
+	if err := write(); err != nil {
+		return nil, err
+	}
+	if len(b.appended) > 0 {
+		var err error
+		file, _, err = file.writeAt(b.appended, file.Size, codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (b *handleBuffer) reset() {
+	b.pages = make(map[int64]*dirtyPage)
+	b.end = 0
+	b.appended = nil
+}
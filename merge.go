@@ -0,0 +1,658 @@
+package fs9
+
+import (
+	"bytes"
+	"io/fs"
+	pathpkg "path"
+	"sort"
+
+	"github.com/reusee/e4"
+	"github.com/reusee/it"
+)
+
+type ConflictKind uint8
+
+const (
+	// both sides changed the same file or dir entry differently
+	ConflictModifyModify ConflictKind = iota + 1
+	// one side removed a file or dir entry that the other side changed
+	ConflictDeleteModify
+	// the sides changed a file or dir entry to different types
+	ConflictTypeChange
+)
+
+func (c ConflictKind) String() string {
+	switch c {
+	case ConflictModifyModify:
+		return "modify/modify"
+	case ConflictDeleteModify:
+		return "delete/modify"
+	case ConflictTypeChange:
+		return "type change"
+	}
+	return "unknown"
+}
+
+// MergeConflict is a change made by both sides of a merge that cannot be merged automatically
+type MergeConflict struct {
+	Kind ConflictKind
+	// slash-separated path, in the merged tree if present, otherwise in ours, theirs or base
+	Path string
+	ID   FileID
+	// conflicting attribute of modify/modify conflicts: content, mode, user, group, symlink or codec. empty for dir entries
+	Field string
+	// stat of the file in each snapshot, nil if absent
+	Base, Ours, Theirs fs.FileInfo
+}
+
+// MergeSnapshots three-way merges ours and theirs, two snapshots diverged from base.
+// base, ours and theirs must be MemFS-based and derived from the same FS.
+//
+// Changes made by only one side are taken as is. Changes made by both sides are merged per dir entry and per attribute.
+// Conflicts are resolved in favor of ours, except that removed dir entries stay removed.
+// Modification times are merged by taking the later one and never conflict.
+// Subtrees unchanged by one side are shared with the other side without merging.
+// Link counts are recounted from the merged dir entries.
+func MergeSnapshots(base, ours, theirs FS) (*MemFS, []MergeConflict, error) {
+	var snapshots [3]*MemFS
+	for i, fsys := range []FS{base, ours, theirs} {
+		m, err := memSnapshot(fsys)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshots[i] = m
+	}
+	b, o, t := snapshots[0], snapshots[1], snapshots[2]
+	if b.root.id != o.root.id || b.root.id != t.root.id {
+		return nil, nil, we.With(
+			e4.Info("snapshots of different FS"),
+		)(ErrBadArgument)
+	}
+
+	merger := &snapshotMerger{
+		ctx:    o.ctx,
+		base:   b.files,
+		ours:   o.files,
+		theirs: t.files,
+	}
+	node, err := merger.mergeNode(b.files, o.files, t.files)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := merger.countLinks(node.(*FileMap), b.root.id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// removed and modified files
+	var basePaths, oursPaths, theirsPaths map[FileID]string
+	for _, p := range []struct {
+		files *FileMap
+		paths *map[FileID]string
+	}{
+		{b.files, &basePaths},
+		{o.files, &oursPaths},
+		{t.files, &theirsPaths},
+	} {
+		*p.paths, err = filePaths(merger.ctx, p.files, b.root.id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for id := range basePaths {
+		_, inOurs := oursPaths[id]
+		_, inTheirs := theirsPaths[id]
+		if inOurs == inTheirs {
+			continue
+		}
+		modified, err := merger.modified(id, !inOurs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !modified {
+			continue
+		}
+		merger.conflicts = append(merger.conflicts, pendingConflict{
+			MergeConflict: MergeConflict{
+				Kind: ConflictDeleteModify,
+				ID:   id,
+			},
+		})
+	}
+
+	ret := newMemFS(o.ctx, files, o.root.id)
+	ret.codec = o.codec
+	ret.keys = o.keys
+	ret.encryptNames = o.encryptNames
+	if len(merger.conflicts) == 0 {
+		return ret, nil, nil
+	}
+
+	mergedPaths, err := filePaths(merger.ctx, files, b.root.id)
+	if err != nil {
+		return nil, nil, err
+	}
+	pathOf := func(id FileID) string {
+		for _, paths := range []map[FileID]string{mergedPaths, oursPaths, theirsPaths, basePaths} {
+			if p, ok := paths[id]; ok {
+				return p
+			}
+		}
+		return ""
+	}
+
+	conflicts := make([]MergeConflict, 0, len(merger.conflicts))
+	for _, pending := range merger.conflicts {
+		c := pending.MergeConflict
+		var name string
+		if pending.entryName != "" {
+			name = pending.entryName
+			c.Path = pathpkg.Join(pathOf(pending.parentID), name)
+		} else {
+			c.Path = pathOf(c.ID)
+			name = pathpkg.Base(c.Path)
+		}
+		for i, side := range []struct {
+			files *FileMap
+			paths map[FileID]string
+			info  *fs.FileInfo
+		}{
+			{b.files, basePaths, &c.Base},
+			{o.files, oursPaths, &c.Ours},
+			{t.files, theirsPaths, &c.Theirs},
+		} {
+			id := c.ID
+			if pending.entryName != "" {
+				id = pending.entryIDs[i]
+				if id == 0 {
+					continue
+				}
+			} else if _, ok := side.paths[id]; !ok {
+				// unreachable
+				continue
+			}
+			file, err := side.files.getFile(merger.ctx, id)
+			if err != nil {
+				return nil, nil, err
+			}
+			if file == nil {
+				continue
+			}
+			info, err := file.Stat()
+			if err != nil { // NOCOVER
+				return nil, nil, err
+			}
+			info.name = name
+			*side.info = info
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+
+	return ret, conflicts, nil
+}
+
+type snapshotMerger struct {
+	ctx                Scope
+	base, ours, theirs *FileMap
+	conflicts          []pendingConflict
+}
+
+type pendingConflict struct {
+	MergeConflict
+	// for dir entry conflicts
+	parentID  FileID
+	entryName string
+	entryIDs  [3]FileID // in base, ours and theirs, 0 if absent
+}
+
+func sameNode(a, b Node) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return nodeID(a) == nodeID(b)
+}
+
+// mergeNode merges *FileMap or *File nodes of the same key. any of b, o and t may be nil
+func (m *snapshotMerger) mergeNode(b, o, t Node) (Node, error) {
+	if sameNode(o, t) {
+		return o, nil
+	}
+	if sameNode(b, o) {
+		return t, nil
+	}
+	if sameNode(b, t) {
+		return o, nil
+	}
+
+	if o == nil || t == nil {
+		// removed from the map by one side and changed by the other.
+		// the changed file is kept, whether it is reachable is decided by dir entries
+		if _, ok := o.(*File); ok {
+			return o, nil
+		}
+		if _, ok := t.(*File); ok {
+			return t, nil
+		}
+	}
+
+	switch node := firstNode(o, t).(type) {
+
+	case *FileMap:
+		var nodes []Node
+		if err := join3(
+			mapSubs(b), mapSubs(o), mapSubs(t),
+			func(b, o, t Node) error {
+				node, err := m.mergeNode(b, o, t)
+				if err != nil {
+					return err
+				}
+				if node != nil {
+					nodes = append(nodes, node)
+				}
+				return nil
+			},
+		); err != nil {
+			return nil, err
+		}
+		return &FileMap{
+			nodeID:   newNodeID(),
+			subs:     it.NewNodeSet(nodes),
+			level:    node.level,
+			shardKey: node.shardKey,
+		}, nil
+
+	case *File:
+		var baseFile *File
+		if b != nil {
+			baseFile = b.(*File)
+		}
+		return m.mergeFile(baseFile, node, t.(*File))
+
+	}
+
+	return nil, we.With( // NOCOVER
+		e4.Info("bad node type %T", o),
+	)(ErrTypeMismatch)
+}
+
+func firstNode(nodes ...Node) Node {
+	for _, node := range nodes {
+		if node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+func mapSubs(node Node) []Node {
+	if node == nil {
+		return nil
+	}
+	return node.(*FileMap).subs.Nodes
+}
+
+func setNodes(set *NodeSet) []Node {
+	if set == nil {
+		return nil
+	}
+	return set.Nodes
+}
+
+func (m *snapshotMerger) fileConflict(kind ConflictKind, id FileID, field string) {
+	m.conflicts = append(m.conflicts, pendingConflict{
+		MergeConflict: MergeConflict{
+			Kind:  kind,
+			ID:    id,
+			Field: field,
+		},
+	})
+}
+
+// mergeFile merges files changed by both sides. b is nil if created by both sides
+func (m *snapshotMerger) mergeFile(b, o, t *File) (*File, error) {
+	if b == nil {
+		m.fileConflict(ConflictModifyModify, o.ID, "")
+		return o, nil
+	}
+	if o.IsDir != t.IsDir || o.Mode&fs.ModeType != t.Mode&fs.ModeType {
+		m.fileConflict(ConflictTypeChange, o.ID, "")
+		return o, nil
+	}
+
+	newFile := *o
+	newFile.nodeID = newNodeID()
+
+	// content
+	oursChanged, err := contentChanged(b, o)
+	if err != nil {
+		return nil, err
+	}
+	theirsChanged, err := contentChanged(b, t)
+	if err != nil {
+		return nil, err
+	}
+	if oursChanged && theirsChanged {
+		if changed, err := contentChanged(o, t); err != nil {
+			return nil, err
+		} else if changed {
+			m.fileConflict(ConflictModifyModify, o.ID, "content")
+		}
+	} else if theirsChanged {
+		newFile.Content = t.Content
+		newFile.Size = t.Size
+	}
+
+	// attributes
+	mergeAttr := func(field string, changed func(a, b *File) bool, take func()) {
+		oursChanged := changed(b, o)
+		theirsChanged := changed(b, t)
+		if oursChanged && theirsChanged {
+			if changed(o, t) {
+				m.fileConflict(ConflictModifyModify, o.ID, field)
+			}
+		} else if theirsChanged {
+			take()
+		}
+	}
+	mergeAttr("mode", func(a, b *File) bool {
+		return a.Mode != b.Mode
+	}, func() {
+		newFile.Mode = t.Mode
+	})
+	mergeAttr("user", func(a, b *File) bool {
+		return a.UserID != b.UserID
+	}, func() {
+		newFile.UserID = t.UserID
+	})
+	mergeAttr("group", func(a, b *File) bool {
+		return a.GroupID != b.GroupID
+	}, func() {
+		newFile.GroupID = t.GroupID
+	})
+	mergeAttr("symlink", func(a, b *File) bool {
+		return a.Symlink != b.Symlink
+	}, func() {
+		newFile.Symlink = t.Symlink
+	})
+	mergeAttr("codec", func(a, b *File) bool {
+		return a.Codec != b.Codec
+	}, func() {
+		newFile.Codec = t.Codec
+	})
+	mergeAttr("project", func(a, b *File) bool {
+		return a.Project != b.Project
+	}, func() {
+		newFile.Project = t.Project
+	})
+	mergeXattrs(b, o, t, func(attr string) {
+		m.fileConflict(ConflictModifyModify, o.ID, "xattr:"+attr)
+	}, &newFile)
+	if t.ModTime.After(newFile.ModTime) {
+		newFile.ModTime = t.ModTime
+	}
+	if t.AccessTime.After(newFile.AccessTime) {
+		newFile.AccessTime = t.AccessTime
+	}
+
+	// entries
+	if o.IsDir && t.IsDir {
+		subs, err := m.mergeEntries(o.ID, b.Subs, o.Subs, t.Subs)
+		if err != nil {
+			return nil, err
+		}
+		newFile.Subs = subs
+	}
+
+	return &newFile, nil
+}
+
+// sameChunks reports whether a and b have the same content chunks
+func sameChunks(a, b *File) bool {
+	return a.Size == b.Size && a.Content.Equal(b.Content)
+}
+
+func contentChanged(a, b *File) (bool, error) {
+	if a.Size != b.Size || a.Content.Len() != b.Content.Len() {
+		return true, nil
+	}
+	if sameChunks(a, b) {
+		return false, nil
+	}
+	// same data written by both sides
+	dataA, err := a.Content.Bytes()
+	if err != nil {
+		return false, err
+	}
+	dataB, err := b.Content.Bytes()
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(dataA, dataB), nil
+}
+
+func asDirEntry(node Node) *DirEntry {
+	switch node := node.(type) {
+	case DirEntry:
+		return &node
+	case *DirEntry:
+		return node
+	}
+	return nil
+}
+
+func sameEntry(a, b *DirEntry) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.id == b.id && a._type == b._type
+}
+
+func (m *snapshotMerger) mergeEntries(parentID FileID, b, o, t *NodeSet) (*NodeSet, error) {
+	var nodes []Node
+	if err := join3(
+		setNodes(b), setNodes(o), setNodes(t),
+		func(nodeB, nodeO, nodeT Node) error {
+			entryB := asDirEntry(nodeB)
+			entryO := asDirEntry(nodeO)
+			entryT := asDirEntry(nodeT)
+			var node Node
+			switch {
+			case sameEntry(entryO, entryT), sameEntry(entryB, entryT):
+				node = nodeO
+			case sameEntry(entryB, entryO):
+				node = nodeT
+			default:
+				// changed by both sides
+				var kind ConflictKind
+				switch {
+				case entryO == nil || entryT == nil:
+					kind = ConflictDeleteModify
+				case entryO._type != entryT._type:
+					kind = ConflictTypeChange
+					node = nodeO
+				default:
+					kind = ConflictModifyModify
+					node = nodeO
+				}
+				var ids [3]FileID
+				var name string
+				for i, entry := range []*DirEntry{entryB, entryO, entryT} {
+					if entry != nil {
+						ids[i] = entry.id
+						name = entry.name
+					}
+				}
+				id := ids[1]
+				if id == 0 {
+					id = ids[2]
+				}
+				m.conflicts = append(m.conflicts, pendingConflict{
+					MergeConflict: MergeConflict{
+						Kind: kind,
+						ID:   id,
+					},
+					parentID:  parentID,
+					entryName: name,
+					entryIDs:  ids,
+				})
+			}
+			if node != nil {
+				nodes = append(nodes, node)
+			}
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+	return it.NewNodeSet(nodes), nil
+}
+
+// modified reports whether the file of id is changed from base by theirs, or by ours if byTheirs is false
+func (m *snapshotMerger) modified(id FileID, byTheirs bool) (bool, error) {
+	side := m.ours
+	if byTheirs {
+		side = m.theirs
+	}
+	baseFile, err := m.base.getFile(m.ctx, id)
+	if err != nil {
+		return false, err
+	}
+	file, err := side.getFile(m.ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if file == nil {
+		return false, nil
+	}
+	return file.nodeID != baseFile.nodeID, nil
+}
+
+// join3 calls fn with nodes of the same key in sorted node lists a, b and c. absent nodes are nil
+func join3(a, b, c []Node, fn func(a, b, c Node) error) error {
+	lists := [3][]Node{a, b, c}
+	for {
+		var minKey Key
+		found := false
+		for _, list := range lists {
+			if len(list) == 0 {
+				continue
+			}
+			key, _ := list[0].KeyRange()
+			if !found || it.Compare(key, minKey) < 0 {
+				minKey = key
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+		var nodes [3]Node
+		for i, list := range lists {
+			if len(list) == 0 {
+				continue
+			}
+			if key, _ := list[0].KeyRange(); it.Compare(key, minKey) == 0 {
+				nodes[i] = list[0]
+				lists[i] = list[1:]
+			}
+		}
+		if err := fn(nodes[0], nodes[1], nodes[2]); err != nil {
+			return err
+		}
+	}
+}
+
+// filePaths returns a path of every file reachable from the root dir
+// countLinks sets link counts of reachable files to the number of merged dir entries referring to them
+func (m *snapshotMerger) countLinks(files *FileMap, rootID FileID) (*FileMap, error) {
+	links := map[FileID]int{
+		rootID: 1,
+	}
+	var walk func(id FileID) error
+	walk = func(id FileID) error {
+		file, err := files.getFile(m.ctx, id)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return we.With(
+				e4.Info("file %d", id),
+			)(ErrFileNotFound)
+		}
+		if !file.IsDir {
+			return nil
+		}
+		for _, node := range file.Subs.Nodes {
+			entry := asDirEntry(node)
+			links[entry.id]++
+			if links[entry.id] > 1 {
+				continue
+			}
+			if err := walk(entry.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(rootID); err != nil {
+		return nil, err
+	}
+	for id, n := range links {
+		n := n
+		node, err := files.Mutate(m.ctx, files.GetPath(id), func(node Node) (Node, error) {
+			file := node.(*File)
+			if file.Nlink == n {
+				return node, nil
+			}
+			newFile := *file
+			newFile.nodeID = newNodeID()
+			newFile.Nlink = n
+			return &newFile, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = node.(*FileMap)
+	}
+	return files, nil
+}
+
+func filePaths(ctx Scope, files *FileMap, rootID FileID) (map[FileID]string, error) {
+	paths := map[FileID]string{
+		rootID: ".",
+	}
+	var walk func(id FileID, dir string) error
+	walk = func(id FileID, dir string) error {
+		file, err := files.getFile(ctx, id)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return we.With(
+				e4.Info("file %d", id),
+			)(ErrFileNotFound)
+		}
+		if !file.IsDir {
+			return nil
+		}
+		for _, node := range file.Subs.Nodes {
+			entry := asDirEntry(node)
+			if _, ok := paths[entry.id]; ok {
+				continue
+			}
+			p := pathpkg.Join(dir, entry.name)
+			paths[entry.id] = p
+			if err := walk(entry.id, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(rootID, "."); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
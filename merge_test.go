@@ -0,0 +1,223 @@
+package fs9
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestMergeSnapshots(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	write := func(fsys FS, name string, content string) {
+		h, err := fsys.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+	read := func(fsys FS, name string) string {
+		data, err := fs.ReadFile(fsys, name)
+		ce(err)
+		return string(data)
+	}
+	exists := func(fsys FS, name string) bool {
+		_, err := fsys.LinkStat(name)
+		if is(err, ErrFileNotFound) {
+			return false
+		}
+		ce(err)
+		return true
+	}
+
+	m := NewMemFS()
+	write(m, "a", "a")
+	write(m, "b", "b")
+	ce(m.MakeDirAll("d/e"))
+	write(m, "d/x", "x")
+	write(m, "d/e/y", "y")
+	base := m.Snapshot()
+	ours := base.Snapshot()
+	theirs := base.Snapshot()
+
+	// non-conflicting
+	write(ours, "a", "ours a")
+	write(ours, "ours", "ours")
+	ce(ours.ChangeMode("b", 0600))
+	ce(ours.Rename("d/e/y", "d/e/z"))
+	write(theirs, "b", "theirs b")
+	write(theirs, "d/theirs", "theirs")
+	ce(theirs.Remove("d/x"))
+	ce(theirs.ChangeOwner("d/e/y", 42, 42))
+	ce(ours.SetXattr("b", "user.ours", []byte("ours"), 0))
+	ce(theirs.SetXattr("b", "user.theirs", []byte("theirs"), 0))
+	merged, conflicts, err := MergeSnapshots(base, ours, theirs)
+	ce(err)
+	eq(
+		len(conflicts), 0,
+		read(merged, "a"), "ours a",
+		read(merged, "b"), "theirs b",
+		read(merged, "ours"), "ours",
+		read(merged, "d/theirs"), "theirs",
+		read(merged, "d/e/z"), "y",
+		exists(merged, "d/x"), false,
+		exists(merged, "d/e/y"), false,
+	)
+	stat, err := merged.Stat("b")
+	ce(err)
+	eq(stat.Mode(), fs.FileMode(0600))
+	attrs, err := merged.ListXattr("b")
+	ce(err)
+	eq(attrs, []string{"user.ours", "user.theirs"})
+	stat, err = merged.Stat("d/e/z")
+	ce(err)
+	eq(stat.Sys().(ExtFileInfo).UserID, 42)
+	// inputs are not changed
+	eq(
+		read(base, "a"), "a",
+		read(ours, "b"), "b",
+	)
+	// merged fs is writable
+	write(merged, "new", "new")
+
+	// unchanged side
+	merged, conflicts, err = MergeSnapshots(base, base, theirs)
+	ce(err)
+	eq(
+		len(conflicts), 0,
+		merged.files == theirs.(*MemFS).files, true,
+	)
+
+	// conflicts
+	ours = base.Snapshot()
+	theirs = base.Snapshot()
+	write(ours, "a", "ours a")
+	write(theirs, "a", "theirs a")
+	ce(ours.ChangeMode("b", 0600))
+	ce(theirs.ChangeMode("b", 0644))
+	ce(ours.SetXattr("b", "user.foo", []byte("ours"), 0))
+	ce(theirs.SetXattr("b", "user.foo", []byte("theirs"), 0))
+	ce(ours.Remove("d", OptAll(true)))
+	write(theirs, "d/e/y", "theirs y")
+	write(ours, "same", "same")
+	write(theirs, "same", "same")
+	write(ours, "new", "ours")
+	ce(theirs.MakeDir("new"))
+	write(ours, "added", "ours")
+	write(theirs, "added", "theirs")
+	merged, conflicts, err = MergeSnapshots(base, ours, theirs)
+	ce(err)
+	type conflict struct {
+		Kind  ConflictKind
+		Path  string
+		Field string
+	}
+	var got []conflict
+	for _, c := range conflicts {
+		got = append(got, conflict{c.Kind, c.Path, c.Field})
+	}
+	eq(
+		got, []conflict{
+			{ConflictModifyModify, "a", "content"},
+			{ConflictModifyModify, "added", ""},
+			{ConflictModifyModify, "b", "mode"},
+			{ConflictModifyModify, "b", "xattr:user.foo"},
+			{ConflictDeleteModify, "d/e/y", ""},
+			{ConflictTypeChange, "new", ""},
+			{ConflictModifyModify, "same", ""},
+		},
+	)
+	eq(
+		conflicts[0].Base.Size(), int64(1),
+		conflicts[0].Ours.Size(), int64(6),
+		conflicts[0].Theirs.Size(), int64(8),
+		conflicts[1].Base == nil, true,
+		conflicts[4].Ours == nil, true,
+		conflicts[4].Theirs.Name(), "y",
+		conflicts[5].Theirs.IsDir(), true,
+		conflicts[5].Kind.String(), "type change",
+	)
+	// resolved in favor of ours, removed entries stay removed
+	eq(
+		read(merged, "a"), "ours a",
+		read(merged, "added"), "ours",
+		read(merged, "new"), "ours",
+		exists(merged, "d"), false,
+	)
+	stat, err = merged.Stat("b")
+	ce(err)
+	eq(stat.Mode(), fs.FileMode(0600))
+
+	// same changes on both sides
+	ours = base.Snapshot()
+	theirs = base.Snapshot()
+	write(ours, "a", "foo")
+	write(theirs, "a", "foo")
+	ce(ours.ChangeMode("b", 0600))
+	ce(theirs.ChangeMode("b", 0600))
+	_, conflicts, err = MergeSnapshots(base, ours, theirs)
+	ce(err)
+	eq(len(conflicts), 0)
+
+	// link counts
+	nlink := func(fsys FS, name string) int {
+		stat, err := fsys.Stat(name)
+		ce(err)
+		return stat.Sys().(ExtFileInfo).Nlink
+	}
+	ce(m.Link("a", "link"))
+	base = m.Snapshot()
+	ours = base.Snapshot()
+	theirs = base.Snapshot()
+	// same link removed by both sides
+	ce(ours.Remove("link"))
+	ce(theirs.Remove("link"))
+	// linked by one side, removed by the other
+	ce(ours.Link("b", "b2"))
+	ce(theirs.Remove("b"))
+	merged, conflicts, err = MergeSnapshots(base, ours, theirs)
+	ce(err)
+	eq(
+		len(conflicts), 1,
+		conflicts[0].Kind, ConflictDeleteModify,
+		exists(merged, "link"), false,
+		exists(merged, "b"), false,
+		nlink(merged, "a"), 1,
+		nlink(merged, "b2"), 1,
+	)
+
+	// unrelated
+	_, _, err = MergeSnapshots(base, ours, NewMemFS())
+	eq(is(err, ErrBadArgument), true)
+}
+
+func TestTwoWayMerge(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	ctx := NewMemFS().ctx
+
+	file := NewFile(false)
+	_, err := file.Merge(ctx, NewFile(false))
+	eq(is(err, ErrBadArgument), true)
+	_, err = file.Merge(ctx, NewFileMap(0, 0))
+	eq(is(err, ErrTypeMismatch), true)
+	dir := *file
+	dir.nodeID++
+	dir.IsDir = true
+	_, err = file.Merge(ctx, &dir)
+	eq(is(err, ErrTypeMismatch), true)
+
+	entry := DirEntry{nodeID: 1, name: "foo"}
+	_, err = entry.Merge(ctx, &DirEntry{nodeID: 2, name: "bar"})
+	eq(is(err, ErrNameMismatch), true)
+	_, err = entry.Merge(ctx, file)
+	eq(is(err, ErrTypeMismatch), true)
+	node, err := entry.Merge(ctx, &DirEntry{nodeID: 2, name: "foo", id: 42})
+	ce(err)
+	eq(node.(DirEntry).id, FileID(42))
+
+	_, err = NewFileMap(0, 0).Merge(ctx, NewFileMap(1, 0))
+	eq(is(err, ErrBadArgument), true)
+	_, err = NewFileMap(0, 0).Merge(ctx, file)
+	eq(is(err, ErrTypeMismatch), true)
+}
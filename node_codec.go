@@ -0,0 +1,364 @@
+package fs9
+
+import (
+	"io/fs"
+	"sort"
+
+	"github.com/reusee/e4"
+	"github.com/reusee/it"
+)
+
+const (
+	nodeKindFileMap uint8 = iota + 1
+	nodeKindFile
+)
+
+// nodeRecord is the serialized form of a *FileMap or *File node
+type nodeRecord struct {
+	Kind    uint8
+	FileMap *fileMapRecord
+	File    *fileRecord
+}
+
+type fileMapRecord struct {
+	NodeID   int64
+	Level    int
+	ShardKey uint8
+	Subs     []int64 // node ids of sub maps or files
+}
+
+type fileRecord struct {
+	NodeID     int64
+	ID         FileID
+	IsDir      bool
+	Size       int64
+	Mode       fs.FileMode
+	ModTime    []byte
+	Subs       []dirEntryRecord
+	Symlink    string
+	Chunks     []int64 // chunk ids
+	Codec      string
+	UserID     int
+	GroupID    int
+	AccessTime []byte
+	Xattrs     []xattrRecord // sorted by name
+	Project    FileID
+	Nlink      int
+}
+
+type xattrRecord struct {
+	Name  string
+	Value []byte
+}
+
+// chunkRecord is the serialized form of a *Chunk
+type chunkRecord struct {
+	ID    int64
+	Codec string
+	Size  int
+	KeyID string // not empty if Data is encrypted
+	Data  []byte
+}
+
+type dirEntryRecord struct {
+	NodeID     int64
+	ID         FileID
+	Name       string
+	KeyID      string // not empty if the name is encrypted in SealedName
+	SealedName []byte
+	IsDir      bool
+	Type       fs.FileMode
+}
+
+func nodeID(node Node) int64 {
+	switch node := node.(type) {
+	case *FileMap:
+		return node.nodeID
+	case *File:
+		return node.nodeID
+	}
+	panic("type mismatch") // NOCOVER
+}
+
+func chunkToRecord(chunk *Chunk) *chunkRecord {
+	return &chunkRecord{
+		ID:    chunk.id,
+		Codec: chunk.codec,
+		Size:  chunk.size,
+		Data:  chunk.Data,
+	}
+}
+
+func recordToChunk(rec *chunkRecord) *Chunk {
+	seedNodeID(rec.ID)
+	return &Chunk{
+		id:    rec.ID,
+		codec: rec.Codec,
+		size:  rec.Size,
+		Data:  rec.Data,
+	}
+}
+
+func nodeToRecord(node Node) (*nodeRecord, error) {
+	switch node := node.(type) {
+
+	case *FileMap:
+		rec := &fileMapRecord{
+			NodeID:   node.nodeID,
+			Level:    node.level,
+			ShardKey: node.shardKey,
+		}
+		for _, sub := range node.subs.Nodes {
+			rec.Subs = append(rec.Subs, nodeID(sub))
+		}
+		return &nodeRecord{
+			Kind:    nodeKindFileMap,
+			FileMap: rec,
+		}, nil
+
+	case *File:
+		modTime, err := node.ModTime.MarshalBinary()
+		if err != nil { // NOCOVER
+			return nil, we(err)
+		}
+		accessTime, err := node.AccessTime.MarshalBinary()
+		if err != nil { // NOCOVER
+			return nil, we(err)
+		}
+		rec := &fileRecord{
+			NodeID:     node.nodeID,
+			ID:         node.ID,
+			IsDir:      node.IsDir,
+			Size:       node.Size,
+			Mode:       node.Mode,
+			ModTime:    modTime,
+			Symlink:    node.Symlink,
+			Codec:      node.Codec,
+			UserID:     node.UserID,
+			GroupID:    node.GroupID,
+			AccessTime: accessTime,
+			Project:    node.Project,
+			Nlink:      node.Nlink,
+		}
+		node.Content.Range(func(_ int64, chunk *Chunk) error {
+			rec.Chunks = append(rec.Chunks, chunk.id)
+			return nil
+		})
+		for name, value := range node.Xattrs {
+			rec.Xattrs = append(rec.Xattrs, xattrRecord{
+				Name:  name,
+				Value: value,
+			})
+		}
+		sort.Slice(rec.Xattrs, func(i, j int) bool {
+			return rec.Xattrs[i].Name < rec.Xattrs[j].Name
+		})
+		if node.Subs != nil {
+			for _, n := range node.Subs.Nodes {
+				var entry DirEntry
+				switch n := n.(type) {
+				case DirEntry:
+					entry = n
+				case *DirEntry:
+					entry = *n
+				}
+				rec.Subs = append(rec.Subs, dirEntryRecord{
+					NodeID: entry.nodeID,
+					ID:     entry.id,
+					Name:   entry.name,
+					IsDir:  entry.isDir,
+					Type:   entry._type,
+				})
+			}
+		}
+		return &nodeRecord{
+			Kind: nodeKindFile,
+			File: rec,
+		}, nil
+
+	}
+	panic("type mismatch") // NOCOVER
+}
+
+// recordToNode rebuilds a node from its record. sub nodes of file maps are loaded by load, content chunks by loadChunk
+func recordToNode(
+	rec *nodeRecord,
+	fsys *MemFS,
+	load func(nodeID int64) (Node, error),
+	loadChunk func(chunkID int64) (*Chunk, error),
+) (Node, error) {
+	switch rec.Kind {
+
+	case nodeKindFileMap:
+		r := rec.FileMap
+		if r == nil {
+			return nil, we(ErrBadRecord)
+		}
+		seedNodeID(r.NodeID)
+		var subs []Node
+		for _, id := range r.Subs {
+			sub, err := load(id)
+			if err != nil {
+				return nil, we(err)
+			}
+			subs = append(subs, sub)
+		}
+		return &FileMap{
+			nodeID:   r.NodeID,
+			subs:     it.NewNodeSet(subs),
+			level:    r.Level,
+			shardKey: r.ShardKey,
+		}, nil
+
+	case nodeKindFile:
+		r := rec.File
+		if r == nil {
+			return nil, we(ErrBadRecord)
+		}
+		seedNodeID(r.NodeID)
+		seedNodeID(int64(r.ID))
+		file := &File{
+			nodeID:  r.NodeID,
+			ID:      r.ID,
+			IsDir:   r.IsDir,
+			Size:    r.Size,
+			Mode:    r.Mode,
+			Symlink: r.Symlink,
+			Codec:   r.Codec,
+			UserID:  r.UserID,
+			GroupID: r.GroupID,
+			Project: r.Project,
+			Nlink:   r.Nlink,
+		}
+		if err := file.ModTime.UnmarshalBinary(r.ModTime); err != nil {
+			return nil, we(err)
+		}
+		if err := file.AccessTime.UnmarshalBinary(r.AccessTime); err != nil {
+			return nil, we(err)
+		}
+		if len(r.Xattrs) > 0 {
+			file.Xattrs = make(map[string][]byte, len(r.Xattrs))
+			for _, x := range r.Xattrs {
+				file.Xattrs[x.Name] = x.Value
+			}
+		}
+		var chunks []*Chunk
+		for _, id := range r.Chunks {
+			chunk, err := loadChunk(id)
+			if err != nil {
+				return nil, we(err)
+			}
+			chunks = append(chunks, chunk)
+		}
+		file.Content = chunksOf(chunks)
+		if file.Content.Size() != file.Size {
+			return nil, we.With(
+				e4.Info("content size %d, file size %d", file.Content.Size(), file.Size),
+			)(ErrBadRecord)
+		}
+		if r.IsDir {
+			var entries []Node
+			for _, e := range r.Subs {
+				seedNodeID(e.NodeID)
+				entries = append(entries, DirEntry{
+					nodeID: e.NodeID,
+					id:     e.ID,
+					name:   e.Name,
+					isDir:  e.IsDir,
+					_type:  e.Type,
+					fs:     fsys,
+				})
+			}
+			file.Subs = it.NewNodeSet(entries)
+		}
+		return file, nil
+
+	}
+	return nil, we.With(
+		e4.Info("node kind: %d", rec.Kind),
+	)(ErrBadRecord)
+}
+
+// walkNodes calls fn on node and all nodes reachable from it
+func walkNodes(node Node, fn func(Node) error) error {
+	if err := fn(node); err != nil {
+		return err
+	}
+	if m, ok := node.(*FileMap); ok {
+		for _, sub := range m.subs.Nodes {
+			if err := walkNodes(sub, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffNodes calls onlyA on nodes reachable from a but not from b, and onlyB on nodes reachable from b but not from a.
+// subtrees shared by a and b are skipped without walking
+func diffNodes(a, b Node, onlyA, onlyB func(Node) error) error {
+	if a == nil && b == nil {
+		return nil
+	}
+	if a == nil {
+		return walkNodes(b, onlyB)
+	}
+	if b == nil {
+		return walkNodes(a, onlyA)
+	}
+	if nodeID(a) == nodeID(b) {
+		return nil
+	}
+	if err := onlyA(a); err != nil {
+		return err
+	}
+	if err := onlyB(b); err != nil {
+		return err
+	}
+
+	mapA, ok := a.(*FileMap)
+	if !ok {
+		return nil
+	}
+	mapB := b.(*FileMap)
+	subsA := mapA.subs.Nodes
+	subsB := mapB.subs.Nodes
+	for len(subsA) > 0 || len(subsB) > 0 {
+		if len(subsA) == 0 {
+			if err := walkNodes(subsB[0], onlyB); err != nil {
+				return err
+			}
+			subsB = subsB[1:]
+			continue
+		}
+		if len(subsB) == 0 {
+			if err := walkNodes(subsA[0], onlyA); err != nil {
+				return err
+			}
+			subsA = subsA[1:]
+			continue
+		}
+		keyA, _ := subsA[0].KeyRange()
+		keyB, _ := subsB[0].KeyRange()
+		switch c := it.Compare(keyA, keyB); {
+		case c < 0:
+			if err := walkNodes(subsA[0], onlyA); err != nil {
+				return err
+			}
+			subsA = subsA[1:]
+		case c > 0:
+			if err := walkNodes(subsB[0], onlyB); err != nil {
+				return err
+			}
+			subsB = subsB[1:]
+		default:
+			if err := diffNodes(subsA[0], subsB[0], onlyA, onlyB); err != nil {
+				return err
+			}
+			subsA = subsA[1:]
+			subsB = subsB[1:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package fs9
+
+import (
+	"sync/atomic"
+
+	"github.com/reusee/it"
+)
+
+// nodeIDSource generates ids from time and a serial, which restarts with the process
+var nodeIDSource = it.NewNodeID
+
+// lastNodeID is the highest id generated or loaded
+var lastNodeID int64
+
+// newNodeID returns an id of nodes, files and chunks, greater than ids generated or loaded before.
+// ids stored by another process in the same second are not repeated
+func newNodeID() int64 {
+	id := nodeIDSource()
+	for {
+		last := atomic.LoadInt64(&lastNodeID)
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastNodeID, last, id) {
+			return id
+		}
+	}
+}
+
+// seedNodeID makes ids generated later greater than the loaded id
+func seedNodeID(id int64) {
+	for {
+		last := atomic.LoadInt64(&lastNodeID)
+		if id <= last || atomic.CompareAndSwapInt64(&lastNodeID, last, id) {
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// message types of 9P2000.L
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+	Tversion     = 100
+	Rversion     = 101
+	Tauth        = 102
+	Rauth        = 103
+	Tattach      = 104
+	Rattach      = 105
+	Tflush       = 108
+	Rflush       = 109
+	Twalk        = 110
+	Rwalk        = 111
+	Tread        = 116
+	Rread        = 117
+	Twrite       = 118
+	Rwrite       = 119
+	Tclunk       = 120
+	Rclunk       = 121
+	Tremove      = 122
+	Rremove      = 123
+)
+
+const (
+	Version = "9P2000.L"
+	NoTag   = ^uint16(0)
+	NoFid   = ^uint32(0)
+
+	headerSize = 7 // size[4] type[1] tag[2]
+	qidSize    = 13
+)
+
+// qid types
+const (
+	QTDIR     = 0x80
+	QTSYMLINK = 0x02
+	QTFILE    = 0x00
+)
+
+// Qid is the server's unique identification of a file
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+var ErrBadMessage = errors.New("bad message")
+
+// Encoder appends little-endian 9P fields to a buffer
+type Encoder struct {
+	Buf []byte
+}
+
+func (e *Encoder) U8(v uint8) {
+	e.Buf = append(e.Buf, v)
+}
+
+func (e *Encoder) U16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.Buf = append(e.Buf, b[:]...)
+}
+
+func (e *Encoder) U32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.Buf = append(e.Buf, b[:]...)
+}
+
+func (e *Encoder) U64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.Buf = append(e.Buf, b[:]...)
+}
+
+func (e *Encoder) Str(s string) {
+	e.U16(uint16(len(s)))
+	e.Buf = append(e.Buf, s...)
+}
+
+func (e *Encoder) Qid(q Qid) {
+	e.U8(q.Type)
+	e.U32(q.Version)
+	e.U64(q.Path)
+}
+
+func (e *Encoder) Bytes(data []byte) {
+	e.U32(uint32(len(data)))
+	e.Buf = append(e.Buf, data...)
+}
+
+// Decoder reads little-endian 9P fields from a buffer. Err is set on short buffer
+type Decoder struct {
+	Buf []byte
+	Err error
+}
+
+func (d *Decoder) take(n int) []byte {
+	if d.Err != nil {
+		return nil
+	}
+	if len(d.Buf) < n {
+		d.Err = ErrBadMessage
+		return nil
+	}
+	ret := d.Buf[:n]
+	d.Buf = d.Buf[n:]
+	return ret
+}
+
+func (d *Decoder) U8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *Decoder) U16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *Decoder) U32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *Decoder) U64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *Decoder) Str() string {
+	n := d.U16()
+	return string(d.take(int(n)))
+}
+
+func (d *Decoder) Qid() (q Qid) {
+	q.Type = d.U8()
+	q.Version = d.U32()
+	q.Path = d.U64()
+	return
+}
+
+func (d *Decoder) Bytes() []byte {
+	n := d.U32()
+	return d.take(int(n))
+}
+
+// ReadMessage reads one message. messages larger than maxSize are rejected
+func ReadMessage(r io.Reader, maxSize uint32) (typ uint8, tag uint16, body []byte, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size < headerSize || size > maxSize {
+		err = ErrBadMessage
+		return
+	}
+	typ = header[4]
+	tag = binary.LittleEndian.Uint16(header[5:])
+	body = make([]byte, size-headerSize)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	return
+}
+
+// WriteMessage writes one message
+func WriteMessage(w io.Writer, typ uint8, tag uint16, body []byte) error {
+	buf := make([]byte, headerSize, headerSize+len(body))
+	binary.LittleEndian.PutUint32(buf, uint32(headerSize+len(body)))
+	buf[4] = typ
+	binary.LittleEndian.PutUint16(buf[5:], tag)
+	buf = append(buf, body...)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,1136 @@
+package p9
+
+import (
+	"bufio"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reusee/fs9"
+)
+
+// Errno is a Linux error number, as carried by Rlerror
+type Errno uint32
+
+const (
+	EPERM      Errno = 1
+	ENOENT     Errno = 2
+	EIO        Errno = 5
+	EBADF      Errno = 9
+	EACCES     Errno = 13
+	EEXIST     Errno = 17
+	EXDEV      Errno = 18
+	ENOTDIR    Errno = 20
+	EISDIR     Errno = 21
+	EINVAL     Errno = 22
+	ENOSPC     Errno = 28
+	ERANGE     Errno = 34
+	ENOSYS     Errno = 38
+	ENOTEMPTY  Errno = 39
+	ELOOP      Errno = 40
+	ENODATA    Errno = 61
+	EOPNOTSUPP Errno = 95
+	EDQUOT     Errno = 122
+)
+
+func (e Errno) Error() string {
+	switch e {
+	case EPERM:
+		return "operation not permitted"
+	case ENOENT:
+		return "no such file or directory"
+	case EBADF:
+		return "bad file descriptor"
+	case EACCES:
+		return "permission denied"
+	case EEXIST:
+		return "file exists"
+	case ENOTDIR:
+		return "not a directory"
+	case EISDIR:
+		return "is a directory"
+	case EINVAL:
+		return "invalid argument"
+	case ENOSYS:
+		return "function not implemented"
+	case ENOTEMPTY:
+		return "directory not empty"
+	}
+	return "errno " + strconv.FormatUint(uint64(e), 10)
+}
+
+// ToErrno maps fs9 errors to Linux error numbers
+func ToErrno(err error) Errno {
+	var errno Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case is(err, fs9.ErrFileNotFound), is(err, fs.ErrNotExist):
+		return ENOENT
+	case is(err, fs9.ErrFileExisted), is(err, fs.ErrExist):
+		return EEXIST
+	case is(err, fs9.ErrDirNotEmpty):
+		return ENOTEMPTY
+	case is(err, fs9.ErrNotDir):
+		return ENOTDIR
+	case is(err, fs9.ErrIsDir):
+		return EISDIR
+	case is(err, fs9.ErrTooManyLinks):
+		return ELOOP
+	case is(err, fs9.ErrNoPermission), is(err, fs.ErrPermission):
+		return EACCES
+	case is(err, fs9.ErrCannotLink), is(err, fs9.ErrCannotRemove):
+		return EPERM
+	case is(err, fs9.ErrClosed):
+		return EBADF
+	case is(err, fs9.ErrQuotaExceeded):
+		return EDQUOT
+	case is(err, fs9.ErrCrossDevice):
+		return EXDEV
+	case is(err, fs9.ErrXattrNotFound):
+		return ENODATA
+	case is(err, fs9.ErrXattrExisted):
+		return EEXIST
+	case is(err, fs9.ErrXattrTooLarge):
+		return ERANGE
+	case is(err, fs9.ErrNotSupported):
+		return EOPNOTSUPP
+	case is(err, fs9.ErrInvalidPath),
+		is(err, fs9.ErrInvalidName),
+		is(err, fs9.ErrBadArgument),
+		is(err, fs9.ErrOutOfBounds),
+		is(err, fs9.ErrTypeMismatch):
+		return EINVAL
+	}
+	return EIO
+}
+
+// linux file types and open flags
+const (
+	sIFMT    = 0170000
+	sIFDIR   = 0040000
+	sIFREG   = 0100000
+	sIFLNK   = 0120000
+	sISUID   = 04000
+	sISGID   = 02000
+	sISVTX   = 01000
+	oACCMODE = 03
+	oRDONLY  = 0
+	oWRONLY  = 01
+	oTRUNC   = 01000
+	oAPPEND  = 02000
+
+	atRemoveDir = 0x200
+
+	dtDir = 4
+	dtReg = 8
+	dtLnk = 10
+)
+
+// Tgetattr and Tsetattr masks
+const (
+	getattrBasic = 0x7ff
+
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+const (
+	defaultMsize = 1 << 20
+	ioHeaderSize = 24
+	maxXattrSize = 64 << 10 // XATTR_SIZE_MAX
+)
+
+// Server serves a fs9.FS over 9P2000.L
+type Server struct {
+	fs    fs9.FS
+	msize uint32
+}
+
+func NewServer(fsys fs9.FS) *Server {
+	return &Server{
+		fs:    fsys,
+		msize: defaultMsize,
+	}
+}
+
+// Serve accepts connections on ln and serves each one in a new goroutine
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+type fid struct {
+	name    string // fs9 name
+	uid     int
+	handle  fs9.Handle
+	entries []dirent // read at directory offset 0
+	xattr   *xattrState
+}
+
+// xattrState is the state of a fid from Txattrwalk or Txattrcreate
+type xattrState struct {
+	name   string // empty for the list of names
+	data   []byte
+	create bool
+	size   uint64
+	flags  uint32
+}
+
+type dirent struct {
+	qid  Qid
+	typ  uint8
+	name string
+}
+
+type conn struct {
+	server *Server
+	msize  uint32
+	fids   map[uint32]*fid
+}
+
+// ServeConn serves one client session. requests are handled in order
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	defer rw.Close()
+	c := &conn{
+		server: s,
+		msize:  s.msize,
+		fids:   make(map[uint32]*fid),
+	}
+	defer c.clunkAll()
+	r := bufio.NewReader(rw)
+	for {
+		typ, tag, body, err := ReadMessage(r, c.msize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		rtyp, resp, err := c.handle(typ, &Decoder{Buf: body})
+		if err != nil {
+			rtyp = Rlerror
+			e := &Encoder{}
+			e.U32(uint32(ToErrno(err)))
+			resp = e.Buf
+		}
+		if err := WriteMessage(rw, rtyp, tag, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) clunkAll() {
+	for id, f := range c.fids {
+		if f.handle != nil {
+			f.handle.Close()
+		}
+		delete(c.fids, id)
+	}
+}
+
+func (c *conn) getFid(id uint32) (*fid, error) {
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, EBADF
+	}
+	return f, nil
+}
+
+func (c *conn) newFid(id uint32, f *fid) error {
+	if _, ok := c.fids[id]; ok {
+		return EBADF
+	}
+	c.fids[id] = f
+	return nil
+}
+
+func join(dir string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", EINVAL
+	}
+	if dir == "." {
+		return name, nil
+	}
+	return dir + "/" + name, nil
+}
+
+func qidOf(name string, info fs.FileInfo) Qid {
+	var q Qid
+	switch {
+	case info.IsDir():
+		q.Type = QTDIR
+	case info.Mode()&fs.ModeSymlink != 0:
+		q.Type = QTSYMLINK
+	}
+	q.Version = uint32(info.ModTime().UnixNano())
+	if ext, ok := info.Sys().(fs9.ExtFileInfo); ok && ext.ID != 0 {
+		q.Path = uint64(ext.ID)
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		q.Path = h.Sum64()
+	}
+	return q
+}
+
+func (c *conn) qid(name string) (Qid, error) {
+	info, err := c.server.fs.LinkStat(name)
+	if err != nil {
+		return Qid{}, err
+	}
+	return qidOf(name, info), nil
+}
+
+func linuxMode(mode fs.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+	switch {
+	case mode&fs.ModeDir != 0:
+		ret |= sIFDIR
+	case mode&fs.ModeSymlink != 0:
+		ret |= sIFLNK
+	default:
+		ret |= sIFREG
+	}
+	if mode&fs.ModeSetuid != 0 {
+		ret |= sISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		ret |= sISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		ret |= sISVTX
+	}
+	return ret
+}
+
+// fileMode converts permission bits of a linux mode, keeping the type bits of typ
+func fileMode(mode uint32, typ fs.FileMode) fs.FileMode {
+	ret := fs.FileMode(mode&0777) | typ&fs.ModeType
+	if mode&sISUID != 0 {
+		ret |= fs.ModeSetuid
+	}
+	if mode&sISGID != 0 {
+		ret |= fs.ModeSetgid
+	}
+	if mode&sISVTX != 0 {
+		ret |= fs.ModeSticky
+	}
+	return ret
+}
+
+func (c *conn) handle(typ uint8, d *Decoder) (rtyp uint8, resp []byte, err error) {
+	e := &Encoder{}
+	fsys := c.server.fs
+
+	switch typ {
+
+	case Tversion:
+		msize := d.U32()
+		version := d.Str()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		c.clunkAll()
+		if msize < c.msize {
+			c.msize = msize
+		}
+		if version != Version {
+			version = "unknown"
+		}
+		e.U32(c.msize)
+		e.Str(version)
+		return Rversion, e.Buf, nil
+
+	case Tauth:
+		return 0, nil, EOPNOTSUPP
+
+	case Tattach:
+		id := d.U32()
+		d.U32() // afid
+		d.Str() // uname
+		d.Str() // aname
+		uid := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		qid, err := c.qid(".")
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.newFid(id, &fid{
+			name: ".",
+			uid:  int(int32(uid)),
+		}); err != nil {
+			return 0, nil, err
+		}
+		e.Qid(qid)
+		return Rattach, e.Buf, nil
+
+	case Tflush:
+		// requests are handled in order, so the flushed one is already answered
+		return Rflush, nil, nil
+
+	case Twalk:
+		oldID := d.U32()
+		f, err := c.getFid(oldID)
+		if err != nil {
+			return 0, nil, err
+		}
+		newID := d.U32()
+		n := d.U16()
+		var names []string
+		for i := 0; i < int(n); i++ {
+			names = append(names, d.Str())
+		}
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		name := f.name
+		var qids []Qid
+		for i, elem := range names {
+			var next string
+			if elem == ".." {
+				next = path.Dir(name)
+			} else {
+				next, err = join(name, elem)
+				if err != nil {
+					return 0, nil, err
+				}
+			}
+			qid, err := c.qid(next)
+			if err != nil {
+				if i == 0 {
+					return 0, nil, err
+				}
+				break
+			}
+			qids = append(qids, qid)
+			name = next
+		}
+		if len(qids) == len(names) {
+			if newID == oldID {
+				// walking to itself
+				f.name = name
+			} else if err := c.newFid(newID, &fid{
+				name: name,
+				uid:  f.uid,
+			}); err != nil {
+				return 0, nil, err
+			}
+		}
+		e.U16(uint16(len(qids)))
+		for _, qid := range qids {
+			e.Qid(qid)
+		}
+		return Rwalk, e.Buf, nil
+
+	case Tlopen:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		flags := d.U32()
+		if f.handle != nil {
+			return 0, nil, EINVAL
+		}
+		handle, err := fsys.OpenHandle(f.name, fs9.OptFlag(openFlag(flags), 0))
+		if err != nil {
+			return 0, nil, err
+		}
+		f.handle = handle
+		qid, err := c.qid(f.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.Qid(qid)
+		e.U32(c.msize - ioHeaderSize)
+		return Rlopen, e.Buf, nil
+
+	case Tlcreate:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(f.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		flags := d.U32()
+		mode := d.U32()
+		gid := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		handle, err := fsys.OpenHandle(name, fs9.OptFlag(openFlag(flags)|os.O_CREATE|os.O_EXCL, fileMode(mode, 0)))
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.setupNew(name, mode, 0, f.uid, gid); err != nil {
+			handle.Close()
+			return 0, nil, err
+		}
+		f.name = name
+		f.handle = handle
+		qid, err := c.qid(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.Qid(qid)
+		e.U32(c.msize - ioHeaderSize)
+		return Rlcreate, e.Buf, nil
+
+	case Tread:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		offset := d.U64()
+		count := d.U32()
+		if f.handle == nil && f.xattr == nil {
+			return 0, nil, EBADF
+		}
+		if max := c.msize - ioHeaderSize; count > max {
+			count = max
+		}
+		if f.xattr != nil {
+			if f.xattr.create {
+				return 0, nil, EBADF
+			}
+			data := f.xattr.data
+			if offset < uint64(len(data)) {
+				data = data[offset:]
+			} else {
+				data = nil
+			}
+			if uint64(len(data)) > uint64(count) {
+				data = data[:count]
+			}
+			e.Bytes(data)
+			return Rread, e.Buf, nil
+		}
+		buf := make([]byte, count)
+		n, err := f.handle.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return 0, nil, err
+		}
+		e.Bytes(buf[:n])
+		return Rread, e.Buf, nil
+
+	case Twrite:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		offset := d.U64()
+		data := d.Bytes()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		if f.xattr != nil {
+			if !f.xattr.create {
+				return 0, nil, EBADF
+			}
+			end := offset + uint64(len(data))
+			if end > f.xattr.size {
+				return 0, nil, ERANGE
+			}
+			if end > uint64(len(f.xattr.data)) {
+				f.xattr.data = append(f.xattr.data, make([]byte, end-uint64(len(f.xattr.data)))...)
+			}
+			copy(f.xattr.data[offset:], data)
+			e.U32(uint32(len(data)))
+			return Rwrite, e.Buf, nil
+		}
+		if f.handle == nil {
+			return 0, nil, EBADF
+		}
+		// handles opened with O_APPEND write to the end of file
+		if _, err := f.handle.Seek(int64(offset), io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		n, err := f.handle.Write(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.U32(uint32(n))
+		return Rwrite, e.Buf, nil
+
+	case Treaddir:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		offset := d.U64()
+		count := d.U32()
+		if f.handle == nil {
+			return 0, nil, EBADF
+		}
+		if offset == 0 || f.entries == nil {
+			if err := c.readDir(f); err != nil {
+				return 0, nil, err
+			}
+		}
+		data := &Encoder{}
+		for i := offset; i < uint64(len(f.entries)); i++ {
+			entry := f.entries[i]
+			if uint32(len(data.Buf)+qidSize+8+1+2+len(entry.name)) > count {
+				break
+			}
+			data.Qid(entry.qid)
+			data.U64(i + 1)
+			data.U8(entry.typ)
+			data.Str(entry.name)
+		}
+		e.Bytes(data.Buf)
+		return Rreaddir, e.Buf, nil
+
+	case Tgetattr:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		info, err := fsys.LinkStat(f.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		var uid, gid uint32
+		atime := info.ModTime()
+		blocks := uint64(info.Size()+511) / 512
+		nlink := uint64(1)
+		if ext, ok := info.Sys().(fs9.ExtFileInfo); ok {
+			uid = uint32(ext.UserID)
+			gid = uint32(ext.GroupID)
+			atime = ext.AccessTime
+			blocks = uint64(ext.Blocks)
+			if ext.Nlink > 0 {
+				nlink = uint64(ext.Nlink)
+			}
+		}
+		mtime := info.ModTime()
+		e.U64(getattrBasic)
+		e.Qid(qidOf(f.name, info))
+		e.U32(linuxMode(info.Mode()))
+		e.U32(uid)
+		e.U32(gid)
+		e.U64(nlink)
+		e.U64(0) // rdev
+		e.U64(uint64(info.Size()))
+		e.U64(4096) // blksize
+		e.U64(blocks)
+		e.U64(uint64(atime.Unix()))
+		e.U64(uint64(atime.Nanosecond()))
+		e.U64(uint64(mtime.Unix()))
+		e.U64(uint64(mtime.Nanosecond()))
+		e.U64(uint64(mtime.Unix())) // ctime
+		e.U64(uint64(mtime.Nanosecond()))
+		e.U64(0) // btime
+		e.U64(0)
+		e.U64(0) // gen
+		e.U64(0) // data version
+		return Rgetattr, e.Buf, nil
+
+	case Tsetattr:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		valid := d.U32()
+		mode := d.U32()
+		uid := d.U32()
+		gid := d.U32()
+		size := d.U64()
+		atimeSec, atimeNsec := d.U64(), d.U64()
+		mtimeSec, mtimeNsec := d.U64(), d.U64()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		info, err := fsys.LinkStat(f.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		noFollow := fs9.OptNoFollow(true)
+		if valid&setattrMode != 0 {
+			if err := fsys.ChangeMode(f.name, fileMode(mode, info.Mode()), noFollow); err != nil {
+				return 0, nil, err
+			}
+		}
+		if valid&(setattrUID|setattrGID) != 0 {
+			newUID, newGID := -1, -1
+			if valid&setattrUID != 0 {
+				newUID = int(uid)
+			}
+			if valid&setattrGID != 0 {
+				newGID = int(gid)
+			}
+			if err := fsys.ChangeOwner(f.name, newUID, newGID, noFollow); err != nil {
+				return 0, nil, err
+			}
+		}
+		if valid&setattrSize != 0 {
+			if err := fsys.Truncate(f.name, int64(size)); err != nil {
+				return 0, nil, err
+			}
+		}
+		if valid&(setattrAtime|setattrMtime) != 0 {
+			info, err := fsys.LinkStat(f.name)
+			if err != nil {
+				return 0, nil, err
+			}
+			now := time.Now()
+			mtime := info.ModTime()
+			atime := mtime
+			if ext, ok := info.Sys().(fs9.ExtFileInfo); ok {
+				atime = ext.AccessTime
+			}
+			if valid&setattrAtime != 0 {
+				atime = now
+				if valid&setattrAtimeSet != 0 {
+					atime = time.Unix(int64(atimeSec), int64(atimeNsec))
+				}
+			}
+			if valid&setattrMtime != 0 {
+				mtime = now
+				if valid&setattrMtimeSet != 0 {
+					mtime = time.Unix(int64(mtimeSec), int64(mtimeNsec))
+				}
+			}
+			if err := fsys.ChangeTimes(f.name, atime, mtime, noFollow); err != nil {
+				return 0, nil, err
+			}
+		}
+		return Rsetattr, nil, nil
+
+	case Tmkdir:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(f.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		mode := d.U32()
+		gid := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		if err := fsys.MakeDir(name); err != nil {
+			return 0, nil, err
+		}
+		if err := c.setupNew(name, mode, fs.ModeDir, f.uid, gid); err != nil {
+			return 0, nil, err
+		}
+		qid, err := c.qid(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.Qid(qid)
+		return Rmkdir, e.Buf, nil
+
+	case Tsymlink:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(f.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		target := d.Str()
+		gid := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		if err := fsys.SymLink(target, name); err != nil {
+			return 0, nil, err
+		}
+		if err := fsys.ChangeOwner(name, f.uid, int(gid), fs9.OptNoFollow(true)); err != nil {
+			return 0, nil, err
+		}
+		qid, err := c.qid(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.Qid(qid)
+		return Rsymlink, e.Buf, nil
+
+	case Tlink:
+		dir, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(dir.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := fsys.Link(f.name, name); err != nil {
+			return 0, nil, err
+		}
+		return Rlink, nil, nil
+
+	case Treadlink:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		target, err := fsys.ReadLink(f.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		e.Str(target)
+		return Rreadlink, e.Buf, nil
+
+	case Trename:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		dir, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(dir.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.rename(f.name, name); err != nil {
+			return 0, nil, err
+		}
+		return Rrename, nil, nil
+
+	case Trenameat:
+		oldDir, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		oldName, err := join(oldDir.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		newDir, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		newName, err := join(newDir.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.rename(oldName, newName); err != nil {
+			return 0, nil, err
+		}
+		return Rrenameat, nil, nil
+
+	case Tunlinkat:
+		dir, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		name, err := join(dir.name, d.Str())
+		if err != nil {
+			return 0, nil, err
+		}
+		flags := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		info, err := fsys.LinkStat(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		if flags&atRemoveDir != 0 && !info.IsDir() {
+			return 0, nil, ENOTDIR
+		}
+		if flags&atRemoveDir == 0 && info.IsDir() {
+			return 0, nil, EISDIR
+		}
+		if err := fsys.Remove(name); err != nil {
+			return 0, nil, err
+		}
+		return Runlinkat, nil, nil
+
+	case Tremove:
+		id := d.U32()
+		f, err := c.getFid(id)
+		if err != nil {
+			return 0, nil, err
+		}
+		// the fid is clunked even if the remove fails
+		if f.handle != nil {
+			f.handle.Close()
+		}
+		delete(c.fids, id)
+		if err := fsys.Remove(f.name); err != nil {
+			return 0, nil, err
+		}
+		return Rremove, nil, nil
+
+	case Tclunk:
+		id := d.U32()
+		f, err := c.getFid(id)
+		if err != nil {
+			return 0, nil, err
+		}
+		delete(c.fids, id)
+		if f.handle != nil {
+			if err := f.handle.Close(); err != nil {
+				return 0, nil, err
+			}
+		}
+		if f.xattr != nil && f.xattr.create {
+			if err := c.commitXattr(f); err != nil {
+				return 0, nil, err
+			}
+		}
+		return Rclunk, nil, nil
+
+	case Tfsync:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		if f.handle == nil {
+			return 0, nil, EBADF
+		}
+		if err := f.handle.Sync(); err != nil {
+			return 0, nil, err
+		}
+		return Rfsync, nil, nil
+
+	case Tstatfs:
+		if _, err := c.getFid(d.U32()); err != nil {
+			return 0, nil, err
+		}
+		e.U32(0x01021997) // V9FS_MAGIC
+		e.U32(4096)       // bsize
+		e.U64(1 << 32)    // blocks
+		e.U64(1 << 32)    // bfree
+		e.U64(1 << 32)    // bavail
+		e.U64(1 << 32)    // files
+		e.U64(1 << 32)    // ffree
+		e.U64(0)          // fsid
+		e.U32(255)        // namelen
+		return Rstatfs, e.Buf, nil
+
+	case Tlock:
+		if _, err := c.getFid(d.U32()); err != nil {
+			return 0, nil, err
+		}
+		// advisory locks are always granted
+		e.U8(0) // P9_LOCK_SUCCESS
+		return Rlock, e.Buf, nil
+
+	case Tgetlock:
+		if _, err := c.getFid(d.U32()); err != nil {
+			return 0, nil, err
+		}
+		d.U8()
+		start := d.U64()
+		length := d.U64()
+		procID := d.U32()
+		clientID := d.Str()
+		e.U8(2) // F_UNLCK
+		e.U64(start)
+		e.U64(length)
+		e.U32(procID)
+		e.Str(clientID)
+		return Rgetlock, e.Buf, nil
+
+	case Txattrwalk:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		newID := d.U32()
+		attr := d.Str()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		var data []byte
+		if attr == "" {
+			// names, each terminated by zero
+			attrs, err := fsys.ListXattr(f.name, fs9.OptNoFollow(true))
+			if err != nil {
+				return 0, nil, err
+			}
+			for _, attr := range attrs {
+				data = append(data, attr...)
+				data = append(data, 0)
+			}
+		} else {
+			data, err = fsys.GetXattr(f.name, attr, fs9.OptNoFollow(true))
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if err := c.newFid(newID, &fid{
+			name: f.name,
+			uid:  f.uid,
+			xattr: &xattrState{
+				name: attr,
+				data: data,
+			},
+		}); err != nil {
+			return 0, nil, err
+		}
+		e.U64(uint64(len(data)))
+		return Rxattrwalk, e.Buf, nil
+
+	case Txattrcreate:
+		f, err := c.getFid(d.U32())
+		if err != nil {
+			return 0, nil, err
+		}
+		attr := d.Str()
+		size := d.U64()
+		flags := d.U32()
+		if d.Err != nil {
+			return 0, nil, EINVAL
+		}
+		if f.handle != nil || f.xattr != nil {
+			return 0, nil, EINVAL
+		}
+		if size > maxXattrSize {
+			return 0, nil, ERANGE
+		}
+		f.xattr = &xattrState{
+			name:   attr,
+			create: true,
+			size:   size,
+			flags:  flags,
+		}
+		return Rxattrcreate, nil, nil
+
+	}
+
+	return 0, nil, ENOSYS
+}
+
+// openFlag maps linux open flags to os flags
+func openFlag(flags uint32) int {
+	var flag int
+	switch flags & oACCMODE {
+	case oRDONLY:
+		flag = os.O_RDONLY
+	case oWRONLY:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDWR
+	}
+	if flags&oTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	if flags&oAPPEND != 0 {
+		flag |= os.O_APPEND
+	}
+	return flag
+}
+
+// commitXattr sets the attribute written to the fid. a zero sized attribute is removed
+func (c *conn) commitXattr(f *fid) error {
+	x := f.xattr
+	fsys := c.server.fs
+	if x.size == 0 {
+		return fsys.RemoveXattr(f.name, x.name, fs9.OptNoFollow(true))
+	}
+	if uint64(len(x.data)) != x.size {
+		return EINVAL
+	}
+	return fsys.SetXattr(f.name, x.name, x.data, int(x.flags), fs9.OptNoFollow(true))
+}
+
+// setupNew applies mode and owner to a newly created file
+func (c *conn) setupNew(name string, mode uint32, typ fs.FileMode, uid int, gid uint32) error {
+	fsys := c.server.fs
+	if err := fsys.ChangeMode(name, fileMode(mode, typ)); err != nil {
+		return err
+	}
+	if err := fsys.ChangeOwner(name, uid, int(gid)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// rename renames a file and updates fids referring to it or its descendants
+func (c *conn) rename(oldName, newName string) error {
+	if err := c.server.fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	for _, f := range c.fids {
+		if f.name == oldName {
+			f.name = newName
+		} else if strings.HasPrefix(f.name, oldName+"/") {
+			f.name = newName + strings.TrimPrefix(f.name, oldName)
+		}
+	}
+	return nil
+}
+
+func (c *conn) readDir(f *fid) error {
+	fsys := c.server.fs
+	entries, err := fs.ReadDir(fsys, f.name)
+	if err != nil {
+		return err
+	}
+	f.entries = f.entries[:0]
+	for _, special := range []string{".", ".."} {
+		name := f.name
+		if special == ".." {
+			name = path.Dir(f.name)
+		}
+		qid, err := c.qid(name)
+		if err != nil {
+			return err
+		}
+		f.entries = append(f.entries, dirent{
+			qid:  qid,
+			typ:  dtDir,
+			name: special,
+		})
+	}
+	for _, entry := range entries {
+		name, err := join(f.name, entry.Name())
+		if err != nil {
+			return err
+		}
+		info, err := fsys.LinkStat(name)
+		if err != nil {
+			return err
+		}
+		typ := uint8(dtReg)
+		switch {
+		case info.IsDir():
+			typ = dtDir
+		case info.Mode()&fs.ModeSymlink != 0:
+			typ = dtLnk
+		}
+		f.entries = append(f.entries, dirent{
+			qid:  qidOf(name, info),
+			typ:  typ,
+			name: entry.Name(),
+		})
+	}
+	return nil
+}
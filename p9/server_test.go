@@ -0,0 +1,645 @@
+package p9
+
+import (
+	"io/fs"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/reusee/fs9"
+)
+
+// testClient is a minimal 9P2000.L client
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+func newTestClient(t *testing.T) (*testClient, *fs9.MemFS) {
+	fsys := fs9.NewMemFS()
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(fsys).ServeConn(serverConn)
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	c := &testClient{
+		t:    t,
+		conn: clientConn,
+	}
+	return c, fsys
+}
+
+// rpc sends a request and returns the response body. Rlerror is returned as Errno
+func (c *testClient) rpc(typ uint8, fn func(e *Encoder)) (*Decoder, error) {
+	c.t.Helper()
+	e := &Encoder{}
+	fn(e)
+	c.tag++
+	if err := WriteMessage(c.conn, typ, c.tag, e.Buf); err != nil {
+		c.t.Fatal(err)
+	}
+	rtyp, tag, body, err := ReadMessage(c.conn, defaultMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if tag != c.tag {
+		c.t.Fatalf("bad tag %d", tag)
+	}
+	d := &Decoder{Buf: body}
+	if rtyp == Rlerror {
+		return nil, Errno(d.U32())
+	}
+	if rtyp != typ+1 {
+		c.t.Fatalf("bad response type %d for %d", rtyp, typ)
+	}
+	return d, nil
+}
+
+func (c *testClient) must(typ uint8, fn func(e *Encoder)) *Decoder {
+	c.t.Helper()
+	d, err := c.rpc(typ, fn)
+	if err != nil {
+		c.t.Fatalf("request %d: %v", typ, err)
+	}
+	return d
+}
+
+func (c *testClient) expectErrno(errno Errno, typ uint8, fn func(e *Encoder)) {
+	c.t.Helper()
+	_, err := c.rpc(typ, fn)
+	if err != errno {
+		c.t.Fatalf("request %d: expected %v, got %v", typ, errno, err)
+	}
+}
+
+func (c *testClient) attach(fid uint32) {
+	c.t.Helper()
+	d := c.must(Tversion, func(e *Encoder) {
+		e.U32(8192)
+		e.Str(Version)
+	})
+	if msize, version := d.U32(), d.Str(); msize != 8192 || version != Version {
+		c.t.Fatalf("bad version %d %s", msize, version)
+	}
+	c.must(Tattach, func(e *Encoder) {
+		e.U32(fid)
+		e.U32(NoFid)
+		e.Str("user")
+		e.Str("")
+		e.U32(1000)
+	})
+}
+
+func (c *testClient) walk(fid, newFid uint32, names ...string) []Qid {
+	c.t.Helper()
+	d := c.must(Twalk, func(e *Encoder) {
+		e.U32(fid)
+		e.U32(newFid)
+		e.U16(uint16(len(names)))
+		for _, name := range names {
+			e.Str(name)
+		}
+	})
+	n := d.U16()
+	var qids []Qid
+	for i := 0; i < int(n); i++ {
+		qids = append(qids, d.Qid())
+	}
+	return qids
+}
+
+func (c *testClient) clunk(fid uint32) {
+	c.t.Helper()
+	c.must(Tclunk, func(e *Encoder) {
+		e.U32(fid)
+	})
+}
+
+func (c *testClient) readDir(fid uint32) map[string]uint8 {
+	c.t.Helper()
+	ret := make(map[string]uint8)
+	offset := uint64(0)
+	for {
+		d := c.must(Treaddir, func(e *Encoder) {
+			e.U32(fid)
+			e.U64(offset)
+			e.U32(64) // small count to exercise continuation
+		})
+		data := &Decoder{Buf: d.Bytes()}
+		if len(data.Buf) == 0 {
+			return ret
+		}
+		for len(data.Buf) > 0 {
+			data.Qid()
+			offset = data.U64()
+			typ := data.U8()
+			ret[data.Str()] = typ
+		}
+		if data.Err != nil {
+			c.t.Fatal(data.Err)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	c, fsys := newTestClient(t)
+	c.attach(1)
+
+	// create and write
+	c.walk(1, 2)
+	d := c.must(Tlcreate, func(e *Encoder) {
+		e.U32(2)
+		e.Str("foo")
+		e.U32(0x2) // O_RDWR
+		e.U32(0640)
+		e.U32(100)
+	})
+	if qid := d.Qid(); qid.Type != QTFILE {
+		t.Fatalf("bad qid %+v", qid)
+	}
+	if iounit := d.U32(); iounit != 8192-ioHeaderSize {
+		t.Fatalf("bad iounit %d", iounit)
+	}
+	d = c.must(Twrite, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.Bytes([]byte("hello, world"))
+	})
+	if n := d.U32(); n != 12 {
+		t.Fatalf("bad write count %d", n)
+	}
+	d = c.must(Tread, func(e *Encoder) {
+		e.U32(2)
+		e.U64(7)
+		e.U32(100)
+	})
+	if data := string(d.Bytes()); data != "world" {
+		t.Fatalf("bad read %q", data)
+	}
+	c.must(Tfsync, func(e *Encoder) {
+		e.U32(2)
+	})
+	c.clunk(2)
+	content, err := fs.ReadFile(fsys, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello, world" {
+		t.Fatalf("bad content %q", content)
+	}
+
+	// getattr
+	qids := c.walk(1, 2, "foo")
+	if len(qids) != 1 {
+		t.Fatalf("bad walk %v", qids)
+	}
+	d = c.must(Tgetattr, func(e *Encoder) {
+		e.U32(2)
+		e.U64(getattrBasic)
+	})
+	d.U64()
+	if qid := d.Qid(); qid != qids[0] {
+		t.Fatalf("bad qid %+v", qid)
+	}
+	mode, uid, gid := d.U32(), d.U32(), d.U32()
+	if mode != sIFREG|0640 || uid != 1000 || gid != 100 {
+		t.Fatalf("bad attr %o %d %d", mode, uid, gid)
+	}
+	d.U64() // nlink
+	d.U64() // rdev
+	if size := d.U64(); size != 12 {
+		t.Fatalf("bad size %d", size)
+	}
+
+	// setattr
+	mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.must(Tsetattr, func(e *Encoder) {
+		e.U32(2)
+		e.U32(setattrMode | setattrSize | setattrMtime | setattrMtimeSet)
+		e.U32(0600)
+		e.U32(0)
+		e.U32(0)
+		e.U64(5)
+		e.U64(0)
+		e.U64(0)
+		e.U64(uint64(mtime.Unix()))
+		e.U64(0)
+	})
+	info, err := fsys.Stat("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0600 || info.Size() != 5 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("bad stat %v %d %v", info.Mode(), info.Size(), info.ModTime())
+	}
+
+	// open with append
+	c.must(Tlopen, func(e *Encoder) {
+		e.U32(2)
+		e.U32(0x1 | oAPPEND) // O_WRONLY
+	})
+	c.must(Twrite, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.Bytes([]byte("!"))
+	})
+	c.clunk(2)
+	content, err = fs.ReadFile(fsys, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello!" {
+		t.Fatalf("bad content %q", content)
+	}
+
+	// concurrent appends
+	for _, fid := range []uint32{5, 6} {
+		c.walk(1, fid, "foo")
+		c.must(Tlopen, func(e *Encoder) {
+			e.U32(fid)
+			e.U32(0x1 | oAPPEND) // O_WRONLY
+		})
+	}
+	for i, fid := range []uint32{5, 6, 5} {
+		c.must(Twrite, func(e *Encoder) {
+			e.U32(fid)
+			e.U64(0)
+			e.Bytes([]byte{'a' + byte(i)})
+		})
+	}
+	c.clunk(5)
+	c.clunk(6)
+	content, err = fs.ReadFile(fsys, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello!abc" {
+		t.Fatalf("bad content %q", content)
+	}
+
+	// access modes
+	c.walk(1, 2, "foo")
+	c.must(Tlopen, func(e *Encoder) {
+		e.U32(2)
+		e.U32(0) // O_RDONLY
+	})
+	c.expectErrno(EACCES, Twrite, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.Bytes([]byte("!"))
+	})
+	c.clunk(2)
+	c.walk(1, 2, "foo")
+	c.must(Tlopen, func(e *Encoder) {
+		e.U32(2)
+		e.U32(0x1) // O_WRONLY
+	})
+	c.expectErrno(EACCES, Tread, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.U32(10)
+	})
+	c.clunk(2)
+
+	// mkdir, symlink, link
+	d = c.must(Tmkdir, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir")
+		e.U32(0755)
+		e.U32(0)
+	})
+	if qid := d.Qid(); qid.Type != QTDIR {
+		t.Fatalf("bad qid %+v", qid)
+	}
+	c.walk(1, 3, "dir")
+	c.must(Tsymlink, func(e *Encoder) {
+		e.U32(3)
+		e.Str("link")
+		e.Str("../foo")
+		e.U32(0)
+	})
+	c.walk(1, 2, "foo")
+	c.must(Tlink, func(e *Encoder) {
+		e.U32(3)
+		e.U32(2)
+		e.Str("hard")
+	})
+	c.clunk(2)
+	c.walk(3, 4, "link")
+	d = c.must(Treadlink, func(e *Encoder) {
+		e.U32(4)
+	})
+	if target := d.Str(); target != "../foo" {
+		t.Fatalf("bad target %q", target)
+	}
+	c.clunk(4)
+
+	// readdir
+	c.must(Tlopen, func(e *Encoder) {
+		e.U32(3)
+		e.U32(0)
+	})
+	entries := c.readDir(3)
+	if len(entries) != 4 ||
+		entries["."] != dtDir ||
+		entries[".."] != dtDir ||
+		entries["link"] != dtLnk ||
+		entries["hard"] != dtReg {
+		t.Fatalf("bad entries %v", entries)
+	}
+	c.clunk(3)
+
+	// walk
+	qids = c.walk(1, 5, "dir", "..", "dir", "hard")
+	if len(qids) != 4 || qids[2] != qids[0] || qids[3].Type != QTFILE {
+		t.Fatalf("bad walk %v", qids)
+	}
+	c.walk(5, 5) // clone to itself
+	c.clunk(5)
+	// partial walk returns the walked prefix without creating the fid
+	qids = c.walk(1, 5, "dir", "nope")
+	if len(qids) != 1 {
+		t.Fatalf("bad walk %v", qids)
+	}
+	c.expectErrno(EBADF, Tclunk, func(e *Encoder) {
+		e.U32(5)
+	})
+
+	// renameat keeps fids valid
+	c.walk(1, 6, "dir", "hard")
+	c.must(Trenameat, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir")
+		e.U32(1)
+		e.Str("dir2")
+	})
+	d = c.must(Tgetattr, func(e *Encoder) {
+		e.U32(6)
+		e.U64(getattrBasic)
+	})
+	if d.U64(); d.Qid().Type != QTFILE {
+		t.Fatal("bad qid")
+	}
+	if _, err := fsys.Stat("dir2/hard"); err != nil {
+		t.Fatal(err)
+	}
+
+	// unlinkat
+	c.expectErrno(EISDIR, Tunlinkat, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir2")
+		e.U32(0)
+	})
+	c.expectErrno(ENOTDIR, Tunlinkat, func(e *Encoder) {
+		e.U32(1)
+		e.Str("foo")
+		e.U32(atRemoveDir)
+	})
+	c.expectErrno(ENOTEMPTY, Tunlinkat, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir2")
+		e.U32(atRemoveDir)
+	})
+	c.must(Tunlinkat, func(e *Encoder) {
+		e.U32(1)
+		e.Str("foo")
+		e.U32(0)
+	})
+
+	// remove clunks the fid
+	c.must(Tremove, func(e *Encoder) {
+		e.U32(6)
+	})
+	c.expectErrno(EBADF, Tclunk, func(e *Encoder) {
+		e.U32(6)
+	})
+	if _, err := fsys.Stat("dir2/hard"); !is(err, fs9.ErrFileNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// statfs
+	d = c.must(Tstatfs, func(e *Encoder) {
+		e.U32(1)
+	})
+	if typ := d.U32(); typ != 0x01021997 {
+		t.Fatalf("bad type %x", typ)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.attach(1)
+
+	// unknown fid
+	c.expectErrno(EBADF, Tgetattr, func(e *Encoder) {
+		e.U32(42)
+		e.U64(getattrBasic)
+	})
+	// fid in use
+	c.expectErrno(EBADF, Tattach, func(e *Encoder) {
+		e.U32(1)
+		e.U32(NoFid)
+		e.Str("user")
+		e.Str("")
+		e.U32(0)
+	})
+	// not found
+	c.expectErrno(ENOENT, Twalk, func(e *Encoder) {
+		e.U32(1)
+		e.U32(2)
+		e.U16(1)
+		e.Str("nope")
+	})
+	// bad names
+	c.expectErrno(EINVAL, Tmkdir, func(e *Encoder) {
+		e.U32(1)
+		e.Str("a/b")
+		e.U32(0755)
+		e.U32(0)
+	})
+	// existed
+	c.must(Tmkdir, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir")
+		e.U32(0755)
+		e.U32(0)
+	})
+	c.expectErrno(EEXIST, Tmkdir, func(e *Encoder) {
+		e.U32(1)
+		e.Str("dir")
+		e.U32(0755)
+		e.U32(0)
+	})
+	c.walk(1, 2)
+	c.expectErrno(EEXIST, Tlcreate, func(e *Encoder) {
+		e.U32(2)
+		e.Str("dir")
+		e.U32(0)
+		e.U32(0644)
+		e.U32(0)
+	})
+	// read without open
+	c.expectErrno(EBADF, Tread, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.U32(10)
+	})
+	// not supported
+	c.expectErrno(EOPNOTSUPP, Tauth, func(e *Encoder) {
+		e.U32(3)
+		e.Str("user")
+		e.Str("")
+		e.U32(0)
+	})
+	c.expectErrno(ENOSYS, Tmknod, func(e *Encoder) {})
+	// short message
+	c.expectErrno(EINVAL, Twalk, func(e *Encoder) {
+		e.U32(1)
+	})
+	// version resets the session
+	c.must(Tversion, func(e *Encoder) {
+		e.U32(8192)
+		e.Str(Version)
+	})
+	c.expectErrno(EBADF, Tclunk, func(e *Encoder) {
+		e.U32(1)
+	})
+}
+
+func TestToErrno(t *testing.T) {
+	for err, errno := range map[error]Errno{
+		fs9.ErrFileNotFound:  ENOENT,
+		fs9.ErrFileExisted:   EEXIST,
+		fs9.ErrDirNotEmpty:   ENOTEMPTY,
+		fs9.ErrInvalidName:   EINVAL,
+		fs9.ErrCannotLink:    EPERM,
+		fs9.ErrClosed:        EBADF,
+		fs9.ErrXattrNotFound: ENODATA,
+		fs9.ErrQuotaExceeded: EDQUOT,
+		fs9.ErrCrossDevice:   EXDEV,
+		fs9.ErrNotSupported:  EOPNOTSUPP,
+		fs9.ErrNotDir:        ENOTDIR,
+		fs9.ErrIsDir:         EISDIR,
+		fs9.ErrTooManyLinks:  ELOOP,
+		EXDEV:                EXDEV,
+		ErrBadMessage:        EIO,
+	} {
+		if got := ToErrno(we(err)); got != errno {
+			t.Fatalf("%v: expected %v, got %v", err, errno, got)
+		}
+	}
+}
+
+func TestServerXattr(t *testing.T) {
+	c, fsys := newTestClient(t)
+	c.attach(1)
+	h, err := fsys.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	// create
+	c.walk(1, 2, "foo")
+	c.must(Txattrcreate, func(e *Encoder) {
+		e.U32(2)
+		e.Str("user.foo")
+		e.U64(3)
+		e.U32(0)
+	})
+	c.must(Twrite, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.Bytes([]byte("bar"))
+	})
+	c.clunk(2)
+	value, err := fsys.GetXattr("foo", "user.foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bar" {
+		t.Fatalf("bad value %q", value)
+	}
+
+	// get
+	c.walk(1, 2, "foo")
+	d := c.must(Txattrwalk, func(e *Encoder) {
+		e.U32(2)
+		e.U32(3)
+		e.Str("user.foo")
+	})
+	if size := d.U64(); size != 3 {
+		t.Fatalf("bad size %d", size)
+	}
+	d = c.must(Tread, func(e *Encoder) {
+		e.U32(3)
+		e.U64(1)
+		e.U32(100)
+	})
+	if data := string(d.Bytes()); data != "ar" {
+		t.Fatalf("bad read %q", data)
+	}
+	c.clunk(3)
+
+	// list
+	d = c.must(Txattrwalk, func(e *Encoder) {
+		e.U32(2)
+		e.U32(3)
+		e.Str("")
+	})
+	if size := d.U64(); size != 9 {
+		t.Fatalf("bad size %d", size)
+	}
+	d = c.must(Tread, func(e *Encoder) {
+		e.U32(3)
+		e.U64(0)
+		e.U32(100)
+	})
+	if data := string(d.Bytes()); data != "user.foo\x00" {
+		t.Fatalf("bad read %q", data)
+	}
+	c.clunk(3)
+
+	// not found
+	c.expectErrno(ENODATA, Txattrwalk, func(e *Encoder) {
+		e.U32(2)
+		e.U32(3)
+		e.Str("user.bar")
+	})
+
+	// create existing
+	c.must(Txattrcreate, func(e *Encoder) {
+		e.U32(2)
+		e.Str("user.foo")
+		e.U64(1)
+		e.U32(1) // XATTR_CREATE
+	})
+	c.must(Twrite, func(e *Encoder) {
+		e.U32(2)
+		e.U64(0)
+		e.Bytes([]byte("x"))
+	})
+	c.expectErrno(EEXIST, Tclunk, func(e *Encoder) {
+		e.U32(2)
+	})
+
+	// remove by zero size
+	c.walk(1, 2, "foo")
+	c.must(Txattrcreate, func(e *Encoder) {
+		e.U32(2)
+		e.Str("user.foo")
+		e.U64(0)
+		e.U32(0)
+	})
+	c.clunk(2)
+	if _, err := fsys.GetXattr("foo", "user.foo"); !is(err, fs9.ErrXattrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
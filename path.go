@@ -18,3 +18,19 @@ func NameToPath(name string) (ret []string, err error) {
 	}
 	return strings.Split(name, "/"), nil
 }
+
+// maxLinkDepth limits symlinks followed in resolving a path
+const maxLinkDepth = 40
+
+// linkTargetToPath splits a symlink target. absolute targets are resolved from the root, others from the dir of the symlink.
+// ".." parts are kept
+func linkTargetToPath(target string) (path []string, abs bool) {
+	abs = strings.HasPrefix(target, "/")
+	for _, name := range strings.Split(target, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		path = append(path, name)
+	}
+	return
+}
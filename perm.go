@@ -0,0 +1,309 @@
+package fs9
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+// Credentials identifies the caller of operations for permission checks. user id 0 bypasses all checks
+type Credentials struct {
+	UserID  int
+	GroupID int
+	// supplementary groups
+	Groups []int
+}
+
+const (
+	permRead  fs.FileMode = 4
+	permWrite fs.FileMode = 2
+	permExec  fs.FileMode = 1
+)
+
+func (c *Credentials) inGroup(gid int) bool {
+	if c.GroupID == gid {
+		return true
+	}
+	for _, id := range c.Groups {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPerm checks the read, write or execute bits of file against the credentials of the batch
+func (m *MemFSReadBatch) checkPerm(file *File, perm fs.FileMode) error {
+	c := m.cred
+	if c == nil || c.UserID == 0 {
+		return nil
+	}
+	mode := file.Mode.Perm()
+	switch {
+	case c.UserID == file.UserID:
+		mode >>= 6
+	case c.inGroup(file.GroupID):
+		mode >>= 3
+	}
+	if mode&perm != perm {
+		return we.With(
+			e4.Info("mode %v, uid %d, gid %d", file.Mode, file.UserID, file.GroupID),
+		)(ErrNoPermission)
+	}
+	return nil
+}
+
+// checkOwner checks that the credentials of the batch own file
+func (m *MemFSReadBatch) checkOwner(file *File) error {
+	c := m.cred
+	if c == nil || c.UserID == 0 || c.UserID == file.UserID {
+		return nil
+	}
+	return we.With(
+		e4.Info("not owner"),
+	)(ErrNoPermission)
+}
+
+// checkSticky checks that the entry of file in dir can be removed or replaced
+func (m *MemFSReadBatch) checkSticky(dir *File, file *File) error {
+	c := m.cred
+	if c == nil || c.UserID == 0 || dir.Mode&fs.ModeSticky == 0 {
+		return nil
+	}
+	if c.UserID == dir.UserID || c.UserID == file.UserID {
+		return nil
+	}
+	return we.With(
+		e4.Info("sticky dir"),
+	)(ErrNoPermission)
+}
+
+func (m *MemFSReadBatch) ownerOnly(fn func(*File) error) func(*File) error {
+	return func(file *File) error {
+		if err := m.checkOwner(file); err != nil {
+			return err
+		}
+		return fn(file)
+	}
+}
+
+func (m *MemFSReadBatch) writableOnly(fn func(*File) error) func(*File) error {
+	return func(file *File) error {
+		if err := m.checkPerm(file, permWrite); err != nil {
+			return err
+		}
+		return fn(file)
+	}
+}
+
+// chownAllowed checks that the owner of file can be changed to uid and gid. only root can change the user,
+// owners can change the group to one of their groups
+func (m *MemFSReadBatch) chownAllowed(uid, gid int, fn func(*File) error) func(*File) error {
+	return func(file *File) error {
+		c := m.cred
+		if c != nil && c.UserID != 0 {
+			if uid != -1 && uid != file.UserID {
+				return we.With(
+					e4.Info("cannot change user"),
+				)(ErrNoPermission)
+			}
+			if err := m.checkOwner(file); err != nil {
+				return err
+			}
+			if gid != -1 && gid != file.GroupID && !c.inGroup(gid) {
+				return we.With(
+					e4.Info("not in group %d", gid),
+				)(ErrNoPermission)
+			}
+		}
+		return fn(file)
+	}
+}
+
+// CredentialsFS is a view of MemFS that checks permissions of operations against credentials
+type CredentialsFS struct {
+	fs   *MemFS
+	cred Credentials
+}
+
+var _ FS = new(CredentialsFS)
+
+// WithCredentials returns a view of m that operates as cred
+func (m *MemFS) WithCredentials(cred Credentials) *CredentialsFS {
+	return &CredentialsFS{
+		fs:   m,
+		cred: cred,
+	}
+}
+
+func (c *CredentialsFS) write(fn func(batch *MemFSWriteBatch) error) error {
+	return c.fs.write(func(batch *MemFSWriteBatch) error {
+		batch.cred = &c.cred
+		return fn(batch)
+	})
+}
+
+func (c *CredentialsFS) read(fn func(batch *MemFSReadBatch) error) (err error) {
+	batch, done := c.fs.NewReadBatch()
+	defer done(&err)
+	batch.cred = &c.cred
+	return fn(batch)
+}
+
+func (c *CredentialsFS) Open(name string) (fs.File, error) {
+	return c.OpenHandle(name, OptFlag(os.O_RDONLY, 0))
+}
+
+func (c *CredentialsFS) OpenHandle(name string, options ...OpenOption) (handle Handle, err error) {
+	err = c.write(func(batch *MemFSWriteBatch) (err error) {
+		handle, err = batch.OpenHandle(name, options...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fs.retain(handle.(*MemHandle)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *CredentialsFS) Create(name string) (handle Handle, err error) {
+	err = c.write(func(batch *MemFSWriteBatch) (err error) {
+		handle, err = batch.Create(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fs.retain(handle.(*MemHandle)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *CredentialsFS) MakeDir(p string) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.MakeDir(p)
+	})
+}
+
+func (c *CredentialsFS) MakeDirAll(p string) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.MakeDirAll(p)
+	})
+}
+
+func (c *CredentialsFS) Remove(name string, options ...RemoveOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.Remove(name, options...)
+	})
+}
+
+func (c *CredentialsFS) Rename(oldname, newname string, options ...RenameOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.Rename(oldname, newname, options...)
+	})
+}
+
+func (c *CredentialsFS) Link(oldname, newname string) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.Link(oldname, newname)
+	})
+}
+
+func (c *CredentialsFS) SymLink(oldname, newname string) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.SymLink(oldname, newname)
+	})
+}
+
+func (c *CredentialsFS) ChangeMode(name string, mode fs.FileMode, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeMode(name, mode, options...)
+	})
+}
+
+func (c *CredentialsFS) ChangeOwner(name string, uid, gid int, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeOwner(name, uid, gid, options...)
+	})
+}
+
+func (c *CredentialsFS) ChangeTimes(name string, atime, mtime time.Time, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeTimes(name, atime, mtime, options...)
+	})
+}
+
+func (c *CredentialsFS) Truncate(name string, size int64) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.Truncate(name, size)
+	})
+}
+
+// ChangeCodec sets the codec of a file, see MemFS.ChangeCodec
+func (c *CredentialsFS) ChangeCodec(name string, codec string, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.ChangeCodec(name, codec, options...)
+	})
+}
+
+func (c *CredentialsFS) GetXattr(name string, attr string, options ...ChangeOption) (value []byte, err error) {
+	err = c.read(func(batch *MemFSReadBatch) (err error) {
+		value, err = batch.GetXattr(name, attr, options...)
+		return
+	})
+	return
+}
+
+func (c *CredentialsFS) ListXattr(name string, options ...ChangeOption) (attrs []string, err error) {
+	err = c.read(func(batch *MemFSReadBatch) (err error) {
+		attrs, err = batch.ListXattr(name, options...)
+		return
+	})
+	return
+}
+
+func (c *CredentialsFS) SetXattr(name string, attr string, value []byte, flag int, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.SetXattr(name, attr, value, flag, options...)
+	})
+}
+
+func (c *CredentialsFS) RemoveXattr(name string, attr string, options ...ChangeOption) error {
+	return c.write(func(batch *MemFSWriteBatch) error {
+		return batch.RemoveXattr(name, attr, options...)
+	})
+}
+
+func (c *CredentialsFS) Stat(name string) (info fs.FileInfo, err error) {
+	err = c.read(func(batch *MemFSReadBatch) (err error) {
+		info, err = batch.Stat(name)
+		return
+	})
+	return
+}
+
+func (c *CredentialsFS) LinkStat(name string) (info fs.FileInfo, err error) {
+	err = c.read(func(batch *MemFSReadBatch) (err error) {
+		info, err = batch.LinkStat(name)
+		return
+	})
+	return
+}
+
+func (c *CredentialsFS) ReadLink(name string) (link string, err error) {
+	err = c.read(func(batch *MemFSReadBatch) (err error) {
+		link, err = batch.ReadLink(name)
+		return
+	})
+	return
+}
+
+// Snapshot returns a view of a snapshot of the MemFS
+func (c *CredentialsFS) Snapshot() FS {
+	return c.fs.Snapshot().(*MemFS).WithCredentials(c.cred)
+}
@@ -0,0 +1,139 @@
+package fs9
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+func TestCredentialsFS(t *testing.T) {
+	testFS(t, func() FS {
+		return NewMemFS().WithCredentials(Credentials{})
+	})
+}
+
+func TestPermissions(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	root := m.WithCredentials(Credentials{})
+	alice := m.WithCredentials(Credentials{
+		UserID:  1000,
+		GroupID: 1000,
+		Groups:  []int{42},
+	})
+	bob := m.WithCredentials(Credentials{
+		UserID:  1001,
+		GroupID: 1001,
+	})
+	denied := func(err error) bool {
+		return is(err, ErrNoPermission)
+	}
+
+	ce(root.ChangeMode(".", fs.ModeDir|0755))
+	ce(root.MakeDir("home"))
+	ce(root.ChangeOwner("home", 1000, 1000))
+	ce(root.ChangeMode("home", fs.ModeDir|0755))
+
+	// create
+	_, err := alice.Create("foo")
+	eq(denied(err), true)
+	err = alice.MakeDir("foo")
+	eq(denied(err), true)
+	h, err := alice.Create("home/a")
+	ce(err)
+	ce(h.Close())
+	stat, err := alice.Stat("home/a")
+	ce(err)
+	eq(
+		stat.Sys().(ExtFileInfo).UserID, 1000,
+		stat.Sys().(ExtFileInfo).GroupID, 1000,
+	)
+	_, err = bob.Create("home/b")
+	eq(denied(err), true)
+	ce(alice.MakeDirAll("home/d"))
+	ce(bob.MakeDirAll("home/d"))
+
+	// read and write
+	ce(alice.ChangeMode("home/a", 0644))
+	h2, err := bob.Open("home/a")
+	ce(err)
+	_, err = h2.(Handle).Write([]byte("foo"))
+	eq(denied(err), true)
+	_, err = bob.OpenHandle("home/a")
+	eq(denied(err), true)
+	ce(alice.ChangeMode("home/a", 0600))
+	_, err = bob.Open("home/a")
+	eq(denied(err), true)
+
+	// owner only
+	eq(
+		denied(bob.ChangeMode("home/a", 0666)), true,
+		denied(bob.ChangeTimes("home/a", time.Now(), time.Now())), true,
+		denied(bob.ChangeOwner("home/a", -1, 1001)), true,
+		denied(alice.ChangeOwner("home/a", 1001, -1)), true,
+		denied(alice.ChangeOwner("home/a", -1, 99)), true,
+	)
+	ce(alice.ChangeOwner("home/a", -1, 42))
+	ce(alice.ChangeTimes("home/a", time.Now(), time.Now()))
+	ce(root.ChangeOwner("home/a", 1001, -1))
+	ce(bob.ChangeMode("home/a", 0644))
+
+	// extended attributes
+	ce(bob.SetXattr("home/a", "user.foo", []byte("foo"), 0))
+	ce(bob.SetXattr("home/a", "security.foo", []byte("foo"), 0))
+	ce(root.SetXattr("home/a", "trusted.foo", []byte("foo"), 0))
+	_, err = alice.GetXattr("home/a", "user.foo")
+	ce(err)
+	_, err = alice.GetXattr("home/a", "security.foo")
+	ce(err)
+	_, err = alice.GetXattr("home/a", "trusted.foo")
+	eq(denied(err), true)
+	eq(
+		denied(alice.SetXattr("home/a", "user.foo", nil, 0)), true,
+		denied(alice.SetXattr("home/a", "security.foo", nil, 0)), true,
+		denied(bob.SetXattr("home/a", "trusted.foo", nil, 0)), true,
+		denied(alice.RemoveXattr("home/a", "user.foo")), true,
+	)
+	attrs, err := alice.ListXattr("home/a")
+	ce(err)
+	eq(attrs, []string{"security.foo", "user.foo"})
+	attrs, err = root.ListXattr("home/a")
+	ce(err)
+	eq(attrs, []string{"security.foo", "trusted.foo", "user.foo"})
+
+	// lookup
+	ce(alice.ChangeMode("home", fs.ModeDir|0700))
+	_, err = bob.Stat("home/a")
+	eq(denied(err), true)
+	_, err = root.Stat("home/a")
+	ce(err)
+	ce(alice.ChangeMode("home", fs.ModeDir|0755))
+
+	// remove and rename
+	eq(
+		denied(bob.Remove("home/a")), true,
+		denied(bob.Rename("home/a", "home/b")), true,
+	)
+	ce(alice.Rename("home/a", "home/b"))
+	ce(alice.Remove("home/b"))
+
+	// sticky
+	ce(root.MakeDir("tmp"))
+	ce(root.ChangeMode("tmp", fs.ModeDir|fs.ModeSticky|0777))
+	h, err = alice.Create("tmp/a")
+	ce(err)
+	ce(h.Close())
+	h, err = bob.Create("tmp/b")
+	ce(err)
+	ce(h.Close())
+	eq(
+		denied(bob.Remove("tmp/a")), true,
+		denied(bob.Rename("tmp/a", "tmp/c")), true,
+	)
+	ce(bob.Rename("tmp/b", "tmp/c"))
+	ce(alice.Remove("tmp/a"))
+	ce(root.Remove("tmp/c"))
+}
@@ -0,0 +1,332 @@
+package fs9
+
+import "github.com/reusee/e4"
+
+// Quota limits space and file count. space is the allocated content, holes are not counted. zero fields are not limited
+type Quota struct {
+	Bytes int64
+	Files int64
+}
+
+// Usage is the space and file count charged to a quota. files are charged to the FS,
+// the owning user and group, and the dir quota of their project
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+func (u Usage) add(u2 Usage) Usage {
+	return Usage{
+		Bytes: u.Bytes + u2.Bytes,
+		Files: u.Files + u2.Files,
+	}
+}
+
+// exceeds reports whether u is over quota q, for fields increased by delta
+func (u Usage) exceeds(q Quota, delta Usage) bool {
+	return (q.Bytes > 0 && delta.Bytes > 0 && u.Bytes > q.Bytes) ||
+		(q.Files > 0 && delta.Files > 0 && u.Files > q.Files)
+}
+
+type quotaKind uint8
+
+const (
+	quotaFS quotaKind = iota
+	quotaUser
+	quotaGroup
+	quotaDir
+)
+
+type quotaKey struct {
+	kind quotaKind
+	id   uint64
+}
+
+type QuotaOption func(*quotaSpec)
+
+type quotaSpec struct {
+	key quotaKey
+	dir string
+}
+
+// OptQuotaUser selects the quota of files owned by user id
+func OptQuotaUser(uid int) QuotaOption {
+	return func(spec *quotaSpec) {
+		spec.key = quotaKey{kind: quotaUser, id: uint64(uid)}
+	}
+}
+
+// OptQuotaGroup selects the quota of files owned by group id
+func OptQuotaGroup(gid int) QuotaOption {
+	return func(spec *quotaSpec) {
+		spec.key = quotaKey{kind: quotaGroup, id: uint64(gid)}
+	}
+}
+
+// OptQuotaDir selects the quota of files in the dir tree
+func OptQuotaDir(name string) QuotaOption {
+	return func(spec *quotaSpec) {
+		spec.key = quotaKey{kind: quotaDir}
+		spec.dir = name
+	}
+}
+
+func usageOf(file *File) Usage {
+	if file == nil {
+		return Usage{}
+	}
+	u := Usage{
+		Files: 1,
+	}
+	if !file.IsDir {
+		// holes are not charged
+		u.Bytes = file.Content.Allocated()
+	}
+	return u
+}
+
+func quotaKeysOf(file *File) []quotaKey {
+	if file == nil {
+		return nil
+	}
+	keys := []quotaKey{
+		{kind: quotaFS},
+		{kind: quotaUser, id: uint64(file.UserID)},
+		{kind: quotaGroup, id: uint64(file.GroupID)},
+	}
+	if file.Project != 0 {
+		keys = append(keys, quotaKey{kind: quotaDir, id: uint64(file.Project)})
+	}
+	return keys
+}
+
+// chargeUsage charges the change of file from old to new to the batch, and checks quotas.
+// usage deltas are not modified in place, so savepoints can restore them
+func (m *MemFSWriteBatch) chargeUsage(old, new *File) error {
+	if m.usage == nil {
+		return nil
+	}
+	changes := make(map[quotaKey]Usage)
+	oldUsage := usageOf(old)
+	for _, key := range quotaKeysOf(old) {
+		changes[key] = changes[key].add(Usage{
+			Bytes: -oldUsage.Bytes,
+			Files: -oldUsage.Files,
+		})
+	}
+	newUsage := usageOf(new)
+	for _, key := range quotaKeysOf(new) {
+		changes[key] = changes[key].add(newUsage)
+	}
+	var delta map[quotaKey]Usage
+	for key, change := range changes {
+		if change == (Usage{}) {
+			continue
+		}
+		if delta == nil {
+			delta = make(map[quotaKey]Usage, len(m.usageDelta)+len(changes))
+			for k, v := range m.usageDelta {
+				delta[k] = v
+			}
+		}
+		delta[key] = delta[key].add(change)
+		if m.usage[key].add(delta[key]).exceeds(m.quotas[key], change) {
+			return quotaExceeded(key)
+		}
+	}
+	if delta != nil {
+		m.usageDelta = delta
+	}
+	return nil
+}
+
+func quotaExceeded(key quotaKey) error {
+	return we.With(
+		e4.Info("quota kind %d id %d", key.kind, key.id),
+	)(ErrQuotaExceeded)
+}
+
+// applyUsage adds usage deltas of batch to the FS. the write lock must be held
+func (m *MemFS) applyUsage(batch *MemFSWriteBatch) (map[quotaKey]Usage, error) {
+	if len(batch.usageDelta) == 0 {
+		return m.usage, nil
+	}
+	usage := make(map[quotaKey]Usage, len(m.usage)+len(batch.usageDelta))
+	for key, u := range m.usage {
+		usage[key] = u
+	}
+	for key, delta := range batch.usageDelta {
+		u := usage[key].add(delta)
+		if u.exceeds(m.quotas[key], delta) {
+			// exceeded by concurrent commits
+			return nil, quotaExceeded(key)
+		}
+		if u == (Usage{}) {
+			delete(usage, key)
+		} else {
+			usage[key] = u
+		}
+	}
+	return usage, nil
+}
+
+// enableUsage computes usage of all files, if not tracked yet. the write lock must be held
+func (m *MemFS) enableUsage() error {
+	if m.usage != nil {
+		return nil
+	}
+	usage, err := filesUsage(m.files)
+	if err != nil {
+		return err
+	}
+	m.usage = usage
+	return nil
+}
+
+// filesUsage computes usage of all files in the map
+func filesUsage(files *FileMap) (map[quotaKey]Usage, error) {
+	usage := make(map[quotaKey]Usage)
+	if err := walkNodes(files, func(node Node) error {
+		file, ok := node.(*File)
+		if !ok {
+			return nil
+		}
+		u := usageOf(file)
+		for _, key := range quotaKeysOf(file) {
+			usage[key] = usage[key].add(u)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// quotaKey resolves the key of options, and the dir of a dir quota
+func (m *MemFSReadBatch) quotaKey(options []QuotaOption) (quotaKey, *File, error) {
+	var spec quotaSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	if spec.key.kind != quotaDir {
+		return spec.key, nil, nil
+	}
+	file, err := m.GetFileByName(spec.dir, true)
+	if err != nil {
+		return spec.key, nil, err
+	}
+	if !file.IsDir {
+		return spec.key, nil, we.With(
+			e4.Info("%s", spec.dir),
+		)(ErrNotDir)
+	}
+	spec.key.id = uint64(file.ID)
+	return spec.key, file, nil
+}
+
+// setProject sets project of file and files under it from old to project.
+// sub trees of other projects are not changed
+func (m *MemFSWriteBatch) setProject(file *File, old FileID, project FileID) error {
+	if file.Project != old {
+		return nil
+	}
+	// quota bookkeeping, ModTime is kept
+	newFile := *file
+	newFile.nodeID = newNodeID()
+	newFile.Project = project
+	if err := m.updateFile(&newFile); err != nil {
+		return err
+	}
+	if !file.IsDir {
+		return nil
+	}
+	for _, node := range file.Subs.Nodes {
+		sub, err := m.GetFileByID(asDirEntry(node).id)
+		if err != nil {
+			return err
+		}
+		if err := m.setProject(sub, old, project); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkProject checks that file can be linked into dir
+func (m *MemFSReadBatch) checkProject(dir *File, id FileID) error {
+	if dir.Project == 0 {
+		return nil
+	}
+	file, err := m.GetFileByID(id)
+	if err != nil {
+		return err
+	}
+	if file.Project != dir.Project {
+		return we.With(
+			e4.Info("project %d to %d", file.Project, dir.Project),
+		)(ErrCrossDevice)
+	}
+	return nil
+}
+
+// SetQuota sets a quota of the FS, or the one selected by options. zero Quota removes the limits.
+// usage exceeding the new quota is kept, but can not grow
+func (m *MemFS) SetQuota(quota Quota, options ...QuotaOption) (err error) {
+	batch, done := m.NewWriteBatch()
+	defer done(&err)
+	if err := m.enableUsage(); err != nil {
+		return err
+	}
+	batch.quotas = m.quotas
+	batch.usage = m.usage
+	key, dir, err := batch.quotaKey(options)
+	if err != nil {
+		return err
+	}
+	if dir != nil && dir.Project != dir.ID {
+		if err := batch.setProject(dir, dir.Project, dir.ID); err != nil {
+			return err
+		}
+	}
+	// charges moved by setting projects are applied before the new quota
+	usage, err := m.applyUsage(batch)
+	if err != nil {
+		return err
+	}
+	m.usage = usage
+	batch.usageDelta = nil
+	quotas := make(map[quotaKey]Quota, len(m.quotas)+1)
+	for k, q := range m.quotas {
+		quotas[k] = q
+	}
+	if quota == (Quota{}) {
+		delete(quotas, key)
+	} else {
+		quotas[key] = quota
+	}
+	m.quotas = quotas
+	return nil
+}
+
+// Usage returns usage of the FS, or the one selected by options
+func (m *MemFS) Usage(options ...QuotaOption) (usage Usage, err error) {
+	batch, done := m.NewReadBatch()
+	defer done(&err)
+	key, dir, err := batch.quotaKey(options)
+	if err != nil {
+		return usage, err
+	}
+	if dir != nil && dir.Project != dir.ID {
+		// no dir quota
+		return usage, nil
+	}
+	if m.usage != nil {
+		return m.usage[key], nil
+	}
+	// not tracked, computed without enabling tracking
+	all, err := filesUsage(batch.files)
+	if err != nil {
+		return usage, err
+	}
+	return all[key], nil
+}
@@ -0,0 +1,151 @@
+package fs9
+
+import (
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestQuota(t *testing.T) {
+	defer he(nil, e4.WrapStacktrace, e4.TestingFatal(t))
+
+	exceeded := func(err error) bool {
+		return is(err, ErrQuotaExceeded)
+	}
+	usage := func(fs *MemFS, options ...QuotaOption) Usage {
+		u, err := fs.Usage(options...)
+		ce(err)
+		return u
+	}
+
+	// fs
+	m := NewMemFS()
+	h, err := m.Create("foo")
+	ce(err)
+	// not tracked until a quota is set
+	eq(
+		usage(m), Usage{Files: 2},
+		m.usage == nil, true,
+	)
+	ce(m.SetQuota(Quota{Bytes: 10, Files: 4}))
+	eq(usage(m), Usage{Files: 2})
+	_, err = h.Write([]byte("0123456789"))
+	ce(err)
+	_, err = h.Write([]byte("a"))
+	eq(
+		exceeded(err), true,
+		usage(m), Usage{Bytes: 10, Files: 2},
+		exceeded(h.Allocate(10, 1)), true,
+	)
+
+	// holes are not charged
+	ce(m.Truncate("foo", 100))
+	eq(usage(m), Usage{Bytes: 10, Files: 2})
+	ce(h.PunchHole(0, 5))
+	eq(usage(m), Usage{Bytes: 5, Files: 2})
+	ce(h.Allocate(0, 5))
+	ce(m.Truncate("foo", 10))
+	eq(usage(m), Usage{Bytes: 10, Files: 2})
+
+	ce(m.MakeDir("bar"))
+	ce(m.SymLink("foo", "baz"))
+	_, err = m.Create("qux")
+	eq(
+		exceeded(err), true,
+		exceeded(m.MakeDir("qux")), true,
+		usage(m), Usage{Bytes: 10, Files: 4},
+	)
+
+	// shrink
+	ce(m.SetQuota(Quota{Bytes: 5}))
+	ce(m.Truncate("foo", 8))
+	eq(exceeded(h.Allocate(8, 1)), true)
+	ce(m.Truncate("foo", 5))
+	eq(usage(m), Usage{Bytes: 5, Files: 4})
+	ce(h.Close())
+
+	// transaction
+	ce(m.Update(func(tx *Tx) error {
+		err := tx.Savepoint(func(tx *Tx) error {
+			h, err := tx.OpenHandle("foo")
+			ce(err)
+			defer h.Close()
+			return h.Allocate(0, 100)
+		})
+		eq(exceeded(err), true)
+		return tx.Truncate("foo", 1)
+	}))
+	eq(usage(m), Usage{Bytes: 1, Files: 4})
+	ce(m.SetQuota(Quota{}))
+	ce(m.Update(func(tx *Tx) error {
+		err := tx.Savepoint(func(tx *Tx) error {
+			ce(tx.Truncate("foo", 100))
+			return ErrRollback
+		})
+		eq(is(err, ErrRollback), true)
+		return nil
+	}))
+	eq(usage(m), Usage{Bytes: 1, Files: 4})
+
+	// users and groups
+	m = NewMemFS()
+	ce(m.ChangeMode(".", 0777))
+	alice := m.WithCredentials(Credentials{UserID: 1000, GroupID: 100})
+	bob := m.WithCredentials(Credentials{UserID: 1001, GroupID: 100})
+	ce(m.SetQuota(Quota{Files: 1}, OptQuotaUser(1000)))
+	ce(m.SetQuota(Quota{Files: 3}, OptQuotaGroup(100)))
+	ce(alice.MakeDir("a"))
+	eq(exceeded(alice.MakeDir("b")), true)
+	ce(bob.MakeDir("b"))
+	ce(bob.MakeDir("c"))
+	eq(
+		exceeded(bob.MakeDir("d")), true,
+		usage(m, OptQuotaUser(1000)), Usage{Files: 1},
+		usage(m, OptQuotaUser(1001)), Usage{Files: 2},
+		usage(m, OptQuotaGroup(100)), Usage{Files: 3},
+		exceeded(m.ChangeOwner("b", 1000, -1)), true,
+	)
+	ce(m.ChangeOwner("b", 1002, 101))
+	ce(bob.MakeDir("d"))
+
+	// dirs
+	m = NewMemFS()
+	ce(m.MakeDirAll("a/b"))
+	write := func(name string, size int) error {
+		h, err := m.Create(name)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		_, err = h.Write(make([]byte, size))
+		return err
+	}
+	ce(write("a/b/foo", 3))
+	ce(write("bar", 3))
+	ce(m.SetQuota(Quota{Bytes: 5}, OptQuotaDir("a")))
+	ce(m.SetQuota(Quota{Files: 2}, OptQuotaDir("a/b")))
+	eq(
+		usage(m, OptQuotaDir("a")), Usage{Files: 1},
+		usage(m, OptQuotaDir("a/b")), Usage{Bytes: 3, Files: 2},
+		usage(m, OptQuotaDir(".")), Usage{},
+	)
+	ce(write("a/foo", 5))
+	eq(
+		exceeded(write("a/bar", 1)), true,
+		exceeded(write("a/b/bar", 1)), true,
+	)
+	ce(write("baz", 10))
+	eq(
+		is(m.Rename("bar", "a/qux"), ErrCrossDevice), true,
+		is(m.Link("bar", "a/qux"), ErrCrossDevice), true,
+	)
+	// moved out keeps the charge
+	ce(m.Rename("a/foo", "foo"))
+	eq(usage(m, OptQuotaDir("a")), Usage{Bytes: 5, Files: 3})
+
+	// concurrent snapshots are not limited
+	snapshot := m.Snapshot()
+	h, err = snapshot.Create("a/b/bar")
+	ce(err)
+	ce(h.Close())
+}
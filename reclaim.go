@@ -0,0 +1,156 @@
+package fs9
+
+// changeLinks adds n to the link count of file. files losing the last link are reclaimed when the batch commits
+func (m *MemFSWriteBatch) changeLinks(id FileID, n int) error {
+	file, err := m.GetFileByID(id)
+	if err != nil {
+		return err
+	}
+	// link count is not content, ModTime is kept
+	newFile := *file
+	newFile.nodeID = newNodeID()
+	newFile.Nlink += n
+	if newFile.Nlink <= 0 {
+		if m.unlinked == nil {
+			m.unlinked = make(map[FileID]bool)
+		}
+		m.unlinked[id] = true
+	}
+	// restore the original node if the changes cancel out, like unlinking and linking in renames
+	orig := file
+	if l, ok := m.linked[id]; ok && l.last == file {
+		orig = l.orig
+	}
+	ret := &newFile
+	if orig != file && orig.Nlink == newFile.Nlink {
+		ret = orig
+	}
+	if m.linked == nil {
+		m.linked = make(map[FileID]linkChange)
+	}
+	m.linked[id] = linkChange{
+		orig: orig,
+		last: ret,
+	}
+	return m.updateFile(ret)
+}
+
+// linkChange is the file before and after link count changes of a batch
+type linkChange struct {
+	orig *File
+	last *File
+}
+
+// dropFile deletes file from the file map. entries of dir are unlinked
+func (m *MemFSWriteBatch) dropFile(file *File) error {
+	if file.IsDir {
+		for _, node := range file.Subs.Nodes {
+			if err := m.changeLinks(asDirEntry(node).id, -1); err != nil {
+				return err
+			}
+		}
+	}
+	newMapNode, err := m.files.Mutate(m.ctx, m.files.GetPath(file.ID), func(node Node) (Node, error) {
+		if node == nil { // NOCOVER
+			return nil, nil
+		}
+		if err := m.chargeUsage(node.(*File), nil); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	m.files = newMapNode.(*FileMap)
+	if m.touched != nil {
+		m.touched.writes[file.ID] = nil
+	}
+	return nil
+}
+
+// reclaim drops files unlinked by batch that are not reachable and not opened by handles.
+// the write lock must be held
+func (m *MemFS) reclaim(batch *MemFSWriteBatch) error {
+	for len(batch.unlinked) > 0 {
+		ids := batch.unlinked
+		batch.unlinked = nil
+		for id := range ids {
+			if id == m.root.id || m.opened(id) {
+				continue
+			}
+			file, err := batch.files.getFile(m.ctx, id)
+			if err != nil {
+				return err
+			}
+			if file == nil || file.Nlink > 0 {
+				continue
+			}
+			if err := batch.dropFile(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) opened(id FileID) bool {
+	m.handlesLock.Lock()
+	defer m.handlesLock.Unlock()
+	return m.handles[id] > 0
+}
+
+// retain counts h as an open handle of its file, so the file is kept after unlinked until h is closed
+func (m *MemFS) retain(h *MemHandle) error {
+	m.handlesLock.Lock()
+	if m.handles == nil {
+		m.handles = make(map[FileID]int)
+	}
+	m.handles[h.id]++
+	m.handlesLock.Unlock()
+	h.retained = true
+
+	// the file may be reclaimed before counted
+	m.RLock()
+	file, err := m.files.getFile(m.ctx, h.id)
+	m.RUnlock()
+	if err == nil && file == nil {
+		err = we(ErrFileNotFound)
+	}
+	if err != nil {
+		m.release(h.id)
+		h.retained = false
+		return err
+	}
+	return nil
+}
+
+// release uncounts an open handle of file id, and reclaims the file if it is the last one and the file is unlinked
+func (m *MemFS) release(id FileID) (err error) {
+	m.handlesLock.Lock()
+	m.handles[id]--
+	last := m.handles[id] <= 0
+	if last {
+		delete(m.handles, id)
+	}
+	m.handlesLock.Unlock()
+	if !last {
+		return nil
+	}
+
+	m.RLock()
+	file, err := m.files.getFile(m.ctx, id)
+	m.RUnlock()
+	if err != nil {
+		return err
+	}
+	if file == nil || file.Nlink > 0 {
+		return nil
+	}
+	batch, done := m.NewWriteBatch()
+	defer done(&err)
+	batch.unlinked = map[FileID]bool{
+		id: true,
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package fs9
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+// S3Config configures an S3Store
+type S3Config struct {
+	Endpoint  string // scheme and host, like https://s3.us-east-1.amazonaws.com
+	Region    string
+	Bucket    string
+	Prefix    string // prepended to all object keys
+	AccessKey string
+	SecretKey string
+
+	// values larger than PartSize are stored by multipart upload. zero means 8MiB
+	PartSize int
+
+	Client *http.Client
+}
+
+// S3Store is a Store that keeps each key as an object in an S3-compatible bucket.
+// requests use path-style addressing and are signed with AWS signature version 4
+type S3Store struct {
+	config S3Config
+}
+
+var _ Store = new(S3Store)
+
+const defaultS3PartSize = 8 * 1024 * 1024
+
+func NewS3Store(config S3Config) *S3Store {
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &S3Store{
+		config: config,
+	}
+}
+
+// NewS3FS returns a StoreFS persisted to an S3-compatible bucket
+func NewS3FS(config S3Config, options ...MemFSOption) (*StoreFS, error) {
+	return NewStoreFS(NewS3Store(config), options...)
+}
+
+func (s *S3Store) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, we(err)
+	}
+	return data, nil
+}
+
+func (s *S3Store) Put(key string, value []byte) error {
+	if len(value) > s.config.PartSize {
+		return s.putMultipart(key, value)
+	}
+	resp, err := s.do("PUT", key, nil, value)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Store) List(prefix string, fn func(key string) error) error {
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.config.Prefix + prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return we(err)
+		}
+		for _, content := range result.Contents {
+			if err := fn(strings.TrimPrefix(content.Key, s.config.Prefix)); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3Store) putMultipart(key string, value []byte) (err error) {
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initResult s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initResult)
+	resp.Body.Close()
+	if err != nil {
+		return we(err)
+	}
+	uploadID := initResult.UploadId
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// abort
+		resp, e := s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+		if e == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	var complete s3CompleteMultipartUpload
+	for i := 0; len(value) > 0; i++ {
+		part := value
+		if len(part) > s.config.PartSize {
+			part = part[:s.config.PartSize]
+		}
+		value = value[len(part):]
+		partNumber := i + 1
+		resp, err := s.do("PUT", key, url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}, part)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{
+			PartNumber: partNumber,
+			ETag:       resp.Header.Get("ETag"),
+		})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil { // NOCOVER
+		return we(err)
+	}
+	resp, err = s.do("POST", key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// errors may be reported in a 200 response
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return we(err)
+	}
+	var errResult s3Error
+	if xml.Unmarshal(respBody, &errResult) == nil && errResult.XMLName.Local == "Error" {
+		return we.With(
+			e4.Info("complete multipart upload: %s: %s", errResult.Code, errResult.Message),
+		)(ErrBadRecord)
+	}
+	return nil
+}
+
+type s3Error struct {
+	XMLName xml.Name
+	Code    string
+	Message string
+}
+
+func (s *S3Store) objectPath(key string) string {
+	p := "/" + s.config.Bucket
+	if key != "" {
+		p += "/" + s.config.Prefix + key
+	}
+	return p
+}
+
+func (s *S3Store) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, we(err)
+	}
+	u.Path = s.objectPath(key)
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3EncodeQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, we(err)
+	}
+	req.ContentLength = int64(len(body))
+	signS3Request(req, body, s.config.Region, s.config.AccessKey, s.config.SecretKey, time.Now())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, we(err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	var errResult s3Error
+	xml.NewDecoder(resp.Body).Decode(&errResult)
+	info := e4.Info("%s %s: %s %s: %s", method, u.Path, resp.Status, errResult.Code, errResult.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, we.With(info, fs.ErrNotExist)(ErrFileNotFound)
+	}
+	return nil, we.With(info)(fmt.Errorf("s3 error: %s", resp.Status))
+}
+
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes all bytes except the unreserved ones as required by signature version 4
+func s3Escape(s string, escapeSlash bool) string {
+	buf := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' ||
+			'a' <= c && c <= 'z' ||
+			'0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' ||
+			c == '/' && !escapeSlash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request adds AWS signature version 4 headers to req
+func signS3Request(req *http.Request, body []byte, region, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHashHex)
+
+	// canonical headers
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "host" || key == "range" || strings.HasPrefix(key, "x-amz-") || key == "content-md5" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var headerKeys []string
+	for key := range headers {
+		headerKeys = append(headerKeys, key)
+	}
+	sort.Strings(headerKeys)
+	canonicalHeaders := new(strings.Builder)
+	for _, key := range headerKeys {
+		canonicalHeaders.WriteString(key + ":" + headers[key] + "\n")
+	}
+	signedHeaders := strings.Join(headerKeys, ";")
+
+	// canonical query
+	query := req.URL.Query()
+	canonicalQuery := s3EncodeQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
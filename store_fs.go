@@ -0,0 +1,330 @@
+package fs9
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/reusee/dscope"
+	"github.com/reusee/e4"
+	"github.com/reusee/sb"
+)
+
+// Store is a key-value storage for serialized nodes.
+// Get of nonexistent keys returns an error matching fs.ErrNotExist.
+// Delete of nonexistent keys may return nil or an error matching fs.ErrNotExist
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	List(prefix string, fn func(key string) error) error
+}
+
+// StoreFS is a MemFS that persists its node tree to a Store.
+//
+// Every committed write batch stores the *FileMap and *File nodes that are new in this version,
+// then atomically switches the root pointer and deletes nodes that are no longer reachable.
+// Content chunks are stored separately and reference counted, so a write to a large file stores only the new chunks.
+// With OptEncryption, chunks and optionally dir entry names are encrypted before they reach the Store.
+// Unchanged subtrees are shared between versions, as in MemFS.
+// Snapshots are in-memory copy-on-write views and are not persisted.
+type StoreFS struct {
+	*MemFS
+	store     Store
+	persisted *FileMap
+	chunkRefs map[int64]int // chunk id -> number of persisted files referencing it
+}
+
+var _ FS = new(StoreFS)
+
+const storeFormatVersion = 1
+
+const (
+	storeRootKey     = "root"
+	storeNodePrefix  = "nodes/"
+	storeChunkPrefix = "chunks/"
+)
+
+type storeRootRecord struct {
+	Version int
+	RootID  FileID
+	FilesID int64
+}
+
+func NewStoreFS(store Store, options ...MemFSOption) (*StoreFS, error) {
+	s := &StoreFS{
+		store:     store,
+		chunkRefs: make(map[int64]int),
+	}
+
+	var root storeRootRecord
+	err := s.getRecord(storeRootKey, &root)
+	if errors.Is(err, fs.ErrNotExist) {
+		// new
+		s.MemFS = NewMemFS(options...)
+		if err := s.commit(s.MemFS.files); err != nil {
+			return nil, we(err)
+		}
+
+	} else if err != nil {
+		return nil, we(err)
+
+	} else {
+		// load
+		if root.Version != storeFormatVersion {
+			return nil, we.With(
+				e4.Info("version: %d", root.Version),
+			)(ErrBadRecord)
+		}
+		m := newMemFS(dscope.New(), nil, root.RootID, options...)
+		s.MemFS = m // for encryption settings
+		reachable := make(map[string]bool)
+		chunks := make(map[int64]*Chunk)
+		files, err := s.loadNode(m, root.FilesID, reachable, chunks)
+		if err != nil {
+			return nil, we(err)
+		}
+		fileMap, ok := files.(*FileMap)
+		if !ok {
+			return nil, we.With(
+				e4.Info("root node is %T", files),
+			)(ErrBadRecord)
+		}
+		m.files = fileMap
+		s.MemFS = m
+		s.persisted = fileMap
+
+		// delete nodes and chunks left by interrupted commits
+		var orphans []string
+		for _, prefix := range []string{storeNodePrefix, storeChunkPrefix} {
+			if err := store.List(prefix, func(key string) error {
+				if !reachable[key] {
+					orphans = append(orphans, key)
+				}
+				return nil
+			}); err != nil {
+				return nil, we(err)
+			}
+		}
+		for _, key := range orphans {
+			if err := s.delete(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	s.MemFS.onCommit = s.commit
+	return s, nil
+}
+
+func nodeKey(id int64) string {
+	return fmt.Sprintf("%s%02x/%016x", storeNodePrefix, uint8(id), id)
+}
+
+func chunkKey(id int64) string {
+	return fmt.Sprintf("%s%02x/%016x", storeChunkPrefix, uint8(id), id)
+}
+
+// commit is called with the MemFS write lock held, before files become visible
+func (s *StoreFS) commit(files *FileMap) (err error) {
+	var prev Node
+	if s.persisted != nil {
+		prev = s.persisted
+	}
+
+	// reference counts are updated in a copy, and set after the root is switched
+	refs := make(map[int64]int, len(s.chunkRefs))
+	for id, n := range s.chunkRefs {
+		refs[id] = n
+	}
+
+	// keys written are not referenced by the persisted root, and are deleted if the commit fails
+	var written []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, key := range written {
+			_ = s.delete(key)
+		}
+	}()
+
+	var obsoleted []Node
+	if err := diffNodes(
+		prev, files,
+		func(node Node) error {
+			obsoleted = append(obsoleted, node)
+			return nil
+		},
+		func(node Node) error {
+			if file, ok := node.(*File); ok {
+				if err := file.Content.Range(func(_ int64, chunk *Chunk) error {
+					refs[chunk.id]++
+					if refs[chunk.id] > 1 {
+						return nil
+					}
+					written = append(written, chunkKey(chunk.id))
+					return s.putChunk(chunk)
+				}); err != nil {
+					return err
+				}
+			}
+			written = append(written, nodeKey(nodeID(node)))
+			return s.putNode(node)
+		},
+	); err != nil {
+		return err
+	}
+
+	var garbage []string
+	for _, node := range obsoleted {
+		garbage = append(garbage, nodeKey(nodeID(node)))
+		file, ok := node.(*File)
+		if !ok {
+			continue
+		}
+		if err := file.Content.Range(func(_ int64, chunk *Chunk) error {
+			refs[chunk.id]--
+			if refs[chunk.id] > 0 {
+				return nil
+			}
+			delete(refs, chunk.id)
+			garbage = append(garbage, chunkKey(chunk.id))
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	// switch root
+	if err := s.putRecord(storeRootKey, storeRootRecord{
+		Version: storeFormatVersion,
+		RootID:  s.MemFS.root.id,
+		FilesID: files.nodeID,
+	}); err != nil {
+		return err
+	}
+	s.chunkRefs = refs
+	s.persisted = files
+
+	// the commit is done. keys failed to delete are removed as orphans on the next open
+	for _, key := range garbage {
+		_ = s.delete(key)
+	}
+
+	return nil
+}
+
+func (s *StoreFS) putNode(node Node) error {
+	rec, err := nodeToRecord(node)
+	if err != nil { // NOCOVER
+		return err
+	}
+	if err := s.sealNames(rec); err != nil {
+		return err
+	}
+	return s.putRecord(nodeKey(nodeID(node)), rec)
+}
+
+func (s *StoreFS) putChunk(chunk *Chunk) error {
+	rec := chunkToRecord(chunk)
+	if err := s.sealChunk(rec); err != nil {
+		return err
+	}
+	return s.putRecord(chunkKey(chunk.id), rec)
+}
+
+func (s *StoreFS) delete(key string) error {
+	if err := s.store.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return we.With(
+			e4.Info("key: %s", key),
+		)(err)
+	}
+	return nil
+}
+
+func (s *StoreFS) loadNode(m *MemFS, id int64, loaded map[string]bool, chunks map[int64]*Chunk) (Node, error) {
+	key := nodeKey(id)
+	var rec nodeRecord
+	if err := s.getRecord(key, &rec); err != nil {
+		return nil, err
+	}
+	if err := s.unsealNames(&rec); err != nil {
+		return nil, we.With(
+			e4.Info("key: %s", key),
+		)(err)
+	}
+	loaded[key] = true
+	return recordToNode(
+		&rec, m,
+		func(id int64) (Node, error) {
+			return s.loadNode(m, id, loaded, chunks)
+		},
+		func(id int64) (*Chunk, error) {
+			s.chunkRefs[id]++
+			if chunk, ok := chunks[id]; ok {
+				return chunk, nil
+			}
+			key := chunkKey(id)
+			var rec chunkRecord
+			if err := s.getRecord(key, &rec); err != nil {
+				return nil, err
+			}
+			if rec.ID != id {
+				return nil, we.With(
+					e4.Info("key: %s", key),
+				)(ErrBadRecord)
+			}
+			if err := s.unsealChunk(&rec); err != nil {
+				return nil, we.With(
+					e4.Info("key: %s", key),
+				)(err)
+			}
+			loaded[key] = true
+			chunk := recordToChunk(&rec)
+			chunks[id] = chunk
+			return chunk, nil
+		},
+	)
+}
+
+func (s *StoreFS) putRecord(key string, value any) error {
+	buf := new(bytes.Buffer)
+	if err := sb.Copy(
+		sb.Marshal(value),
+		sb.Encode(buf),
+	); err != nil { // NOCOVER
+		return we(err)
+	}
+	if err := s.store.Put(key, buf.Bytes()); err != nil {
+		return we.With(
+			e4.Info("key: %s", key),
+		)(err)
+	}
+	return nil
+}
+
+func (s *StoreFS) getRecord(key string, target any) error {
+	data, err := s.store.Get(key)
+	if err != nil {
+		return we.With(
+			e4.Info("key: %s", key),
+		)(err)
+	}
+	if err := sb.Copy(
+		sb.Decode(bytes.NewReader(data)),
+		sb.Unmarshal(target),
+	); err != nil {
+		return we.With(
+			e4.Info("key: %s", key),
+			ErrBadRecord,
+		)(err)
+	}
+	return nil
+}
+
+func isStoreKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/") && fs.ValidPath(key)
+}
@@ -0,0 +1,100 @@
+package fs9
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+var errStoreFailed = errors.New("store failed")
+
+// failingStore fails operations selected by fail
+type failingStore struct {
+	Store
+	fail func(op string, key string) bool
+}
+
+func (f *failingStore) Put(key string, value []byte) error {
+	if f.fail != nil && f.fail("put", key) {
+		return errStoreFailed
+	}
+	return f.Store.Put(key, value)
+}
+
+func (f *failingStore) Delete(key string) error {
+	if f.fail != nil && f.fail("delete", key) {
+		return errStoreFailed
+	}
+	return f.Store.Delete(key)
+}
+
+func TestStoreFSFailedCommit(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	disk, err := NewDiskStore(t.TempDir())
+	ce(err)
+	store := &failingStore{
+		Store: disk,
+	}
+	s, err := NewStoreFS(store)
+	ce(err)
+	keys := func(prefix string) (n int) {
+		ce(disk.List(prefix, func(string) error {
+			n++
+			return nil
+		}))
+		return
+	}
+	write := func(name string, content string) error {
+		h, err := s.OpenHandle(name, OptCreate(true))
+		if err != nil {
+			return err
+		}
+		if _, err := h.Write([]byte(content)); err != nil {
+			h.Close()
+			return err
+		}
+		return h.Close()
+	}
+
+	// fails after some chunks stored
+	ce(write("foo", ""))
+	puts := 0
+	store.fail = func(op string, key string) bool {
+		if strings.HasPrefix(key, storeChunkPrefix) {
+			puts++
+		}
+		return op == "put" && key == storeRootKey
+	}
+	eq(is(write("foo", "foo"), errStoreFailed), true)
+	eq(puts > 0, true)
+	stat, err := s.Stat("foo")
+	ce(err)
+	eq(stat.Size(), int64(0))
+
+	// reference counts are not changed by the failed commit
+	store.fail = nil
+	ce(write("foo", "foo"))
+	ce(s.Remove("foo"))
+	eq(keys(storeChunkPrefix), 0)
+
+	// failed deletes after the root switched
+	ce(write("foo", "foo"))
+	store.fail = func(op string, key string) bool {
+		return op == "delete"
+	}
+	ce(s.Remove("foo"))
+	_, err = s.Stat("foo")
+	eq(is(err, ErrFileNotFound), true)
+	eq(keys(storeChunkPrefix) > 0, true)
+
+	// orphans are removed on open
+	store.fail = nil
+	s, err = NewStoreFS(store)
+	ce(err)
+	_, err = s.Stat("foo")
+	eq(is(err, ErrFileNotFound), true)
+	eq(keys(storeChunkPrefix), 0)
+}
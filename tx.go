@@ -0,0 +1,122 @@
+package fs9
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/reusee/e4"
+)
+
+// Tx is a read-write transaction of MemFS. it must not be used after the Update call returns
+type Tx struct {
+	*MemFSWriteBatch
+	done bool
+}
+
+// ReadTx is a read-only transaction of MemFS. it must not be used after the View call returns
+type ReadTx struct {
+	*MemFSReadBatch
+	done bool
+}
+
+var _ fs.FS = new(Tx)
+
+var _ fs.FS = new(ReadTx)
+
+// Update runs fn in a transaction. changes made by fn are committed atomically if fn returns nil,
+// or discarded if fn returns an error or panics
+func (m *MemFS) Update(fn func(tx *Tx) error) (err error) {
+	batch, done := m.NewWriteBatch()
+	tx := &Tx{
+		MemFSWriteBatch: batch,
+	}
+	defer func() {
+		tx.done = true
+		if p := recover(); p != nil {
+			err = we.With(
+				e4.Info("panic: %v", p),
+			)(ErrRollback)
+			done(&err)
+			panic(p)
+		}
+		done(&err)
+	}()
+	return fn(tx)
+}
+
+// View runs fn in a read-only transaction
+func (m *MemFS) View(fn func(tx *ReadTx) error) (err error) {
+	batch, done := m.NewReadBatch()
+	tx := &ReadTx{
+		MemFSReadBatch: batch,
+	}
+	defer func() {
+		tx.done = true
+		done(&err)
+	}()
+	return fn(tx)
+}
+
+// Savepoint runs fn in a nested transaction. changes made by fn are discarded if fn returns an error or panics
+func (t *Tx) Savepoint(fn func(tx *Tx) error) (err error) {
+	files := t.files
+	usageDelta := t.usageDelta
+	defer func() {
+		if p := recover(); p != nil {
+			t.files = files
+			t.usageDelta = usageDelta
+			panic(p)
+		}
+		if err != nil {
+			t.files = files
+			t.usageDelta = usageDelta
+		}
+	}()
+	return fn(t)
+}
+
+// OpenHandle opens a handle operating in the transaction
+func (t *Tx) OpenHandle(name string, options ...OpenOption) (Handle, error) {
+	handle, err := t.MemFSWriteBatch.OpenHandle(name, options...)
+	if err != nil {
+		return nil, err
+	}
+	h := handle.(*MemHandle)
+	h.tx = t
+	// writes are already collected in the transaction
+	h.buffer = nil
+	return h, nil
+}
+
+func (t *Tx) Open(name string) (fs.File, error) {
+	return t.OpenHandle(name, OptFlag(os.O_RDONLY, 0))
+}
+
+// Create creates or truncates a file and opens a handle operating in the transaction
+func (t *Tx) Create(name string) (Handle, error) {
+	handle, err := t.MemFSWriteBatch.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	handle.(*MemHandle).tx = t
+	return handle, nil
+}
+
+// OpenHandle opens a read-only handle of the transaction
+func (t *ReadTx) OpenHandle(name string) (Handle, error) {
+	path, err := NameToPath(name)
+	if err != nil {
+		return nil, we(err)
+	}
+	id, err := t.GetFileIDByPath(path, true)
+	if err != nil {
+		return nil, we(err)
+	}
+	handle := t.NewHandle(name, id)
+	handle.readTx = t
+	return handle, nil
+}
+
+func (t *ReadTx) Open(name string) (fs.File, error) {
+	return t.OpenHandle(name)
+}
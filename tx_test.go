@@ -0,0 +1,132 @@
+package fs9
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/reusee/e4"
+)
+
+func TestTx(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	write := func(tx *Tx, name string, content string) {
+		h, err := tx.Create(name)
+		ce(err)
+		_, err = h.Write([]byte(content))
+		ce(err)
+		ce(h.Close())
+	}
+	exists := func(name string) bool {
+		_, err := m.LinkStat(name)
+		return err == nil
+	}
+
+	// commit
+	var handle Handle
+	ce(m.Update(func(tx *Tx) error {
+		ce(tx.MakeDir("d"))
+		write(tx, "d/foo", "foo")
+		write(tx, "bar", "bar")
+		ce(tx.Rename("bar", "d/bar"))
+		write(tx, "baz", "baz")
+		ce(tx.Remove("baz"))
+		data, err := fs.ReadFile(tx, "d/foo")
+		ce(err)
+		eq(string(data), "foo")
+		entries, err := fs.ReadDir(tx, "d")
+		ce(err)
+		eq(len(entries), 2)
+		info, err := entries[1].Info()
+		ce(err)
+		eq(info.Size(), int64(3))
+		handle, err = tx.OpenHandle("d/foo")
+		ce(err)
+		return nil
+	}))
+	eq(
+		exists("d/foo"), true,
+		exists("d/bar"), true,
+		exists("bar"), false,
+		exists("baz"), false,
+	)
+	_, err := handle.Write([]byte("foo"))
+	eq(is(err, ErrTxDone), true)
+
+	// rollback on error
+	err = m.Update(func(tx *Tx) error {
+		write(tx, "d/foo", "bar")
+		ce(tx.Remove("d/bar"))
+		return ErrRollback
+	})
+	eq(is(err, ErrRollback), true)
+	data, err := fs.ReadFile(m, "d/foo")
+	ce(err)
+	eq(
+		string(data), "foo",
+		exists("d/bar"), true,
+	)
+
+	// rollback on panic
+	func() {
+		defer func() {
+			p := recover()
+			eq(p, "foo")
+		}()
+		ce(m.Update(func(tx *Tx) error {
+			ce(tx.Remove("d", OptAll(true)))
+			panic("foo")
+		}))
+	}()
+	eq(exists("d"), true)
+
+	// savepoints
+	ce(m.Update(func(tx *Tx) error {
+		write(tx, "a", "a")
+		err := tx.Savepoint(func(tx *Tx) error {
+			write(tx, "b", "b")
+			ce(tx.Savepoint(func(tx *Tx) error {
+				write(tx, "c", "c")
+				return nil
+			}))
+			err := tx.Savepoint(func(tx *Tx) error {
+				write(tx, "d/e", "e")
+				return ErrRollback
+			})
+			eq(is(err, ErrRollback), true)
+			_, err = tx.Stat("c")
+			ce(err)
+			_, err = tx.Stat("d/e")
+			eq(is(err, ErrFileNotFound), true)
+			return ErrRollback
+		})
+		eq(is(err, ErrRollback), true)
+		return nil
+	}))
+	eq(
+		exists("a"), true,
+		exists("b"), false,
+		exists("c"), false,
+		exists("d/e"), false,
+	)
+
+	// view
+	ce(m.View(func(tx *ReadTx) error {
+		data, err := fs.ReadFile(tx, "a")
+		ce(err)
+		eq(string(data), "a")
+		entries, err := fs.ReadDir(tx, ".")
+		ce(err)
+		eq(len(entries), 2)
+		_, err = entries[0].Info()
+		ce(err)
+		handle, err = tx.OpenHandle("a")
+		ce(err)
+		_, err = handle.Write([]byte("foo"))
+		eq(is(err, ErrImmutable), true)
+		return nil
+	}))
+	_, err = handle.Read(make([]byte, 1))
+	eq(is(err, ErrTxDone), true)
+}
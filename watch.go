@@ -0,0 +1,595 @@
+package fs9
+
+import (
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reusee/e4"
+)
+
+type WatchOp uint8
+
+const (
+	WatchCreate WatchOp = iota + 1
+	WatchWrite
+	WatchRemove
+	WatchRename
+	WatchChmod
+	WatchChown
+	WatchUtimes
+	WatchXattr
+)
+
+func (w WatchOp) String() string {
+	switch w {
+	case WatchCreate:
+		return "create"
+	case WatchWrite:
+		return "write"
+	case WatchRemove:
+		return "remove"
+	case WatchRename:
+		return "rename"
+	case WatchChmod:
+		return "chmod"
+	case WatchChown:
+		return "chown"
+	case WatchUtimes:
+		return "utimes"
+	case WatchXattr:
+		return "xattr"
+	}
+	return "unknown"
+}
+
+// WatchEvent is a change of a path
+type WatchEvent struct {
+	// increasing in the MemFS
+	Seq int64
+	Op  WatchOp
+	// slash-separated path
+	Path string
+	// old path of WatchRename
+	OldPath string
+}
+
+// Watcher receives events of a path. events of a commit are delivered together, after the commit is done
+type Watcher struct {
+	fs        *MemFS
+	path      string
+	recursive bool
+	events    chan WatchEvent
+	notify    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	pending []WatchEvent
+}
+
+// Watch returns a Watcher of events of path and its direct entries, or all entries under it if recursive
+func (m *MemFS) Watch(path string, recursive bool) (*Watcher, error) {
+	parts, err := NameToPath(path)
+	if err != nil {
+		return nil, we(err)
+	}
+	path = "."
+	if len(parts) > 0 {
+		path = strings.Join(parts, "/")
+	}
+	w := &Watcher{
+		fs:        m,
+		path:      path,
+		recursive: recursive,
+		events:    make(chan WatchEvent),
+		notify:    make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	m.Lock()
+	if m.watchers == nil {
+		m.watchers = make(map[*Watcher]bool)
+	}
+	m.watchers[w] = true
+	m.Unlock()
+	go w.run()
+	return w, nil
+}
+
+// Events returns the channel of events. it is closed after Close is called
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		w.fs.Lock()
+		delete(w.fs.watchers, w)
+		w.fs.Unlock()
+		close(w.closed)
+	})
+	return nil
+}
+
+func (w *Watcher) run() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		pending := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		for _, event := range pending {
+			select {
+			case w.events <- event:
+			case <-w.closed:
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (w *Watcher) match(path string) bool {
+	if path == w.path {
+		return true
+	}
+	rel := path
+	if w.path != "." {
+		if !strings.HasPrefix(path, w.path+"/") {
+			return false
+		}
+		rel = path[len(w.path)+1:]
+	}
+	return w.recursive || !strings.Contains(rel, "/")
+}
+
+func (w *Watcher) push(events []WatchEvent) {
+	w.mu.Lock()
+	n := len(w.pending)
+	for _, event := range events {
+		if w.match(event.Path) || (event.Op == WatchRename && w.match(event.OldPath)) {
+			w.pending = append(w.pending, event)
+		}
+	}
+	pushed := len(w.pending) > n
+	w.mu.Unlock()
+	if pushed {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchCommit is a commit to be turned into events for watchers
+type watchCommit struct {
+	files, newFiles *FileMap
+	written         map[FileID]*File // files written by the commit
+	watchers        []*Watcher
+}
+
+// queueEvents queues the commit from files to newFiles for current watchers. the write lock must be held.
+// events are computed by dispatchEvents after the lock is released, so commits do not wait for them
+func (m *MemFS) queueEvents(files, newFiles *FileMap, written map[FileID]*File) {
+	if len(m.watchers) == 0 {
+		return
+	}
+	watchers := make([]*Watcher, 0, len(m.watchers))
+	for w := range m.watchers {
+		watchers = append(watchers, w)
+	}
+	m.watchQueueLock.Lock()
+	m.watchQueue = append(m.watchQueue, watchCommit{
+		files:    files,
+		newFiles: newFiles,
+		written:  written,
+		watchers: watchers,
+	})
+	m.watchQueueLock.Unlock()
+}
+
+// dispatchEvents computes events of queued commits in order, and pushes them to watchers. the write lock must not be held
+func (m *MemFS) dispatchEvents() {
+	m.watchLock.Lock()
+	defer m.watchLock.Unlock()
+	for {
+		m.watchQueueLock.Lock()
+		commits := m.watchQueue
+		m.watchQueue = nil
+		m.watchQueueLock.Unlock()
+		if len(commits) == 0 {
+			return
+		}
+		for _, commit := range commits {
+			events, err := m.watchEvents(commit)
+			if err != nil { // NOCOVER
+				// the commit is done, events of it are dropped
+				m.watchParents = nil
+				continue
+			}
+			m.publishEvents(events, commit.watchers)
+		}
+	}
+}
+
+// parentIndex maps files to the dir entries linking them, since files do not refer to their parents
+type parentIndex struct {
+	files   *FileMap // the version indexed
+	parents map[FileID][]parentLink
+}
+
+type parentLink struct {
+	dir  FileID
+	name string
+}
+
+// newParentIndex indexes dirs reachable from the root in files
+func (m *MemFS) newParentIndex(files *FileMap) (*parentIndex, error) {
+	index := &parentIndex{
+		files:   files,
+		parents: make(map[FileID][]parentLink),
+	}
+	var walk func(id FileID) error
+	walk = func(id FileID) error {
+		dir, err := files.getFile(m.ctx, id)
+		if err != nil {
+			return err
+		}
+		if dir == nil { // NOCOVER
+			return we.With(
+				e4.Info("file %d", id),
+			)(ErrFileNotFound)
+		}
+		for _, node := range setNodes(dir.Subs) {
+			entry := asDirEntry(node)
+			index.link(entry.id, parentLink{id, entry.name})
+			if !entry.isDir {
+				continue
+			}
+			if err := walk(entry.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(m.root.id); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (p *parentIndex) link(id FileID, link parentLink) {
+	p.parents[id] = append(p.parents[id], link)
+}
+
+func (p *parentIndex) unlink(id FileID, link parentLink) {
+	links := p.parents[id]
+	for i, l := range links {
+		if l != link {
+			continue
+		}
+		links = append(links[:i:i], links[i+1:]...)
+		break
+	}
+	if len(links) == 0 {
+		delete(p.parents, id)
+		return
+	}
+	p.parents[id] = links
+}
+
+// paths returns paths of the file. files not reachable from root have no path
+func (p *parentIndex) paths(id FileID, root FileID) []string {
+	if id == root {
+		return []string{"."}
+	}
+	var ret []string
+	for _, link := range p.parents[id] {
+		for _, dir := range p.paths(link.dir, root) {
+			ret = append(ret, pathpkg.Join(dir, link.name))
+		}
+	}
+	return ret
+}
+
+// watchEvents returns events of changes of the commit.
+// only files written by the commit are compared, and their paths are found with the parent index, which is updated to the new version
+func (m *MemFS) watchEvents(commit watchCommit) (events []WatchEvent, err error) {
+	index := m.watchParents
+	if index == nil || index.files != commit.files {
+		index, err = m.newParentIndex(commit.files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rootID := m.root.id
+
+	type filePair struct {
+		id       FileID
+		old, new *File
+	}
+	var changed []filePair
+	for id := range commit.written {
+		oldFile, err := commit.files.getFile(m.ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		newFile, err := commit.newFiles.getFile(m.ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if oldFile == nil && newFile == nil ||
+			oldFile != nil && newFile != nil && oldFile.nodeID == newFile.nodeID {
+			continue
+		}
+		changed = append(changed, filePair{id, oldFile, newFile})
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].id < changed[j].id
+	})
+
+	// changed entries of written dirs
+	type entryChange struct {
+		link parentLink
+		id   FileID
+	}
+	var removedEntries, addedEntries []entryChange
+	for _, pair := range changed {
+		var oldSubs, newSubs []Node
+		if pair.old != nil && pair.old.IsDir {
+			oldSubs = setNodes(pair.old.Subs)
+		}
+		if pair.new != nil && pair.new.IsDir {
+			newSubs = setNodes(pair.new.Subs)
+		}
+		if err := join3(oldSubs, newSubs, nil, func(nodeA, nodeB, _ Node) error {
+			entryA := asDirEntry(nodeA)
+			entryB := asDirEntry(nodeB)
+			if entryA != nil && entryB != nil && entryA.id == entryB.id {
+				return nil
+			}
+			if entryA != nil {
+				removedEntries = append(removedEntries, entryChange{parentLink{pair.id, entryA.name}, entryA.id})
+			}
+			if entryB != nil {
+				addedEntries = append(addedEntries, entryChange{parentLink{pair.id, entryB.name}, entryB.id})
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// paths in the old version
+	var removed []diffPath
+	existed := make(map[FileID]bool) // files with paths in the old version
+	for _, entry := range removedEntries {
+		for _, dir := range index.paths(entry.link.dir, rootID) {
+			removed = append(removed, diffPath{
+				path: pathpkg.Join(dir, entry.link.name),
+				id:   entry.id,
+			})
+		}
+		existed[entry.id] = true
+	}
+	for _, entry := range addedEntries {
+		if len(index.paths(entry.id, rootID)) > 0 {
+			existed[entry.id] = true
+		}
+	}
+
+	// update the index to the new version
+	for _, entry := range removedEntries {
+		index.unlink(entry.id, entry.link)
+	}
+	for _, entry := range addedEntries {
+		index.link(entry.id, entry.link)
+	}
+	index.files = commit.newFiles
+	m.watchParents = index
+
+	// paths in the new version
+	var added []diffPath
+	addedPaths := make(map[string]bool)
+	for _, entry := range addedEntries {
+		for _, dir := range index.paths(entry.link.dir, rootID) {
+			p := pathpkg.Join(dir, entry.link.name)
+			added = append(added, diffPath{
+				path: p,
+				id:   entry.id,
+			})
+			addedPaths[p] = true
+		}
+	}
+
+	// entries of removed dirs are reported one by one.
+	// entries of dropped dirs are already collected, but dirs kept by handles are not written
+	removedPaths := make(map[string]bool)
+	for _, r := range removed {
+		removedPaths[r.path] = true
+	}
+	var collect func(p string, id FileID) error
+	collect = func(p string, id FileID) error {
+		dir, err := commit.files.getFile(m.ctx, id)
+		if err != nil {
+			return err
+		}
+		for _, node := range setNodes(dir.Subs) {
+			entry := asDirEntry(node)
+			sub := pathpkg.Join(p, entry.name)
+			if !removedPaths[sub] {
+				removedPaths[sub] = true
+				removed = append(removed, diffPath{
+					path: sub,
+					id:   entry.id,
+				})
+			}
+			if !entry.isDir {
+				continue
+			}
+			if err := collect(sub, entry.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, r := range removed[:len(removed):len(removed)] {
+		if len(index.paths(r.id, rootID)) > 0 {
+			continue
+		}
+		file, err := commit.newFiles.getFile(m.ctx, r.id)
+		if err != nil {
+			return nil, err
+		}
+		if file == nil || !file.IsDir {
+			continue
+		}
+		if err := collect(r.path, r.id); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(removed, func(i, j int) bool {
+		return removed[i].path < removed[j].path
+	})
+	sort.SliceStable(added, func(i, j int) bool {
+		return added[i].path < added[j].path
+	})
+
+	// changes in the order of Diff
+	var changes []Change
+	modified := make(map[FileID]filePair)
+	for _, pair := range changed {
+		if pair.old == nil || pair.new == nil {
+			continue
+		}
+		modified[pair.id] = pair
+		for _, p := range index.paths(pair.id, rootID) {
+			if addedPaths[p] {
+				continue
+			}
+			changes = append(changes, Change{
+				Kind: ChangeModified,
+				Path: p,
+				ID:   pair.id,
+			})
+		}
+	}
+	oldPaths := make(map[FileID][]string)
+	for _, r := range removed {
+		oldPaths[r.id] = append(oldPaths[r.id], r.path)
+	}
+	pairedOld := make(map[string]bool)
+	pairedNew := make(map[string]bool)
+	for _, a := range added {
+		olds := oldPaths[a.id]
+		if len(olds) == 0 {
+			continue
+		}
+		oldPaths[a.id] = olds[1:]
+		pairedOld[olds[0]] = true
+		pairedNew[a.path] = true
+		changes = append(changes, Change{
+			Kind:    ChangeRenamed,
+			Path:    a.path,
+			OldPath: olds[0],
+			ID:      a.id,
+		})
+		if _, ok := modified[a.id]; ok {
+			changes = append(changes, Change{
+				Kind: ChangeModified,
+				Path: a.path,
+				ID:   a.id,
+			})
+		}
+	}
+	for _, a := range added {
+		if pairedNew[a.path] {
+			continue
+		}
+		kind := ChangeAdded
+		if existed[a.id] {
+			kind = ChangeLinked
+		}
+		changes = append(changes, Change{
+			Kind: kind,
+			Path: a.path,
+			ID:   a.id,
+		})
+	}
+	for _, r := range removed {
+		if pairedOld[r.path] {
+			continue
+		}
+		kind := ChangeRemoved
+		if len(index.paths(r.id, rootID)) > 0 {
+			kind = ChangeUnlinked
+		}
+		changes = append(changes, Change{
+			Kind: kind,
+			Path: r.path,
+			ID:   r.id,
+		})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	add := func(op WatchOp, path, oldPath string) {
+		events = append(events, WatchEvent{
+			Op:      op,
+			Path:    path,
+			OldPath: oldPath,
+		})
+	}
+	for _, c := range changes {
+		switch c.Kind {
+		case ChangeAdded, ChangeLinked:
+			add(WatchCreate, c.Path, "")
+		case ChangeRemoved, ChangeUnlinked:
+			add(WatchRemove, c.Path, "")
+		case ChangeRenamed:
+			add(WatchRename, c.Path, c.OldPath)
+		case ChangeModified:
+			oldFile, newFile := modified[c.ID].old, modified[c.ID].new
+			n := len(events)
+			if !sameChunks(oldFile, newFile) || oldFile.Symlink != newFile.Symlink {
+				add(WatchWrite, c.Path, "")
+			}
+			if oldFile.Mode != newFile.Mode {
+				add(WatchChmod, c.Path, "")
+			}
+			if oldFile.UserID != newFile.UserID || oldFile.GroupID != newFile.GroupID {
+				add(WatchChown, c.Path, "")
+			}
+			if !sameXattrs(oldFile, newFile) {
+				add(WatchXattr, c.Path, "")
+			}
+			if len(events) == n &&
+				(oldFile.Subs == nil || oldFile.Subs.Equal(newFile.Subs)) &&
+				(!oldFile.ModTime.Equal(newFile.ModTime) || !oldFile.AccessTime.Equal(newFile.AccessTime)) {
+				// dirs with changed entries are reported by events of the entries
+				add(WatchUtimes, c.Path, "")
+			}
+		}
+	}
+	return events, nil
+}
+
+// publishEvents assigns sequence numbers to events and pushes them to watchers. watchLock must be held
+func (m *MemFS) publishEvents(events []WatchEvent, watchers []*Watcher) {
+	if len(events) == 0 {
+		return
+	}
+	for i := range events {
+		m.watchSeq++
+		events[i].Seq = m.watchSeq
+	}
+	for _, w := range watchers {
+		w.push(events)
+	}
+}
@@ -0,0 +1,131 @@
+package fs9
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/reusee/e4"
+)
+
+func TestWatch(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+
+	m := NewMemFS()
+	ce(m.MakeDir("d"))
+	w, err := m.Watch("d", false)
+	ce(err)
+	defer w.Close()
+	all, err := m.Watch(".", true)
+	ce(err)
+
+	type event struct {
+		Op      WatchOp
+		Path    string
+		OldPath string
+	}
+	var lastSeq int64
+	next := func(w *Watcher) event {
+		select {
+		case e := <-w.Events():
+			if e.Seq <= lastSeq {
+				t.Fatalf("bad seq")
+			}
+			lastSeq = e.Seq
+			return event{e.Op, e.Path, e.OldPath}
+		case <-time.After(time.Second * 10):
+			t.Fatalf("no event")
+		}
+		panic("impossible")
+	}
+
+	h, err := m.Create("d/a")
+	ce(err)
+	eq(next(w), event{WatchCreate, "d/a", ""})
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	ce(h.Close())
+	eq(next(w), event{WatchWrite, "d/a", ""})
+	ce(m.ChangeMode("d/a", 0600))
+	eq(next(w), event{WatchChmod, "d/a", ""})
+	ce(m.ChangeOwner("d/a", 1, 2))
+	eq(next(w), event{WatchChown, "d/a", ""})
+	ce(m.ChangeTimes("d/a", time.Now(), time.Now()))
+	eq(next(w), event{WatchUtimes, "d/a", ""})
+	ce(m.SetXattr("d/a", "user.foo", []byte("foo"), 0))
+	eq(next(w), event{WatchXattr, "d/a", ""})
+	ce(m.Rename("d/a", "d/b"))
+	eq(next(w), event{WatchRename, "d/b", "d/a"})
+	ce(m.MakeDirAll("d/e/f"))
+	eq(next(w), event{WatchCreate, "d/e", ""})
+	ce(m.Remove("d/b"))
+	eq(next(w), event{WatchRemove, "d/b", ""})
+	ce(m.ChangeTimes("d", time.Now(), time.Now()))
+	eq(next(w), event{WatchUtimes, "d", ""})
+
+	// events of a transaction are published at commit
+	ce(m.Update(func(tx *Tx) error {
+		h, err := tx.Create("d/x")
+		ce(err)
+		_, err = h.Write([]byte("foo"))
+		ce(err)
+		ce(tx.Rename("d/e", "d/e2"))
+		return nil
+	}))
+	eq(
+		next(w), event{WatchRename, "d/e2", "d/e"},
+		next(w), event{WatchCreate, "d/x", ""},
+	)
+	err = m.Update(func(tx *Tx) error {
+		ce(tx.MakeDir("d/z"))
+		return ErrRollback
+	})
+	eq(is(err, ErrRollback), true)
+	ce(m.MakeDir("d/z2"))
+	eq(next(w), event{WatchCreate, "d/z2", ""})
+
+	// recursive
+	lastSeq = 0
+	eq(
+		next(all), event{WatchCreate, "d/a", ""},
+		next(all), event{WatchWrite, "d/a", ""},
+		next(all), event{WatchChmod, "d/a", ""},
+		next(all), event{WatchChown, "d/a", ""},
+		next(all), event{WatchUtimes, "d/a", ""},
+		next(all), event{WatchXattr, "d/a", ""},
+		next(all), event{WatchRename, "d/b", "d/a"},
+		next(all), event{WatchCreate, "d/e", ""},
+		next(all), event{WatchCreate, "d/e/f", ""},
+		next(all), event{WatchRemove, "d/b", ""},
+		next(all), event{WatchUtimes, "d", ""},
+		next(all), event{WatchRename, "d/e2", "d/e"},
+		next(all), event{WatchCreate, "d/x", ""},
+		next(all), event{WatchCreate, "d/z2", ""},
+	)
+
+	// entries of a removed dir kept by a handle
+	ce(m.MakeDirAll("k/l"))
+	h, err = m.Create("k/l/x")
+	ce(err)
+	ce(h.Close())
+	eq(
+		next(all), event{WatchCreate, "k", ""},
+		next(all), event{WatchCreate, "k/l", ""},
+		next(all), event{WatchCreate, "k/l/x", ""},
+	)
+	h, err = m.OpenHandle("k", OptFlag(os.O_RDONLY, 0))
+	ce(err)
+	ce(m.Remove("k", OptAll(true)))
+	eq(
+		next(all), event{WatchRemove, "k", ""},
+		next(all), event{WatchRemove, "k/l", ""},
+		next(all), event{WatchRemove, "k/l/x", ""},
+	)
+	ce(h.Close())
+	ce(m.MakeDir("k"))
+	eq(next(all), event{WatchCreate, "k", ""})
+
+	ce(all.Close())
+	_, ok := <-all.Events()
+	eq(ok, false)
+}
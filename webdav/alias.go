@@ -0,0 +1,16 @@
+package webdav
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/reusee/e4"
+)
+
+var (
+	he = e4.Handle
+	ce = e4.Check
+	we = e4.Wrap
+	pt = fmt.Printf
+	is = errors.Is
+)
@@ -0,0 +1,454 @@
+package webdav
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/reusee/fs9"
+)
+
+// Handler serves a fs9.FS over WebDAV (RFC 4918, class 1 and 2)
+type Handler struct {
+	fs     fs9.FS
+	prefix string
+	locks  *lockSystem
+}
+
+var _ http.Handler = new(Handler)
+
+// NewHandler returns a Handler serving fsys. prefix is stripped from request paths
+func NewHandler(fsys fs9.FS, prefix string) *Handler {
+	return &Handler{
+		fs:     fsys,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		locks:  newLockSystem(),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.nameOf(r.URL.Path)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	var status int
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		status, err = h.handleOptions(w, r, name)
+	case "GET", "HEAD":
+		status, err = h.handleGet(w, r, name)
+	case "PUT":
+		status, err = h.handlePut(w, r, name)
+	case "DELETE":
+		status, err = h.handleDelete(w, r, name)
+	case "MKCOL":
+		status, err = h.handleMkcol(w, r, name)
+	case "COPY", "MOVE":
+		status, err = h.handleCopyMove(w, r, name)
+	case "PROPFIND":
+		status, err = h.handlePropfind(w, r, name)
+	case "PROPPATCH":
+		status, err = h.handleProppatch(w, r, name)
+	case "LOCK":
+		status, err = h.handleLock(w, r, name)
+	case "UNLOCK":
+		status, err = h.handleUnlock(w, r, name)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	if status == 0 && err != nil {
+		status = errorStatus(err)
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		if status != http.StatusNoContent && r.Method != "HEAD" {
+			fmt.Fprintln(w, http.StatusText(status))
+		}
+	}
+}
+
+// nameOf converts an url path to a fs9 name
+func (h *Handler) nameOf(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, h.prefix) {
+		return "", false
+	}
+	p := path.Clean("/" + strings.TrimPrefix(urlPath, h.prefix))
+	if p == "/" {
+		return ".", true
+	}
+	return p[1:], true
+}
+
+// hrefOf converts a fs9 name to an escaped url path
+func (h *Handler) hrefOf(name string, isDir bool) string {
+	href := h.prefix + "/"
+	if name != "." {
+		parts := strings.Split(name, "/")
+		for i, part := range parts {
+			parts[i] = url.PathEscape(part)
+		}
+		href += strings.Join(parts, "/")
+		if isDir {
+			href += "/"
+		}
+	}
+	return href
+}
+
+func parentOf(name string) string {
+	return path.Dir(name)
+}
+
+// errorStatus maps fs9 errors to HTTP status codes
+func errorStatus(err error) int {
+	switch {
+	case is(err, errLocked):
+		return http.StatusLocked
+	case is(err, fs9.ErrFileNotFound),
+		is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case is(err, fs9.ErrDirNotEmpty),
+		is(err, fs9.ErrFileExisted),
+		is(err, fs9.ErrTypeMismatch),
+		is(err, fs9.ErrIsDir),
+		is(err, fs9.ErrCannotLink):
+		return http.StatusConflict
+	case is(err, fs9.ErrNoPermission),
+		is(err, fs9.ErrCannotRemove),
+		is(err, fs9.ErrImmutable),
+		is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case is(err, fs9.ErrInvalidPath),
+		is(err, fs9.ErrInvalidName),
+		is(err, fs9.ErrBadArgument):
+		return http.StatusBadRequest
+	case is(err, fs9.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case is(err, fs9.ErrTooManyLinks):
+		return http.StatusLoopDetected
+	}
+	return http.StatusInternalServerError
+}
+
+func etag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	allow := "OPTIONS, LOCK, PUT, MKCOL"
+	if info, err := h.fs.Stat(name); err == nil {
+		if info.IsDir() {
+			allow = "OPTIONS, LOCK, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
+		} else {
+			allow = "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT"
+		}
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	return 0, nil
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, err := h.fs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		// simple index
+		entries, err := fs.ReadDir(h.fs, name)
+		if err != nil {
+			return 0, err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == "HEAD" {
+			return 0, nil
+		}
+		fmt.Fprintf(w, "<html><body><ul>\n")
+		for _, entry := range entries {
+			href := h.hrefOf(path.Join(name, entry.Name()), entry.IsDir())
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n",
+				html.EscapeString(href),
+				html.EscapeString(entry.Name()),
+			)
+		}
+		fmt.Fprintf(w, "</ul></body></html>\n")
+		return 0, nil
+	}
+
+	handle, err := h.fs.OpenHandle(name, fs9.OptFlag(os.O_RDONLY, 0))
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	w.Header().Set("ETag", etag(info))
+	// ServeContent handles Range, HEAD and conditional requests
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), handle)
+	return 0, nil
+}
+
+func (h *Handler) checkParent(name string) (int, error) {
+	info, err := h.fs.Stat(parentOf(name))
+	if is(err, fs9.ErrFileNotFound) {
+		return http.StatusConflict, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return http.StatusConflict, nil
+	}
+	return 0, nil
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if err := h.locks.confirm(name, false, ifTokens(r)); err != nil {
+		return 0, err
+	}
+	if status, err := h.checkParent(name); status != 0 || err != nil {
+		return status, err
+	}
+	info, err := h.fs.Stat(name)
+	existed := err == nil
+	if existed && info.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	handle, err := h.fs.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	if _, err := io.Copy(handle, r.Body); err != nil {
+		return 0, err
+	}
+	if info, err := handle.Stat(); err == nil {
+		w.Header().Set("ETag", etag(info))
+	}
+	if existed {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if err := h.locks.confirm(name, true, ifTokens(r)); err != nil {
+		return 0, err
+	}
+	if err := h.fs.Remove(name, fs9.OptAll(true)); err != nil {
+		return 0, err
+	}
+	h.locks.remove(name)
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	if err := h.locks.confirm(name, false, ifTokens(r)); err != nil {
+		return 0, err
+	}
+	if status, err := h.checkParent(name); status != 0 || err != nil {
+		return status, err
+	}
+	if err := h.fs.MakeDir(name); is(err, fs9.ErrFileExisted) {
+		return http.StatusMethodNotAllowed, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+func isUnder(name string, dir string) bool {
+	if dir == "." {
+		return true
+	}
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return http.StatusBadRequest, nil
+	}
+	if dest.Host != "" && dest.Host != r.Host {
+		return http.StatusBadGateway, nil
+	}
+	destName, ok := h.nameOf(dest.Path)
+	if !ok {
+		return http.StatusBadGateway, nil
+	}
+	if isUnder(destName, name) || destName == "." {
+		// same resource, or destination inside source
+		return http.StatusForbidden, nil
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	recursive := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if r.Method == "MOVE" {
+			return http.StatusBadRequest, nil
+		}
+		recursive = false
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	if _, err := h.fs.LinkStat(name); err != nil {
+		return 0, err
+	}
+	tokens := ifTokens(r)
+	if r.Method == "MOVE" {
+		if err := h.locks.confirm(name, true, tokens); err != nil {
+			return 0, err
+		}
+	}
+	if err := h.locks.confirm(destName, true, tokens); err != nil {
+		return 0, err
+	}
+	if status, err := h.checkParent(destName); status != 0 || err != nil {
+		return status, err
+	}
+
+	_, err = h.fs.LinkStat(destName)
+	destExisted := err == nil
+	if destExisted && !overwrite {
+		return http.StatusPreconditionFailed, nil
+	}
+
+	if r.Method == "MOVE" {
+		// the destination is replaced by Rename atomically, and removed first only if not replaceable
+		err := h.fs.Rename(name, destName)
+		if destExisted && (is(err, fs9.ErrIsDir) || is(err, fs9.ErrNotDir) || is(err, fs9.ErrDirNotEmpty)) {
+			if err := h.fs.Remove(destName, fs9.OptAll(true)); err != nil {
+				return 0, err
+			}
+			err = h.fs.Rename(name, destName)
+		}
+		if is(err, fs9.ErrCrossDevice) {
+			// across dir quotas
+			if err := h.fs.Remove(destName, fs9.OptAll(true)); err != nil && !is(err, fs9.ErrFileNotFound) {
+				return 0, err
+			}
+			if err := h.copy(name, destName, true); err != nil {
+				return 0, err
+			}
+			if err := h.fs.Remove(name, fs9.OptAll(true)); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+		h.locks.remove(name)
+	} else {
+		if destExisted {
+			if err := h.fs.Remove(destName, fs9.OptAll(true)); err != nil {
+				return 0, err
+			}
+		}
+		if err := h.copy(name, destName, recursive); err != nil {
+			return 0, err
+		}
+	}
+
+	if destExisted {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) copy(src, dest string, recursive bool) error {
+	info, err := h.fs.LinkStat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := h.fs.ReadLink(src)
+		if err != nil {
+			return err
+		}
+		if err := h.fs.SymLink(target, dest); err != nil {
+			return err
+		}
+
+	case info.IsDir():
+		if err := h.fs.MakeDir(dest); err != nil {
+			return err
+		}
+		if err := h.fs.ChangeMode(dest, info.Mode()); err != nil {
+			return err
+		}
+		if recursive {
+			entries, err := fs.ReadDir(h.fs, src)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := h.copy(
+					path.Join(src, entry.Name()),
+					path.Join(dest, entry.Name()),
+					true,
+				); err != nil {
+					return err
+				}
+			}
+		}
+
+	default:
+		srcHandle, err := h.fs.OpenHandle(src, fs9.OptFlag(os.O_RDONLY, 0))
+		if err != nil {
+			return err
+		}
+		defer srcHandle.Close()
+		destHandle, err := h.fs.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer destHandle.Close()
+		if _, err := io.Copy(destHandle, srcHandle); err != nil {
+			return err
+		}
+		if err := destHandle.ChangeMode(info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return h.copyDeadProps(src, dest)
+	}
+	return nil
+}
+
+func modTimeAndAccessTime(info fs.FileInfo) (mtime time.Time, atime time.Time) {
+	mtime = info.ModTime()
+	atime = mtime
+	if ext, ok := info.Sys().(fs9.ExtFileInfo); ok {
+		atime = ext.AccessTime
+	}
+	return
+}
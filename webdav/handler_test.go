@@ -0,0 +1,364 @@
+package webdav
+
+import (
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reusee/e4"
+	"github.com/reusee/fs9"
+)
+
+type testServer struct {
+	t      *testing.T
+	fs     *fs9.MemFS
+	server *httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	fs := fs9.NewMemFS()
+	server := httptest.NewServer(NewHandler(fs, "/dav"))
+	t.Cleanup(server.Close)
+	return &testServer{
+		t:      t,
+		fs:     fs,
+		server: server,
+	}
+}
+
+func (s *testServer) do(method string, path string, body string, headers ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	ce(err)
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := s.server.Client().Do(req)
+	ce(err)
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	ce(err)
+	return resp, string(content)
+}
+
+func (s *testServer) expect(method string, path string, body string, status int, headers ...string) string {
+	resp, content := s.do(method, path, body, headers...)
+	if resp.StatusCode != status {
+		s.t.Helper()
+		s.t.Fatalf("%s %s: expected %d, got %d: %s", method, path, status, resp.StatusCode, content)
+	}
+	return content
+}
+
+func check(t *testing.T, ok bool, format string, args ...any) {
+	if !ok {
+		t.Helper()
+		t.Fatalf(format, args...)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+
+	s.expect("PUT", "/dav/foo", "hello, world", http.StatusCreated)
+	s.expect("PUT", "/dav/foo", "hello, webdav", http.StatusNoContent)
+	content := s.expect("GET", "/dav/foo", "", http.StatusOK)
+	check(t, content == "hello, webdav", "got %q", content)
+	data, err := iofs.ReadFile(s.fs, "foo")
+	ce(err)
+	check(t, string(data) == "hello, webdav", "got %q", data)
+
+	// range
+	content = s.expect("GET", "/dav/foo", "", http.StatusPartialContent, "Range", "bytes=7-")
+	check(t, content == "webdav", "got %q", content)
+
+	// not found
+	s.expect("GET", "/dav/bar", "", http.StatusNotFound)
+	s.expect("GET", "/bar", "", http.StatusNotFound)
+
+	// missing parent
+	s.expect("PUT", "/dav/bar/baz", "", http.StatusConflict)
+
+	// put to collection
+	s.expect("MKCOL", "/dav/bar", "", http.StatusCreated)
+	s.expect("PUT", "/dav/bar", "", http.StatusMethodNotAllowed)
+
+	// collection index
+	content = s.expect("GET", "/dav/", "", http.StatusOK)
+	check(t, strings.Contains(content, `href="/dav/bar/"`), "got %s", content)
+}
+
+func TestReadOnlyFile(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	fs := fs9.NewMemFS()
+	ce(fs.ChangeMode(".", 0777))
+	user := fs.WithCredentials(fs9.Credentials{UserID: 1000, GroupID: 100})
+	h, err := user.Create("foo")
+	ce(err)
+	_, err = h.Write([]byte("foo"))
+	ce(err)
+	ce(h.Close())
+	ce(user.ChangeMode("foo", 0444))
+	server := httptest.NewServer(NewHandler(user, "/dav"))
+	t.Cleanup(server.Close)
+	s := &testServer{
+		t:      t,
+		fs:     fs,
+		server: server,
+	}
+
+	content := s.expect("GET", "/dav/foo", "", http.StatusOK)
+	check(t, content == "foo", "got %q", content)
+	s.expect("COPY", "/dav/foo", "", http.StatusCreated, "Destination", server.URL+"/dav/bar")
+	data, err := iofs.ReadFile(fs, "bar")
+	ce(err)
+	check(t, string(data) == "foo", "got %q", data)
+}
+
+func TestMkcolDelete(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+
+	s.expect("MKCOL", "/dav/foo", "", http.StatusCreated)
+	s.expect("MKCOL", "/dav/foo", "", http.StatusMethodNotAllowed)
+	s.expect("MKCOL", "/dav/bar/baz", "", http.StatusConflict)
+	s.expect("MKCOL", "/dav/qux", "body", http.StatusUnsupportedMediaType)
+	s.expect("PUT", "/dav/foo/bar", "bar", http.StatusCreated)
+
+	s.expect("DELETE", "/dav/foo", "", http.StatusNoContent)
+	_, err := s.fs.Stat("foo")
+	check(t, is(err, fs9.ErrFileNotFound), "got %v", err)
+	s.expect("DELETE", "/dav/foo", "", http.StatusNotFound)
+	s.expect("DELETE", "/dav/", "", http.StatusForbidden)
+}
+
+func TestCopyMove(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+	dest := func(p string) string {
+		return s.server.URL + p
+	}
+
+	s.expect("MKCOL", "/dav/foo", "", http.StatusCreated)
+	s.expect("PUT", "/dav/foo/bar", "bar", http.StatusCreated)
+	ce(s.fs.SymLink("foo/bar", "foo/link"))
+
+	// copy
+	s.expect("COPY", "/dav/foo", "", http.StatusCreated, "Destination", dest("/dav/baz"))
+	data, err := iofs.ReadFile(s.fs, "baz/bar")
+	ce(err)
+	check(t, string(data) == "bar", "got %q", data)
+	link, err := s.fs.ReadLink("baz/link")
+	ce(err)
+	check(t, link == "foo/bar", "got %q", link)
+
+	// shallow copy
+	s.expect("COPY", "/dav/foo", "", http.StatusCreated, "Destination", dest("/dav/shallow"), "Depth", "0")
+	entries, err := iofs.ReadDir(s.fs, "shallow")
+	ce(err)
+	check(t, len(entries) == 0, "got %d", len(entries))
+
+	// no overwrite
+	s.expect("COPY", "/dav/foo", "", http.StatusPreconditionFailed, "Destination", dest("/dav/baz"), "Overwrite", "F")
+	// overwrite
+	s.expect("COPY", "/dav/foo/bar", "", http.StatusNoContent, "Destination", dest("/dav/baz"))
+	info, err := s.fs.Stat("baz")
+	ce(err)
+	check(t, !info.IsDir(), "should be file")
+
+	// move
+	s.expect("MOVE", "/dav/foo", "", http.StatusCreated, "Destination", dest("/dav/qux"))
+	_, err = s.fs.Stat("foo")
+	check(t, is(err, fs9.ErrFileNotFound), "got %v", err)
+	data, err = iofs.ReadFile(s.fs, "qux/bar")
+	ce(err)
+	check(t, string(data) == "bar", "got %q", data)
+
+	// move over existing
+	s.expect("PUT", "/dav/x", "x", http.StatusCreated)
+	s.expect("PUT", "/dav/y", "y", http.StatusCreated)
+	s.expect("MOVE", "/dav/x", "", http.StatusNoContent, "Destination", dest("/dav/y"))
+	data, err = iofs.ReadFile(s.fs, "y")
+	ce(err)
+	check(t, string(data) == "x", "got %q", data)
+	s.expect("MOVE", "/dav/qux", "", http.StatusNoContent, "Destination", dest("/dav/y"))
+	data, err = iofs.ReadFile(s.fs, "y/bar")
+	ce(err)
+	check(t, string(data) == "bar", "got %q", data)
+
+	// bad destinations
+	s.expect("MOVE", "/dav/y", "", http.StatusForbidden, "Destination", dest("/dav/y/sub"))
+	s.expect("MOVE", "/dav/y", "", http.StatusBadGateway, "Destination", "http://example.com/dav/x")
+	s.expect("MOVE", "/dav/y", "", http.StatusConflict, "Destination", dest("/dav/no/x"))
+	s.expect("MOVE", "/dav/nonexist", "", http.StatusNotFound, "Destination", dest("/dav/x"))
+}
+
+func TestPropfind(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+
+	s.expect("MKCOL", "/dav/foo", "", http.StatusCreated)
+	s.expect("PUT", "/dav/foo/bar.txt", "bar", http.StatusCreated)
+	s.expect("PUT", "/dav/foo/with space", "", http.StatusCreated)
+
+	// depth 0
+	content := s.expect("PROPFIND", "/dav/foo", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, "<D:collection/>"), "got %s", content)
+	check(t, !strings.Contains(content, "bar.txt"), "got %s", content)
+
+	// depth 1
+	content = s.expect("PROPFIND", "/dav/foo", "", http.StatusMultiStatus, "Depth", "1")
+	check(t, strings.Contains(content, "<D:href>/dav/foo/bar.txt</D:href>"), "got %s", content)
+	check(t, strings.Contains(content, "<D:href>/dav/foo/with%20space</D:href>"), "got %s", content)
+	check(t, strings.Contains(content, "<D:getcontentlength>3</D:getcontentlength>"), "got %s", content)
+	check(t, strings.Contains(content, "<D:getcontenttype>text/plain; charset=utf-8</D:getcontenttype>"), "got %s", content)
+
+	// named props
+	content = s.expect("PROPFIND", "/dav/foo/bar.txt", `<?xml version="1.0"?>
+		<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><x:foo xmlns:x="urn:x"/></D:prop></D:propfind>`,
+		http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, "<D:getcontentlength>3</D:getcontentlength>"), "got %s", content)
+	check(t, strings.Contains(content, `<foo xmlns="urn:x"></foo></D:prop><D:status>HTTP/1.1 404 Not Found`), "got %s", content)
+
+	// prop names
+	content = s.expect("PROPFIND", "/dav/foo/bar.txt", `<?xml version="1.0"?>
+		<propfind xmlns="DAV:"><propname/></propfind>`,
+		http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, "<D:getetag></D:getetag>"), "got %s", content)
+
+	s.expect("PROPFIND", "/dav/nonexist", "", http.StatusNotFound)
+	s.expect("PROPFIND", "/dav/foo", "<bad", http.StatusBadRequest)
+}
+
+func TestProppatch(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+	s.expect("PUT", "/dav/foo", "foo", http.StatusCreated)
+
+	// set dead property and modification time
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := s.expect("PROPPATCH", "/dav/foo", `<?xml version="1.0"?>
+		<D:propertyupdate xmlns:D="DAV:" xmlns:x="urn:x">
+			<D:set><D:prop>
+				<x:color>red</x:color>
+				<D:getlastmodified>`+mtime.Format(http.TimeFormat)+`</D:getlastmodified>
+			</D:prop></D:set>
+		</D:propertyupdate>`, http.StatusMultiStatus)
+	check(t, strings.Contains(content, "HTTP/1.1 200 OK"), "got %s", content)
+	info, err := s.fs.Stat("foo")
+	ce(err)
+	check(t, info.ModTime().Equal(mtime), "got %v", info.ModTime())
+	content = s.expect("PROPFIND", "/dav/foo", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, `<color xmlns="urn:x">red</color>`), "got %s", content)
+
+	// protected property fails the whole request
+	content = s.expect("PROPPATCH", "/dav/foo", `<?xml version="1.0"?>
+		<D:propertyupdate xmlns:D="DAV:" xmlns:x="urn:x">
+			<D:remove><D:prop><x:color/></D:prop></D:remove>
+			<D:set><D:prop><D:getetag>x</D:getetag></D:prop></D:set>
+		</D:propertyupdate>`, http.StatusMultiStatus)
+	check(t, strings.Contains(content, "424 Failed Dependency"), "got %s", content)
+	check(t, strings.Contains(content, "403 Forbidden"), "got %s", content)
+
+	// remove
+	s.expect("PROPPATCH", "/dav/foo", `<?xml version="1.0"?>
+		<D:propertyupdate xmlns:D="DAV:" xmlns:x="urn:x">
+			<D:remove><D:prop><x:color/></D:prop></D:remove>
+		</D:propertyupdate>`, http.StatusMultiStatus)
+	content = s.expect("PROPFIND", "/dav/foo", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, !strings.Contains(content, "color"), "got %s", content)
+
+	// moved with the resource
+	s.expect("PROPPATCH", "/dav/foo", `<?xml version="1.0"?>
+		<D:propertyupdate xmlns:D="DAV:" xmlns:x="urn:x">
+			<D:set><D:prop><x:color>blue</x:color></D:prop></D:set>
+		</D:propertyupdate>`, http.StatusMultiStatus)
+	s.expect("MOVE", "/dav/foo", "", http.StatusCreated, "Destination", s.server.URL+"/dav/bar")
+	content = s.expect("PROPFIND", "/dav/bar", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, `<color xmlns="urn:x">blue</color>`), "got %s", content)
+
+	// stored as extended attributes and copied with the resource
+	value, err := s.fs.GetXattr("bar", "user.webdav.{urn:x}color")
+	ce(err)
+	check(t, string(value) == "blue", "got %s", value)
+	s.expect("COPY", "/dav/bar", "", http.StatusCreated, "Destination", s.server.URL+"/dav/baz")
+	content = s.expect("PROPFIND", "/dav/baz", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, `<color xmlns="urn:x">blue</color>`), "got %s", content)
+}
+
+func TestLock(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+	s.expect("MKCOL", "/dav/dir", "", http.StatusCreated)
+
+	lockBody := `<?xml version="1.0"?>
+		<D:lockinfo xmlns:D="DAV:">
+			<D:lockscope><D:exclusive/></D:lockscope>
+			<D:locktype><D:write/></D:locktype>
+			<D:owner><D:href>me</D:href></D:owner>
+		</D:lockinfo>`
+
+	// lock unmapped url
+	resp, content := s.do("LOCK", "/dav/dir/foo", lockBody, "Timeout", "Second-60")
+	check(t, resp.StatusCode == http.StatusCreated, "got %d: %s", resp.StatusCode, content)
+	token := resp.Header.Get("Lock-Token")
+	check(t, strings.HasPrefix(token, "<opaquelocktoken:"), "got %s", token)
+	check(t, strings.Contains(content, "<D:timeout>Second-60</D:timeout>"), "got %s", content)
+	_, err := s.fs.Stat("dir/foo")
+	ce(err)
+
+	// locked
+	s.expect("PUT", "/dav/dir/foo", "foo", http.StatusLocked)
+	s.expect("DELETE", "/dav/dir", "", http.StatusLocked)
+	s.expect("LOCK", "/dav/dir", lockBody, http.StatusLocked)
+	s.expect("PUT", "/dav/dir/foo", "foo", http.StatusNoContent, "If", "("+token+")")
+	s.expect("PUT", "/dav/dir/bar", "bar", http.StatusCreated)
+
+	// discovery
+	content = s.expect("PROPFIND", "/dav/dir/foo", "", http.StatusMultiStatus, "Depth", "0")
+	check(t, strings.Contains(content, "<D:owner><D:href>me</D:href></D:owner>"), "got %s", content)
+
+	// refresh
+	content = s.expect("LOCK", "/dav/dir/foo", "", http.StatusOK, "If", "("+token+")", "Timeout", "Second-120")
+	check(t, strings.Contains(content, "<D:timeout>Second-120</D:timeout>"), "got %s", content)
+	s.expect("LOCK", "/dav/dir/foo", "", http.StatusPreconditionFailed, "If", "(<opaquelocktoken:bad>)")
+
+	// unlock
+	s.expect("UNLOCK", "/dav/dir/bar", "", http.StatusConflict, "Lock-Token", token)
+	s.expect("UNLOCK", "/dav/dir/foo", "", http.StatusNoContent, "Lock-Token", token)
+	s.expect("PUT", "/dav/dir/foo", "foo", http.StatusNoContent)
+
+	// shared locks
+	shared := strings.Replace(lockBody, "exclusive", "shared", 1)
+	s.expect("LOCK", "/dav/dir", shared, http.StatusOK)
+	s.expect("LOCK", "/dav/dir/bar", shared, http.StatusOK, "Depth", "0")
+	s.expect("LOCK", "/dav/dir/bar", lockBody, http.StatusLocked, "Depth", "0")
+}
+
+func TestOptions(t *testing.T) {
+	defer he(nil, e4.TestingFatal(t))
+	s := newTestServer(t)
+	resp, _ := s.do("OPTIONS", "/dav/", "")
+	check(t, resp.Header.Get("DAV") == "1, 2", "got %s", resp.Header.Get("DAV"))
+	check(t, strings.Contains(resp.Header.Get("Allow"), "PROPFIND"), "got %s", resp.Header.Get("Allow"))
+}
+
+func TestErrorStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		fs9.ErrFileNotFound:  http.StatusNotFound,
+		fs9.ErrDirNotEmpty:   http.StatusConflict,
+		fs9.ErrIsDir:         http.StatusConflict,
+		fs9.ErrNoPermission:  http.StatusForbidden,
+		fs9.ErrInvalidPath:   http.StatusBadRequest,
+		fs9.ErrQuotaExceeded: http.StatusInsufficientStorage,
+		fs9.ErrTooManyLinks:  http.StatusLoopDetected,
+		errLocked:            http.StatusLocked,
+		io.ErrUnexpectedEOF:  http.StatusInternalServerError,
+	} {
+		check(t, errorStatus(we(err)) == status, "%v: got %d", err, errorStatus(err))
+	}
+}
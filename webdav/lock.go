@@ -0,0 +1,311 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reusee/fs9"
+)
+
+var errLocked = errors.New("locked")
+
+const (
+	defaultLockTimeout = time.Hour
+	maxLockTimeout     = 24 * time.Hour
+)
+
+type lock struct {
+	token    string
+	root     string // fs9 name
+	infinite bool
+	shared   bool
+	owner    string // inner xml
+	timeout  time.Duration
+	expires  time.Time
+}
+
+// covers reports whether name is locked by l
+func (l *lock) covers(name string) bool {
+	if l.infinite {
+		return isUnder(name, l.root)
+	}
+	return name == l.root
+}
+
+type lockSystem struct {
+	sync.Mutex
+	locks map[string]*lock // token -> lock
+}
+
+func newLockSystem() *lockSystem {
+	return &lockSystem{
+		locks: make(map[string]*lock),
+	}
+}
+
+func (l *lockSystem) expire(now time.Time) {
+	for token, lock := range l.locks {
+		if now.After(lock.expires) {
+			delete(l.locks, token)
+		}
+	}
+}
+
+// confirm returns errLocked if name is locked by a lock not in tokens.
+// if recursive, locks on descendants of name are also checked
+func (l *lockSystem) confirm(name string, recursive bool, tokens []string) error {
+	l.Lock()
+	defer l.Unlock()
+	l.expire(time.Now())
+loop_locks:
+	for token, lock := range l.locks {
+		if !lock.covers(name) && !(recursive && isUnder(lock.root, name)) {
+			continue
+		}
+		for _, t := range tokens {
+			if t == token {
+				continue loop_locks
+			}
+		}
+		return errLocked
+	}
+	return nil
+}
+
+func (l *lockSystem) create(name string, infinite bool, shared bool, owner string, timeout time.Duration) (*lock, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.expire(now)
+	for _, existing := range l.locks {
+		conflict := existing.covers(name) ||
+			infinite && isUnder(existing.root, name)
+		if conflict && !(shared && existing.shared) {
+			return nil, errLocked
+		}
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil { // NOCOVER
+		return nil, err
+	}
+	newLock := &lock{
+		token:    fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", token[:4], token[4:6], token[6:8], token[8:10], token[10:]),
+		root:     name,
+		infinite: infinite,
+		shared:   shared,
+		owner:    owner,
+		timeout:  timeout,
+		expires:  now.Add(timeout),
+	}
+	l.locks[newLock.token] = newLock
+	return newLock, nil
+}
+
+func (l *lockSystem) refresh(name string, tokens []string, timeout time.Duration) *lock {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.expire(now)
+	for _, token := range tokens {
+		if lock, ok := l.locks[token]; ok && lock.covers(name) {
+			lock.timeout = timeout
+			lock.expires = now.Add(timeout)
+			return lock
+		}
+	}
+	return nil
+}
+
+func (l *lockSystem) unlock(name string, token string) bool {
+	l.Lock()
+	defer l.Unlock()
+	lock, ok := l.locks[token]
+	if !ok || !lock.covers(name) {
+		return false
+	}
+	delete(l.locks, token)
+	return true
+}
+
+// remove deletes locks of name and its descendants
+func (l *lockSystem) remove(name string) {
+	l.Lock()
+	defer l.Unlock()
+	for token, lock := range l.locks {
+		if isUnder(lock.root, name) {
+			delete(l.locks, token)
+		}
+	}
+}
+
+// discover returns locks covering name
+func (l *lockSystem) discover(name string) (ret []*lock) {
+	l.Lock()
+	defer l.Unlock()
+	l.expire(time.Now())
+	for _, lock := range l.locks {
+		if lock.covers(name) {
+			ret = append(ret, lock)
+		}
+	}
+	return
+}
+
+var (
+	ifListPattern  = regexp.MustCompile(`\(([^)]*)\)`)
+	ifTokenPattern = regexp.MustCompile(`<([^>]*)>`)
+)
+
+// ifTokens returns state tokens in the If header
+func ifTokens(r *http.Request) (tokens []string) {
+	for _, list := range ifListPattern.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		for _, token := range ifTokenPattern.FindAllStringSubmatch(list[1], -1) {
+			tokens = append(tokens, token[1])
+		}
+	}
+	return
+}
+
+func parseTimeout(header string) time.Duration {
+	// the first supported value is used
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return maxLockTimeout
+		}
+		if strings.HasPrefix(value, "Second-") {
+			seconds, err := strconv.ParseUint(strings.TrimPrefix(value, "Second-"), 10, 32)
+			if err != nil {
+				continue
+			}
+			timeout := time.Duration(seconds) * time.Second
+			if timeout > maxLockTimeout {
+				timeout = maxLockTimeout
+			}
+			return timeout
+		}
+	}
+	return defaultLockTimeout
+}
+
+func writeActiveLock(w io.Writer, h *Handler, l *lock) {
+	scope := "exclusive"
+	if l.shared {
+		scope = "shared"
+	}
+	depth := "0"
+	if l.infinite {
+		depth = "infinity"
+	}
+	fmt.Fprintf(w, "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope>", scope)
+	fmt.Fprintf(w, "<D:depth>%s</D:depth>", depth)
+	if l.owner != "" {
+		fmt.Fprintf(w, "<D:owner>%s</D:owner>", l.owner)
+	}
+	fmt.Fprintf(w, "<D:timeout>Second-%d</D:timeout>", int64(l.timeout/time.Second))
+	fmt.Fprintf(w, "<D:locktoken><D:href>%s</D:href></D:locktoken>", escapeXML(l.token))
+	fmt.Fprintf(w, "<D:lockroot><D:href>%s</D:href></D:lockroot>", escapeXML(h.hrefOf(l.root, false)))
+	fmt.Fprintf(w, "</D:activelock>")
+}
+
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+	body, err := readBody(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var l *lock
+	status := http.StatusOK
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		// refresh
+		l = h.locks.refresh(name, ifTokens(r), timeout)
+		if l == nil {
+			return http.StatusPreconditionFailed, nil
+		}
+
+	} else {
+		var info lockInfo
+		if err := xml.Unmarshal(body, &info); err != nil {
+			return http.StatusBadRequest, nil
+		}
+		if info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil) {
+			return http.StatusBadRequest, nil
+		}
+		infinite := true
+		switch r.Header.Get("Depth") {
+		case "", "infinity":
+		case "0":
+			infinite = false
+		default:
+			return http.StatusBadRequest, nil
+		}
+
+		l, err = h.locks.create(name, infinite, info.Shared != nil, info.Owner.InnerXML, timeout)
+		if err != nil {
+			return 0, err
+		}
+
+		// locking an unmapped url creates an empty resource
+		if _, err := h.fs.Stat(name); is(err, fs9.ErrFileNotFound) {
+			parentStatus, err := h.checkParent(name)
+			if parentStatus == 0 && err == nil {
+				var handle fs9.Handle
+				handle, err = h.fs.Create(name)
+				if err == nil {
+					err = handle.Close()
+				}
+			}
+			if parentStatus != 0 || err != nil {
+				h.locks.unlock(name, l.token)
+				return parentStatus, err
+			}
+			status = http.StatusCreated
+		} else if err != nil {
+			h.locks.unlock(name, l.token)
+			return 0, err
+		}
+		w.Header().Set("Lock-Token", "<"+l.token+">")
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n")
+	io.WriteString(w, `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`)
+	writeActiveLock(w, h, l)
+	io.WriteString(w, "</D:lockdiscovery></D:prop>\n")
+	return 0, nil
+}
+
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		return http.StatusBadRequest, nil
+	}
+	token = token[1 : len(token)-1]
+	if !h.locks.unlock(name, token) {
+		return http.StatusConflict, nil
+	}
+	return http.StatusNoContent, nil
+}
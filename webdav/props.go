@@ -0,0 +1,449 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/reusee/fs9"
+)
+
+const davNS = "DAV:"
+
+// property is a named property with its value as inner xml
+type property struct {
+	XMLName  xml.Name
+	InnerXML string `xml:",innerxml"`
+}
+
+// propNames collects names of child elements
+type propNames []xml.Name
+
+func (p *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			*p = append(*p, token.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     propNames `xml:"DAV: prop"`
+}
+
+type proppatchRequest struct {
+	XMLName xml.Name        `xml:"DAV: propertyupdate"`
+	Items   []proppatchItem `xml:",any"`
+}
+
+type proppatchItem struct {
+	XMLName xml.Name
+	Prop    struct {
+		Props []property `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// dead properties set by PROPPATCH are stored as extended attributes of the file,
+// named by the prefix and the property name in clark notation
+const (
+	deadPropPrefix  = "user.webdav."
+	maxDeadPropName = 255 // length limit of extended attribute names
+)
+
+func deadPropAttr(name xml.Name) string {
+	return deadPropPrefix + "{" + name.Space + "}" + name.Local
+}
+
+func parseDeadPropAttr(attr string) (name xml.Name, ok bool) {
+	s := strings.TrimPrefix(attr, deadPropPrefix)
+	if len(s) == len(attr) || !strings.HasPrefix(s, "{") {
+		return
+	}
+	i := strings.LastIndex(s, "}")
+	if i < 0 {
+		return
+	}
+	return xml.Name{Space: s[1:i], Local: s[i+1:]}, true
+}
+
+func (h *Handler) deadProps(name string) ([]property, error) {
+	attrs, err := h.fs.ListXattr(name)
+	if err != nil {
+		return nil, err
+	}
+	var ret []property
+	for _, attr := range attrs {
+		propName, ok := parseDeadPropAttr(attr)
+		if !ok {
+			continue
+		}
+		value, err := h.fs.GetXattr(name, attr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, property{
+			XMLName:  propName,
+			InnerXML: string(value),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i].XMLName, ret[j].XMLName
+		if a.Space != b.Space {
+			return a.Space < b.Space
+		}
+		return a.Local < b.Local
+	})
+	return ret, nil
+}
+
+func (h *Handler) setDeadProps(name string, props []property, removes []xml.Name) error {
+	for _, prop := range props {
+		if err := h.fs.SetXattr(name, deadPropAttr(prop.XMLName), []byte(prop.InnerXML), 0); err != nil {
+			return err
+		}
+	}
+	for _, propName := range removes {
+		if err := h.fs.RemoveXattr(name, deadPropAttr(propName)); err != nil && !is(err, fs9.ErrXattrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDeadProps copies dead properties of src to dest
+func (h *Handler) copyDeadProps(src, dest string) error {
+	props, err := h.deadProps(src)
+	if err != nil {
+		return err
+	}
+	return h.setDeadProps(dest, props, nil)
+}
+
+// live properties
+var liveProps = []xml.Name{
+	{Space: davNS, Local: "resourcetype"},
+	{Space: davNS, Local: "displayname"},
+	{Space: davNS, Local: "getcontentlength"},
+	{Space: davNS, Local: "getlastmodified"},
+	{Space: davNS, Local: "getcontenttype"},
+	{Space: davNS, Local: "getetag"},
+	{Space: davNS, Local: "supportedlock"},
+	{Space: davNS, Local: "lockdiscovery"},
+}
+
+func isLiveProp(name xml.Name) bool {
+	for _, live := range liveProps {
+		if live == name {
+			return true
+		}
+	}
+	return false
+}
+
+func escapeXML(s string) string {
+	buf := new(strings.Builder)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// liveProp returns the value of a live property. ok is false if the resource does not have it
+func (h *Handler) liveProp(name string, info fs.FileInfo, propName xml.Name) (value string, ok bool) {
+	if propName.Space != davNS {
+		return "", false
+	}
+	switch propName.Local {
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		if name == "." {
+			return "", false
+		}
+		return escapeXML(path.Base(name)), true
+	case "getcontentlength":
+		if info.IsDir() {
+			return "", false
+		}
+		return fmt.Sprintf("%d", info.Size()), true
+	case "getlastmodified":
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+	case "getcontenttype":
+		if info.IsDir() {
+			return "", false
+		}
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		return escapeXML(ctype), true
+	case "getetag":
+		if info.IsDir() {
+			return "", false
+		}
+		return escapeXML(etag(info)), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		buf := new(strings.Builder)
+		for _, l := range h.locks.discover(name) {
+			writeActiveLock(buf, h, l)
+		}
+		return buf.String(), true
+	}
+	return "", false
+}
+
+type propstat struct {
+	status int
+	props  []property
+}
+
+func writeProp(w io.Writer, prop property) {
+	if prop.XMLName.Space == davNS {
+		fmt.Fprintf(w, "<D:%s>%s</D:%s>", prop.XMLName.Local, prop.InnerXML, prop.XMLName.Local)
+		return
+	}
+	fmt.Fprintf(w, "<%s xmlns=\"%s\">%s</%s>",
+		prop.XMLName.Local,
+		escapeXML(prop.XMLName.Space),
+		prop.InnerXML,
+		prop.XMLName.Local,
+	)
+}
+
+func writeResponse(w io.Writer, href string, propstats []propstat) {
+	fmt.Fprintf(w, "<D:response><D:href>%s</D:href>", escapeXML(href))
+	for _, ps := range propstats {
+		if len(ps.props) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "<D:propstat><D:prop>")
+		for _, prop := range ps.props {
+			writeProp(w, prop)
+		}
+		fmt.Fprintf(w, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>",
+			ps.status, http.StatusText(ps.status))
+	}
+	fmt.Fprintf(w, "</D:response>")
+}
+
+func writeMultistatus(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n")
+	io.WriteString(w, `<D:multistatus xmlns:D="DAV:">`)
+	w.Write(body)
+	io.WriteString(w, "</D:multistatus>\n")
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r.Body, 1<<20))
+}
+
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, err := h.fs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+
+	depth := -1
+	switch r.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "1":
+		depth = 1
+	case "", "infinity":
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return 0, err
+	}
+	var req propfindRequest
+	if len(bytes.TrimSpace(body)) == 0 {
+		req.AllProp = new(struct{})
+	} else if err := xml.Unmarshal(body, &req); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	buf := new(bytes.Buffer)
+	var walk func(name string, info fs.FileInfo, depth int) error
+	walk = func(name string, info fs.FileInfo, depth int) error {
+		var found, notFound propstat
+		found.status = http.StatusOK
+		notFound.status = http.StatusNotFound
+		dead, err := h.deadProps(name)
+		if err != nil {
+			return err
+		}
+
+		switch {
+
+		case req.PropName != nil:
+			for _, propName := range liveProps {
+				if _, ok := h.liveProp(name, info, propName); ok {
+					found.props = append(found.props, property{XMLName: propName})
+				}
+			}
+			for _, prop := range dead {
+				found.props = append(found.props, property{XMLName: prop.XMLName})
+			}
+
+		case req.AllProp != nil:
+			for _, propName := range liveProps {
+				if value, ok := h.liveProp(name, info, propName); ok {
+					found.props = append(found.props, property{XMLName: propName, InnerXML: value})
+				}
+			}
+			found.props = append(found.props, dead...)
+
+		default:
+			values := make(map[xml.Name]string)
+			for _, prop := range dead {
+				values[prop.XMLName] = prop.InnerXML
+			}
+			for _, propName := range req.Prop {
+				if value, ok := h.liveProp(name, info, propName); ok {
+					found.props = append(found.props, property{XMLName: propName, InnerXML: value})
+				} else if value, ok := values[propName]; ok {
+					found.props = append(found.props, property{XMLName: propName, InnerXML: value})
+				} else {
+					notFound.props = append(notFound.props, property{XMLName: propName})
+				}
+			}
+
+		}
+
+		writeResponse(buf, h.hrefOf(name, info.IsDir()), []propstat{found, notFound})
+
+		if !info.IsDir() || depth == 0 {
+			return nil
+		}
+		entries, err := fs.ReadDir(h.fs, name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			subName := path.Join(name, entry.Name())
+			subInfo, err := h.fs.Stat(subName)
+			if is(err, fs.ErrNotExist) || errorStatus(err) == http.StatusNotFound {
+				// dangling symlink
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := walk(subName, subInfo, depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(name, info, depth); err != nil {
+		return 0, err
+	}
+
+	writeMultistatus(w, buf.Bytes())
+	return 0, nil
+}
+
+var lastModifiedProp = xml.Name{Space: davNS, Local: "getlastmodified"}
+
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, err := h.fs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.locks.confirm(name, false, ifTokens(r)); err != nil {
+		return 0, err
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return 0, err
+	}
+	var req proppatchRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	// validate
+	var ok, forbidden propstat
+	ok.status = http.StatusOK
+	forbidden.status = http.StatusForbidden
+	var sets []property
+	var removes []xml.Name
+	var mtime *string
+	for _, item := range req.Items {
+		if item.XMLName.Space != davNS {
+			continue
+		}
+		for _, prop := range item.Prop.Props {
+			switch {
+			case prop.XMLName == lastModifiedProp && item.XMLName.Local == "set":
+				value := strings.TrimSpace(prop.InnerXML)
+				if _, err := http.ParseTime(value); err != nil {
+					forbidden.props = append(forbidden.props, property{XMLName: prop.XMLName})
+					continue
+				}
+				mtime = &value
+			case isLiveProp(prop.XMLName),
+				len(deadPropAttr(prop.XMLName)) > maxDeadPropName:
+				forbidden.props = append(forbidden.props, property{XMLName: prop.XMLName})
+				continue
+			case item.XMLName.Local == "set":
+				sets = append(sets, prop)
+			case item.XMLName.Local == "remove":
+				removes = append(removes, prop.XMLName)
+			default:
+				continue
+			}
+			ok.props = append(ok.props, property{XMLName: prop.XMLName})
+		}
+	}
+
+	if len(forbidden.props) > 0 {
+		// all or nothing
+		ok.status = http.StatusFailedDependency
+	} else {
+		if err := h.setDeadProps(name, sets, removes); err != nil {
+			return 0, err
+		}
+		if mtime != nil {
+			t, _ := http.ParseTime(*mtime)
+			_, atime := modTimeAndAccessTime(info)
+			if err := h.fs.ChangeTimes(name, atime, t); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	writeResponse(buf, h.hrefOf(name, info.IsDir()), []propstat{ok, forbidden})
+	writeMultistatus(w, buf.Bytes())
+	return 0, nil
+}
@@ -0,0 +1,372 @@
+package fs9
+
+import (
+	"bytes"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/reusee/e4"
+)
+
+// flags of SetXattr
+const (
+	// fail if the attribute exists
+	XATTR_CREATE = 1
+	// fail if the attribute does not exist
+	XATTR_REPLACE = 2
+)
+
+const (
+	maxXattrNameLen  = 255
+	maxXattrValueLen = 64 << 10
+)
+
+// namespaces of extended attribute names.
+// user attributes are checked against file permissions, trusted ones are for user id 0 only,
+// security ones are readable by all and writable by the owner
+var xattrNamespaces = []string{"user.", "trusted.", "security."}
+
+func checkXattrName(attr string) error {
+	if len(attr) > maxXattrNameLen {
+		return we.With(
+			e4.Info("name too long: %s", attr),
+		)(ErrXattrTooLarge)
+	}
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(attr, ns) {
+			if len(attr) == len(ns) {
+				return we.With(
+					e4.Info("empty name: %s", attr),
+				)(ErrInvalidName)
+			}
+			return nil
+		}
+	}
+	return we.With(
+		e4.Info("namespace of %s", attr),
+	)(ErrNotSupported)
+}
+
+// checkXattr checks name of the attribute and permission to access it
+func (m *MemFSReadBatch) checkXattr(file *File, attr string, write bool) error {
+	if err := checkXattrName(attr); err != nil {
+		return err
+	}
+	c := m.cred
+	switch {
+	case strings.HasPrefix(attr, "trusted."):
+		if c != nil && c.UserID != 0 {
+			return we.With(
+				e4.Info("trusted namespace"),
+			)(ErrNoPermission)
+		}
+	case strings.HasPrefix(attr, "security."):
+		if write {
+			return m.checkOwner(file)
+		}
+	case strings.HasPrefix(attr, "user."):
+		if file.Mode&fs.ModeType&^fs.ModeDir != 0 {
+			return we.With(
+				e4.Info("user namespace of %v", file.Mode.Type()),
+			)(ErrNoPermission)
+		}
+		if write {
+			return m.checkPerm(file, permWrite)
+		}
+		return m.checkPerm(file, permRead)
+	}
+	return nil
+}
+
+func fileSetXattr(attr string, value []byte, flag int) func(*File) error {
+	return func(file *File) error {
+		if len(value) > maxXattrValueLen {
+			return we.With(
+				e4.Info("value size %d", len(value)),
+			)(ErrXattrTooLarge)
+		}
+		_, ok := file.Xattrs[attr]
+		if ok && flag&XATTR_CREATE != 0 {
+			return we.With(
+				e4.Info("%s", attr),
+			)(ErrXattrExisted)
+		}
+		if !ok && flag&XATTR_REPLACE != 0 {
+			return we.With(
+				e4.Info("%s", attr),
+			)(ErrXattrNotFound)
+		}
+		// copy on write, the map may be shared by other versions of the file
+		xattrs := make(map[string][]byte, len(file.Xattrs)+1)
+		for k, v := range file.Xattrs {
+			xattrs[k] = v
+		}
+		xattrs[attr] = append([]byte{}, value...)
+		file.Xattrs = xattrs
+		return nil
+	}
+}
+
+func fileRemoveXattr(attr string) func(*File) error {
+	return func(file *File) error {
+		if _, ok := file.Xattrs[attr]; !ok {
+			return we.With(
+				e4.Info("%s", attr),
+			)(ErrXattrNotFound)
+		}
+		var xattrs map[string][]byte
+		if len(file.Xattrs) > 1 {
+			xattrs = make(map[string][]byte, len(file.Xattrs)-1)
+			for k, v := range file.Xattrs {
+				if k != attr {
+					xattrs[k] = v
+				}
+			}
+		}
+		file.Xattrs = xattrs
+		return nil
+	}
+}
+
+func sameXattr(a, b []byte, okA, okB bool) bool {
+	return okA == okB && bytes.Equal(a, b)
+}
+
+// sameXattrs reports whether a and b have the same extended attributes
+func sameXattrs(a, b *File) bool {
+	if len(a.Xattrs) != len(b.Xattrs) {
+		return false
+	}
+	for attr, value := range a.Xattrs {
+		other, ok := b.Xattrs[attr]
+		if !sameXattr(value, other, true, ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeXattrs merges extended attributes of o and t into file, per attribute
+func mergeXattrs(b, o, t *File, conflict func(attr string), file *File) {
+	if sameXattrs(b, t) || sameXattrs(o, t) {
+		return
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, xattrs := range []map[string][]byte{b.Xattrs, o.Xattrs, t.Xattrs} {
+		for attr := range xattrs {
+			if !seen[attr] {
+				seen[attr] = true
+				names = append(names, attr)
+			}
+		}
+	}
+	sort.Strings(names)
+	xattrs := make(map[string][]byte, len(names))
+	for _, attr := range names {
+		valueB, okB := b.Xattrs[attr]
+		valueO, okO := o.Xattrs[attr]
+		valueT, okT := t.Xattrs[attr]
+		oursChanged := !sameXattr(valueB, valueO, okB, okO)
+		theirsChanged := !sameXattr(valueB, valueT, okB, okT)
+		if oursChanged && theirsChanged && !sameXattr(valueO, valueT, okO, okT) {
+			conflict(attr)
+		}
+		if theirsChanged && !oursChanged {
+			valueO, okO = valueT, okT
+		}
+		if okO {
+			xattrs[attr] = valueO
+		}
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	file.Xattrs = xattrs
+}
+
+func (m *MemFSReadBatch) xattrAllowed(attr string, fn func(*File) error) func(*File) error {
+	return func(file *File) error {
+		if err := m.checkXattr(file, attr, true); err != nil {
+			return err
+		}
+		return fn(file)
+	}
+}
+
+func (m *MemFSReadBatch) getXattr(file *File, attr string) ([]byte, error) {
+	if err := m.checkXattr(file, attr, false); err != nil {
+		return nil, err
+	}
+	value, ok := file.Xattrs[attr]
+	if !ok {
+		return nil, we.With(
+			e4.Info("%s", attr),
+		)(ErrXattrNotFound)
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *MemFSReadBatch) listXattr(file *File) []string {
+	ret := make([]string, 0, len(file.Xattrs))
+	for attr := range file.Xattrs {
+		if m.checkXattr(file, attr, false) != nil {
+			continue
+		}
+		ret = append(ret, attr)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// GetXattr returns the value of an extended attribute
+func (m *MemFSReadBatch) GetXattr(name string, attr string, options ...ChangeOption) ([]byte, error) {
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	file, err := m.GetFileByName(name, !spec.NoFollow)
+	if err != nil {
+		return nil, err
+	}
+	return m.getXattr(file, attr)
+}
+
+// ListXattr returns sorted names of extended attributes readable by the batch
+func (m *MemFSReadBatch) ListXattr(name string, options ...ChangeOption) ([]string, error) {
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	file, err := m.GetFileByName(name, !spec.NoFollow)
+	if err != nil {
+		return nil, err
+	}
+	return m.listXattr(file), nil
+}
+
+// SetXattr sets an extended attribute. flag is zero, XATTR_CREATE or XATTR_REPLACE
+func (m *MemFSWriteBatch) SetXattr(name string, attr string, value []byte, flag int, options ...ChangeOption) error {
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	file, err := m.GetFileByName(name, !spec.NoFollow)
+	if err != nil {
+		return err
+	}
+	return m.changeXattrs(file, m.xattrAllowed(attr, fileSetXattr(attr, value, flag)))
+}
+
+func (m *MemFSWriteBatch) RemoveXattr(name string, attr string, options ...ChangeOption) error {
+	var spec changeSpec
+	for _, fn := range options {
+		fn(&spec)
+	}
+	file, err := m.GetFileByName(name, !spec.NoFollow)
+	if err != nil {
+		return err
+	}
+	return m.changeXattrs(file, m.xattrAllowed(attr, fileRemoveXattr(attr)))
+}
+
+// changeXattrs applies fn to a copy of file. xattrs are not content, modification time is not changed
+func (m *MemFSWriteBatch) changeXattrs(file *File, fn func(*File) error) error {
+	newFile := *file
+	newFile.nodeID = newNodeID()
+	if err := fn(&newFile); err != nil {
+		return err
+	}
+	return m.updateFile(&newFile)
+}
+
+func (m *MemFS) GetXattr(name string, attr string, options ...ChangeOption) (value []byte, err error) {
+	batch, done := m.NewReadBatch()
+	defer done(&err)
+	return batch.GetXattr(name, attr, options...)
+}
+
+func (m *MemFS) ListXattr(name string, options ...ChangeOption) (attrs []string, err error) {
+	batch, done := m.NewReadBatch()
+	defer done(&err)
+	return batch.ListXattr(name, options...)
+}
+
+func (m *MemFS) SetXattr(name string, attr string, value []byte, flag int, options ...ChangeOption) error {
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.SetXattr(name, attr, value, flag, options...)
+	})
+}
+
+func (m *MemFS) RemoveXattr(name string, attr string, options ...ChangeOption) error {
+	return m.write(func(batch *MemFSWriteBatch) error {
+		return batch.RemoveXattr(name, attr, options...)
+	})
+}
+
+func (h *MemHandle) GetXattr(attr string) (value []byte, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	batch, done, err := h.readBatch()
+	if err != nil {
+		return nil, err
+	}
+	defer done(&err)
+	file, err := batch.GetFileByID(h.id)
+	if err != nil {
+		return nil, err
+	}
+	return batch.getXattr(file, attr)
+}
+
+func (h *MemHandle) ListXattr() (attrs []string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	batch, done, err := h.readBatch()
+	if err != nil {
+		return nil, err
+	}
+	defer done(&err)
+	file, err := batch.GetFileByID(h.id)
+	if err != nil {
+		return nil, err
+	}
+	return batch.listXattr(file), nil
+}
+
+func (h *MemHandle) SetXattr(attr string, value []byte, flag int) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	return h.update(func(batch *MemFSWriteBatch) error {
+		file, err := batch.GetFileByID(h.id)
+		if err != nil {
+			return err
+		}
+		return batch.changeXattrs(file, batch.xattrAllowed(attr, fileSetXattr(attr, value, flag)))
+	})
+}
+
+func (h *MemHandle) RemoveXattr(attr string) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	return h.update(func(batch *MemFSWriteBatch) error {
+		file, err := batch.GetFileByID(h.id)
+		if err != nil {
+			return err
+		}
+		return batch.changeXattrs(file, batch.xattrAllowed(attr, fileRemoveXattr(attr)))
+	})
+}